@@ -1,25 +1,62 @@
 package api
 
 import (
+	"context"
+	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout is how long requests in progress are given to finish
+// once the server starts shutting down
+const shutdownTimeout = 10 * time.Second
+
 // RouteHandler describes objects which handle requests
 // to specific HTTP endpoints
 type RouteHandler interface {
 	RegisterRoutes(*mux.Router)
 }
 
-// StartServer registers all of the routes handled
-// by the server and runs the HTTP server
-func StartServer(handlers []RouteHandler) {
+// StartServer registers all of the routes handled by the server and runs the
+// HTTP server until ctx is done. It then waits for requests in progress to
+// finish and closes the handlers that implement io.Closer, such as those
+// holding websockets or background jobs
+func StartServer(ctx context.Context, handlers []RouteHandler) error {
 	router := mux.NewRouter()
 	for _, handler := range handlers {
 		handler.RegisterRoutes(router)
 	}
+	server := &http.Server{Addr: ":8888", Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
 	log.Println("Starting HTTP server...")
-	log.Fatal(http.ListenAndServe(":8888", router))
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = server.Shutdown(shutdownCtx)
+	}
+	closeHandlers(handlers)
+	return err
+}
+
+// closeHandlers closes each of the handlers that implement io.Closer
+func closeHandlers(handlers []RouteHandler) {
+	for _, handler := range handlers {
+		closer, ok := handler.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := closer.Close()
+		if err != nil {
+			log.Printf("Error closing %T: %s\n", handler, err)
+		}
+	}
 }
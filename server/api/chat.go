@@ -233,7 +233,7 @@ func (c *ChatHandler) ChatSocket(res http.ResponseWriter, req *http.Request) {
 // and relay such messages to each WebSocket currently connected
 func SubscribeDriverStatus() {
 	points := make(chan *datatypes.Datapoint)
-	listener.Subscribe(points, "Driver_ACK_Status")
+	listener.SubscribeWith(points, listener.SubscribeOptions{Name: "driver status"}, "Driver_ACK_Status")
 	slackMessenger := message.NewSlackMessenger()
 	for point := range points {
 		msg := ""
@@ -281,6 +281,22 @@ func removeSocketConn(conn *websocket.Conn) {
 	log.Fatalf("Connection not found in activeWebsockets!")
 }
 
+// Close tells every connected chat client that the server is going away and
+// closes its websocket
+func (c *ChatHandler) Close() error {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down")
+	for _, conn := range activeWebsockets {
+		err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		if err != nil {
+			log.Println(err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
 func pingClient(conn *websocket.Conn) {
 	ticker := time.NewTicker(time.Second * 10)
 	defer ticker.Stop()
@@ -298,7 +314,7 @@ func pingClient(conn *websocket.Conn) {
 // posts Slack messages in response
 func MonitorConnection() {
 	c := make(chan *datatypes.Datapoint, 10)
-	err := listener.Subscribe(c, "Connection_Status")
+	err := listener.SubscribeWith(c, listener.SubscribeOptions{Name: "connection alerts"}, "Connection_Status")
 	if err != nil {
 		log.Fatalf("Error getting datapoint publisher: %v", err)
 	}
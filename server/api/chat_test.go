@@ -6,6 +6,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -111,3 +114,41 @@ func TestChatSlashCommandErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestChatHandlerClose(t *testing.T) {
+	chatHandler := &ChatHandler{}
+	server := httptest.NewServer(http.HandlerFunc(chatHandler.ChatSocket))
+	defer server.Close()
+	cookie, err := sc.Encode(cookieName, map[string]string{"id": randToken()})
+	if err != nil {
+		t.Fatalf("Failed to encode cookie: %q", err)
+	}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Cookie": {cookieName + "=" + cookie}})
+	if err != nil {
+		t.Fatalf("Failed to connect to chat websocket: %q", err)
+	}
+	defer conn.Close()
+	// Wait for the handler to start relaying to the websocket
+	for i := 0; i < 100 && activeWebsocketCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	chatHandler.Close()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the websocket to be closed as going away, got: %v", err)
+	}
+	for i := 0; i < 100 && activeWebsocketCount() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := activeWebsocketCount(); count != 0 {
+		t.Errorf("Websocket still active after closing: %d", count)
+	}
+}
+
+func activeWebsocketCount() int {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+	return len(activeWebsockets)
+}
@@ -2,9 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"server/computations"
 	"server/configs"
+	"server/datatypes"
+	"server/listener"
 	"server/storage"
 	"sort"
 	"strings"
@@ -15,11 +20,11 @@ import (
 
 // Core is the object which handles HTTP Core requests
 type Core struct {
-	store *storage.Storage
+	store storage.Storage
 }
 
 // NewCore returns a new API initialized with the provided store
-func NewCore(store *storage.Storage) *Core {
+func NewCore(store storage.Storage) *Core {
 	return &Core{store: store}
 }
 
@@ -41,20 +46,22 @@ func (c *Core) Metrics(res http.ResponseWriter, req *http.Request) {
 }
 
 // LastActive returns the timestamp of the last seen datapoint in the store
+// Like Latest, it can be restricted to datapoints with certain tags
 func (c *Core) LastActive(res http.ResponseWriter, req *http.Request) {
 	metrics, err := c.store.ListMetrics()
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	tags := tagFilters(req.URL.Query())
 	var maxTime time.Time
 	for _, metric := range metrics {
-		point, err := c.store.Latest(metric)
+		point, err := c.store.Latest(metric, tags)
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if point.Time.After(maxTime) {
+		if point != nil && point.Time.After(maxTime) {
 			maxTime = point.Time
 		}
 	}
@@ -81,16 +88,66 @@ func (c *Core) Configs(res http.ResponseWriter, req *http.Request) {
 	encoder.Encode(canConfigList)
 }
 
+// Values returns the names of the values of each enumerated metric, keyed by
+// metric and then by raw value, e.g. {"Trip_Status": {"0": "OK", "1": "Overvoltage"}}
+func (c *Core) Values(res http.ResponseWriter, req *http.Request) {
+	enums, err := configs.Enums()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	values := make(map[string]map[int]string, len(enums))
+	for name, config := range enums {
+		values[name] = config.Values
+	}
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(values)
+}
+
+// configValidation is the result of validating CAN configs
+type configValidation struct {
+	Valid    bool              `json:"valid"`
+	Problems []configs.Problem `json:"problems"`
+}
+
+// ValidateConfigs reports the problems with the CAN configs. A GET validates the
+// files in the config directory, which are only loaded if they are valid, while
+// a POST validates a JSON list of configs in the body before they are deployed
+func (c *Core) ValidateConfigs(res http.ResponseWriter, req *http.Request) {
+	var problems []configs.Problem
+	if req.Method == http.MethodPost {
+		var canConfigList []*configs.CanConfigType
+		err := json.NewDecoder(req.Body).Decode(&canConfigList)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Error parsing CAN configs: %s", err), http.StatusBadRequest)
+			return
+		}
+		problems = configs.Validate(canConfigList)
+	} else {
+		var err error
+		problems, err = configs.ValidateDir()
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(configValidation{
+		Valid:    len(problems) == 0,
+		Problems: problems,
+	})
+}
+
 // Latest returns the last known value of the metric specified by name
+// The query may also filter by any of the tags stamped onto datapoints,
+// e.g. /api/latest?name=BMS_Current&car=SR-3
 func (c *Core) Latest(res http.ResponseWriter, req *http.Request) {
 	name := req.URL.Query().Get("name")
-	if strings.Contains(name, ";") {
-		http.Error(res, "Invalid metric name", 400)
-		return
-	}
-	lastPoint, err := c.store.Latest(name)
+	lastPoint, err := c.store.Latest(name, tagFilters(req.URL.Query()))
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		http.Error(res, err.Error(), storageErrorStatus(err))
 		return
 	}
 	if lastPoint == nil {
@@ -102,12 +159,13 @@ func (c *Core) Latest(res http.ResponseWriter, req *http.Request) {
 
 // Location returns the current position of the car
 func (c *Core) Location(res http.ResponseWriter, req *http.Request) {
-	latpt, err := c.store.LatestNonZero("SB_GPS_Latitude")
+	tags := tagFilters(req.URL.Query())
+	latpt, err := c.store.LatestNonZero("SB_GPS_Latitude", tags)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	lngpt, err := c.store.LatestNonZero("SB_GPS_Longitude")
+	lngpt, err := c.store.LatestNonZero("SB_GPS_Longitude", tags)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
@@ -123,12 +181,90 @@ func (c *Core) Location(res http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(res).Encode(location)
 }
 
+// Session returns the name of the current test session
+func (c *Core) Session(res http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(res).Encode(listener.Session())
+}
+
+// SetSession starts a new test session with the provided name, which is
+// stamped onto all datapoints received until the session changes.
+// An empty name ends the current session
+func (c *Core) SetSession(res http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Error parsing form: %s", err), http.StatusBadRequest)
+		return
+	}
+	listener.SetSession(strings.TrimSpace(req.Form.Get("name")))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// Link returns the health of each connection the car's data is being
+// received on: the packets, bytes, parse errors, out of bounds values,
+// CRC failures and gaps in the sequence numbers received, and the
+// fraction of packets lost
+func (c *Core) Link(res http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(listener.Links())
+}
+
+// Publisher returns the number of points waiting to be published and, for
+// each subscriber, its policy for when it is full and the points delivered
+// to it, dropped and waiting in its channel
+func (c *Core) Publisher(res http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(listener.GetDatapointPublisher().Stats())
+}
+
+// Computations returns the graph of the computations: the metrics each is updated
+// with, the computations it depends on and that depend on it, the rates it is
+// updated and computes at, its last error, and any cycles which weren't started
+func (c *Core) Computations(res http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(computations.GetGraph())
+}
+
+// storageErrorStatus returns the HTTP status for an error returned by the store.
+// Names the store rejects came from the request, so they are the client's fault
+func storageErrorStatus(err error) int {
+	if errors.Is(err, storage.ErrIllegalName) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// tagFilters returns the tags a request filters datapoints by,
+// taken from the parameters named after tag keys
+func tagFilters(params url.Values) map[string]string {
+	var tags map[string]string
+	for _, key := range datatypes.TagKeys {
+		if value := params.Get(key); value != "" {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
 // RegisterRoutes registers the routes handled by the API core
 func (c *Core) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/api", c.Default).Methods("GET")
 	router.HandleFunc("/api/metrics", c.Metrics).Methods("GET")
 	router.HandleFunc("/api/lastActive", c.LastActive).Methods("GET")
+	router.HandleFunc("/api/computations", c.Computations).Methods("GET")
 	router.HandleFunc("/api/configs", c.Configs).Methods("GET")
+	router.HandleFunc("/api/configs/validate", c.ValidateConfigs).Methods("GET", "POST")
+	router.HandleFunc("/api/values", c.Values).Methods("GET")
 	router.HandleFunc("/api/latest", c.Latest).Methods("GET")
 	router.HandleFunc("/api/location", c.Location).Methods("GET")
+	router.HandleFunc("/api/link", c.Link).Methods("GET")
+	router.HandleFunc("/api/publisher", c.Publisher).Methods("GET")
+	router.HandleFunc("/api/query", c.Query).Methods("GET")
+	router.HandleFunc("/api/session", c.Session).Methods("GET")
+	router.HandleFunc("/api/session", c.SetSession).Methods("POST")
 }
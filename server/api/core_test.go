@@ -0,0 +1,266 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"server/api"
+	"server/computations"
+	"server/configs"
+	"server/datatypes"
+	"server/listener"
+	"server/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCoreRouter(t *testing.T) (*mux.Router, storage.Storage) {
+	store, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	router := mux.NewRouter()
+	api.NewCore(store).RegisterRoutes(router)
+	return router, store
+}
+
+func TestCoreLatest(t *testing.T) {
+	router, store := newCoreRouter(t)
+	err := store.Insert([]*datatypes.Datapoint{
+		{Metric: "BMS_Current", Value: 1, Time: time.Unix(1, 0)},
+		{Metric: "BMS_Current", Value: 2, Time: time.Unix(2, 0)},
+	})
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/latest?name=BMS_Current", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var value float64
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&value))
+	assert.Equal(t, float64(2), value)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/latest?name=Missing", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/latest?name=BMS_Current;DROP%20MEASUREMENT%20BMS_Current", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var metrics []string
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&metrics))
+	assert.Equal(t, []string{"BMS_Current"}, metrics)
+}
+
+func TestCoreLocation(t *testing.T) {
+	router, store := newCoreRouter(t)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/location", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	err := store.Insert([]*datatypes.Datapoint{
+		{Metric: "SB_GPS_Latitude", Value: 33.77, Time: time.Unix(1, 0)},
+		{Metric: "SB_GPS_Latitude", Value: 0, Time: time.Unix(2, 0)},
+		{Metric: "SB_GPS_Longitude", Value: -84.39, Time: time.Unix(1, 0)},
+	})
+	assert.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/location", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var location map[string]float64
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&location))
+	assert.Equal(t, map[string]float64{"lat": 33.77, "lng": -84.39}, location)
+}
+
+func TestCoreLatestTags(t *testing.T) {
+	router, store := newCoreRouter(t)
+	err := store.Insert([]*datatypes.Datapoint{
+		{Metric: "BMS_Current", Value: 1, Time: time.Unix(1, 0), Tags: map[string]string{datatypes.CarTag: "SR-3"}},
+		{Metric: "BMS_Current", Value: 2, Time: time.Unix(2, 0), Tags: map[string]string{datatypes.CarTag: "SR-4"}},
+	})
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/latest?name=BMS_Current&car=SR-3", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var value float64
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&value))
+	assert.Equal(t, float64(1), value)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/latest?name=BMS_Current&car=SR-5", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCoreSession(t *testing.T) {
+	router, _ := newCoreRouter(t)
+	defer listener.SetSession("")
+
+	req := httptest.NewRequest("POST", "/api/session", strings.NewReader("name=Endurance+Test"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "Endurance Test", listener.Session())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/session", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var session string
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&session))
+	assert.Equal(t, "Endurance Test", session)
+}
+
+func TestCoreQuery(t *testing.T) {
+	router, store := newCoreRouter(t)
+	err := store.Insert([]*datatypes.Datapoint{
+		{Metric: "BMS_Current", Value: 1, Time: time.Unix(0, 0)},
+		{Metric: "BMS_Current", Value: 3, Time: time.Unix(0, 500*1e6)},
+		{Metric: "BMS_Current", Value: 10, Time: time.Unix(2, 0)},
+	})
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/query?start=0&end=3000&window=1000&metric=BMS_Current&metric=max(BMS_Current)&aggregation=mean", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var results []struct {
+		Metric      string
+		Aggregation string
+		Points      []*datatypes.Datapoint
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&results))
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "BMS_Current", results[0].Metric)
+	assert.Equal(t, "mean", results[0].Aggregation)
+	assert.Equal(t, "max", results[1].Aggregation)
+	if assert.Equal(t, 2, len(results[0].Points)) && assert.Equal(t, 2, len(results[1].Points)) {
+		assert.Equal(t, float64(2), results[0].Points[0].Value)
+		assert.Equal(t, float64(10), results[0].Points[1].Value)
+		assert.True(t, time.Unix(2, 0).Equal(results[0].Points[1].Time))
+		assert.Equal(t, float64(3), results[1].Points[0].Value)
+	}
+
+	badQueries := []string{
+		"/api/query?start=0&end=3000&window=1000",
+		"/api/query?start=0&end=3000&window=0&metric=BMS_Current",
+		"/api/query?start=3000&end=0&window=1000&metric=BMS_Current",
+		"/api/query?start=0&end=3000&window=1000&metric=median(BMS_Current)",
+		"/api/query?start=0&end=3000&window=1000&metric=BMS_Current;DROP",
+		"/api/query?start=0&end=3000000000&window=1&metric=BMS_Current",
+	}
+	for _, query := range badQueries {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestCoreValidateConfigs(t *testing.T) {
+	router, _ := newCoreRouter(t)
+	var validation struct {
+		Valid    bool
+		Problems []configs.Problem
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/configs/validate", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&validation))
+	assert.True(t, validation.Valid)
+	assert.Empty(t, validation.Problems)
+
+	body := `[
+		{"can_id": 1, "datatype": "uint16", "name": "Validate_Test", "offset": 0},
+		{"can_id": 1, "datatype": "uint8", "name": "Validate_Test", "offset": 1}
+	]`
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/configs/validate", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&validation))
+	assert.False(t, validation.Valid)
+	assert.Len(t, validation.Problems, 2)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/configs/validate", strings.NewReader("{")))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestCoreValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "core_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer configs.SetDir("")
+	canConfigs := `[
+		{"can_id": 1, "datatype": "uint8", "name": "Values_Test", "offset": 0, "values": {"0": "OK", "1": "Fault"}},
+		{"can_id": 1, "datatype": "uint8", "name": "Plain_Test", "offset": 1}
+	]`
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "test_config.json"), []byte(canConfigs), 0644))
+	configs.SetDir(dir)
+
+	router, _ := newCoreRouter(t)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/values", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var values map[string]map[int]string
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&values))
+	assert.Equal(t, map[string]map[int]string{"Values_Test": {0: "OK", 1: "Fault"}}, values)
+}
+
+func TestCoreLink(t *testing.T) {
+	router, _ := newCoreRouter(t)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/link", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var links []listener.Link
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&links))
+	assert.Empty(t, links)
+}
+
+func TestCorePublisher(t *testing.T) {
+	router, _ := newCoreRouter(t)
+	points := make(chan *datatypes.Datapoint, 5)
+	err := listener.SubscribeWith(points, listener.SubscribeOptions{Name: "core test", Policy: listener.DropOldest}, "Core_Test")
+	assert.NoError(t, err)
+	defer listener.Unsubscribe(points)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/publisher", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var stats listener.PublisherStats
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+	assert.Contains(t, stats.Subscribers, listener.SubscriberStats{
+		Name:     "core test",
+		Policy:   listener.DropOldest,
+		Metrics:  []string{"Core_Test"},
+		Capacity: 5,
+	})
+}
+
+func TestCoreComputations(t *testing.T) {
+	router, _ := newCoreRouter(t)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/computations", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var graph computations.Graph
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&graph))
+	assert.Empty(t, graph.Cycles)
+	var velocity *computations.ComputationStats
+	for i, computation := range graph.Computations {
+		if computation.Name == "RPM_Derived_Velocity" {
+			velocity = &graph.Computations[i]
+		}
+	}
+	if assert.NotNil(t, velocity) {
+		assert.Equal(t, []string{"Average_Wavesculptor_RPM"}, velocity.Inputs)
+		assert.Contains(t, velocity.Dependents, "RPM_Derived_Acceleration")
+		assert.False(t, velocity.Running)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"server/configs"
+	"server/datatypes"
 	"server/storage"
+	"sort"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -25,18 +29,22 @@ func init() {
 
 // CSVHandler handles requests related to the CSV generator tool
 type CSVHandler struct {
-	store *storage.Storage
+	store storage.Storage
 }
 
 // NewCSVHandler returns an initialized CSVHandler
-func NewCSVHandler(store *storage.Storage) *CSVHandler {
+func NewCSVHandler(store storage.Storage) *CSVHandler {
 	return &CSVHandler{store: store}
 }
 
 type generationRequest struct {
-	start      time.Time
-	end        time.Time
-	resolution int
+	start       time.Time
+	end         time.Time
+	resolution  int
+	aggregation storage.Aggregation
+	tags        map[string]string
+	groupBy     string
+	labels      bool
 }
 
 var genQueue = make(chan generationRequest)
@@ -44,7 +52,7 @@ var genQueue = make(chan generationRequest)
 func (c *CSVHandler) generationScheduler() {
 	for req := range genQueue {
 		generating.Store(true)
-		c.generateCsv(req.start, req.end, req.resolution)
+		c.generateCsv(req)
 		generating.Store(false)
 	}
 }
@@ -64,6 +72,10 @@ func (c *CSVHandler) IsGenerating(res http.ResponseWriter, req *http.Request) {
 }
 
 // GenerateCsv generates the csv
+// Besides the time range and resolution, the form may filter by any of the tags stamped onto
+// datapoints (e.g. car=SR-3) and name a tag in groupBy to get a column per value of that tag.
+// Each row holds the first point in its bucket unless another aggregation (e.g. mean) is requested.
+// With labels=true, enumerated metrics are written as the names of their values
 func (c *CSVHandler) GenerateCsv(res http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	if err != nil {
@@ -97,8 +109,19 @@ func (c *CSVHandler) GenerateCsv(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "Resolution must be strictly greater than 0", http.StatusBadRequest)
 		return
 	}
+	aggregation, err := storage.ParseAggregation(req.Form.Get("aggregation"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupBy := req.Form.Get("groupBy")
+	if groupBy != "" && !isTagKey(groupBy) {
+		http.Error(res, fmt.Sprintf("Cannot group by %s", groupBy), http.StatusBadRequest)
+		return
+	}
+	labels := req.Form.Get("labels") == "true"
 	select {
-	case genQueue <- generationRequest{startDate, endDate, resolution}:
+	case genQueue <- generationRequest{startDate, endDate, resolution, aggregation, tagFilters(req.Form), groupBy, labels}:
 	default:
 		http.Error(res, "Already generating CSV", http.StatusLocked)
 		return
@@ -114,19 +137,21 @@ func unixStringMillisToTime(timeString string) (time.Time, error) {
 	return time.Unix(0, timeMillis*1e6), nil
 }
 
-func (c *CSVHandler) generateCsv(start time.Time, end time.Time, resolution int) {
-	columns, err := c.store.GetAllMetricPointsRange(start, end, resolution)
+func isTagKey(key string) bool {
+	for _, tagKey := range datatypes.TagKeys {
+		if key == tagKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CSVHandler) generateCsv(req generationRequest) {
+	names, columns, enums, err := c.openColumns(req)
 	if err != nil {
 		log.Printf("Error getting metrics: %s\n", err)
 		return
 	}
-	WriteCsv(columns, start, end, resolution)
-}
-
-// WriteCsv writes the contents of columns to api/csv/telemetry.csv
-// with the first column being the timestamp of each row based on the
-// start, end and resolution
-func WriteCsv(columns map[string][]float64, start time.Time, end time.Time, resolution int) {
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
 		log.Println("Could not find runtime caller")
@@ -139,31 +164,103 @@ func WriteCsv(columns map[string][]float64, start time.Time, end time.Time, reso
 		return
 	}
 	defer file.Close()
+	err = WriteCsv(file, names, columns, enums, req.start, req.end, req.resolution)
+	if err != nil {
+		log.Printf("Error writing api/csv/telemetry.csv: %s\n", err)
+	}
+}
+
+// csvColumn describes a column of the generated CSV
+type csvColumn struct {
+	name   string
+	metric string
+	tags   map[string]string
+}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// openColumns opens a column aggregating the points of each metric, or of each value of
+// the groupBy tag of each metric, sorted by name. Metrics whose tags can't be read are skipped.
+// If the request asks for labels, the CAN config of each enumerated column is returned too
+func (c *CSVHandler) openColumns(req generationRequest) ([]string, []*storage.AggregatedColumn, []*configs.CanConfigType, error) {
+	metrics, err := c.store.ListMetrics()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var enumConfigs map[string]*configs.CanConfigType
+	if req.labels && req.aggregation != storage.Count {
+		enumConfigs, err = configs.Enums()
+		if err != nil {
+			log.Printf("Error getting enumerated metrics: %s\n", err)
+		}
+	}
+	var specs []csvColumn
+	for _, metric := range metrics {
+		if req.groupBy == "" {
+			specs = append(specs, csvColumn{metric, metric, req.tags})
+			continue
+		}
+		values, err := c.store.TagValues(metric, req.groupBy, req.start, req.end, req.tags)
+		if err != nil {
+			log.Printf("Error getting values of %s for metric %s: %s\n", req.groupBy, metric, err)
+			continue
+		}
+		if len(values) == 0 {
+			specs = append(specs, csvColumn{metric, metric, req.tags})
+		}
+		for _, value := range values {
+			tags := map[string]string{req.groupBy: value}
+			for key, value := range req.tags {
+				tags[key] = value
+			}
+			specs = append(specs, csvColumn{storage.GroupedColumnName(metric, req.groupBy, value), metric, tags})
+		}
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].name < specs[j].name
+	})
+	names := make([]string, 0, len(specs))
+	columns := make([]*storage.AggregatedColumn, 0, len(specs))
+	enums := make([]*configs.CanConfigType, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.name)
+		columns = append(columns, storage.NewAggregatedColumn(c.store, spec.metric, req.start, req.end, req.resolution, req.aggregation, spec.tags))
+		enums = append(enums, enumConfigs[spec.metric])
+	}
+	return names, columns, enums, nil
+}
 
+// WriteCsv writes a row to w for each step of the given resolution from start to end.
+// The first column is the timestamp of the row and the rest are read from columns,
+// headed by names. Values of columns with a config in enums are written as the names
+// of the values where they have one. enums may be nil, or have a nil entry for columns
+// that aren't enumerated. Rows are written as they are read, so only a page of each column is held in memory
+func WriteCsv(w io.Writer, names []string, columns []*storage.AggregatedColumn, enums []*configs.CanConfigType, start time.Time, end time.Time, resolution int) error {
+	writer := csv.NewWriter(w)
 	rowContents := make([]string, len(columns)+1)
-	columnIndices := make(map[string]int, len(columns))
 	rowContents[0] = "time"
-	col := 1
-	for metric := range columns {
-		rowContents[col] = metric
-		columnIndices[metric] = col
-		col++
-	}
+	copy(rowContents[1:], names)
 	writer.Write(rowContents)
 
 	resolutionDur := time.Duration(resolution) * time.Millisecond
-	row := 0
 	for rowTime := start; rowTime.Before(end); rowTime = rowTime.Add(resolutionDur) {
 		rowContents[0] = fmt.Sprintf("%d", rowTime.UnixNano()/1e6)
-		for metric, column := range columns {
-			rowContents[columnIndices[metric]] = fmt.Sprintf("%v", column[row])
+		for i, column := range columns {
+			value := column.Next()
+			rowContents[i+1] = fmt.Sprintf("%v", value)
+			if i < len(enums) && enums[i] != nil {
+				if label, ok := enums[i].Label(value); ok {
+					rowContents[i+1] = label
+				}
+			}
 		}
 		writer.Write(rowContents)
-		row++
 	}
+	writer.Flush()
+	for i, column := range columns {
+		if column.Err() != nil {
+			return fmt.Errorf("Error reading %s: %s", names[i], column.Err())
+		}
+	}
+	return writer.Error()
 }
 
 // RegisterRoutes registers the routes for the CSV service
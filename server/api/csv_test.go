@@ -1,23 +1,22 @@
 package api_test
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
-	"os"
-	"path"
-	"runtime"
 	"strconv"
 	"testing"
 	"time"
 
 	"server/api"
+	"server/configs"
+	"server/datatypes"
+	"server/storage"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWriteCsv(t *testing.T) {
-	backupCsv(t)
-	defer restoreCsv(t)
 	start := time.Unix(0, 0)
 	end := time.Unix(1, 0)
 	resolution := 250
@@ -25,15 +24,27 @@ func TestWriteCsv(t *testing.T) {
 		"Column_1": {0, 1, 2, 3},
 		"Column_2": {4, 5, 6, 7},
 	}
-	api.WriteCsv(columns, start, end, resolution)
-	_, callerFile, _, ok := runtime.Caller(0)
-	assert.True(t, ok)
-	file, err := os.Open(path.Join(path.Dir(callerFile), "csv/telemetry.csv"))
+	store, err := storage.NewEmbeddedStorage("")
 	assert.NoError(t, err)
-	reader := csv.NewReader(file)
+	names := []string{"Column_1", "Column_2"}
+	sampledColumns := make([]*storage.AggregatedColumn, len(names))
+	for i, name := range names {
+		for row, value := range columns[name] {
+			err = store.Insert([]*datatypes.Datapoint{{
+				Metric: name,
+				Value:  value,
+				Time:   start.Add(time.Duration(row*resolution) * time.Millisecond),
+			}})
+			assert.NoError(t, err)
+		}
+		sampledColumns[i] = storage.NewAggregatedColumn(store, name, start, end, resolution, storage.First, nil)
+	}
+	var buf bytes.Buffer
+	err = api.WriteCsv(&buf, names, sampledColumns, nil, start, end, resolution)
+	assert.NoError(t, err)
+	reader := csv.NewReader(&buf)
 	lines, err := reader.ReadAll()
 	assert.NoError(t, err)
-	file.Close()
 	assert.Equal(t, 5, len(lines))
 	heading := lines[0]
 	assert.Equal(t, 3, len(heading))
@@ -73,20 +84,35 @@ func TestWriteCsv(t *testing.T) {
 	assert.Equal(t, columns, actualColumns)
 }
 
-func backupCsv(t *testing.T) {
-	_, callerFile, _, ok := runtime.Caller(0)
-	assert.True(t, ok)
-	baseDir := path.Dir(callerFile)
-	oldpath := path.Join(baseDir, "csv/telemetry.csv")
-	newpath := path.Join(baseDir, "csv/telemetry_copy.csv")
-	os.Rename(oldpath, newpath)
-}
-
-func restoreCsv(t *testing.T) {
-	_, callerFile, _, ok := runtime.Caller(0)
-	assert.True(t, ok)
-	baseDir := path.Dir(callerFile)
-	oldpath := path.Join(baseDir, "csv/telemetry_copy.csv")
-	newpath := path.Join(baseDir, "csv/telemetry.csv")
-	os.Rename(oldpath, newpath)
+func TestWriteCsvLabels(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := time.Unix(1, 0)
+	store, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	for i, value := range []float64{0, 1, 5} {
+		err = store.Insert([]*datatypes.Datapoint{{
+			Metric: "Trip_Status",
+			Value:  value,
+			Time:   start.Add(time.Duration(i*250) * time.Millisecond),
+		}})
+		assert.NoError(t, err)
+	}
+	names := []string{"Trip_Status", "Trip_Status_Raw"}
+	columns := make([]*storage.AggregatedColumn, len(names))
+	for i := range names {
+		columns[i] = storage.NewAggregatedColumn(store, "Trip_Status", start, end, 250, storage.First, nil)
+	}
+	enums := []*configs.CanConfigType{{Name: "Trip_Status", Values: map[int]string{0: "OK", 1: "Fault"}}, nil}
+	var buf bytes.Buffer
+	assert.NoError(t, api.WriteCsv(&buf, names, columns, enums, start, end, 250))
+	lines, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	// Values without a name are written as numbers
+	assert.Equal(t, [][]string{
+		{"time", "Trip_Status", "Trip_Status_Raw"},
+		{"0", "OK", "0"},
+		{"250", "Fault", "1"},
+		{"500", "5", "5"},
+		{"750", "5", "5"},
+	}, lines)
 }
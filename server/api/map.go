@@ -37,6 +37,12 @@ func NewMapHandler() *MapHandler {
 	}
 }
 
+// Close stops uploading the route to the car, saving how far the upload got
+func (m *MapHandler) Close() error {
+	m.track.Close()
+	return nil
+}
+
 // MapDefault is the default handler for the /map path
 func (m *MapHandler) MapDefault(res http.ResponseWriter, req *http.Request) {
 	http.Redirect(res, req, "/map/static/index.html", http.StatusFound)
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"path"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,17 +37,27 @@ func init() {
 // instance of the server onto the main remote server.
 type MergeHandler struct {
 	merger *merge.Merger
-	store  *storage.Storage
+	store  storage.Storage
+	// ctx is cancelled when the handler is closed, stopping the merge in progress
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
 }
 
 // NewMergeHandler returns a pointer to a new MergeHandler.
-func NewMergeHandler(store *storage.Storage) *MergeHandler {
+func NewMergeHandler(store storage.Storage) *MergeHandler {
 	merger, err := merge.NewMerger(store)
 	if err != nil {
 		log.Fatalf("Error instantiating a new Merger object: %v", err.Error())
 	}
 
-	return &MergeHandler{merger, store}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MergeHandler{
+		merger: merger,
+		store:  store,
+		ctx:    ctx,
+		cancel: cancel,
+	}
 }
 
 type uploadRequest struct {
@@ -60,13 +72,27 @@ var uploadRequestQueue = make(chan uploadRequest)
 // "/merge", m.LocalMergeHandler() validates that form data, then creates a new
 // uploadRequest which will be picked up here.
 func (m *MergeHandler) processUploadRequests() {
-	for request := range uploadRequestQueue {
-		isUploading.Store(true)
-		m.uploadLocalPointsToRemote(request.startTime, request.endTime)
-		isUploading.Store(false)
+	defer m.running.Done()
+	for {
+		select {
+		case request := <-uploadRequestQueue:
+			isUploading.Store(true)
+			m.uploadLocalPointsToRemote(request.startTime, request.endTime)
+			isUploading.Store(false)
+		case <-m.ctx.Done():
+			return
+		}
 	}
 }
 
+// Close stops the merge in progress once its current block has been merged,
+// leaving the job to be resumed by the next merge request
+func (m *MergeHandler) Close() error {
+	m.cancel()
+	m.running.Wait()
+	return nil
+}
+
 // MergeDefault is the default handler for the /merge path.
 func (m *MergeHandler) MergeDefault(w http.ResponseWriter, r *http.Request) {
 	if !isUploading.Load().(bool) {
@@ -161,7 +187,7 @@ func (m *MergeHandler) RemoteMergeHandler(w http.ResponseWriter, r *http.Request
 // the process of merging datapoints on a local server instance to the remote
 // server.
 func (m *MergeHandler) uploadLocalPointsToRemote(startTime, endTime time.Time) {
-	err := m.merger.UploadLocalPointsToRemote(startTime, endTime)
+	err := m.merger.UploadLocalPointsToRemote(m.ctx, startTime, endTime)
 	if err != nil {
 		errMsg := fmt.Errorf("Error uploading local datapoints to remote"+
 			" server: %v", err.Error())
@@ -201,6 +227,7 @@ func formatRFC3339(date string, timezone string) (time.Time, error) {
 
 // RegisterRoutes registers the routes for the merge service.
 func (m *MergeHandler) RegisterRoutes(router *mux.Router) {
+	m.running.Add(1)
 	go m.processUploadRequests()
 
 	_, filename, _, ok := runtime.Caller(0)
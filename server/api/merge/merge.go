@@ -2,6 +2,7 @@ package merge
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -43,12 +44,12 @@ func init() {
 // the remote server.
 type Merger struct {
 	model *Model
-	store *storage.Storage
+	store storage.Storage
 }
 
 // NewMerger returns a pointer to a new Merger object initialized with the
 // provided values.
-func NewMerger(store *storage.Storage) (*Merger, error) {
+func NewMerger(store storage.Storage) (*Merger, error) {
 	model, err := ReadMergeInfoModel()
 	if err != nil {
 		return nil, err
@@ -66,8 +67,11 @@ func NewMerger(store *storage.Storage) (*Merger, error) {
 // that were created between the specified time range, and begins the process
 // of uploading those points to the server hosted at solarracing.me.
 //
+// If ctx is done before every block has been merged, the job stops after the
+// current block and is left marked as incomplete, so the next job resumes it.
+//
 // This func is intended to run on a local server.
-func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
+func (m *Merger) UploadLocalPointsToRemote(ctx context.Context, startTime, endTime time.Time) error {
 	var curBlockNum int
 
 	// Check the contents of merge_info_config.json to see if there is an
@@ -91,7 +95,8 @@ func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
 		log.Println(msg)
 	}
 
-	// Get all points (of all metric types) within the current job's time range.
+	// Stream all points (of all metric types) within the current job's time
+	// range one metric at a time, so they never all have to be held in memory.
 	metrics, err := m.store.ListMetrics()
 	if err != nil {
 		errMsg := "Failed to list all metrics in the data store." +
@@ -99,28 +104,40 @@ func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
 		log.Println(errMsg)
 		return errors.New(errMsg)
 	}
-
-	pointsToMerge := []*datatypes.Datapoint{}
-	for _, metric := range metrics {
-		newPoints, err := m.store.SelectMetricTimeRange(
-			metric, startTime, endTime,
-		)
+	points := storage.IterateMetrics(m.store, metrics, startTime, endTime, nil)
+	defer points.Close()
+	nextBlock := func() ([]*datatypes.Datapoint, error) {
+		block, err := readBlock(points)
 		if err != nil {
-			errMsg := fmt.Sprintf("Failed to fetch points for the %s metric"+
-				" within the current job's time range (times %s to %s): %v",
-				metric,
+			errMsg := fmt.Sprintf("Failed to fetch points within the current"+
+				" job's time range (times %s to %s): %v",
 				startTime.Format(timeFormatString),
 				endTime.Format(timeFormatString),
 				err.Error(),
 			)
 			log.Println(errMsg)
-			return errors.New(errMsg)
+			return nil, errors.New(errMsg)
 		}
+		return block, nil
+	}
 
-		pointsToMerge = append(pointsToMerge, newPoints...)
+	// The blocks before the last one merged by an incomplete job were already
+	// merged, so they don't need to be sent again.
+	for skipped := 0; skipped < curBlockNum; skipped++ {
+		block, err := nextBlock()
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			break
+		}
+	}
+	curBlock, err := nextBlock()
+	if err != nil {
+		return err
 	}
 
-	if len(pointsToMerge) <= 0 {
+	if len(curBlock) <= 0 && curBlockNum == 0 {
 		errMsg := fmt.Sprintf("No points were collected locally within the"+
 			" current job's time range (times %s to %s)",
 			startTime.Format(timeFormatString),
@@ -130,61 +147,54 @@ func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
 		return errors.New(errMsg)
 	}
 
-	// Begin the process of merging the points in pointsToMerge in blocks.
+	// Begin the process of merging the points in blocks as they are read.
 	m.model.LastJobStartTimestamp = startTime
 	m.model.LastJobEndTimestamp = endTime
 	m.model.DidLastJobFinish = false
 	m.model.Commit()
 
-	msg := "Fetched points collected locally. Beginning the upload process" +
+	msg := "Fetching points collected locally. Beginning the upload process" +
 		" to the remote server..."
 	log.Println(msg)
 
 	c := make(chan bool, 1)
 	retryCount := 0
 
-	for ; curBlockNum <= len(pointsToMerge)/blockSize; curBlockNum++ {
-		suffix := min(len(pointsToMerge), blockSize*(curBlockNum+1))
-		if blockSize*curBlockNum < suffix {
-			curBlock := pointsToMerge[blockSize*curBlockNum : suffix]
-			curBlockAsJSON, err := json.Marshal(curBlock)
-			if err != nil {
-				return err
-			}
+	for len(curBlock) > 0 {
+		if ctx.Err() != nil {
+			errMsg := "Stopping the current merge operation and marking" +
+				" this job as incomplete..."
+			log.Println(errMsg)
+			return errors.New(errMsg)
+		}
 
-			go func() {
-				mergeBlockErr := mergeCurBlockOfPoints(curBlockAsJSON)
-				if mergeBlockErr != nil {
-					log.Println(mergeBlockErr.Error())
-				}
-				c <- mergeBlockErr == nil
-			}()
+		curBlockAsJSON, err := json.Marshal(curBlock)
+		if err != nil {
+			return err
+		}
 
-			select {
-			case res := <-c:
-				if res {
-					// Record that the current block was merged successfully.
-					m.model.LastJobBlockNumber = curBlockNum
-					m.model.Commit()
-				} else {
-					// Attempt to merge the current block again.
-					curBlockNum--
-					retryCount++
-					if retryCount >= maxRetries {
-						errMsg := "Max number of attempts to send blocks of" +
-							" points exceeded. Aborting the current merge" +
-							" operation and marking this job as incomplete..."
-						log.Println(errMsg)
-						return errors.New(errMsg)
-					}
+		go func() {
+			mergeBlockErr := mergeCurBlockOfPoints(curBlockAsJSON)
+			if mergeBlockErr != nil {
+				log.Println(mergeBlockErr.Error())
+			}
+			c <- mergeBlockErr == nil
+		}()
 
-					msg := "Retrying to merge the last block of points..."
-					log.Println(msg)
+		select {
+		case res := <-c:
+			if res {
+				// Record that the current block was merged successfully and
+				// move on to the next one.
+				m.model.LastJobBlockNumber = curBlockNum
+				m.model.Commit()
+				curBlockNum++
+				curBlock, err = nextBlock()
+				if err != nil {
+					return err
 				}
-			case <-time.After(timeout):
-				// The current block took too long to merge. Attempt to merge
-				// the current block again.
-				curBlockNum--
+			} else {
+				// Attempt to merge the current block again.
 				retryCount++
 				if retryCount >= maxRetries {
 					errMsg := "Max number of attempts to send blocks of" +
@@ -193,6 +203,20 @@ func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
 					log.Println(errMsg)
 					return errors.New(errMsg)
 				}
+
+				msg := "Retrying to merge the last block of points..."
+				log.Println(msg)
+			}
+		case <-time.After(timeout):
+			// The current block took too long to merge. Attempt to merge
+			// the current block again.
+			retryCount++
+			if retryCount >= maxRetries {
+				errMsg := "Max number of attempts to send blocks of" +
+					" points exceeded. Aborting the current merge" +
+					" operation and marking this job as incomplete..."
+				log.Println(errMsg)
+				return errors.New(errMsg)
 			}
 		}
 	}
@@ -218,8 +242,17 @@ func (m *Merger) UploadLocalPointsToRemote(startTime, endTime time.Time) error {
 // needs to become more complicated, this is the place for that logic to be
 // expanded upon.
 //
+// The points keep the tags they were recorded with on the local server, except
+// that their source is now the merge.
+//
 // This func is intended to run on the remote server.
 func (m *Merger) MergePointsOntoRemote(pointsToMerge []*datatypes.Datapoint) error {
+	for _, point := range pointsToMerge {
+		if point.Tags == nil {
+			point.Tags = make(map[string]string)
+		}
+		point.Tags[datatypes.SourceTag] = datatypes.SourceMerge
+	}
 	err := m.store.Insert(pointsToMerge)
 	if err != nil {
 		return err
@@ -250,10 +283,12 @@ func mergeCurBlockOfPoints(curBlockAsJSON []byte) error {
 	return nil
 }
 
-// Helper func that should really be in the standard library if you ask me...
-func min(a, b int) int {
-	if a < b {
-		return a
+// readBlock reads the next block of up to blockSize points from the provided
+// iterator. The block is empty once every point has been read.
+func readBlock(points storage.PointIterator) ([]*datatypes.Datapoint, error) {
+	block := make([]*datatypes.Datapoint, 0, blockSize)
+	for len(block) < blockSize && points.Next() {
+		block = append(block, points.Point())
 	}
-	return b
+	return block, points.Err()
 }
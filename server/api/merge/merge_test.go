@@ -0,0 +1,48 @@
+package merge
+
+import (
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReadBlock tests that the points of every metric are read in blocks of
+// at most blockSize points, one metric after another.
+func TestReadBlock(t *testing.T) {
+	store, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	for _, metric := range []string{"Merge_Test_1", "Merge_Test_2"} {
+		points := make([]*datatypes.Datapoint, 1250)
+		for i := range points {
+			points[i] = &datatypes.Datapoint{
+				Metric: metric,
+				Value:  float64(i),
+				Time:   time.Unix(int64(i), 0),
+			}
+		}
+		assert.NoError(t, store.Insert(points))
+	}
+	metrics, err := store.ListMetrics()
+	assert.NoError(t, err)
+	points := storage.IterateMetrics(store, metrics, time.Unix(0, 0), time.Unix(2000, 0), nil)
+	defer points.Close()
+
+	var blockSizes []int
+	for {
+		block, err := readBlock(points)
+		assert.NoError(t, err)
+		if len(block) == 0 {
+			break
+		}
+		blockSizes = append(blockSizes, len(block))
+		if len(blockSizes) == 2 {
+			assert.Equal(t, "Merge_Test_1", block[0].Metric)
+			assert.Equal(t, "Merge_Test_2", block[len(block)-1].Metric)
+		}
+	}
+	assert.Equal(t, []int{1000, 1000, 500}, blockSizes)
+}
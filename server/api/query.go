@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/datatypes"
+	"server/storage"
+)
+
+// maxQueryWindows limits how many windows a single query may aggregate each metric into
+const maxQueryWindows = 100000
+
+// queryResult is the aggregated series of one metric returned by Query
+type queryResult struct {
+	Metric      string                 `json:"metric"`
+	Aggregation storage.Aggregation    `json:"aggregation"`
+	Points      []*datatypes.Datapoint `json:"points"`
+}
+
+// Query aggregates metrics over windows of a time range in the store.
+// start and end are unix timestamps in milliseconds and window is the length of each window
+// in milliseconds. Each metric parameter is either a metric name, aggregated with the function
+// named by the aggregation parameter (first by default), or an aggregation of a metric such as
+// max(Motor_Speed). The query may also filter by any of the tags stamped onto datapoints, e.g.
+// /api/query?start=0&end=60000&window=1000&metric=mean(BMS_Current)&metric=p95(BMS_Current)&car=SR-3
+func (c *Core) Query(res http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	start, err := unixStringMillisToTime(params.Get("start"))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Error parsing start: %s", err), http.StatusBadRequest)
+		return
+	}
+	end, err := unixStringMillisToTime(params.Get("end"))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Error parsing end: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !start.Before(end) {
+		http.Error(res, "start must be before end", http.StatusBadRequest)
+		return
+	}
+	windowMillis, err := strconv.ParseInt(params.Get("window"), 10, 64)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Error parsing window: %s", err), http.StatusBadRequest)
+		return
+	}
+	if windowMillis <= 0 {
+		http.Error(res, "window must be strictly greater than 0", http.StatusBadRequest)
+		return
+	}
+	window := time.Duration(windowMillis) * time.Millisecond
+	if end.Sub(start)/window >= maxQueryWindows {
+		http.Error(res, fmt.Sprintf("Query spans more than %d windows", maxQueryWindows), http.StatusBadRequest)
+		return
+	}
+	defaultAggregation, err := storage.ParseAggregation(params.Get("aggregation"))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(params["metric"]) == 0 {
+		http.Error(res, "No metrics requested", http.StatusBadRequest)
+		return
+	}
+	tags := tagFilters(params)
+	results := make([]queryResult, len(params["metric"]))
+	for i, expression := range params["metric"] {
+		metric, aggregation, err := parseQueryMetric(expression, defaultAggregation)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points, err := c.store.Aggregate(metric, start, end, window, aggregation, tags)
+		if err != nil {
+			http.Error(res, err.Error(), storageErrorStatus(err))
+			return
+		}
+		results[i] = queryResult{
+			Metric:      metric,
+			Aggregation: aggregation,
+			Points:      points,
+		}
+	}
+	json.NewEncoder(res).Encode(results)
+}
+
+// parseQueryMetric splits a query expression such as mean(BMS_Current) into the metric and
+// its aggregation. A bare metric name is aggregated with defaultAggregation.
+// The metric name itself is checked by the store
+func parseQueryMetric(expression string, defaultAggregation storage.Aggregation) (string, storage.Aggregation, error) {
+	open := strings.Index(expression, "(")
+	if open < 0 || !strings.HasSuffix(expression, ")") {
+		return expression, defaultAggregation, nil
+	}
+	aggregation, err := storage.ParseAggregation(expression[:open])
+	if err != nil || open == 0 {
+		return "", "", fmt.Errorf("Invalid aggregation in %s", expression)
+	}
+	return expression[open+1 : len(expression)-1], aggregation, nil
+}
@@ -88,6 +88,7 @@ function runServer() {
   request.open("POST", "/reconTool/timeRange", true);
   request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
   var formEncoded = "startDate=" + startTime + "&endDate=" + endTime + "&resolution=" + resolution;
+  formEncoded += "&aggregation=" + document.getElementById("aggregation").value;
   formEncoded += formEncodedCommonConfigs();
   request.send(formEncoded);
   showLoadingSpinner();
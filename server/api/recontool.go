@@ -22,7 +22,7 @@ import (
 
 // ReconToolHandler handles requests related to ReconTool
 type ReconToolHandler struct {
-	store *storage.Storage
+	store storage.Storage
 }
 
 type csvParse struct {
@@ -37,7 +37,7 @@ type reconResult struct {
 }
 
 // NewReconToolHandler returns an initialized ReconToolHandler
-func NewReconToolHandler(store *storage.Storage) *ReconToolHandler {
+func NewReconToolHandler(store storage.Storage) *ReconToolHandler {
 	return &ReconToolHandler{store: store}
 }
 
@@ -47,11 +47,13 @@ func (r *ReconToolHandler) ReconToolDefault(res http.ResponseWriter, req *http.R
 }
 
 type timeRangeParams struct {
-	start      time.Time
-	end        time.Time
-	resolution int
-	gps        bool
-	vehicle    *recontool.Vehicle
+	start       time.Time
+	end         time.Time
+	resolution  int
+	aggregation storage.Aggregation
+	gps         bool
+	vehicle     *recontool.Vehicle
+	tags        map[string]string
 }
 
 // ReconTimeRange runs ReconTool on data taken from the server
@@ -61,7 +63,7 @@ func (r *ReconToolHandler) ReconTimeRange(res http.ResponseWriter, req *http.Req
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
-	data, err := r.store.GetMetricPointsRange(recontool.MetricNames, params.start, params.end, params.resolution, true)
+	data, err := storage.GetMetricPointsRange(r.store, recontool.MetricNames, params.start, params.end, params.resolution, params.aggregation, true, params.tags)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
@@ -105,6 +107,10 @@ func parseTimeRangeParams(req *http.Request) (*timeRangeParams, error) {
 	if resolution <= 0 {
 		return nil, fmt.Errorf("Resolution must be positive")
 	}
+	aggregation, err := storage.ParseAggregation(req.Form.Get("aggregation"))
+	if err != nil {
+		return nil, err
+	}
 	gpsTerrain, err := strconv.ParseBool(paramStrings["terrain"])
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing terrain specifier: %s", err)
@@ -114,11 +120,13 @@ func parseTimeRangeParams(req *http.Request) (*timeRangeParams, error) {
 		return nil, err
 	}
 	return &timeRangeParams{
-		start:      startDate,
-		end:        endDate,
-		resolution: resolution,
-		gps:        gpsTerrain,
-		vehicle:    vehicle,
+		start:       startDate,
+		end:         endDate,
+		resolution:  resolution,
+		aggregation: aggregation,
+		gps:         gpsTerrain,
+		vehicle:     vehicle,
+		tags:        tagFilters(req.Form),
 	}, nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"server/recontool"
+	"server/storage"
 	"sort"
 	"strings"
 	"testing"
@@ -48,13 +49,18 @@ func TestParseTimeRangeParams(t *testing.T) {
 	_, err = parseTimeRangeParams(req)
 	assert.Error(t, err)
 	req.Form.Set("Rmot", "0.3")
+	req.Form.Set("aggregation", "median")
+	_, err = parseTimeRangeParams(req)
+	assert.Error(t, err)
+	req.Form.Set("aggregation", "mean")
 	params, err := parseTimeRangeParams(req)
 	assert.NoError(t, err)
 	assert.Equal(t, &timeRangeParams{
-		start:      time.Unix(3133690620, 0),
-		end:        time.Unix(3133691220, 0),
-		resolution: 500,
-		gps:        false,
+		start:       time.Unix(3133690620, 0),
+		end:         time.Unix(3133691220, 0),
+		resolution:  500,
+		aggregation: storage.Mean,
+		gps:         false,
 		vehicle: &recontool.Vehicle{
 			RMot:  0.3,
 			M:     320,
@@ -0,0 +1,120 @@
+// Command dbc converts between Vector DBC files and the JSON CAN configs in configs/can_configs.
+//
+// Usage:
+//
+//	go run ./cmd/dbc import [-o bms_config.json] bms.dbc
+//	go run ./cmd/dbc export [-dir configs/can_configs] [-o telemetry.dbc]
+//
+// Signals that can't be imported are listed on stderr
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"server/configs"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = importDBC(os.Args[2:])
+	case "export":
+		err = exportDBC(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbc import [-o configs.json] file.dbc")
+	fmt.Fprintln(os.Stderr, "       dbc export [-dir configs/can_configs] [-o file.dbc]")
+	os.Exit(2)
+}
+
+// output returns the file named by the -o flag, or stdout
+func output(name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(name)
+}
+
+func importDBC(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	out := flags.String("o", "", "JSON file to write the CAN configs to (default stdout)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dbc, err := configs.ParseDBC(file)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %s", flags.Arg(0), err)
+	}
+	canConfigs, problems := configs.ImportDBC(dbc)
+	for _, problem := range problems {
+		log.Printf("Skipped %s", problem)
+	}
+	for _, problem := range configs.Validate(canConfigs) {
+		log.Printf("Warning: %s", problem)
+	}
+	rawJSON, err := json.MarshalIndent(canConfigs, "", "    ")
+	if err != nil {
+		return err
+	}
+	w, err := output(*out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(rawJSON, '\n'))
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func exportDBC(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("dir", "configs/can_configs", "directory of the CAN configs to export")
+	out := flags.String("o", "", "DBC file to write (default stdout)")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+	canConfigs, err := configs.ReadDir(*dir)
+	if err != nil {
+		return err
+	}
+	dbc, err := configs.ExportDBC(canConfigs)
+	if err != nil {
+		return err
+	}
+	w, err := output(*out)
+	if err != nil {
+		return err
+	}
+	err = dbc.Write(w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -21,6 +21,11 @@ func NewArrayPower() *ArrayPower {
 	}
 }
 
+// GetOutput returns the metric ArrayPower computes
+func (a *ArrayPower) GetOutput() string {
+	return "Array_Power"
+}
+
 // Compute computes solar array power
 func (a *ArrayPower) Compute() *datatypes.Datapoint {
 	mg0Power := a.values["MG_0_Input_Power"] / 1000.0
@@ -31,7 +36,7 @@ func (a *ArrayPower) Compute() *datatypes.Datapoint {
 	totalPower := mg0Power + photon0Power + photon1Power
 
 	point := &datatypes.Datapoint{
-		Metric: "Array_Power",
+		Metric: a.GetOutput(),
 		Value:  totalPower,
 		Time:   a.timestamp,
 	}
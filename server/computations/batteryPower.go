@@ -19,6 +19,11 @@ func NewBatteryPower() *BatteryPower {
 	}
 }
 
+// GetOutput returns the metric BatteryPower computes
+func (bp *BatteryPower) GetOutput() string {
+	return "Battery_Power"
+}
+
 // Compute computes the battery power as the product of the BMS current
 // and the bus voltage if the bus voltage value is nominal; otherwise,
 // the pack voltage measurement is used
@@ -27,7 +32,7 @@ func (bp *BatteryPower) Compute() *datatypes.Datapoint {
 	packVoltage := bp.values["Pack_Voltage"]
 	busVoltage := (bp.values["Left_Bus_Voltage"] + bp.values["Right_Bus_Voltage"]) / 2
 	point := &datatypes.Datapoint{
-		Metric: "Battery_Power",
+		Metric: bp.GetOutput(),
 		Time:   bp.timestamp,
 	}
 	if busVoltage < 50.0 {
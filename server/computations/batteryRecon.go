@@ -2,9 +2,11 @@ package computations
 
 import (
 	"fmt"
+	"math"
 	"server/datatypes"
 	"server/recontool"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -59,6 +61,11 @@ func (r *PackResistance) Update(point *datatypes.Datapoint) bool {
 	return len(r.packCurrents) > 1 && len(r.packCurrents) == len(r.packVoltages)
 }
 
+// GetOutput returns the metric PackResistance computes
+func (r *PackResistance) GetOutput() string {
+	return "Pack_Resistance"
+}
+
 // Compute returns the pack's resistance in ohms
 func (r *PackResistance) Compute() *datatypes.Datapoint {
 	resistance := recontool.PackResistanceUnfiltered(r.packCurrents, r.packVoltages)
@@ -67,12 +74,22 @@ func (r *PackResistance) Compute() *datatypes.Datapoint {
 		r.packVoltages = r.packVoltages[1:]
 	}
 	return &datatypes.Datapoint{
-		Metric: "Pack_Resistance",
+		Metric: r.GetOutput(),
 		Value:  resistance,
 		Time:   r.time,
 	}
 }
 
+// TryCompute returns the pack's resistance in ohms, or an error if the currents
+// received are all the same, which leaves the resistance undefined
+func (r *PackResistance) TryCompute() (*datatypes.Datapoint, error) {
+	point := r.Compute()
+	if math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+		return nil, fmt.Errorf("Pack current hasn't varied over %d readings", len(r.packCurrents))
+	}
+	return point, nil
+}
+
 // PackEfficiency computes the efficiency of the battery pack's high voltage bus
 type PackEfficiency struct {
 	standardComputation
@@ -88,10 +105,15 @@ func NewPackEfficiency() *PackEfficiency {
 	}
 }
 
+// GetOutput returns the metric PackEfficiency computes
+func (e *PackEfficiency) GetOutput() string {
+	return "Pack_Efficiency"
+}
+
 // Compute returns the pack's efficiency
 func (e *PackEfficiency) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Pack_Efficiency",
+		Metric: e.GetOutput(),
 		Value:  recontool.PackEfficiency(e.values["Bus_Current"], e.values["Bus_Power"], e.values["Pack_Resistance"]),
 		Time:   e.timestamp,
 	}
@@ -99,6 +121,21 @@ func (e *PackEfficiency) Compute() *datatypes.Datapoint {
 	return datapoint
 }
 
+// cellVoltagePattern matches the voltage metric of every battery module, but not
+// other metrics such as Cell_Voltage_Imbalance, which would otherwise make it look
+// like the computations of the imbalance depend on themselves
+const cellVoltagePattern = "Cell_Voltage_[0-9]*"
+
+// cellIndex returns the number of the module a Cell_Voltage_N metric is the voltage of.
+// Other metrics matching cellVoltagePattern, such as Cell_Voltage_0, aren't
+func cellIndex(metric string) (uint, bool) {
+	ind, err := strconv.ParseUint(strings.TrimPrefix(metric, "Cell_Voltage_"), 10, 32)
+	if err != nil || ind < 1 || ind > uint64(sr3.VSer) {
+		return 0, false
+	}
+	return uint(ind), true
+}
+
 // MinModuleVoltage calculates the battery module with the minimum voltage
 type MinModuleVoltage struct {
 	moduleVoltages []float64
@@ -116,18 +153,13 @@ func NewMinModuleVoltage() *MinModuleVoltage {
 
 // GetMetrics returns the MinModuleVoltage's metrics
 func (m *MinModuleVoltage) GetMetrics() []string {
-	metrics := make([]string, sr3.VSer)
-	var i uint
-	for i = 0; i < sr3.VSer; i++ {
-		metrics[i] = fmt.Sprintf("Cell_Voltage_%d", i+1)
-	}
-	return metrics
+	return []string{cellVoltagePattern}
 }
 
 // Update signifies an update when all required metrics have been received
 func (m *MinModuleVoltage) Update(point *datatypes.Datapoint) bool {
-	ind, err := strconv.ParseUint(point.Metric[13:], 10, 32)
-	if err != nil {
+	ind, ok := cellIndex(point.Metric)
+	if !ok {
 		return false
 	}
 	if m.moduleVoltages[ind-1] == 0 {
@@ -138,6 +170,11 @@ func (m *MinModuleVoltage) Update(point *datatypes.Datapoint) bool {
 	return m.size == sr3.VSer
 }
 
+// GetOutput returns the metric MinModuleVoltage computes
+func (m *MinModuleVoltage) GetOutput() string {
+	return "Min_Cell_Voltage"
+}
+
 // Compute finds the module with the lowest voltage
 func (m *MinModuleVoltage) Compute() *datatypes.Datapoint {
 	time := m.time
@@ -151,7 +188,7 @@ func (m *MinModuleVoltage) Compute() *datatypes.Datapoint {
 	m.size = 0
 	m.moduleVoltages = make([]float64, sr3.VSer)
 	return &datatypes.Datapoint{
-		Metric: "Min_Cell_Voltage",
+		Metric: m.GetOutput(),
 		Value:  float64(argmin + 1),
 		Time:   time,
 	}
@@ -174,18 +211,13 @@ func NewMaxModuleVoltage() *MaxModuleVoltage {
 
 // GetMetrics returns the MaxModuleVoltage's metrics
 func (m *MaxModuleVoltage) GetMetrics() []string {
-	metrics := make([]string, sr3.VSer)
-	var i uint
-	for i = 0; i < sr3.VSer; i++ {
-		metrics[i] = fmt.Sprintf("Cell_Voltage_%d", i+1)
-	}
-	return metrics
+	return []string{cellVoltagePattern}
 }
 
 // Update signifies an update when all required metrics have been received
 func (m *MaxModuleVoltage) Update(point *datatypes.Datapoint) bool {
-	ind, err := strconv.ParseUint(point.Metric[13:], 10, 32)
-	if err != nil {
+	ind, ok := cellIndex(point.Metric)
+	if !ok {
 		return false
 	}
 	if m.moduleVoltages[ind-1] == 0 {
@@ -196,6 +228,11 @@ func (m *MaxModuleVoltage) Update(point *datatypes.Datapoint) bool {
 	return m.size == sr3.VSer
 }
 
+// GetOutput returns the metric MaxModuleVoltage computes
+func (m *MaxModuleVoltage) GetOutput() string {
+	return "Max_Cell_Voltage"
+}
+
 // Compute finds the module with the highest voltage
 func (m *MaxModuleVoltage) Compute() *datatypes.Datapoint {
 	time := m.time
@@ -209,7 +246,7 @@ func (m *MaxModuleVoltage) Compute() *datatypes.Datapoint {
 	m.size = 0
 	m.moduleVoltages = make([]float64, sr3.VSer)
 	return &datatypes.Datapoint{
-		Metric: "Max_Cell_Voltage",
+		Metric: m.GetOutput(),
 		Value:  float64(argmax + 1),
 		Time:   time,
 	}
@@ -232,18 +269,13 @@ func NewModuleVoltageImbalance() *ModuleVoltageImbalance {
 
 // GetMetrics returns the ModuleVoltageImbalance's metrics
 func (m *ModuleVoltageImbalance) GetMetrics() []string {
-	metrics := make([]string, sr3.VSer)
-	var i uint
-	for i = 0; i < sr3.VSer; i++ {
-		metrics[i] = fmt.Sprintf("Cell_Voltage_%d", i+1)
-	}
-	return metrics
+	return []string{cellVoltagePattern}
 }
 
 // Update signifies an update when all required metrics have been received
 func (m *ModuleVoltageImbalance) Update(point *datatypes.Datapoint) bool {
-	ind, err := strconv.ParseUint(point.Metric[13:], 10, 32)
-	if err != nil {
+	ind, ok := cellIndex(point.Metric)
+	if !ok {
 		return false
 	}
 	if m.moduleVoltages[ind-1] == 0 {
@@ -254,6 +286,11 @@ func (m *ModuleVoltageImbalance) Update(point *datatypes.Datapoint) bool {
 	return m.size == sr3.VSer
 }
 
+// GetOutput returns the metric ModuleVoltageImbalance computes
+func (m *ModuleVoltageImbalance) GetOutput() string {
+	return "Cell_Voltage_Imbalance"
+}
+
 // Compute returns the imbalance of the battery pack
 func (m *ModuleVoltageImbalance) Compute() *datatypes.Datapoint {
 	time := m.time
@@ -270,7 +307,7 @@ func (m *ModuleVoltageImbalance) Compute() *datatypes.Datapoint {
 	m.size = 0
 	m.moduleVoltages = make([]float64, sr3.VSer)
 	return &datatypes.Datapoint{
-		Metric: "Cell_Voltage_Imbalance",
+		Metric: m.GetOutput(),
 		Value:  max - min,
 		Time:   time,
 	}
@@ -314,6 +351,11 @@ func (r *ModuleResistance) Update(point *datatypes.Datapoint) bool {
 	return len(r.currents) > 1 && len(r.voltages) > 1
 }
 
+// GetOutput returns the metric ModuleResistance computes
+func (r *ModuleResistance) GetOutput() string {
+	return fmt.Sprintf("Cell_Resistance_%d", r.moduleNumber)
+}
+
 // Compute returns the module's resistance in ohms
 func (r *ModuleResistance) Compute() *datatypes.Datapoint {
 	resistance := recontool.ModuleResistance(r.voltages, r.currents)
@@ -324,7 +366,7 @@ func (r *ModuleResistance) Compute() *datatypes.Datapoint {
 		r.voltages = r.voltages[1:]
 	}
 	return &datatypes.Datapoint{
-		Metric: fmt.Sprintf("Cell_Resistance_%d", r.moduleNumber),
+		Metric: r.GetOutput(),
 		Value:  resistance,
 		Time:   r.time,
 	}
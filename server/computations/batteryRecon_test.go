@@ -55,6 +55,26 @@ func TestPackResistance(t *testing.T) {
 	})
 }
 
+func TestPackResistanceTryCompute(t *testing.T) {
+	r := NewPackResistance()
+	for _, point := range []*datatypes.Datapoint{
+		makeDatapoint("Average_Bus_Voltage", 120),
+		makeDatapoint("BMS_Current", 3),
+		makeDatapoint("Average_Bus_Voltage", 118),
+		makeDatapoint("BMS_Current", 3),
+	} {
+		r.Update(point)
+	}
+	// The resistance is undefined while the current doesn't change
+	_, err := r.TryCompute()
+	assert.Error(t, err)
+	r.Update(makeDatapoint("Average_Bus_Voltage", 117))
+	r.Update(makeDatapoint("BMS_Current", 6))
+	point, err := r.TryCompute()
+	assert.NoError(t, err)
+	assert.Equal(t, "Pack_Resistance", point.Metric)
+}
+
 func TestPackEfficiency(t *testing.T) {
 	e := NewPackEfficiency()
 	computationRunner(t, e, []*datatypes.Datapoint{
@@ -80,20 +100,7 @@ func TestPackEfficiency(t *testing.T) {
 
 func TestMinModuleVoltage(t *testing.T) {
 	m := NewMinModuleVoltage()
-	assert.Equal(t, []string{
-		"Cell_Voltage_1", "Cell_Voltage_2", "Cell_Voltage_3",
-		"Cell_Voltage_4", "Cell_Voltage_5", "Cell_Voltage_6",
-		"Cell_Voltage_7", "Cell_Voltage_8", "Cell_Voltage_9",
-		"Cell_Voltage_10", "Cell_Voltage_11", "Cell_Voltage_12",
-		"Cell_Voltage_13", "Cell_Voltage_14", "Cell_Voltage_15",
-		"Cell_Voltage_16", "Cell_Voltage_17", "Cell_Voltage_18",
-		"Cell_Voltage_19", "Cell_Voltage_20", "Cell_Voltage_21",
-		"Cell_Voltage_22", "Cell_Voltage_23", "Cell_Voltage_24",
-		"Cell_Voltage_25", "Cell_Voltage_26", "Cell_Voltage_27",
-		"Cell_Voltage_28", "Cell_Voltage_29", "Cell_Voltage_30",
-		"Cell_Voltage_31", "Cell_Voltage_32", "Cell_Voltage_33",
-		"Cell_Voltage_34", "Cell_Voltage_35",
-	}, m.GetMetrics())
+	assert.Equal(t, []string{"Cell_Voltage_[0-9]*"}, m.GetMetrics())
 	computationRunner(t, m, moduleVoltagePoints(35, 3, 18, []int{5}), &datatypes.Datapoint{
 		Metric: "Min_Cell_Voltage",
 		Value:  3.0,
@@ -108,20 +115,7 @@ func TestMinModuleVoltage(t *testing.T) {
 
 func TestMaxModuleVoltage(t *testing.T) {
 	m := NewMaxModuleVoltage()
-	assert.Equal(t, []string{
-		"Cell_Voltage_1", "Cell_Voltage_2", "Cell_Voltage_3",
-		"Cell_Voltage_4", "Cell_Voltage_5", "Cell_Voltage_6",
-		"Cell_Voltage_7", "Cell_Voltage_8", "Cell_Voltage_9",
-		"Cell_Voltage_10", "Cell_Voltage_11", "Cell_Voltage_12",
-		"Cell_Voltage_13", "Cell_Voltage_14", "Cell_Voltage_15",
-		"Cell_Voltage_16", "Cell_Voltage_17", "Cell_Voltage_18",
-		"Cell_Voltage_19", "Cell_Voltage_20", "Cell_Voltage_21",
-		"Cell_Voltage_22", "Cell_Voltage_23", "Cell_Voltage_24",
-		"Cell_Voltage_25", "Cell_Voltage_26", "Cell_Voltage_27",
-		"Cell_Voltage_28", "Cell_Voltage_29", "Cell_Voltage_30",
-		"Cell_Voltage_31", "Cell_Voltage_32", "Cell_Voltage_33",
-		"Cell_Voltage_34", "Cell_Voltage_35",
-	}, m.GetMetrics())
+	assert.Equal(t, []string{"Cell_Voltage_[0-9]*"}, m.GetMetrics())
 	computationRunner(t, m, moduleVoltagePoints(35, 3, 18, []int{5}), &datatypes.Datapoint{
 		Metric: "Max_Cell_Voltage",
 		Value:  18.0,
@@ -134,22 +128,22 @@ func TestMaxModuleVoltage(t *testing.T) {
 	})
 }
 
+func TestCellIndex(t *testing.T) {
+	for metric, expected := range map[string]uint{"Cell_Voltage_1": 1, "Cell_Voltage_35": 35} {
+		ind, ok := cellIndex(metric)
+		assert.True(t, ok, metric)
+		assert.Equal(t, expected, ind, metric)
+	}
+	// Other metrics matching the pattern are ignored
+	for _, metric := range []string{"Cell_Voltage_Imbalance", "Cell_Voltage_0", "Cell_Voltage_36", "Cell_Voltage_-1"} {
+		_, ok := cellIndex(metric)
+		assert.False(t, ok, metric)
+	}
+}
+
 func TestModuleVoltageImbalance(t *testing.T) {
 	m := NewModuleVoltageImbalance()
-	assert.Equal(t, []string{
-		"Cell_Voltage_1", "Cell_Voltage_2", "Cell_Voltage_3",
-		"Cell_Voltage_4", "Cell_Voltage_5", "Cell_Voltage_6",
-		"Cell_Voltage_7", "Cell_Voltage_8", "Cell_Voltage_9",
-		"Cell_Voltage_10", "Cell_Voltage_11", "Cell_Voltage_12",
-		"Cell_Voltage_13", "Cell_Voltage_14", "Cell_Voltage_15",
-		"Cell_Voltage_16", "Cell_Voltage_17", "Cell_Voltage_18",
-		"Cell_Voltage_19", "Cell_Voltage_20", "Cell_Voltage_21",
-		"Cell_Voltage_22", "Cell_Voltage_23", "Cell_Voltage_24",
-		"Cell_Voltage_25", "Cell_Voltage_26", "Cell_Voltage_27",
-		"Cell_Voltage_28", "Cell_Voltage_29", "Cell_Voltage_30",
-		"Cell_Voltage_31", "Cell_Voltage_32", "Cell_Voltage_33",
-		"Cell_Voltage_34", "Cell_Voltage_35",
-	}, m.GetMetrics())
+	assert.Equal(t, []string{"Cell_Voltage_[0-9]*"}, m.GetMetrics())
 	computationRunner(t, m, moduleVoltagePoints(35, 3, 18, []int{5}), &datatypes.Datapoint{
 		Metric: "Cell_Voltage_Imbalance",
 		Value:  0.215,
@@ -19,12 +19,17 @@ func NewBusPower() *BusPower {
 	}
 }
 
+// GetOutput returns the metric BusPower computes
+func (bp *BusPower) GetOutput() string {
+	return "Bus_Power"
+}
+
 // Compute computes the bus power as the sum of the left and right bus powers
 func (bp *BusPower) Compute() *datatypes.Datapoint {
 	val := bp.values["Left_Bus_Power"] + bp.values["Right_Bus_Power"]
 	bp.values = make(map[string]float64)
 	return &datatypes.Datapoint{
-		Metric: "Bus_Power",
+		Metric: bp.GetOutput(),
 		Value:  val,
 		Time:   bp.timestamp,
 	}
@@ -45,13 +50,18 @@ func NewLeftBusPower() *LeftBusPower {
 	}
 }
 
+// GetOutput returns the metric LeftBusPower computes
+func (bp *LeftBusPower) GetOutput() string {
+	return "Left_Bus_Power"
+}
+
 // Compute computes the bus power as the product of the bus voltage
 // and the bus current
 func (bp *LeftBusPower) Compute() *datatypes.Datapoint {
 	val := bp.values["Left_Bus_Voltage"] * bp.values["Left_Bus_Current"]
 	bp.values = make(map[string]float64)
 	return &datatypes.Datapoint{
-		Metric: "Left_Bus_Power",
+		Metric: bp.GetOutput(),
 		Value:  val,
 		Time:   bp.timestamp,
 	}
@@ -72,13 +82,18 @@ func NewRightBusPower() *RightBusPower {
 	}
 }
 
+// GetOutput returns the metric RightBusPower computes
+func (bp *RightBusPower) GetOutput() string {
+	return "Right_Bus_Power"
+}
+
 // Compute computes the bus power as the product of the bus voltage
 // and the bus current
 func (bp *RightBusPower) Compute() *datatypes.Datapoint {
 	val := bp.values["Right_Bus_Voltage"] * bp.values["Right_Bus_Current"]
 	bp.values = make(map[string]float64)
 	return &datatypes.Datapoint{
-		Metric: "Right_Bus_Power",
+		Metric: bp.GetOutput(),
 		Value:  val,
 		Time:   bp.timestamp,
 	}
@@ -1,46 +1,416 @@
 package computations
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math"
 	"server/datatypes"
 	"server/listener"
+	"sync"
+	"time"
 )
 
 // Computable is the base interface which every computation must implement
 type Computable interface {
 	Update(point *datatypes.Datapoint) bool
 	Compute() *datatypes.Datapoint
+	// GetMetrics returns the metrics the computation is updated with,
+	// which may be glob patterns such as Cell_Voltage_*
 	GetMetrics() []string
+	// GetOutput returns the metric the computation computes, which other
+	// computations may depend on
+	GetOutput() string
 }
 
-var registry []Computable
+// ErrorComputable is a computation which can fail to compute a value. The
+// computations of those which implement it are made with TryCompute instead of Compute
+type ErrorComputable interface {
+	Computable
+	TryCompute() (*datatypes.Datapoint, error)
+}
+
+var registry []*node
+
+const (
+	// errorReportInterval is how often the number of errors of each computation is published
+	errorReportInterval = 5 * time.Second
+	// errorsMetric is the number of invalid values a computation has computed,
+	// or times it has failed, since it started
+	errorsMetric = "Computation_Errors"
+)
 
-// Register registers a computation
+// Register registers a computation which drops invalid values
 func Register(computation Computable) {
-	registry = append(registry, computation)
+	registry = append(registry, newNode(computation, Options{Invalid: Drop}))
+}
+
+// RegisterWith registers a computation which handles invalid values as options say
+func RegisterWith(computation Computable, options Options) error {
+	options, err := validateOptions(computation.GetOutput(), options)
+	if err != nil {
+		return err
+	}
+	registry = append(registry, newNode(computation, options))
+	return nil
+}
+
+// validateOptions returns options with the default policy filled in,
+// or an error if they are invalid for the computation of output
+func validateOptions(output string, options Options) (Options, error) {
+	switch options.Invalid {
+	case "":
+		options.Invalid = Drop
+	case Drop, Hold:
+	case Clamp:
+		if !(options.Min < options.Max) {
+			return options, fmt.Errorf("Invalid bounds [%f, %f] to clamp %s to", options.Min, options.Max, output)
+		}
+	default:
+		return options, fmt.Errorf("Unknown invalid value policy %q for %s", options.Invalid, output)
+	}
+	return options, nil
+}
+
+// runner runs the registered computations and those defined by formulas,
+// which can be replaced while they run
+type runner struct {
+	mu sync.Mutex
+	// registry points to the registered computations, which tests replace
+	registry *[]*node
+	formulas []*node
+	// graph is the graph of the running computations, and ctx their context,
+	// once they have been started
+	graph *graph
+	ctx   context.Context
+	// levels are the running computations at each depth of the graph, which
+	// are stopped one depth at a time so that each gets the points computed
+	// by those it depends on
+	levels []*level
+	// stopFormulas stop the running formulas, and formulaStreams are the
+	// channels they are subscribed with
+	stopFormulas   []context.CancelFunc
+	formulaStreams []chan *datatypes.Datapoint
+	// reporting is done once the errors are no longer being reported, and
+	// stopped is closed once ctx is done and every computation has returned
+	reporting sync.WaitGroup
+	stopped   chan struct{}
+}
+
+// level is the computations at one depth of the graph
+type level struct {
+	ctx       context.Context
+	stop      context.CancelFunc
+	computing sync.WaitGroup
+}
+
+var active = &runner{registry: &registry}
+
+// GetGraph returns the registered computations, how they depend on each other and,
+// once they have been started, the points each has been updated with and computed
+func GetGraph() Graph {
+	return active.stats()
 }
 
 // RunComputations is the main function, which spawns goroutines for every computation and routes
-// incoming data points to their associated computations
-func RunComputations() {
-	for _, computation := range registry {
-		stream := make(chan *datatypes.Datapoint, 100)
-		listener.Subscribe(stream, computation.GetMetrics()...)
-		go compute(computation, stream)
+// incoming data points to their associated computations until ctx is done. Computations are
+// started after those they depend on. Computations in a cycle would feed each other forever,
+// so they are not started. Once started, each computation runs on its own and is updated in
+// the order points are published, so a computation may be updated with a point before the
+// points computed from it by the computations it depends on.
+//
+// Once ctx is done the computations compute the points already published, and are then
+// stopped in the order they were started, so that each computes the points computed by
+// those it depends on. The returned channel is closed once they have all stopped
+func RunComputations(ctx context.Context) <-chan struct{} {
+	active.run(ctx)
+	return active.stopped
+}
+
+// nodes returns the registered computations followed by the formulas
+func (r *runner) nodes(formulas []*node) []*node {
+	nodes := make([]*node, 0, len(*r.registry)+len(formulas))
+	nodes = append(nodes, *r.registry...)
+	return append(nodes, formulas...)
+}
+
+func (r *runner) stats() Graph {
+	r.mu.Lock()
+	g := r.graph
+	if g == nil {
+		g = buildGraph(r.nodes(r.formulas))
+	}
+	r.mu.Unlock()
+	return g.stats()
+}
+
+func (r *runner) run(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.graph = buildGraph(r.nodes(r.formulas))
+	r.ctx = ctx
+	r.stopped = make(chan struct{})
+	for _, cycle := range r.graph.cycles {
+		log.Printf("WARNING: Computations %s depend on each other. Not starting them...\n", describeCycle(cycle))
+		for _, n := range cycle {
+			n.disable(fmt.Errorf("In a cycle with %s", describeCycle(cycle)))
+		}
+	}
+	isFormula := make(map[*node]bool)
+	for _, n := range r.formulas {
+		isFormula[n] = true
+	}
+	for _, n := range r.graph.nodes {
+		if r.graph.cycle[n] {
+			continue
+		}
+		stream, err := r.start(n, isFormula[n])
+		if err != nil {
+			continue
+		}
+		if isFormula[n] {
+			r.formulaStreams = append(r.formulaStreams, stream)
+		}
 	}
+	r.reporting.Add(1)
+	go func() {
+		defer r.reporting.Done()
+		reportErrors(ctx, r)
+	}()
+	go r.stop()
 }
 
-func compute(computation Computable, stream chan *datatypes.Datapoint) {
+// stop waits for the runner's ctx to be done, and then stops the computations one
+// depth at a time. Before each depth is stopped the publisher is flushed, so that
+// it is sent the points computed by the depths before it, which it computes before
+// returning. Once every computation has stopped, stopped is closed
+func (r *runner) stop() {
+	<-r.ctx.Done()
+	// Computations are only started with the lock held and ctx not done,
+	// so none can be started once it is taken here
+	r.mu.Lock()
+	levels := r.levels
+	r.mu.Unlock()
 	publisher := listener.GetDatapointPublisher()
-	for point := range stream {
-		if computation.Update(point) {
-			computed := computation.Compute()
-			if math.IsInf(computed.Value, 0) || math.IsNaN(computed.Value) {
-				log.Printf("WARNING: %T computed invalid value %f. Stopping computation...\n", computation, computed.Value)
+	for _, l := range levels {
+		publisher.Flush()
+		l.stop()
+		l.computing.Wait()
+	}
+	r.reporting.Wait()
+	close(r.stopped)
+}
+
+// level returns the computations at depth, adding the levels up to it if they
+// haven't been started. It must be called with the lock held
+func (r *runner) level(depth int) *level {
+	for len(r.levels) <= depth {
+		ctx, stop := context.WithCancel(context.Background())
+		r.levels = append(r.levels, &level{ctx: ctx, stop: stop})
+	}
+	return r.levels[depth]
+}
+
+// setFormulas replaces the computations defined by formulas with formulas, stopping
+// the old ones and starting the new ones if the computations are running. An error is
+// returned, and nothing is replaced, if a formula computes a metric which is already
+// computed, or it would be in a cycle. Formulas which fail to start are disabled,
+// and the first of their errors returned
+func (r *runner) setFormulas(formulas []*node) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	outputs := make(map[string]bool)
+	for _, n := range r.nodes(formulas) {
+		if outputs[n.name] {
+			return fmt.Errorf("%s is already computed", n.name)
+		}
+		outputs[n.name] = true
+	}
+	g := buildGraph(r.nodes(formulas))
+	isFormula := make(map[*node]bool)
+	for _, n := range formulas {
+		isFormula[n] = true
+	}
+	for _, cycle := range g.cycles {
+		for _, n := range cycle {
+			if isFormula[n] {
+				return fmt.Errorf("Formulas would make a cycle of computations %s", describeCycle(cycle))
+			}
+		}
+	}
+	r.formulas = formulas
+	if r.graph == nil || r.ctx.Err() != nil {
+		return nil
+	}
+	// The old formulas are unsubscribed straight away so that they don't
+	// compute anything published after they are replaced
+	for _, stream := range r.formulaStreams {
+		listener.Unsubscribe(stream)
+	}
+	for _, stop := range r.stopFormulas {
+		stop()
+	}
+	r.graph = g
+	r.stopFormulas = nil
+	r.formulaStreams = nil
+	var startErr error
+	for _, n := range formulas {
+		stream, err := r.start(n, true)
+		if err != nil {
+			if startErr == nil {
+				startErr = err
+			}
+			continue
+		}
+		r.formulaStreams = append(r.formulaStreams, stream)
+	}
+	return startErr
+}
+
+// start runs the computation of n until its depth is stopped or, if it is a formula,
+// the formulas are replaced, returning the channel it is subscribed to the publisher
+// with. If it can't be subscribed, it is disabled and not started. It must be called
+// with the lock held
+func (r *runner) start(n *node, formula bool) (chan *datatypes.Datapoint, error) {
+	stream := make(chan *datatypes.Datapoint, 100)
+	err := listener.SubscribeWith(stream, listener.SubscribeOptions{Name: n.name}, n.computation.GetMetrics()...)
+	if err != nil {
+		err = fmt.Errorf("Error subscribing %s: %s", n.name, err)
+		log.Printf("WARNING: %s. Not starting it...\n", err)
+		n.disable(err)
+		return nil, err
+	}
+	l := r.level(r.graph.depth[n])
+	ctx := l.ctx
+	if formula {
+		var stop context.CancelFunc
+		ctx, stop = context.WithCancel(ctx)
+		r.stopFormulas = append(r.stopFormulas, stop)
+	}
+	n.setRunning(true)
+	l.computing.Add(1)
+	go func() {
+		defer l.computing.Done()
+		compute(ctx, n, stream)
+	}()
+	return stream, nil
+}
+
+// compute updates the computation of n with the points received on stream until ctx
+// is done, publishing what it computes. Invalid values are handled by its policy and
+// counted as errors, and the computation carries on with the next point. Once ctx is
+// done, the points already received are computed before it returns
+func compute(ctx context.Context, n *node, stream chan *datatypes.Datapoint) {
+	defer n.setRunning(false)
+	publisher := listener.GetDatapointPublisher()
+	var last *datatypes.Datapoint
+	stopping := false
+	for {
+		var point *datatypes.Datapoint
+		if stopping {
+			select {
+			case point = <-stream:
+			default:
 				return
 			}
-			publisher.Publish(computed)
+		} else {
+			select {
+			case point = <-stream:
+			case <-ctx.Done():
+				listener.Unsubscribe(stream)
+				stopping = true
+				continue
+			}
+		}
+		if point == nil {
+			// The publisher was closed
+			return
+		}
+		n.input()
+		computed, err := update(n.computation, point)
+		if computed == nil && err == nil {
+			continue
+		}
+		if err == nil && (math.IsInf(computed.Value, 0) || math.IsNaN(computed.Value)) {
+			err = fmt.Errorf("Computed invalid value %f", computed.Value)
+		}
+		if err != nil {
+			n.fail(err)
+			computed = handleInvalid(n.options, computed, last, point.Time)
+			if computed == nil {
+				continue
+			}
+		} else {
+			n.succeed()
+			if n.options.Invalid == Clamp {
+				computed = clamp(n.options, computed)
+			}
+			last = computed
+		}
+		n.output()
+		published := *computed
+		if published.Tags == nil {
+			published.Tags = derivedTags(point)
+		}
+		publisher.Publish(&published)
+	}
+}
+
+// update updates computation with point, returning what it computes if it is ready.
+// A computation which panics is treated as having failed
+func update(computation Computable, point *datatypes.Datapoint) (computed *datatypes.Datapoint, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			computed = nil
+			err = fmt.Errorf("Panicked: %v", r)
+		}
+	}()
+	if !computation.Update(point) {
+		return nil, nil
+	}
+	if fallible, ok := computation.(ErrorComputable); ok {
+		return fallible.TryCompute()
+	}
+	return computation.Compute(), nil
+}
+
+// reportErrors periodically publishes the number of errors of each computation r runs until ctx is done
+func reportErrors(ctx context.Context, r *runner) {
+	ticker := time.NewTicker(errorReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		r.mu.Lock()
+		g := r.graph
+		r.mu.Unlock()
+		publishErrors(g, time.Now())
+	}
+}
+
+func publishErrors(g *graph, now time.Time) {
+	publisher := listener.GetDatapointPublisher()
+	for _, n := range g.nodes {
+		publisher.Publish(&datatypes.Datapoint{
+			Metric: errorsMetric,
+			Value:  float64(n.stats().Errors),
+			Time:   now,
+			Tags:   map[string]string{datatypes.ComputationTag: n.name},
+		})
+	}
+}
+
+// derivedTags returns the tags of a computed datapoint, which belongs to
+// the same car and session as the point that triggered the computation
+func derivedTags(point *datatypes.Datapoint) map[string]string {
+	tags := map[string]string{datatypes.SourceTag: datatypes.SourceComputation}
+	for _, key := range []string{datatypes.CarTag, datatypes.SessionTag} {
+		if value, ok := point.Tags[key]; ok {
+			tags[key] = value
 		}
 	}
+	return tags
 }
@@ -1,7 +1,7 @@
-package computations_test
+package computations
 
 import (
-	"server/computations"
+	"context"
 	"server/datatypes"
 	"server/listener"
 	"testing"
@@ -21,7 +21,7 @@ func (mc *mockComputable) Update(point *datatypes.Datapoint) bool {
 
 func (mc *mockComputable) Compute() *datatypes.Datapoint {
 	point := &datatypes.Datapoint{
-		Metric: "Result Metric",
+		Metric: mc.GetOutput(),
 		Value:  mc.values[0] + mc.values[1],
 	}
 	mc.values = make([]float64, 0, 2)
@@ -32,13 +32,25 @@ func (mc *mockComputable) GetMetrics() []string {
 	return []string{"Computable_Integration_Test_Metric_1", "Computable_Integration_Test_Metric_2"}
 }
 
+func (mc *mockComputable) GetOutput() string {
+	return "Result Metric"
+}
+
 func TestComputations(t *testing.T) {
-	computations.Register(&mockComputable{})
-	go computations.RunComputations()
+	nodes := []*node{newNode(&mockComputable{}, Options{Invalid: Drop})}
+	r := &runner{registry: &nodes}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.run(ctx)
 
 	publisher := listener.GetDatapointPublisher()
 	defer func() {
-		<-time.After(10 * time.Millisecond)
+		// The computations are stopped before the publisher they publish to is closed
+		cancel()
+		select {
+		case <-r.stopped:
+		case <-time.After(time.Second):
+			t.Error("Computations didn't stop")
+		}
 		publisher.Close()
 	}()
 	stream := make(chan *datatypes.Datapoint, 1000)
@@ -72,6 +84,10 @@ func TestComputations(t *testing.T) {
 	publisher.Publish(&datatypes.Datapoint{
 		Metric: "Computable_Integration_Test_Metric_2",
 		Value:  100,
+		Tags: map[string]string{
+			datatypes.CarTag:        "SR-3",
+			datatypes.ConnectionTag: "127.0.0.1:6001",
+		},
 	})
 	<-stream
 	var point *datatypes.Datapoint
@@ -82,4 +98,69 @@ func TestComputations(t *testing.T) {
 	}
 	assert.Equal(t, "Result Metric", point.Metric)
 	assert.Equal(t, float64(101), point.Value)
+	assert.Equal(t, map[string]string{
+		datatypes.CarTag:    "SR-3",
+		datatypes.SourceTag: datatypes.SourceComputation,
+	}, point.Tags)
+
+	for _, computation := range r.stats().Computations {
+		if computation.Name == "Result Metric" {
+			assert.True(t, computation.Running)
+			assert.Equal(t, uint64(2), computation.InputCount)
+			assert.Equal(t, uint64(1), computation.Computed)
+		}
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	nodes := []*node{
+		newNode(&graphComputation{inputs: []string{"Start_Test_["}, output: "Start_Test_Bad"}, Options{Invalid: Drop}),
+		newNode(&graphComputation{inputs: []string{"Start_Test_Input"}, output: "Start_Test_Good"}, Options{Invalid: Drop}),
+	}
+	r := &runner{registry: &nodes}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.run(ctx)
+	stats := r.stats().Computations
+	cancel()
+	<-r.stopped
+
+	// A computation that can't be subscribed isn't started, and the others are
+	assert.False(t, stats[0].Running)
+	assert.Contains(t, stats[0].LastError, "malformed pattern")
+	assert.True(t, stats[1].Running)
+	assert.False(t, r.stats().Computations[1].Running)
+}
+
+func TestStopComputesPublished(t *testing.T) {
+	var nodes []*node
+	for _, definition := range []string{"Stop_Test_Double = 2 * Stop_Test_Input", "Stop_Test_Quadruple = 2 * Stop_Test_Double"} {
+		formula, err := NewFormula(definition, 0)
+		assert.NoError(t, err)
+		nodes = append(nodes, newNode(formula, Options{Invalid: Drop}))
+	}
+	outputs := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, listener.Subscribe(outputs, "Stop_Test_Quadruple"))
+	defer listener.Unsubscribe(outputs)
+	r := &runner{registry: &nodes}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.run(ctx)
+
+	// The last point published is computed through the chain before the computations stop
+	listener.GetDatapointPublisher().Publish(&datatypes.Datapoint{Metric: "Stop_Test_Input", Value: 2})
+	cancel()
+	select {
+	case <-r.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Computations didn't stop")
+	}
+	listener.GetDatapointPublisher().Flush()
+	select {
+	case point := <-outputs:
+		assert.Equal(t, float64(8), point.Value)
+	default:
+		t.Error("Last point wasn't computed")
+	}
+	for _, computation := range r.stats().Computations {
+		assert.False(t, computation.Running)
+	}
 }
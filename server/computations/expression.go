@@ -0,0 +1,348 @@
+package computations
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is an arithmetic expression of metrics, such as
+// BMS_Current * Average_Bus_Voltage. It may use numbers, metric names,
+// + - * / and ^ (power), parentheses and the functions in expressionFunctions
+type Expression struct {
+	root    expressionNode
+	metrics []string
+}
+
+// expressionNode is a node in the syntax tree of an expression
+type expressionNode interface {
+	eval(values map[string]float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(values map[string]float64) float64 {
+	return float64(n)
+}
+
+type metricNode string
+
+func (n metricNode) eval(values map[string]float64) float64 {
+	return values[string(n)]
+}
+
+type negateNode struct {
+	operand expressionNode
+}
+
+func (n negateNode) eval(values map[string]float64) float64 {
+	return -n.operand.eval(values)
+}
+
+type binaryNode struct {
+	operator    rune
+	left, right expressionNode
+}
+
+func (n binaryNode) eval(values map[string]float64) float64 {
+	left, right := n.left.eval(values), n.right.eval(values)
+	switch n.operator {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	case '/':
+		return left / right
+	}
+	return math.Pow(left, right)
+}
+
+type callNode struct {
+	function expressionFunction
+	args     []expressionNode
+}
+
+func (n callNode) eval(values map[string]float64) float64 {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.eval(values)
+	}
+	return n.function.call(args)
+}
+
+// expressionFunction is a function which can be called in an expression
+type expressionFunction struct {
+	// arity is the number of arguments the function takes, or -1 for one or more
+	arity int
+	call  func(args []float64) float64
+}
+
+// unary returns an expressionFunction for a function of one argument
+func unary(f func(float64) float64) expressionFunction {
+	return expressionFunction{1, func(args []float64) float64 { return f(args[0]) }}
+}
+
+// binary returns an expressionFunction for a function of two arguments
+func binary(f func(float64, float64) float64) expressionFunction {
+	return expressionFunction{2, func(args []float64) float64 { return f(args[0], args[1]) }}
+}
+
+// expressionFunctions are the functions which can be called in an expression
+var expressionFunctions = map[string]expressionFunction{
+	"abs":   unary(math.Abs),
+	"sqrt":  unary(math.Sqrt),
+	"exp":   unary(math.Exp),
+	"log":   unary(math.Log),
+	"sin":   unary(math.Sin),
+	"cos":   unary(math.Cos),
+	"tan":   unary(math.Tan),
+	"asin":  unary(math.Asin),
+	"acos":  unary(math.Acos),
+	"atan":  unary(math.Atan),
+	"atan2": binary(math.Atan2),
+	"pow":   binary(math.Pow),
+	"min": {-1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result
+	}},
+	"max": {-1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result
+	}},
+}
+
+// ParseExpression parses an arithmetic expression of metrics
+func ParseExpression(text string) (*Expression, error) {
+	p := &expressionParser{text: text, seen: make(map[string]bool)}
+	p.next()
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		return nil, p.unexpected()
+	}
+	return &Expression{root: root, metrics: p.metrics}, nil
+}
+
+// Eval returns the value of the expression given the values of its metrics
+func (e *Expression) Eval(values map[string]float64) float64 {
+	return e.root.eval(values)
+}
+
+// Metrics returns the metrics the expression uses, in the order they first appear
+func (e *Expression) Metrics() []string {
+	return e.metrics
+}
+
+// expressionParser is a recursive descent parser of expressions
+type expressionParser struct {
+	text string
+	// token is the current token, which starts at position in text. It is
+	// empty at the end of the text
+	token    string
+	position int
+	end      int
+	metrics  []string
+	seen     map[string]bool
+}
+
+// next moves on to the next token
+func (p *expressionParser) next() {
+	start := p.end
+	for start < len(p.text) && unicode.IsSpace(rune(p.text[start])) {
+		start++
+	}
+	end := start
+	switch {
+	case end == len(p.text):
+	case isNameByte(p.text[end]) && !isDigit(p.text[end]):
+		for end < len(p.text) && isNameByte(p.text[end]) {
+			end++
+		}
+	case isDigit(p.text[end]) || p.text[end] == '.':
+		for end < len(p.text) && (isDigit(p.text[end]) || p.text[end] == '.') {
+			end++
+		}
+		// An exponent, such as the e-3 of 1e-3
+		if end < len(p.text) && (p.text[end] == 'e' || p.text[end] == 'E') {
+			exponent := end + 1
+			if exponent < len(p.text) && (p.text[exponent] == '+' || p.text[exponent] == '-') {
+				exponent++
+			}
+			if exponent < len(p.text) && isDigit(p.text[exponent]) {
+				end = exponent
+				for end < len(p.text) && isDigit(p.text[end]) {
+					end++
+				}
+			}
+		}
+	default:
+		end++
+	}
+	p.token = p.text[start:end]
+	p.position = start
+	p.end = end
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isNameByte(b byte) bool {
+	return b == '_' || isDigit(b) || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// unexpected returns an error for the current token
+func (p *expressionParser) unexpected() error {
+	if p.token == "" {
+		return fmt.Errorf("Unexpected end of expression %q", p.text)
+	}
+	return fmt.Errorf("Unexpected %q at position %d of expression %q", p.token, p.position+1, p.text)
+}
+
+// parseSum parses terms added or subtracted
+func (p *expressionParser) parseSum() (expressionNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "+" || p.token == "-" {
+		operator := rune(p.token[0])
+		p.next()
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{operator, left, right}
+	}
+	return left, nil
+}
+
+// parseProduct parses factors multiplied or divided
+func (p *expressionParser) parseProduct() (expressionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "*" || p.token == "/" {
+		operator := rune(p.token[0])
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{operator, left, right}
+	}
+	return left, nil
+}
+
+// parseUnary parses a factor with any signs before it. Powers bind more
+// tightly than signs, so -2^2 is -4
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	switch p.token {
+	case "-":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand}, nil
+	case "+":
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+// parsePower parses a value raised to a power. Powers are right associative,
+// so 2^3^2 is 2^9
+func (p *expressionParser) parsePower() (expressionNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "^" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{'^', base, exponent}, nil
+}
+
+// parsePrimary parses a number, metric, function call or parenthesized expression
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	token := p.token
+	switch {
+	case token == "(":
+		p.next()
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return inner, nil
+	case token != "" && (isDigit(token[0]) || token[0] == '.'):
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q at position %d of expression %q", token, p.position+1, p.text)
+		}
+		p.next()
+		return numberNode(value), nil
+	case token != "" && isNameByte(token[0]):
+		p.next()
+		if p.token == "(" {
+			return p.parseCall(token)
+		}
+		if !p.seen[token] {
+			p.seen[token] = true
+			p.metrics = append(p.metrics, token)
+		}
+		return metricNode(token), nil
+	}
+	return nil, p.unexpected()
+}
+
+// parseCall parses the arguments of a call to the function name
+func (p *expressionParser) parseCall(name string) (expressionNode, error) {
+	function, ok := expressionFunctions[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %s in expression %q", name, p.text)
+	}
+	p.next()
+	var args []expressionNode
+	for p.token != ")" {
+		if len(args) > 0 {
+			if p.token != "," {
+				return nil, p.unexpected()
+			}
+			p.next()
+		}
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if function.arity == -1 && len(args) == 0 || function.arity >= 0 && len(args) != function.arity {
+		return nil, fmt.Errorf("Wrong number of arguments to %s in expression %q", name, p.text)
+	}
+	return callNode{function, args}, nil
+}
@@ -0,0 +1,55 @@
+package computations
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpression(t *testing.T) {
+	values := map[string]float64{"BMS_Current": 2, "Average_Bus_Voltage": 100, "Left_RPM": 3, "Right_RPM": 5}
+	for text, expected := range map[string]float64{
+		"BMS_Current * Average_Bus_Voltage": 200,
+		"(Left_RPM + Right_RPM) / 2":        4,
+		"Left_RPM + Right_RPM / 2":          5.5,
+		"10 - 4 - 3":                        3,
+		"2 ^ 3 ^ 2":                         512,
+		"-2^2":                              -4,
+		"2^-1":                              0.5,
+		"--Left_RPM":                        3,
+		"1.5e2 + .5 + 2E-1":                 150.7,
+		"abs(Left_RPM - Right_RPM)":         2,
+		"max(Left_RPM, Right_RPM, 4)":       5,
+		"min(Left_RPM)":                     3,
+		"pow(BMS_Current, 3) + sqrt(16)":    12,
+		"ATAN2(0, 1)":                       0,
+	} {
+		expression, err := ParseExpression(text)
+		if assert.NoError(t, err, text) {
+			assert.InDelta(t, expected, expression.Eval(values), 1e-9, text)
+		}
+	}
+
+	expression, err := ParseExpression("Left_RPM * Left_RPM / (BMS_Current - 2)")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Left_RPM", "BMS_Current"}, expression.Metrics())
+	assert.True(t, math.IsInf(expression.Eval(values), 1))
+
+	for _, text := range []string{
+		"",
+		"BMS_Current *",
+		"(BMS_Current",
+		"BMS_Current)",
+		"BMS_Current Average_Bus_Voltage",
+		"1.2.3",
+		"BMS_Current % 2",
+		"median(BMS_Current)",
+		"sqrt(1, 2)",
+		"max()",
+		"min(1 2)",
+	} {
+		_, err := ParseExpression(text)
+		assert.Error(t, err, text)
+	}
+}
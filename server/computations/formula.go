@@ -0,0 +1,250 @@
+package computations
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"server/datatypes"
+	"server/settings"
+	"strings"
+	"time"
+)
+
+// Formula computes a metric from an expression of other metrics, such as
+// Pack_Power = BMS_Current * Average_Bus_Voltage. Formulas are defined in the
+// formulas file instead of in Go, so they can be added while the server runs
+type Formula struct {
+	name       string
+	expression *Expression
+	// maxAge is how old an input may be, relative to the newest, to be used.
+	// Zero means inputs never go stale
+	maxAge    time.Duration
+	values    map[string]float64
+	times     map[string]time.Time
+	timestamp time.Time
+}
+
+// FormulaDefinition is the definition of a formula or a statistic in the formulas file
+type FormulaDefinition struct {
+	// Formula is the metric computed and the expression it is computed
+	// from, such as "Pack_Power = BMS_Current * Average_Bus_Voltage"
+	Formula string `json:"formula"`
+	// MaxAge is how much older than the newest input the other inputs may be to
+	// be used, as a duration such as "500ms" or "2s". Empty means any age
+	MaxAge string `json:"max_age"`
+	// Statistic is the statistic of Metric computed instead of a formula, named
+	// Name. Window is the rolling window, or the time constant of an EWMA, as a
+	// duration such as "5m"
+	Statistic Statistic `json:"statistic"`
+	Metric    string    `json:"metric"`
+	Window    string    `json:"window"`
+	Name      string    `json:"name"`
+	// Invalid is the policy for invalid values, and Min and Max the bounds
+	// values are clamped to with the clamp policy
+	Invalid InvalidPolicy `json:"invalid"`
+	Min     float64       `json:"min"`
+	Max     float64       `json:"max"`
+}
+
+// NewFormula returns a Formula computing the metric named on the left of definition
+// from the expression on the right, from inputs no more than maxAge older than the newest
+func NewFormula(definition string, maxAge time.Duration) (*Formula, error) {
+	parts := strings.SplitN(definition, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Formula %q should be of the form Metric = expression", definition)
+	}
+	name := strings.TrimSpace(parts[0])
+	if !isMetricName(name) {
+		return nil, fmt.Errorf("Invalid metric name %q in formula %q", name, definition)
+	}
+	expression, err := ParseExpression(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(expression.Metrics()) == 0 {
+		return nil, fmt.Errorf("Formula %q doesn't use any metrics", definition)
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("Negative max age %s for formula %q", maxAge, definition)
+	}
+	return &Formula{
+		name:       name,
+		expression: expression,
+		maxAge:     maxAge,
+		values:     make(map[string]float64),
+		times:      make(map[string]time.Time),
+	}, nil
+}
+
+// isMetricName returns whether name can be used as a metric in an expression
+func isMetricName(name string) bool {
+	if name == "" || isDigit(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Update records the value of point, signifying an update when every input
+// has a value no more than maxAge older than point
+func (f *Formula) Update(point *datatypes.Datapoint) bool {
+	f.values[point.Metric] = point.Value
+	f.times[point.Metric] = point.Time
+	if point.Time.After(f.timestamp) {
+		f.timestamp = point.Time
+	}
+	for _, metric := range f.expression.Metrics() {
+		received, ok := f.times[metric]
+		if !ok {
+			return false
+		}
+		if f.maxAge > 0 && f.timestamp.Sub(received) > f.maxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Compute evaluates the formula's expression with the latest inputs
+func (f *Formula) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{
+		Metric: f.GetOutput(),
+		Value:  f.expression.Eval(f.values),
+		Time:   f.timestamp,
+	}
+}
+
+// GetMetrics returns the metrics used in the formula's expression
+func (f *Formula) GetMetrics() []string {
+	return f.expression.Metrics()
+}
+
+// GetOutput returns the metric the formula computes
+func (f *Formula) GetOutput() string {
+	return f.name
+}
+
+// formulasFileName is the formulas file used if none is configured
+const formulasFileName = "formulas.json"
+
+// formulasFile returns filename, or the default formulas file if it is empty
+func formulasFile(filename string) (string, error) {
+	if filename != "" {
+		return filename, nil
+	}
+	return settings.SourcePath(formulasFileName)
+}
+
+// ReadFormulas reads the formulas and statistics defined in filename, a JSON list of
+// FormulaDefinitions. A missing file defines none
+func ReadFormulas(filename string) ([]Computable, []Options, error) {
+	rawJSON, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var definitions []FormulaDefinition
+	err = json.Unmarshal(rawJSON, &definitions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing %s: %s", filename, err)
+	}
+	computations := make([]Computable, len(definitions))
+	options := make([]Options, len(definitions))
+	for i, definition := range definitions {
+		computations[i], err = definition.computation()
+		if err != nil {
+			return nil, nil, err
+		}
+		options[i], err = validateOptions(computations[i].GetOutput(), Options{
+			Invalid: definition.Invalid,
+			Min:     definition.Min,
+			Max:     definition.Max,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return computations, options, nil
+}
+
+// computation returns the formula or statistic defined
+func (definition FormulaDefinition) computation() (Computable, error) {
+	if (definition.Formula == "") == (definition.Statistic == "") {
+		return nil, fmt.Errorf("Definition %+v should have either a formula or a statistic", definition)
+	}
+	if definition.Statistic != "" {
+		var window time.Duration
+		if definition.Window != "" {
+			var err error
+			window, err = time.ParseDuration(definition.Window)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing window of %s: %s", definition.Name, err)
+			}
+		}
+		if !isMetricName(definition.Metric) {
+			return nil, fmt.Errorf("Invalid metric name %q for %s", definition.Metric, definition.Name)
+		}
+		return NewStatistic(definition.Statistic, definition.Metric, window, definition.Name)
+	}
+	var maxAge time.Duration
+	if definition.MaxAge != "" {
+		var err error
+		maxAge, err = time.ParseDuration(definition.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing max age of formula %q: %s", definition.Formula, err)
+		}
+	}
+	return NewFormula(definition.Formula, maxAge)
+}
+
+// LoadFormulas replaces the computations defined by formulas with those in
+// filename, which defaults to computations/formulas.json if empty. If the
+// computations are running, the old formulas are stopped and the new ones
+// started. An error is returned, and the formulas are left as they were, if
+// the file is invalid, a formula computes a metric that is already computed,
+// or the formulas would make a cycle of computations
+func LoadFormulas(filename string) error {
+	filename, err := formulasFile(filename)
+	if err != nil {
+		return err
+	}
+	computations, options, err := ReadFormulas(filename)
+	if err != nil {
+		return err
+	}
+	nodes := make([]*node, len(computations))
+	for i, computation := range computations {
+		nodes[i] = newNode(computation, options[i])
+	}
+	return active.setFormulas(nodes)
+}
+
+// WatchFormulas checks the formulas file for changes every interval until done
+// is closed, reloading the formulas when it changes. Formulas with problems are
+// logged and ignored until they are fixed
+func WatchFormulas(filename string, interval time.Duration, done <-chan struct{}) {
+	var file string
+	state := func() (string, error) {
+		var err error
+		file, err = formulasFile(filename)
+		if err != nil {
+			return "", err
+		}
+		return settings.FileState(file)
+	}
+	reload := func() error {
+		err := LoadFormulas(file)
+		if err == nil {
+			log.Printf("Reloaded formulas from %s\n", file)
+		}
+		return err
+	}
+	settings.Watch("formulas", interval, done, state, reload)
+}
@@ -0,0 +1,154 @@
+package computations
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/listener"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormula(t *testing.T) {
+	f, err := NewFormula("Pack_Power = BMS_Current * Average_Bus_Voltage", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "Pack_Power", f.GetOutput())
+	assert.Equal(t, []string{"BMS_Current", "Average_Bus_Voltage"}, f.GetMetrics())
+
+	start := time.Now()
+	assert.False(t, f.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 2, Time: start}))
+	assert.True(t, f.Update(&datatypes.Datapoint{Metric: "Average_Bus_Voltage", Value: 100, Time: start.Add(500 * time.Millisecond)}))
+	assert.Equal(t, &datatypes.Datapoint{Metric: "Pack_Power", Value: 200, Time: start.Add(500 * time.Millisecond)}, f.Compute())
+	// Every new input is computed with the latest of the others
+	assert.True(t, f.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 3, Time: start.Add(time.Second)}))
+	assert.Equal(t, float64(300), f.Compute().Value)
+	// Until they are too old
+	assert.False(t, f.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 4, Time: start.Add(2 * time.Second)}))
+	assert.True(t, f.Update(&datatypes.Datapoint{Metric: "Average_Bus_Voltage", Value: 50, Time: start.Add(2 * time.Second)}))
+	assert.Equal(t, float64(200), f.Compute().Value)
+
+	for _, definition := range []string{
+		"BMS_Current * 2",
+		"= BMS_Current * 2",
+		"Pack Power = BMS_Current * 2",
+		"2x = BMS_Current * 2",
+		"Pack_Power = 2 * 3",
+		"Pack_Power = BMS_Current *",
+	} {
+		_, err := NewFormula(definition, 0)
+		assert.Error(t, err, definition)
+	}
+	_, err = NewFormula("Pack_Power = BMS_Current", -time.Second)
+	assert.Error(t, err)
+}
+
+func TestReadFormulas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formula_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, formulasFileName)
+
+	// A missing file has no formulas
+	formulas, _, err := ReadFormulas(filename)
+	assert.NoError(t, err)
+	assert.Empty(t, formulas)
+
+	err = ioutil.WriteFile(filename, []byte(`[
+		{"formula": "Pack_Power = BMS_Current * Average_Bus_Voltage", "max_age": "500ms"},
+		{"formula": "Efficiency_Percent = 100 * Pack_Efficiency", "invalid": "clamp", "min": 0, "max": 100},
+		{"statistic": "ewma", "metric": "BMS_Current", "window": "10s", "name": "BMS_Current_EWMA"}
+	]`), 0644)
+	assert.NoError(t, err)
+	formulas, options, err := ReadFormulas(filename)
+	assert.NoError(t, err)
+	if assert.Len(t, formulas, 3) {
+		assert.Equal(t, 500*time.Millisecond, formulas[0].(*Formula).maxAge)
+		assert.Equal(t, Options{Invalid: Drop}, options[0])
+		assert.Equal(t, "Efficiency_Percent", formulas[1].GetOutput())
+		assert.Equal(t, Options{Invalid: Clamp, Min: 0, Max: 100}, options[1])
+		assert.Equal(t, NewExponentialAverage("BMS_Current", 10*time.Second, "BMS_Current_EWMA"), formulas[2])
+	}
+
+	for _, contents := range []string{
+		`{"formula": "Pack_Power = BMS_Current"}`,
+		`[{"formula": "Pack_Power = BMS_Current", "max_age": "soon"}]`,
+		`[{"formula": "Pack_Power = BMS_Current +"}]`,
+		`[{"formula": "Pack_Power = BMS_Current", "invalid": "clamp"}]`,
+		`[{}]`,
+		`[{"formula": "Pack_Power = BMS_Current", "statistic": "mean"}]`,
+		`[{"statistic": "mean", "metric": "BMS_Current", "window": "a while", "name": "Mean_Current"}]`,
+		`[{"statistic": "mean", "metric": "BMS Current", "window": "1s", "name": "Mean_Current"}]`,
+		`[{"statistic": "mean", "metric": "BMS_Current", "name": "Mean_Current"}]`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+		_, _, err = ReadFormulas(filename)
+		assert.Error(t, err, contents)
+	}
+}
+
+func TestSetFormulas(t *testing.T) {
+	registered := []*node{newNode(&graphComputation{inputs: []string{"Formula_Test_RPM"}, output: "Formula_Test_Velocity"}, Options{})}
+
+	newFormulas := func(definitions ...string) []*node {
+		nodes := make([]*node, len(definitions))
+		for i, definition := range definitions {
+			formula, err := NewFormula(definition, 0)
+			assert.NoError(t, err)
+			nodes[i] = newNode(formula, Options{Invalid: Drop})
+		}
+		return nodes
+	}
+	outputs := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, listener.Subscribe(outputs, "Formula_Test_Double", "Formula_Test_Triple"))
+	defer listener.Unsubscribe(outputs)
+	publisher := listener.GetDatapointPublisher()
+
+	r := &runner{registry: &registered}
+	assert.NoError(t, r.setFormulas(newFormulas("Formula_Test_Double = 2 * Formula_Test_Velocity")))
+	ctx, cancel := context.WithCancel(context.Background())
+	r.run(ctx)
+	defer func() {
+		cancel()
+		<-r.stopped
+	}()
+	graph := r.stats()
+	assert.Len(t, graph.Computations, 2)
+	assert.Equal(t, []string{"Formula_Test_Velocity"}, graph.Computations[1].Dependencies)
+	assert.Equal(t, 1, graph.Computations[1].Depth)
+
+	publisher.Publish(&datatypes.Datapoint{Metric: "Formula_Test_Velocity", Value: 2})
+	select {
+	case point := <-outputs:
+		assert.Equal(t, "Formula_Test_Double", point.Metric)
+		assert.Equal(t, float64(4), point.Value)
+	case <-time.After(time.Second):
+		t.Fatal("Formula wasn't computed")
+	}
+
+	// Formulas which compute a metric that is already computed or make a cycle are rejected
+	assert.Error(t, r.setFormulas(newFormulas("Formula_Test_Velocity = Formula_Test_RPM")))
+	assert.Error(t, r.setFormulas(newFormulas("Formula_Test_Triple = 3 * Formula_Test_Velocity", "Formula_Test_Triple = Formula_Test_RPM")))
+	assert.Error(t, r.setFormulas(newFormulas("Formula_Test_RPM = Formula_Test_Velocity")))
+	assert.Equal(t, "Formula_Test_Double", r.stats().Computations[1].Name)
+
+	// Reloading replaces the running formulas
+	assert.NoError(t, r.setFormulas(newFormulas("Formula_Test_Triple = 3 * Formula_Test_Velocity")))
+	publisher.Publish(&datatypes.Datapoint{Metric: "Formula_Test_Velocity", Value: 2})
+	select {
+	case point := <-outputs:
+		assert.Equal(t, "Formula_Test_Triple", point.Metric)
+		assert.Equal(t, float64(6), point.Value)
+	case <-time.After(time.Second):
+		t.Fatal("Reloaded formula wasn't computed")
+	}
+	select {
+	case point := <-outputs:
+		t.Errorf("Old formula computed %v", point)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
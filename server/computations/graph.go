@@ -0,0 +1,351 @@
+package computations
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateWindow is how long the input and output rates of a computation are averaged over
+const rateWindow = 10 * time.Second
+
+// Graph describes the registered computations and how they depend on each other
+type Graph struct {
+	Computations []ComputationStats `json:"computations"`
+	// Cycles lists the computations in each cycle, which are not run
+	Cycles [][]string `json:"cycles"`
+}
+
+// ComputationStats describes a computation, the computations it depends on and
+// the points it has been updated with and computed
+type ComputationStats struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Inputs []string `json:"inputs"`
+	// Dependencies are the computations whose outputs are inputs of this one,
+	// and Dependents the computations this one's output is an input of
+	Dependencies []string `json:"dependencies"`
+	Dependents   []string `json:"dependents"`
+	// Depth is the length of the longest chain of computations leading to this one
+	Depth      int           `json:"depth"`
+	Running    bool          `json:"running"`
+	Policy     InvalidPolicy `json:"policy"`
+	InputCount uint64        `json:"input_count"`
+	InputRate  float64       `json:"input_rate"`
+	Computed   uint64        `json:"computed"`
+	OutputRate float64       `json:"output_rate"`
+	// Errors counts the invalid values computed and failed computations, and
+	// Failing is whether the computation hasn't computed a valid value since its last error
+	Errors    uint64    `json:"errors"`
+	Failing   bool      `json:"failing"`
+	LastError string    `json:"last_error,omitempty"`
+	ErrorTime time.Time `json:"error_time"`
+}
+
+// rate counts events, and the rate per second they happened at in the last rateWindow
+type rate struct {
+	count       uint64
+	windowCount uint64
+	windowStart time.Time
+	perSecond   float64
+}
+
+// add counts an event that happened at now
+func (r *rate) add(now time.Time) {
+	r.roll(now)
+	r.count++
+	r.windowCount++
+}
+
+// roll starts a new window once the current one is over
+func (r *rate) roll(now time.Time) {
+	elapsed := now.Sub(r.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	if elapsed < 2*rateWindow {
+		r.perSecond = float64(r.windowCount) / elapsed.Seconds()
+	} else {
+		// Nothing happened in the last window
+		r.perSecond = 0
+	}
+	r.windowCount = 0
+	r.windowStart = now
+}
+
+// node is a registered computation, which keeps its stats while the graph
+// is rebuilt around it
+type node struct {
+	computation Computable
+	options     Options
+	name        string
+
+	mu        sync.Mutex
+	running   bool
+	inputs    rate
+	outputs   rate
+	errors    uint64
+	failing   bool
+	lastError string
+	errorTime time.Time
+}
+
+// input counts a point the computation was updated with
+func (n *node) input() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inputs.add(time.Now())
+}
+
+// output counts a point the computation computed
+func (n *node) output() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.outputs.add(time.Now())
+}
+
+// fail records an error of the computation, logging it if the computation was working
+func (n *node) fail(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.failing {
+		log.Printf("WARNING: Computation of %s failed, handling invalid values with the %s policy until it recovers: %s\n", n.name, n.options.Invalid, err)
+	}
+	n.errors++
+	n.failing = true
+	n.lastError = err.Error()
+	n.errorTime = time.Now()
+}
+
+// disable records why the computation isn't run
+func (n *node) disable(reason error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastError = reason.Error()
+	n.errorTime = time.Now()
+}
+
+// succeed records that the computation computed a valid value
+func (n *node) succeed() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failing {
+		log.Printf("Computation of %s recovered\n", n.name)
+		n.failing = false
+	}
+}
+
+// setRunning records whether the computation is running
+func (n *node) setRunning(running bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.running = running
+}
+
+// newNode returns a node for computation
+func newNode(computation Computable, options Options) *node {
+	return &node{computation: computation, options: options, name: computation.GetOutput()}
+}
+
+// stats returns a description of the computation, apart from its place in a graph
+func (n *node) stats() ComputationStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	n.inputs.roll(now)
+	n.outputs.roll(now)
+	return ComputationStats{
+		Name:       n.name,
+		Type:       fmt.Sprintf("%T", n.computation),
+		Inputs:     n.computation.GetMetrics(),
+		Running:    n.running,
+		Policy:     n.options.Invalid,
+		InputCount: n.inputs.count,
+		InputRate:  n.inputs.perSecond,
+		Computed:   n.outputs.count,
+		OutputRate: n.outputs.perSecond,
+		Errors:     n.errors,
+		Failing:    n.failing,
+		LastError:  n.lastError,
+		ErrorTime:  n.errorTime,
+	}
+}
+
+// names returns the names of nodes
+func names(nodes []*node) []string {
+	result := make([]string, len(nodes))
+	for i, n := range nodes {
+		result[i] = n.name
+	}
+	return result
+}
+
+// graph is the dependency graph of a set of computations
+type graph struct {
+	// nodes are sorted so that every computation comes after those it depends on,
+	// apart from computations in cycles, which come last
+	nodes        []*node
+	cycles       [][]*node
+	dependencies map[*node][]*node
+	dependents   map[*node][]*node
+	depth        map[*node]int
+	cycle        map[*node]bool
+}
+
+// buildGraph works out which of nodes depend on each other from the metrics
+// they are updated with and compute. A computation depends on another if one of
+// its metrics, or a pattern in them, matches the other's output
+func buildGraph(nodes []*node) *graph {
+	g := &graph{
+		dependencies: make(map[*node][]*node),
+		dependents:   make(map[*node][]*node),
+		depth:        make(map[*node]int),
+		cycle:        make(map[*node]bool),
+	}
+	for _, n := range nodes {
+		for _, producer := range nodes {
+			if consumes(n.computation, producer.name) {
+				g.dependencies[n] = append(g.dependencies[n], producer)
+				g.dependents[producer] = append(g.dependents[producer], n)
+			}
+		}
+	}
+	g.cycles = g.findCycles(nodes)
+	for _, cycle := range g.cycles {
+		for _, n := range cycle {
+			g.cycle[n] = true
+		}
+	}
+
+	// Kahn's algorithm, leaving out the computations in cycles
+	waiting := make(map[*node]int)
+	var ready []*node
+	for _, n := range nodes {
+		if g.cycle[n] {
+			continue
+		}
+		for _, dependency := range g.dependencies[n] {
+			if !g.cycle[dependency] {
+				waiting[n]++
+			}
+		}
+		if waiting[n] == 0 {
+			ready = append(ready, n)
+		}
+	}
+	for len(ready) > 0 {
+		n := ready[0]
+		ready = ready[1:]
+		g.nodes = append(g.nodes, n)
+		for _, dependent := range g.dependents[n] {
+			if g.cycle[dependent] {
+				continue
+			}
+			if g.depth[n]+1 > g.depth[dependent] {
+				g.depth[dependent] = g.depth[n] + 1
+			}
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	for _, cycle := range g.cycles {
+		g.nodes = append(g.nodes, cycle...)
+	}
+	return g
+}
+
+// consumes returns whether computation is updated with metric
+func consumes(computation Computable, metric string) bool {
+	for _, input := range computation.GetMetrics() {
+		if input == metric {
+			return true
+		}
+		if matched, err := path.Match(input, metric); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// findCycles returns the strongly connected components of nodes which are cycles,
+// using Tarjan's algorithm
+func (g *graph) findCycles(nodes []*node) [][]*node {
+	index := make(map[*node]int)
+	lowLink := make(map[*node]int)
+	onStack := make(map[*node]bool)
+	var stack []*node
+	var cycles [][]*node
+
+	var visit func(n *node)
+	visit = func(n *node) {
+		index[n] = len(index)
+		lowLink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+		for _, dependent := range g.dependents[n] {
+			if _, visited := index[dependent]; !visited {
+				visit(dependent)
+				if lowLink[dependent] < lowLink[n] {
+					lowLink[n] = lowLink[dependent]
+				}
+			} else if onStack[dependent] && index[dependent] < lowLink[n] {
+				lowLink[n] = index[dependent]
+			}
+		}
+		if lowLink[n] != index[n] {
+			return
+		}
+		var component []*node
+		for {
+			last := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[last] = false
+			component = append(component, last)
+			if last == n {
+				break
+			}
+		}
+		if len(component) > 1 || consumes(n.computation, n.name) {
+			sort.Slice(component, func(i, j int) bool {
+				return component[i].name < component[j].name
+			})
+			cycles = append(cycles, component)
+		}
+	}
+	for _, n := range nodes {
+		if _, visited := index[n]; !visited {
+			visit(n)
+		}
+	}
+	return cycles
+}
+
+// describeCycle returns the names of the computations in a cycle
+func describeCycle(cycle []*node) string {
+	return strings.Join(names(cycle), ", ")
+}
+
+// stats describes the computations in the graph
+func (g *graph) stats() Graph {
+	result := Graph{
+		Computations: make([]ComputationStats, len(g.nodes)),
+		Cycles:       make([][]string, len(g.cycles)),
+	}
+	for i, n := range g.nodes {
+		stats := n.stats()
+		stats.Dependencies = names(g.dependencies[n])
+		stats.Dependents = names(g.dependents[n])
+		stats.Depth = g.depth[n]
+		result.Computations[i] = stats
+	}
+	for i, cycle := range g.cycles {
+		result.Cycles[i] = names(cycle)
+	}
+	return result
+}
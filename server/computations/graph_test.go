@@ -0,0 +1,100 @@
+package computations
+
+import (
+	"testing"
+	"time"
+
+	"server/datatypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// graphComputation is a computation which only has inputs and an output
+type graphComputation struct {
+	inputs []string
+	output string
+}
+
+func (c *graphComputation) Update(point *datatypes.Datapoint) bool {
+	return false
+}
+
+func (c *graphComputation) Compute() *datatypes.Datapoint {
+	return nil
+}
+
+func (c *graphComputation) GetMetrics() []string {
+	return c.inputs
+}
+
+func (c *graphComputation) GetOutput() string {
+	return c.output
+}
+
+func TestBuildGraph(t *testing.T) {
+	g := buildGraph([]*node{
+		newNode(&graphComputation{inputs: []string{"Velocity", "Acceleration"}, output: "Force"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"Velocity"}, output: "Acceleration"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"RPM"}, output: "Velocity"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"Cell_*"}, output: "Pack"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"Pack"}, output: "Cell_Sum"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"Loop"}, output: "Loop"}, Options{}),
+		newNode(&graphComputation{inputs: []string{"Loop"}, output: "Downstream"}, Options{}),
+	})
+	stats := g.stats()
+	byName := make(map[string]ComputationStats)
+	order := make([]string, len(stats.Computations))
+	for i, computation := range stats.Computations {
+		byName[computation.Name] = computation
+		order[i] = computation.Name
+	}
+	// Computations come after those they depend on
+	assert.Equal(t, []string{"Velocity", "Downstream", "Acceleration", "Force"}, order[:4])
+	assert.Equal(t, 0, byName["Velocity"].Depth)
+	assert.Equal(t, 1, byName["Acceleration"].Depth)
+	assert.Equal(t, 2, byName["Force"].Depth)
+	assert.Equal(t, []string{"Force", "Acceleration"}, byName["Velocity"].Dependents)
+	assert.Equal(t, []string{"Acceleration", "Velocity"}, byName["Force"].Dependencies)
+	assert.Equal(t, "*computations.graphComputation", byName["Force"].Type)
+	assert.Equal(t, []string{"Loop"}, byName["Downstream"].Dependencies)
+
+	// Patterns are dependencies on every computation they match, including a cycle
+	assert.Equal(t, []string{"Cell_Sum"}, byName["Pack"].Dependencies)
+	assert.Equal(t, [][]string{{"Cell_Sum", "Pack"}, {"Loop"}}, stats.Cycles)
+	assert.Equal(t, "Loop", order[len(order)-1])
+}
+
+func TestRegisteredGraph(t *testing.T) {
+	graph := GetGraph()
+	assert.Empty(t, graph.Cycles)
+	assert.Len(t, graph.Computations, len(registry))
+	byName := make(map[string]ComputationStats)
+	for _, computation := range graph.Computations {
+		assert.NotContains(t, byName, computation.Name, "Computed twice")
+		byName[computation.Name] = computation
+	}
+	// The derived chain from motor RPM to the modeled motor force is worked out
+	assert.Equal(t, []string{"Average_Wavesculptor_RPM"}, byName["RPM_Derived_Velocity"].Dependencies)
+	assert.Contains(t, byName["RPM_Derived_Acceleration"].Dependencies, "RPM_Derived_Velocity")
+	assert.Contains(t, byName["Terrain_Angle"].Dependencies, "RPM_Derived_Acceleration")
+	assert.Contains(t, byName["Modeled_Motor_Force"].Dependencies, "Terrain_Angle")
+	assert.Equal(t, 4, byName["Modeled_Motor_Force"].Depth)
+	// The imbalance isn't mistaken for a module voltage
+	assert.Empty(t, byName["Min_Cell_Voltage"].Dependencies)
+}
+
+func TestRate(t *testing.T) {
+	start := time.Now()
+	r := rate{windowStart: start}
+	for i := 0; i < 20; i++ {
+		r.add(start.Add(time.Duration(i) * time.Second / 2))
+	}
+	assert.Equal(t, uint64(20), r.count)
+	assert.Equal(t, float64(0), r.perSecond)
+	r.roll(start.Add(rateWindow))
+	assert.Equal(t, float64(2), r.perSecond)
+	// A window without any events has no rate
+	r.roll(start.Add(3 * rateWindow))
+	assert.Equal(t, float64(0), r.perSecond)
+	assert.Equal(t, uint64(20), r.count)
+}
@@ -0,0 +1,66 @@
+package computations
+
+import (
+	"math"
+	"server/datatypes"
+	"time"
+)
+
+// InvalidPolicy is what is done when a computation computes a value which is
+// NaN or infinite, or fails to compute one
+type InvalidPolicy string
+
+// What is done with invalid values
+const (
+	// Drop skips the value. This is the default
+	Drop InvalidPolicy = "drop"
+	// Clamp publishes the value clamped to the computation's bounds. Values which
+	// are NaN, and failed computations, are skipped since they can't be clamped
+	Clamp InvalidPolicy = "clamp"
+	// Hold publishes the last valid value computed again, or skips the value if
+	// there hasn't been one
+	Hold InvalidPolicy = "hold"
+)
+
+// Options configure how a registered computation handles invalid values
+type Options struct {
+	Invalid InvalidPolicy
+	// Min and Max are the bounds values are clamped to with the Clamp policy,
+	// which values outside of them are clamped to as well
+	Min float64
+	Max float64
+}
+
+// handleInvalid returns the point to publish in place of an invalid one computed, if any,
+// following options. last is the last valid point computed, and now the time of the point
+// that triggered the computation
+func handleInvalid(options Options, computed *datatypes.Datapoint, last *datatypes.Datapoint, now time.Time) *datatypes.Datapoint {
+	switch options.Invalid {
+	case Clamp:
+		if computed == nil || math.IsNaN(computed.Value) {
+			return nil
+		}
+		return clamp(options, computed)
+	case Hold:
+		if last == nil {
+			return nil
+		}
+		held := *last
+		held.Time = now
+		if computed != nil && !computed.Time.IsZero() {
+			held.Time = computed.Time
+		}
+		return &held
+	}
+	return nil
+}
+
+// clamp returns point with its value clamped to the bounds in options
+func clamp(options Options, point *datatypes.Datapoint) *datatypes.Datapoint {
+	if point.Value >= options.Min && point.Value <= options.Max {
+		return point
+	}
+	clamped := *point
+	clamped.Value = math.Max(options.Min, math.Min(options.Max, clamped.Value))
+	return &clamped
+}
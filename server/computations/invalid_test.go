@@ -0,0 +1,141 @@
+package computations
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/listener"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyComputation computes the value of each point it is updated with,
+// failing when the value is negative and panicking when it is 13
+type flakyComputation struct {
+	value float64
+}
+
+func (c *flakyComputation) Update(point *datatypes.Datapoint) bool {
+	if point.Value == 13 {
+		panic("unlucky")
+	}
+	c.value = point.Value
+	return true
+}
+
+func (c *flakyComputation) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{Metric: c.GetOutput(), Value: c.value}
+}
+
+func (c *flakyComputation) TryCompute() (*datatypes.Datapoint, error) {
+	if c.value < 0 {
+		return nil, errors.New("negative")
+	}
+	return c.Compute(), nil
+}
+
+func (c *flakyComputation) GetMetrics() []string {
+	return []string{"Flaky_Input"}
+}
+
+func (c *flakyComputation) GetOutput() string {
+	return "Flaky_Output"
+}
+
+func TestHandleInvalid(t *testing.T) {
+	now := time.Now()
+	last := &datatypes.Datapoint{Metric: "Output", Value: 2, Time: now.Add(-time.Second)}
+	inf := &datatypes.Datapoint{Metric: "Output", Value: math.Inf(-1), Time: now}
+	nan := &datatypes.Datapoint{Metric: "Output", Value: math.NaN(), Time: now}
+
+	assert.Nil(t, handleInvalid(Options{Invalid: Drop}, inf, last, now))
+
+	bounds := Options{Invalid: Clamp, Min: -1, Max: 1}
+	assert.Equal(t, &datatypes.Datapoint{Metric: "Output", Value: -1, Time: now}, handleInvalid(bounds, inf, last, now))
+	assert.Nil(t, handleInvalid(bounds, nan, last, now))
+	assert.Nil(t, handleInvalid(bounds, nil, last, now))
+	assert.Equal(t, float64(1), clamp(bounds, &datatypes.Datapoint{Value: 3}).Value)
+	assert.Equal(t, 0.5, clamp(bounds, &datatypes.Datapoint{Value: 0.5}).Value)
+
+	hold := Options{Invalid: Hold}
+	assert.Equal(t, &datatypes.Datapoint{Metric: "Output", Value: 2, Time: now}, handleInvalid(hold, nan, last, now))
+	assert.Equal(t, &datatypes.Datapoint{Metric: "Output", Value: 2, Time: now.Add(time.Second)}, handleInvalid(hold, nil, last, now.Add(time.Second)))
+	assert.Nil(t, handleInvalid(hold, nan, nil, now))
+	// The last point isn't changed
+	assert.Equal(t, now.Add(-time.Second), last.Time)
+}
+
+func TestRegisterWith(t *testing.T) {
+	defer func(original []*node) {
+		registry = original
+	}(registry)
+	assert.NoError(t, RegisterWith(&flakyComputation{}, Options{}))
+	assert.Equal(t, Drop, registry[len(registry)-1].options.Invalid)
+	assert.Error(t, RegisterWith(&flakyComputation{}, Options{Invalid: Clamp, Min: 1, Max: 1}))
+	assert.Error(t, RegisterWith(&flakyComputation{}, Options{Invalid: "ignore"}))
+}
+
+func TestComputeRecovers(t *testing.T) {
+	outputs := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, listener.Subscribe(outputs, "Flaky_Output"))
+	defer listener.Unsubscribe(outputs)
+
+	n := &node{computation: &flakyComputation{}, options: Options{Invalid: Hold}, name: "Flaky_Output"}
+	stream := make(chan *datatypes.Datapoint, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go compute(ctx, n, stream)
+
+	// Failures and panics hold the last value, and the computation carries on
+	for _, value := range []float64{1, -1, 13, 2, math.Inf(1), 3} {
+		stream <- &datatypes.Datapoint{Metric: "Flaky_Input", Value: value}
+	}
+	for _, expected := range []float64{1, 1, 1, 2, 2, 3} {
+		select {
+		case point := <-outputs:
+			assert.Equal(t, expected, point.Value)
+			assert.Equal(t, datatypes.SourceComputation, point.Tags[datatypes.SourceTag])
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %f", expected)
+		}
+	}
+	stats := n.stats()
+	assert.Equal(t, uint64(6), stats.InputCount)
+	assert.Equal(t, uint64(6), stats.Computed)
+	assert.Equal(t, uint64(3), stats.Errors)
+	assert.False(t, stats.Failing)
+	assert.Equal(t, "Computed invalid value +Inf", stats.LastError)
+
+	stream <- &datatypes.Datapoint{Metric: "Flaky_Input", Value: -1}
+	<-outputs
+	stats = n.stats()
+	assert.True(t, stats.Failing)
+	assert.Equal(t, "negative", stats.LastError)
+}
+
+func TestPublishErrors(t *testing.T) {
+	errorCounts := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, listener.Subscribe(errorCounts, errorsMetric))
+	defer listener.Unsubscribe(errorCounts)
+
+	n := &node{computation: &flakyComputation{}, name: "Flaky_Output"}
+	n.fail(errors.New("negative"))
+	n.fail(errors.New("negative"))
+	now := time.Now()
+	publishErrors(&graph{nodes: []*node{n}}, now)
+	select {
+	case point := <-errorCounts:
+		assert.Equal(t, &datatypes.Datapoint{
+			Metric: errorsMetric,
+			Value:  2,
+			Time:   now,
+			Tags:   map[string]string{datatypes.ComputationTag: "Flaky_Output"},
+		}, point)
+	case <-time.After(time.Second):
+		t.Fatal("Errors weren't published")
+	}
+}
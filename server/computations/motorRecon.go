@@ -23,10 +23,15 @@ func NewVelocity() *Velocity {
 	}
 }
 
+// GetOutput returns the metric Velocity computes
+func (v *Velocity) GetOutput() string {
+	return "RPM_Derived_Velocity"
+}
+
 // Compute returns the current velocity of the car in m/s
 func (v *Velocity) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "RPM_Derived_Velocity",
+		Metric: v.GetOutput(),
 		Value:  recontool.Velocity(v.values["Average_Wavesculptor_RPM"], sr3.RMot),
 		Time:   v.timestamp,
 	}
@@ -74,6 +79,11 @@ func (a *Acceleration) Update(point *datatypes.Datapoint) bool {
 	return a.size == 3
 }
 
+// GetOutput returns the metric Acceleration computes
+func (a *Acceleration) GetOutput() string {
+	return "RPM_Derived_Acceleration"
+}
+
 // Compute computes the current acceleration as
 // a_n = (v_{n+1}-v_{n-1})/(t_{n+1}-t_{n-1})
 // Unit: m/s^2
@@ -84,7 +94,7 @@ func (a *Acceleration) Compute() *datatypes.Datapoint {
 	afterIndex := (a.idx + 2) % 3
 	dvdt := (a.velocities[afterIndex] - a.velocities[beforeIndex]) / a.times[afterIndex].Sub(a.times[beforeIndex]).Seconds()
 	return &datatypes.Datapoint{
-		Metric: "RPM_Derived_Acceleration",
+		Metric: a.GetOutput(),
 		Value:  dvdt,
 		Time:   a.times[nowIndex],
 	}
@@ -126,6 +136,11 @@ func (d *Distance) Update(point *datatypes.Datapoint) bool {
 	return d.idx == 2
 }
 
+// GetOutput returns the metric Distance computes
+func (d *Distance) GetOutput() string {
+	return "RPM_Derived_Distance"
+}
+
 // Compute computes distance as cumsum(RPM_Derived_Velocity * dt)
 func (d *Distance) Compute() *datatypes.Datapoint {
 	d.cumSum += d.velocities[0].Value * (d.velocities[1].Time.Sub(d.velocities[0].Time).Seconds())
@@ -133,7 +148,7 @@ func (d *Distance) Compute() *datatypes.Datapoint {
 	d.velocities[0] = d.velocities[1]
 	d.idx = 1
 	return &datatypes.Datapoint{
-		Metric: "RPM_Derived_Distance",
+		Metric: d.GetOutput(),
 		Value:  d.cumSum,
 		Time:   t,
 	}
@@ -157,10 +172,15 @@ func NewEmpiricalTorque(motor string) *EmpiricalTorque {
 	}
 }
 
+// GetOutput returns the metric EmpiricalTorque computes
+func (t *EmpiricalTorque) GetOutput() string {
+	return fmt.Sprintf("%s_RPM_Derived_Torque", t.motor)
+}
+
 // Compute returns the motor's torque in Nm
 func (t *EmpiricalTorque) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: fmt.Sprintf("%s_RPM_Derived_Torque", t.motor),
+		Metric: t.GetOutput(),
 		Value: recontool.MotorTorque(
 			t.values[fmt.Sprintf("%s_Wavesculptor_RPM", t.motor)],
 			t.values[fmt.Sprintf("%s_Phase_C_Current", t.motor)],
@@ -188,10 +208,15 @@ func NewModeledMotorForce() *ModeledMotorForce {
 	}
 }
 
+// GetOutput returns the metric ModeledMotorForce computes
+func (f *ModeledMotorForce) GetOutput() string {
+	return "Modeled_Motor_Force"
+}
+
 // Compute returns the modeled motor force in Newtons
 func (f *ModeledMotorForce) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Modeled_Motor_Force",
+		Metric: f.GetOutput(),
 		Value: recontool.ModeledMotorForce(
 			f.values["RPM_Derived_Velocity"],
 			f.values["RPM_Derived_Acceleration"],
@@ -219,10 +244,15 @@ func NewModeledMotorTorque() *ModeledMotorTorque {
 	}
 }
 
+// GetOutput returns the metric ModeledMotorTorque computes
+func (t *ModeledMotorTorque) GetOutput() string {
+	return "Modeled_Motor_Torque"
+}
+
 // Compute computes modeled motor torque in Nm
 func (t *ModeledMotorTorque) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Modeled_Motor_Torque",
+		Metric: t.GetOutput(),
 		Value:  t.values["Modeled_Motor_Force"] * sr3.RMot,
 		Time:   t.timestamp,
 	}
@@ -245,10 +275,15 @@ func NewMotorEfficiency() *MotorEfficiency {
 	}
 }
 
+// GetOutput returns the metric MotorEfficiency computes
+func (e *MotorEfficiency) GetOutput() string {
+	return "Motor_Efficiency"
+}
+
 // Compute computes motor efficiency
 func (e *MotorEfficiency) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Motor_Efficiency",
+		Metric: e.GetOutput(),
 		Value:  recontool.MotorEfficiency(e.values["Average_Bus_Voltage"], e.values["RPM_Derived_Torque"]),
 		Time:   e.timestamp,
 	}
@@ -285,10 +320,15 @@ func (p *EmpiricalMotorPower) Update(point *datatypes.Datapoint) bool {
 	return len(p.values) >= len(p.fields)
 }
 
+// GetOutput returns the metric EmpiricalMotorPower computes
+func (p *EmpiricalMotorPower) GetOutput() string {
+	return "RPM_Derived_Motor_Power"
+}
+
 // Compute computes empirical motor power in Watts
 func (p *EmpiricalMotorPower) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "RPM_Derived_Motor_Power",
+		Metric: p.GetOutput(),
 		Value: recontool.MotorPower(
 			p.values["RPM_Derived_Torque"],
 			p.values["RPM_Derived_Velocity"],
@@ -331,10 +371,15 @@ func (p *ModeledMotorPower) Update(point *datatypes.Datapoint) bool {
 	return len(p.values) >= len(p.fields)
 }
 
+// GetOutput returns the metric ModeledMotorPower computes
+func (p *ModeledMotorPower) GetOutput() string {
+	return "Modeled_Motor_Power"
+}
+
 // Compute computes modeled motor power in Watts
 func (p *ModeledMotorPower) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Modeled_Motor_Power",
+		Metric: p.GetOutput(),
 		Value: recontool.ModelDerivedPower(
 			p.values["Modeled_Motor_Force"],
 			p.values["RPM_Derived_Velocity"],
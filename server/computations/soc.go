@@ -1,70 +1,378 @@
 package computations
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"server/datatypes"
+	"server/settings"
+	"sync"
 	"time"
 )
 
-var imat = []float64{0, 36, 60, 120, 180}
+// SOCConfig mirrors the structure of the SOC config file, which holds the tables
+// of the pack's cells and the parameters of the filter estimating its state of charge
+type SOCConfig struct {
+	// CapacityAh is the charge of the full pack in amp hours
+	CapacityAh float64 `json:"capacity_ah"`
+	// SeriesCells is the number of cells in series, which share the pack's voltage drop
+	SeriesCells float64 `json:"series_cells"`
+	// Resistance is the pack's resistance in ohms used until Pack_Resistance is computed
+	Resistance float64 `json:"resistance"`
+	// ProcessNoise is the standard deviation of the drift of the SOC over an hour of
+	// counting current, which grows with the square root of the time counted.
+	// VoltageNoise is that of Min_Voltage from the cell model in volts, and
+	// InitialUncertainty that of the SOC first looked up from the tables
+	ProcessNoise       float64 `json:"process_noise"`
+	VoltageNoise       float64 `json:"voltage_noise"`
+	InitialUncertainty float64 `json:"initial_uncertainty"`
+	// Currents are the pack currents in amps the cells were discharged at, starting at 0.
+	// Voltages[i] are the cell voltages, ascending, at which Discharged[i] mAh had been
+	// discharged at Currents[i]. The curve at 0 A is the cells' open circuit voltage
+	Currents   []float64   `json:"currents"`
+	Voltages   [][]float64 `json:"voltages"`
+	Discharged [][]float64 `json:"discharged"`
+}
+
+// socConfigFileName is the SOC config file used if none is configured
+const socConfigFileName = "soc_config.json"
 
-var v = [][]float64{
-	{2.500000, 3.220000, 3.450000, 3.520000, 3.580000, 3.650000, 3.750000, 3.830000, 3.950000, 4.050000, 4.150000, 4.190000},
-	{2.500000, 3.050000, 3.300000, 3.380000, 3.450000, 3.550000, 3.650000, 3.750000, 3.850000, 3.950000, 4.080000, 4.120000},
-	{2.500000, 3.000000, 3.220000, 3.300000, 3.400000, 3.480000, 3.580000, 3.680000, 3.780000, 3.870000, 4.000000, 4.050000},
-	{2.500000, 2.900000, 3.100000, 3.180000, 3.250000, 3.350000, 3.450000, 3.550000, 3.650000, 3.750000, 3.870000, 3.900000},
-	{2.500000, 2.830000, 3.000000, 3.100000, 3.180000, 3.250000, 3.330000, 3.430000, 3.520000, 3.630000, 3.830000, 3.850000}}
+// maxCurrentGap is the longest gap between BMS_Current points over which
+// charge is counted. Longer gaps leave the SOC to the voltage corrections
+const maxCurrentGap = 10 * time.Second
 
-var q = [][]float64{
-	{2998.000000, 2700.000000, 2400.000000, 2100.000000, 1800.000000, 1500.000000, 1200.000000, 900.000000, 600.000000, 300.000000, 30.000000, 0.000000},
-	{2886.000000, 2700.000000, 2400.000000, 2100.000000, 1800.000000, 1500.000000, 1200.000000, 900.000000, 600.000000, 300.000000, 30.000000, 0.000000},
-	{2884.000000, 2700.000000, 2400.000000, 2100.000000, 1800.000000, 1500.000000, 1200.000000, 900.000000, 600.000000, 300.000000, 30.000000, 0.000000},
-	{2855.000000, 2700.000000, 2400.000000, 2100.000000, 1800.000000, 1500.000000, 1200.000000, 900.000000, 600.000000, 300.000000, 30.000000, 0.000000},
-	{2825.000000, 2700.000000, 2400.000000, 2100.000000, 1800.000000, 1500.000000, 1200.000000, 900.000000, 600.000000, 300.000000, 30.000000, 0.000000}}
+// socEstimate is the registered estimate, which is given the SOC config once it is loaded
+var socEstimate = NewSOCEstimate(nil)
 
-// SOCPercentage is the estimated state of charge of the pack
-type SOCPercentage struct {
-	values map[string]float64
+// LoadSOCConfig reads the SOC config from filename, which defaults to
+// computations/soc_config.json if empty, and gives it to the SOC estimate.
+// The state of charge isn't estimated until it has been loaded
+func LoadSOCConfig(filename string) error {
+	if filename == "" {
+		var err error
+		filename, err = settings.SourcePath(socConfigFileName)
+		if err != nil {
+			return err
+		}
+	}
+	config, err := ReadSOCConfig(filename)
+	if err != nil {
+		return err
+	}
+	socEstimate.SetConfig(config)
+	return nil
 }
 
-// NewSOCPercentage returns a SOCPercentage initialized with the proper values
-func NewSOCPercentage() *SOCPercentage {
-	return &SOCPercentage{
-		values: make(map[string]float64),
+// ReadSOCConfig reads and validates the SOC config in filename
+func ReadSOCConfig(filename string) (*SOCConfig, error) {
+	rawJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
+	config := &SOCConfig{}
+	err = json.Unmarshal(rawJSON, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", filename, err)
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SOC config %s: %s", filename, err)
+	}
+	return config, nil
 }
 
-// GetMetrics returns the SOC Percentage's metrics
-func (sp *SOCPercentage) GetMetrics() []string {
-	return []string{"Min_Voltage", "BMS_Current"}
+func (c *SOCConfig) validate() error {
+	if c.CapacityAh <= 0 || c.SeriesCells <= 0 {
+		return fmt.Errorf("Capacity and series cells must be positive")
+	}
+	if c.Resistance < 0 {
+		return fmt.Errorf("Negative resistance %f", c.Resistance)
+	}
+	if c.ProcessNoise <= 0 || c.VoltageNoise <= 0 || c.InitialUncertainty <= 0 {
+		return fmt.Errorf("Noises and initial uncertainty must be positive")
+	}
+	if len(c.Currents) == 0 || c.Currents[0] != 0 {
+		return fmt.Errorf("Currents must start at 0")
+	}
+	if len(c.Voltages) != len(c.Currents) || len(c.Discharged) != len(c.Currents) {
+		return fmt.Errorf("There must be a row of voltages and discharged charges for each of %d currents", len(c.Currents))
+	}
+	for i := range c.Currents {
+		if i > 0 && c.Currents[i] <= c.Currents[i-1] {
+			return fmt.Errorf("Currents must be ascending")
+		}
+		if len(c.Voltages[i]) < 2 || len(c.Voltages[i]) != len(c.Discharged[i]) {
+			return fmt.Errorf("The voltages and discharged charges at %f A must be the same length of at least 2", c.Currents[i])
+		}
+		for j := 1; j < len(c.Voltages[i]); j++ {
+			if c.Voltages[i][j] <= c.Voltages[i][j-1] || c.Discharged[i][j] >= c.Discharged[i][j-1] {
+				return fmt.Errorf("At %f A, voltages must be ascending and discharged charges descending", c.Currents[i])
+			}
+		}
+	}
+	return nil
 }
 
-// Update waits for a BMS current and min voltage reading.
-// Since min voltage updates so infrequently relative to BMS_Current,
-// we only signify an update every time the Min_Voltage is updated
-// So we override Update accordingly
-func (sp *SOCPercentage) Update(point *datatypes.Datapoint) bool {
-	sp.values[point.Metric] = point.Value
-	return (len(sp.values) == 2) && point.Metric == "Min_Voltage"
+// SOCEstimate estimates the state of charge of the pack with an extended Kalman filter.
+// Charge is counted from BMS_Current, and corrected whenever Min_Voltage is received
+// by comparing it to the open circuit voltage of the estimated SOC less the drop across
+// the cell's share of Pack_Resistance. It computes SOC_Percentage, the SOC as a fraction
+// of the pack's capacity, and SOCUncertainty and SOCRemaining read the rest of its state.
+// The filter restarts from the cell tables when the car comes back online
+type SOCEstimate struct {
+	// mu guards the config and the filter's state, which are read by the
+	// computations of its uncertainty and the charge remaining
+	mu     sync.Mutex
+	config *SOCConfig
+	// soc and variance are the filter's state, once it has been initialized
+	soc         float64
+	variance    float64
+	initialized bool
+	current     float64
+	currentTime time.Time
+	hasCurrent  bool
+	resistance  float64
+	timestamp   time.Time
 }
 
-// Compute returns the current percentage remaining using linear interpolation of current and voltage
-func (sp *SOCPercentage) Compute() *datatypes.Datapoint {
-	minVoltage := sp.values["Min_Voltage"]
-	bmsCurrent := sp.values["BMS_Current"]
-	point := &datatypes.Datapoint{
-		Metric: "SOC_Percentage",
-		Time:   time.Now(),
+// NewSOCEstimate returns a SOCEstimate with the cells and filter described by config
+func NewSOCEstimate(config *SOCConfig) *SOCEstimate {
+	return &SOCEstimate{
+		config:     config,
+		resistance: math.NaN(),
+	}
+}
+
+// SetConfig replaces the estimate's config, restarting the filter with it
+func (e *SOCEstimate) SetConfig(config *SOCConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.config = config
+	e.initialized = false
+}
+
+// GetMetrics returns the SOC estimate's metrics
+func (e *SOCEstimate) GetMetrics() []string {
+	return []string{"BMS_Current", "Min_Voltage", "Pack_Resistance", "Connection_Status"}
+}
+
+// GetOutput returns the metric SOCEstimate computes
+func (e *SOCEstimate) GetOutput() string {
+	return "SOC_Percentage"
+}
+
+// Update counts the charge used since the last BMS_Current and corrects the SOC with
+// Min_Voltage, signifying an update with each once the filter has been initialized.
+// The filter is initialized by looking up the first Min_Voltage after a BMS_Current
+// in the cell tables
+func (e *SOCEstimate) Update(point *datatypes.Datapoint) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.config == nil {
+		return false
+	}
+	switch point.Metric {
+	case "Connection_Status":
+		if point.Value == 0 {
+			e.initialized = false
+			e.hasCurrent = false
+		}
+		return false
+	case "Pack_Resistance":
+		if point.Value >= 0 && !math.IsInf(point.Value, 0) {
+			e.resistance = point.Value
+		}
+		return false
+	case "BMS_Current":
+		if e.hasCurrent && point.Time.Before(e.currentTime) {
+			return false
+		}
+		if e.initialized && e.hasCurrent {
+			dt := point.Time.Sub(e.currentTime)
+			if dt <= maxCurrentGap {
+				e.predict((e.current+point.Value)/2, dt)
+			}
+		}
+		e.current = point.Value
+		e.currentTime = point.Time
+		e.hasCurrent = true
+	case "Min_Voltage":
+		if !e.hasCurrent {
+			return false
+		}
+		if e.initialized {
+			e.correct(point.Value)
+		} else {
+			e.soc = clampSOC(lookupPercent(e.config, point.Value, e.current))
+			e.variance = e.config.InitialUncertainty * e.config.InitialUncertainty
+			e.initialized = true
+		}
+	default:
+		return false
+	}
+	e.timestamp = point.Time
+	return e.initialized
+}
+
+// predict counts the charge used by current amps over dt, and the uncertainty it adds
+func (e *SOCEstimate) predict(current float64, dt time.Duration) {
+	hours := dt.Hours()
+	e.soc -= current * hours / e.config.CapacityAh
+	e.variance += e.config.ProcessNoise * e.config.ProcessNoise * hours
+}
+
+// correct moves the SOC towards the one which explains minVoltage, weighing
+// the model's uncertainty against the measurement's
+func (e *SOCEstimate) correct(minVoltage float64) {
+	resistance := e.resistance
+	if math.IsNaN(resistance) {
+		resistance = e.config.Resistance
+	}
+	voltage, slope := openCircuitVoltage(e.config, e.soc)
+	predicted := voltage - e.current*resistance/e.config.SeriesCells
+	innovationVariance := slope*e.variance*slope + e.config.VoltageNoise*e.config.VoltageNoise
+	gain := e.variance * slope / innovationVariance
+	e.soc = clampSOC(e.soc + gain*(minVoltage-predicted))
+	e.variance = (1 - gain*slope) * e.variance
+}
+
+// Compute returns the SOC as a fraction of the pack's capacity
+func (e *SOCEstimate) Compute() *datatypes.Datapoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &datatypes.Datapoint{
+		Metric: e.GetOutput(),
+		Value:  e.soc,
+		Time:   e.timestamp,
+	}
+}
+
+// uncertainty returns the standard deviation of the SOC and when it was estimated,
+// or false if the filter hasn't been initialized
+func (e *SOCEstimate) uncertainty() (float64, time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return math.Sqrt(e.variance), e.timestamp, e.initialized
+}
+
+// capacity returns the pack's capacity in amp hours, or false if there is no config
+func (e *SOCEstimate) capacity() (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.config == nil {
+		return 0, false
+	}
+	return e.config.CapacityAh, true
+}
+
+// SOCUncertainty is the standard deviation of a SOCEstimate, computed whenever it estimates the SOC
+type SOCUncertainty struct {
+	estimate    *SOCEstimate
+	uncertainty float64
+	time        time.Time
+}
+
+// NewSOCUncertainty returns the SOCUncertainty of estimate
+func NewSOCUncertainty(estimate *SOCEstimate) *SOCUncertainty {
+	return &SOCUncertainty{estimate: estimate}
+}
+
+// GetMetrics returns the SOC estimated
+func (u *SOCUncertainty) GetMetrics() []string {
+	return []string{u.estimate.GetOutput()}
+}
+
+// GetOutput returns the metric SOCUncertainty computes
+func (u *SOCUncertainty) GetOutput() string {
+	return "SOC_Uncertainty"
+}
+
+// Update reads the estimate's uncertainty. If the estimate has moved on since
+// the SOC was computed, the newer uncertainty is used with its own time
+func (u *SOCUncertainty) Update(point *datatypes.Datapoint) bool {
+	var ok bool
+	u.uncertainty, u.time, ok = u.estimate.uncertainty()
+	return ok
+}
+
+// Compute returns the standard deviation of the SOC
+func (u *SOCUncertainty) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{
+		Metric: u.GetOutput(),
+		Value:  u.uncertainty,
+		Time:   u.time,
+	}
+}
+
+// SOCRemaining is the charge remaining in the pack, computed from each SOC a SOCEstimate computes
+type SOCRemaining struct {
+	estimate *SOCEstimate
+	soc      *datatypes.Datapoint
+	capacity float64
+}
+
+// NewSOCRemaining returns the SOCRemaining of estimate
+func NewSOCRemaining(estimate *SOCEstimate) *SOCRemaining {
+	return &SOCRemaining{estimate: estimate}
+}
+
+// GetMetrics returns the SOC estimated
+func (r *SOCRemaining) GetMetrics() []string {
+	return []string{r.estimate.GetOutput()}
+}
+
+// GetOutput returns the metric SOCRemaining computes
+func (r *SOCRemaining) GetOutput() string {
+	return "SOC_Remaining_Ah"
+}
+
+// Update signifies an update with every SOC once the pack's capacity is known
+func (r *SOCRemaining) Update(point *datatypes.Datapoint) bool {
+	var ok bool
+	r.capacity, ok = r.estimate.capacity()
+	r.soc = point
+	return ok
+}
+
+// Compute returns the charge remaining in amp hours
+func (r *SOCRemaining) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{
+		Metric: r.GetOutput(),
+		Value:  r.soc.Value * r.capacity,
+		Time:   r.soc.Time,
 	}
-	point.Value = lookupPercent(minVoltage, bmsCurrent)
-	sp.values = make(map[string]float64)
-	return point
 }
 
 func init() {
-	Register(NewSOCPercentage())
+	Register(socEstimate)
+	Register(NewSOCUncertainty(socEstimate))
+	Register(NewSOCRemaining(socEstimate))
+}
+
+// openCircuitVoltage returns the cell voltage at rest at soc, from the 0 A curve,
+// and its derivative with respect to soc
+func openCircuitVoltage(config *SOCConfig, soc float64) (float64, float64) {
+	v, q := config.Voltages[0], config.Discharged[0]
+	discharged := (1 - soc) * q[0]
+	// q is descending, so find the segment from the end
+	i := len(q) - 2
+	for i > 0 && discharged > q[i] {
+		i--
+	}
+	slope := (v[i+1] - v[i]) / (q[i+1] - q[i])
+	return v[i] + slope*(discharged-q[i]), -slope * q[0]
+}
+
+// clampSOC returns soc within [0, 1]
+func clampSOC(soc float64) float64 {
+	return math.Max(0, math.Min(1, soc))
 }
 
-func lookupPercent(voltage float64, current float64) float64 {
+// lookupPercent returns the SOC at which the cells are at voltage when the
+// pack draws current, interpolating the config's tables
+func lookupPercent(config *SOCConfig, voltage float64, current float64) float64 {
+	imat, v, q := config.Currents, config.Voltages, config.Discharged
 	I1, I2 := search(current, imat[:])
 	ind1, ind2 := search(voltage, v[I1][:])
 	Q1 := q[I1][ind1]
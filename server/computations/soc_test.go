@@ -1,7 +1,11 @@
 package computations_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"server/computations"
 	"server/datatypes"
@@ -9,60 +13,124 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestSOCPercentage(t *testing.T) {
-	sp := computations.NewSOCPercentage()
-	done := sp.Update(&datatypes.Datapoint{
-		Metric: "BMS_Current",
-		Value:  38.4,
-	})
-	assert.False(t, done)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "BMS_Current",
-		Value:  0.0,
-	})
-	assert.False(t, done)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "Min_Voltage",
-		Value:  2.5,
-	})
-	assert.True(t, done)
-	expectedPoint := &datatypes.Datapoint{
-		Metric: "SOC_Percentage",
-		Value:  0.0,
+func TestSOCEstimateInitialization(t *testing.T) {
+	config, err := computations.ReadSOCConfig("soc_config.json")
+	assert.NoError(t, err)
+	for _, test := range []struct {
+		current  float64
+		voltage  float64
+		expected float64
+	}{
+		{0, 2.5, 0},
+		{0, 4.19, 1},
+		{38.4, 3.09, 0.117903},
+	} {
+		e := computations.NewSOCEstimate(config)
+		assert.False(t, e.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: test.voltage}))
+		assert.False(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: test.current}))
+		assert.True(t, e.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: test.voltage}))
+		assert.InDelta(t, test.expected, e.Compute().Value, 0.001)
 	}
-	actualPoint := sp.Compute()
-	assert.InDelta(t, expectedPoint.Value, actualPoint.Value, 0.001)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "BMS_Current",
-		Value:  0.0,
-	})
-	assert.False(t, done)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "Min_Voltage",
-		Value:  4.19,
-	})
-	assert.True(t, done)
-	expectedPoint = &datatypes.Datapoint{
-		Metric: "SOC_Percentage",
-		Value:  1.0,
+
+	// Nothing is estimated without a config
+	e := computations.NewSOCEstimate(nil)
+	assert.False(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 10}))
+	assert.False(t, e.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: 3.5}))
+	assert.False(t, computations.NewSOCUncertainty(e).Update(&datatypes.Datapoint{Metric: "SOC_Percentage"}))
+	assert.False(t, computations.NewSOCRemaining(e).Update(&datatypes.Datapoint{Metric: "SOC_Percentage"}))
+
+	// Setting the config starts it, and setting it again restarts it
+	e.SetConfig(config)
+	assert.False(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 10}))
+	assert.True(t, e.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: 3.5}))
+	e.SetConfig(config)
+	assert.False(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 10}))
+}
+
+func TestSOCEstimate(t *testing.T) {
+	config, err := computations.ReadSOCConfig("soc_config.json")
+	assert.NoError(t, err)
+	soc := computations.NewSOCEstimate(config)
+	uncertainty := computations.NewSOCUncertainty(soc)
+	remaining := computations.NewSOCRemaining(soc)
+	assert.Equal(t, []string{"SOC_Percentage"}, uncertainty.GetMetrics())
+	assert.Equal(t, []string{"SOC_Percentage"}, remaining.GetMetrics())
+	update := func(metric string, value float64, at time.Time) {
+		if soc.Update(&datatypes.Datapoint{Metric: metric, Value: value, Time: at}) {
+			point := soc.Compute()
+			assert.True(t, uncertainty.Update(point))
+			assert.True(t, remaining.Update(point))
+		}
 	}
-	actualPoint = sp.Compute()
-	assert.InDelta(t, expectedPoint.Value, actualPoint.Value, 0.001)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "BMS_Current",
-		Value:  38.4,
-	})
-	assert.False(t, done)
-	done = sp.Update(&datatypes.Datapoint{
-		Metric: "Min_Voltage",
-		Value:  3.09,
-	})
-	assert.True(t, done)
-	expectedPoint = &datatypes.Datapoint{
-		Metric: "SOC_Percentage",
-		Value:  0.117903,
+
+	start := time.Now()
+	update("BMS_Current", 0, start)
+	update("Min_Voltage", 3.65, start)
+	initial := soc.Compute().Value
+	assert.InDelta(t, 1-1500.0/2998, initial, 1e-9)
+	assert.InDelta(t, config.InitialUncertainty, uncertainty.Compute().Value, 1e-9)
+	assert.InDelta(t, 36*initial, remaining.Compute().Value, 1e-9)
+
+	// Drawing 36 A for a minute uses 1/60 of the pack's charge and adds uncertainty
+	update("BMS_Current", 36, start)
+	update("BMS_Current", 36, start.Add(5*time.Second))
+	for i := 2; i <= 12; i++ {
+		update("BMS_Current", 36, start.Add(time.Duration(i)*5*time.Second))
 	}
-	actualPoint = sp.Compute()
-	assert.InDelta(t, expectedPoint.Value, actualPoint.Value, 0.001)
+	assert.InDelta(t, initial-1.0/60, soc.Compute().Value, 1e-9)
+	assert.Equal(t, start.Add(time.Minute), soc.Compute().Time)
+	counted := uncertainty.Compute().Value
+	assert.True(t, counted > config.InitialUncertainty)
+	assert.InDelta(t, 36*soc.Compute().Value, remaining.Compute().Value, 1e-9)
+
+	// A voltage consistent with the counted charge and the drop across the pack's
+	// resistance leaves the SOC where it is, and reduces the uncertainty
+	update("Pack_Resistance", 0.35, start.Add(time.Minute))
+	update("Min_Voltage", 3.65-2998.0/60*0.07/300-36*0.35/35, start.Add(time.Minute))
+	assert.InDelta(t, initial-1.0/60, soc.Compute().Value, 1e-6)
+	assert.True(t, uncertainty.Compute().Value < counted)
 
+	// A higher voltage pulls the SOC up
+	before := soc.Compute().Value
+	update("Min_Voltage", 3.8, start.Add(time.Minute))
+	assert.True(t, soc.Compute().Value > before)
+
+	// A long gap isn't counted
+	before = soc.Compute().Value
+	update("BMS_Current", 36, start.Add(time.Hour))
+	assert.Equal(t, before, soc.Compute().Value)
+
+	// Going offline restarts the filter from the tables
+	update("Connection_Status", 0, start.Add(time.Hour))
+	assert.False(t, soc.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: 4.19, Time: start.Add(time.Hour)}))
+	assert.False(t, soc.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 0, Time: start.Add(time.Hour)}))
+	assert.True(t, soc.Update(&datatypes.Datapoint{Metric: "Min_Voltage", Value: 4.19, Time: start.Add(time.Hour)}))
+	assert.InDelta(t, 1, soc.Compute().Value, 1e-9)
+}
+
+func TestReadSOCConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soc_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "soc_config.json")
+
+	_, err = computations.ReadSOCConfig(filename)
+	assert.Error(t, err)
+	assert.NoError(t, computations.LoadSOCConfig(""))
+
+	valid := `"capacity_ah": 36, "series_cells": 35, "resistance": 0.1, "process_noise": 0.01, "voltage_noise": 0.05, "initial_uncertainty": 0.05`
+	for contents, ok := range map[string]bool{
+		`{` + valid + `, "currents": [0], "voltages": [[3, 4]], "discharged": [[3000, 0]]}`:                         true,
+		`{` + valid + `, "currents": [1], "voltages": [[3, 4]], "discharged": [[3000, 0]]}`:                         false,
+		`{` + valid + `, "currents": [0, 10], "voltages": [[3, 4]], "discharged": [[3000, 0]]}`:                     false,
+		`{` + valid + `, "currents": [0], "voltages": [[3, 4, 5]], "discharged": [[3000, 0]]}`:                      false,
+		`{` + valid + `, "currents": [0], "voltages": [[4, 3]], "discharged": [[3000, 0]]}`:                         false,
+		`{` + valid + `, "currents": [0], "voltages": [[3, 4]], "discharged": [[0, 3000]]}`:                         false,
+		`{"capacity_ah": 36, "series_cells": 35, "currents": [0], "voltages": [[3, 4]], "discharged": [[3000, 0]]}`: false,
+		`{"capacity_ah": 36`: false,
+	} {
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+		_, err = computations.ReadSOCConfig(filename)
+		assert.Equal(t, ok, err == nil, contents)
+	}
 }
@@ -0,0 +1,287 @@
+package computations
+
+import (
+	"fmt"
+	"math"
+	"server/datatypes"
+	"time"
+)
+
+// Statistic is a statistic of a metric computed over time
+type Statistic string
+
+// Statistics which can be computed of a metric
+const (
+	// WindowMean, WindowMin, WindowMax and WindowStdDev are the mean, minimum, maximum
+	// and standard deviation of the values of a metric received in a rolling window
+	WindowMean   Statistic = "mean"
+	WindowMin    Statistic = "min"
+	WindowMax    Statistic = "max"
+	WindowStdDev Statistic = "std"
+	// Derivative is the rate of change per second of a metric over a rolling window,
+	// or between consecutive values without one
+	Derivative Statistic = "derivative"
+	// EWMA is the exponentially weighted moving average of a metric, with the
+	// weight of each value decaying by a factor of e every window
+	EWMA Statistic = "ewma"
+	// Integral is the integral of a metric over time, like RPM_Derived_Distance
+	// is of RPM_Derived_Velocity. It resets when the car goes offline
+	Integral Statistic = "integral"
+)
+
+// maxWindowPoints is the most points kept in a rolling window, so that a long
+// window of a fast metric can't use up the server's memory
+const maxWindowPoints = 1 << 16
+
+// NewStatistic returns a computation of a statistic of metric, named output.
+// window is the length of the rolling window for the windowed statistics and
+// the time constant of an EWMA. Integrals don't have one
+func NewStatistic(statistic Statistic, metric string, window time.Duration, output string) (Computable, error) {
+	if !isMetricName(output) {
+		return nil, fmt.Errorf("Invalid metric name %q for the %s of %s", output, statistic, metric)
+	}
+	if window < 0 {
+		return nil, fmt.Errorf("Negative window %s for %s", window, output)
+	}
+	switch statistic {
+	case WindowMean, WindowMin, WindowMax, WindowStdDev:
+		if window == 0 {
+			return nil, fmt.Errorf("Missing window for %s", output)
+		}
+		return NewWindowStatistic(statistic, metric, window, output), nil
+	case Derivative:
+		return NewWindowStatistic(statistic, metric, window, output), nil
+	case EWMA:
+		if window == 0 {
+			return nil, fmt.Errorf("Missing time constant for %s", output)
+		}
+		return NewExponentialAverage(metric, window, output), nil
+	case Integral:
+		if window != 0 {
+			return nil, fmt.Errorf("Integral %s doesn't take a window", output)
+		}
+		return NewIntegral(metric, output), nil
+	}
+	return nil, fmt.Errorf("Unknown statistic %q for %s", statistic, output)
+}
+
+// WindowStatistic computes a statistic of the values of a metric received in a rolling window
+type WindowStatistic struct {
+	statistic Statistic
+	metric    string
+	window    time.Duration
+	output    string
+	points    []*datatypes.Datapoint
+}
+
+// NewWindowStatistic returns a WindowStatistic computing statistic of the values of metric
+// received in the last window, named output
+func NewWindowStatistic(statistic Statistic, metric string, window time.Duration, output string) *WindowStatistic {
+	return &WindowStatistic{
+		statistic: statistic,
+		metric:    metric,
+		window:    window,
+		output:    output,
+	}
+}
+
+// GetMetrics returns the metric the statistic is of
+func (w *WindowStatistic) GetMetrics() []string {
+	return []string{w.metric}
+}
+
+// GetOutput returns the metric the WindowStatistic computes
+func (w *WindowStatistic) GetOutput() string {
+	return w.output
+}
+
+// Update adds point to the window, dropping the points older than the window
+// before it. Points older than the whole window are ignored. A derivative needs
+// two points at different times
+func (w *WindowStatistic) Update(point *datatypes.Datapoint) bool {
+	if len(w.points) > 0 {
+		newest := w.points[len(w.points)-1].Time
+		if point.Time.Before(newest.Add(-w.window)) {
+			return false
+		}
+	}
+	w.points = append(w.points, point)
+	if w.window == 0 {
+		// A derivative between consecutive values
+		if len(w.points) > 2 {
+			w.points = w.points[len(w.points)-2:]
+		}
+	} else {
+		start := point.Time.Add(-w.window)
+		drop := 0
+		for drop < len(w.points)-1 && w.points[drop].Time.Before(start) {
+			drop++
+		}
+		if len(w.points)-drop > maxWindowPoints {
+			drop = len(w.points) - maxWindowPoints
+		}
+		w.points = w.points[drop:]
+	}
+	if w.statistic == Derivative {
+		return len(w.points) > 1 && !w.points[len(w.points)-1].Time.Equal(w.points[0].Time)
+	}
+	return true
+}
+
+// Compute returns the statistic of the values in the window
+func (w *WindowStatistic) Compute() *datatypes.Datapoint {
+	first, last := w.points[0], w.points[len(w.points)-1]
+	var value float64
+	switch w.statistic {
+	case WindowMin:
+		value = math.Inf(1)
+		for _, point := range w.points {
+			value = math.Min(value, point.Value)
+		}
+	case WindowMax:
+		value = math.Inf(-1)
+		for _, point := range w.points {
+			value = math.Max(value, point.Value)
+		}
+	case Derivative:
+		value = (last.Value - first.Value) / last.Time.Sub(first.Time).Seconds()
+	default:
+		sum := 0.0
+		for _, point := range w.points {
+			sum += point.Value
+		}
+		mean := sum / float64(len(w.points))
+		value = mean
+		if w.statistic == WindowStdDev {
+			squares := 0.0
+			for _, point := range w.points {
+				squares += (point.Value - mean) * (point.Value - mean)
+			}
+			value = math.Sqrt(squares / float64(len(w.points)))
+		}
+	}
+	return &datatypes.Datapoint{
+		Metric: w.GetOutput(),
+		Value:  value,
+		Time:   last.Time,
+	}
+}
+
+// ExponentialAverage is the exponentially weighted moving average of a metric. The
+// weight of each value depends on the time since the previous one, so values
+// received irregularly are averaged the same way as those received steadily
+type ExponentialAverage struct {
+	metric       string
+	timeConstant time.Duration
+	output       string
+	average      float64
+	time         time.Time
+	started      bool
+}
+
+// NewExponentialAverage returns an ExponentialAverage of metric whose weights
+// decay by a factor of e every timeConstant, named output
+func NewExponentialAverage(metric string, timeConstant time.Duration, output string) *ExponentialAverage {
+	return &ExponentialAverage{
+		metric:       metric,
+		timeConstant: timeConstant,
+		output:       output,
+	}
+}
+
+// GetMetrics returns the metric averaged
+func (e *ExponentialAverage) GetMetrics() []string {
+	return []string{e.metric}
+}
+
+// GetOutput returns the metric the ExponentialAverage computes
+func (e *ExponentialAverage) GetOutput() string {
+	return e.output
+}
+
+// Update adds point to the average. Points older than the last are ignored
+func (e *ExponentialAverage) Update(point *datatypes.Datapoint) bool {
+	if !e.started {
+		e.average = point.Value
+		e.time = point.Time
+		e.started = true
+		return true
+	}
+	dt := point.Time.Sub(e.time)
+	if dt < 0 {
+		return false
+	}
+	weight := 1 - math.Exp(-dt.Seconds()/e.timeConstant.Seconds())
+	e.average += weight * (point.Value - e.average)
+	e.time = point.Time
+	return true
+}
+
+// Compute returns the average
+func (e *ExponentialAverage) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{
+		Metric: e.GetOutput(),
+		Value:  e.average,
+		Time:   e.time,
+	}
+}
+
+// RunningIntegral computes the integral of a metric over time with the trapezoidal rule.
+// Resets when car goes offline
+type RunningIntegral struct {
+	metric   string
+	output   string
+	integral float64
+	previous *datatypes.Datapoint
+}
+
+// NewIntegral returns a RunningIntegral of metric named output
+func NewIntegral(metric string, output string) *RunningIntegral {
+	return &RunningIntegral{
+		metric: metric,
+		output: output,
+	}
+}
+
+// GetMetrics returns the metric integrated and Connection_Status
+func (i *RunningIntegral) GetMetrics() []string {
+	return []string{i.metric, "Connection_Status"}
+}
+
+// GetOutput returns the metric the RunningIntegral computes
+func (i *RunningIntegral) GetOutput() string {
+	return i.output
+}
+
+// Update signifies an update when two values have been received so that a ∆time can
+// be computed. Points older than the last are ignored. A Connection_Status = 0 point
+// resets the integral
+func (i *RunningIntegral) Update(point *datatypes.Datapoint) bool {
+	if point.Metric == "Connection_Status" {
+		if point.Value == 0 {
+			i.integral = 0
+			i.previous = nil
+		}
+		return false
+	}
+	if i.previous == nil {
+		i.previous = point
+		return false
+	}
+	dt := point.Time.Sub(i.previous.Time)
+	if dt < 0 {
+		return false
+	}
+	i.integral += (i.previous.Value + point.Value) / 2 * dt.Seconds()
+	i.previous = point
+	return true
+}
+
+// Compute returns the integral so far
+func (i *RunningIntegral) Compute() *datatypes.Datapoint {
+	return &datatypes.Datapoint{
+		Metric: i.GetOutput(),
+		Value:  i.integral,
+		Time:   i.previous.Time,
+	}
+}
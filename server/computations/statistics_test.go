@@ -0,0 +1,112 @@
+package computations
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"server/datatypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowStatistic(t *testing.T) {
+	start := time.Now()
+	points := []*datatypes.Datapoint{
+		{Metric: "Window_Test", Value: 2, Time: start},
+		{Metric: "Window_Test", Value: 4, Time: start.Add(time.Second)},
+		{Metric: "Window_Test", Value: 9, Time: start.Add(2 * time.Second)},
+		{Metric: "Window_Test", Value: 5, Time: start.Add(3 * time.Second)},
+	}
+	// The first point has left the 2s window by the last
+	for statistic, expected := range map[Statistic]float64{
+		WindowMean:   6,
+		WindowMin:    4,
+		WindowMax:    9,
+		WindowStdDev: math.Sqrt(14.0 / 3),
+		Derivative:   0.5,
+	} {
+		w := NewWindowStatistic(statistic, "Window_Test", 2*time.Second, "Window_Test_Output")
+		for _, point := range points {
+			assert.Equal(t, statistic != Derivative || point != points[0], w.Update(point), statistic)
+		}
+		output := w.Compute()
+		assert.Equal(t, "Window_Test_Output", output.Metric)
+		assert.InDelta(t, expected, output.Value, 1e-9, statistic)
+		assert.Equal(t, points[3].Time, output.Time)
+
+		// Points older than the window are ignored
+		assert.False(t, w.Update(&datatypes.Datapoint{Metric: "Window_Test", Value: 100, Time: start}))
+		assert.InDelta(t, expected, w.Compute().Value, 1e-9, statistic)
+	}
+
+	// Without a window, the derivative is between consecutive points
+	d := NewWindowStatistic(Derivative, "Window_Test", 0, "Window_Test_Rate")
+	for _, point := range points {
+		d.Update(point)
+	}
+	assert.Equal(t, float64(-4), d.Compute().Value)
+	assert.False(t, d.Update(&datatypes.Datapoint{Metric: "Window_Test", Value: 8, Time: points[3].Time}))
+}
+
+func TestExponentialAverage(t *testing.T) {
+	start := time.Now()
+	e := NewExponentialAverage("BMS_Current", 10*time.Second, "BMS_Current_EWMA")
+	assert.Equal(t, []string{"BMS_Current"}, e.GetMetrics())
+	assert.True(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 10, Time: start}))
+	assert.Equal(t, float64(10), e.Compute().Value)
+	// After one time constant the average has moved 1 - 1/e of the way to the new value
+	assert.True(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 20, Time: start.Add(10 * time.Second)}))
+	assert.InDelta(t, 20-10/math.E, e.Compute().Value, 1e-9)
+	assert.Equal(t, start.Add(10*time.Second), e.Compute().Time)
+	assert.False(t, e.Update(&datatypes.Datapoint{Metric: "BMS_Current", Value: 0, Time: start}))
+}
+
+func TestRunningIntegral(t *testing.T) {
+	start := time.Now()
+	i := NewIntegral("RPM_Derived_Velocity", "Velocity_Integral")
+	assert.Equal(t, []string{"RPM_Derived_Velocity", "Connection_Status"}, i.GetMetrics())
+	assert.False(t, i.Update(&datatypes.Datapoint{Metric: "RPM_Derived_Velocity", Value: 2, Time: start}))
+	assert.True(t, i.Update(&datatypes.Datapoint{Metric: "RPM_Derived_Velocity", Value: 4, Time: start.Add(2 * time.Second)}))
+	assert.Equal(t, &datatypes.Datapoint{Metric: "Velocity_Integral", Value: 6, Time: start.Add(2 * time.Second)}, i.Compute())
+	assert.True(t, i.Update(&datatypes.Datapoint{Metric: "RPM_Derived_Velocity", Value: 4, Time: start.Add(3 * time.Second)}))
+	assert.Equal(t, float64(10), i.Compute().Value)
+
+	// Going offline resets the integral
+	assert.False(t, i.Update(&datatypes.Datapoint{Metric: "Connection_Status", Value: 0, Time: start.Add(4 * time.Second)}))
+	assert.False(t, i.Update(&datatypes.Datapoint{Metric: "RPM_Derived_Velocity", Value: 1, Time: start.Add(5 * time.Second)}))
+	assert.True(t, i.Update(&datatypes.Datapoint{Metric: "RPM_Derived_Velocity", Value: 1, Time: start.Add(6 * time.Second)}))
+	assert.Equal(t, float64(1), i.Compute().Value)
+}
+
+func TestNewStatistic(t *testing.T) {
+	c, err := NewStatistic(WindowMean, "RPM_Derived_Velocity", 5*time.Minute, "Average_Speed_5min")
+	assert.NoError(t, err)
+	assert.IsType(t, &WindowStatistic{}, c)
+	assert.Equal(t, "Average_Speed_5min", c.GetOutput())
+	c, err = NewStatistic(EWMA, "BMS_Current", 10*time.Second, "BMS_Current_EWMA")
+	assert.NoError(t, err)
+	assert.IsType(t, &ExponentialAverage{}, c)
+	c, err = NewStatistic(Integral, "BMS_Current", 0, "BMS_Charge")
+	assert.NoError(t, err)
+	assert.IsType(t, &RunningIntegral{}, c)
+	_, err = NewStatistic(Derivative, "BMS_Current", 0, "BMS_Current_Rate")
+	assert.NoError(t, err)
+
+	for _, bad := range []struct {
+		statistic Statistic
+		window    time.Duration
+		output    string
+	}{
+		{WindowMax, time.Second, ""},
+		{WindowMax, time.Second, "Max Current"},
+		{WindowMax, 0, "Max_Current"},
+		{WindowMax, -time.Second, "Max_Current"},
+		{EWMA, 0, "BMS_Current_EWMA"},
+		{Integral, time.Second, "BMS_Charge"},
+		{"median", time.Second, "Median_Current"},
+	} {
+		_, err := NewStatistic(bad.statistic, "BMS_Current", bad.window, bad.output)
+		assert.Error(t, err, bad)
+	}
+}
@@ -43,10 +43,15 @@ func (t *TerrainAngle) Update(point *datatypes.Datapoint) bool {
 	return false
 }
 
+// GetOutput returns the metric TerrainAngle computes
+func (t *TerrainAngle) GetOutput() string {
+	return "Terrain_Angle"
+}
+
 // Compute returns the terrain angle in radians
 func (t *TerrainAngle) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Terrain_Angle",
+		Metric: t.GetOutput(),
 		Value: recontool.DeriveTerrainAngle(
 			t.values["RPM_Derived_Torque"],
 			t.values["RPM_Derived_Velocity"],
@@ -20,6 +20,11 @@ func (tc *TestComputation) Update(point *datatypes.Datapoint) bool {
 	return len(tc.values) >= 10
 }
 
+// GetOutput returns the metric TestComputation computes
+func (tc *TestComputation) GetOutput() string {
+	return "Test_Computation"
+}
+
 // Compute computes the average of the values tracked by the TestComputation
 func (tc *TestComputation) Compute() *datatypes.Datapoint {
 	sum := float64(0)
@@ -34,7 +39,7 @@ func (tc *TestComputation) Compute() *datatypes.Datapoint {
 	}
 	tc.values = make([]float64, 0, 10)
 	return &datatypes.Datapoint{
-		Metric: "Test_Computation",
+		Metric: tc.GetOutput(),
 		Value:  val,
 		Time:   time.Now(),
 	}
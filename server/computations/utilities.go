@@ -23,10 +23,15 @@ func NewLeftRightSum(baseMetric string) *LeftRightSum {
 	}
 }
 
+// GetOutput returns the metric LeftRightSum computes
+func (s *LeftRightSum) GetOutput() string {
+	return s.baseMetric
+}
+
 // Compute adds Left_[base metric] + Right_[base metric]
 func (s *LeftRightSum) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: s.baseMetric,
+		Metric: s.GetOutput(),
 		Value:  s.values[fmt.Sprintf("Left_%s", s.baseMetric)] + s.values[fmt.Sprintf("Right_%s", s.baseMetric)],
 		Time:   s.timestamp,
 	}
@@ -54,10 +59,15 @@ func NewLeftRightAverage(baseMetric string) *LeftRightAverage {
 	}
 }
 
+// GetOutput returns the metric LeftRightAverage computes
+func (a *LeftRightAverage) GetOutput() string {
+	return fmt.Sprintf("Average_%s", a.baseMetric)
+}
+
 // Compute averages Left_[base metric] with Right_[base metric]
 func (a *LeftRightAverage) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: fmt.Sprintf("Average_%s", a.baseMetric),
+		Metric: a.GetOutput(),
 		Value:  (a.values[fmt.Sprintf("Left_%s", a.baseMetric)] + a.values[fmt.Sprintf("Right_%s", a.baseMetric)]) / 2,
 		Time:   a.timestamp,
 	}
@@ -105,6 +115,11 @@ func (c *ChargeIntegral) Update(point *datatypes.Datapoint) bool {
 	return c.idx == 2
 }
 
+// GetOutput returns the metric ChargeIntegral computes
+func (c *ChargeIntegral) GetOutput() string {
+	return fmt.Sprintf("%s_Charge_Consumed", c.currentName)
+}
+
 // Compute computes charge as cumsum(current * dt)
 func (c *ChargeIntegral) Compute() *datatypes.Datapoint {
 	c.cumSum += c.currents[0].Value * (c.currents[1].Time.Sub(c.currents[0].Time).Seconds())
@@ -112,7 +127,7 @@ func (c *ChargeIntegral) Compute() *datatypes.Datapoint {
 	c.currents[0] = c.currents[1]
 	c.idx = 1
 	return &datatypes.Datapoint{
-		Metric: fmt.Sprintf("%s_Charge_Consumed", c.currentName),
+		Metric: c.GetOutput(),
 		Value:  c.cumSum,
 		Time:   t,
 	}
@@ -35,10 +35,15 @@ func (e *MotorControllerEfficiency) Update(point *datatypes.Datapoint) bool {
 	return len(e.values) >= len(e.fields)
 }
 
+// GetOutput returns the metric MotorControllerEfficiency computes
+func (e *MotorControllerEfficiency) GetOutput() string {
+	return "Motor_Controller_Efficiency"
+}
+
 // Compute returns the motor controller efficiency
 func (e *MotorControllerEfficiency) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Motor_Controller_Efficiency",
+		Metric: e.GetOutput(),
 		Value: recontool.MotorControllerEfficiency(
 			e.values["Phase_C_Current"],
 			e.values["Average_Bus_Voltage"],
@@ -65,10 +70,15 @@ func NewDrivetrainEfficiency() *DrivetrainEfficiency {
 	}
 }
 
+// GetOutput returns the metric DrivetrainEfficiency computes
+func (e *DrivetrainEfficiency) GetOutput() string {
+	return "Drivetrain_Efficiency"
+}
+
 // Compute computes drivetrain efficiency
 func (e *DrivetrainEfficiency) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Drivetrain_Efficiency",
+		Metric: e.GetOutput(),
 		Value: recontool.DrivetrainEfficiency(
 			e.values["Motor_Controller_Efficiency"],
 			e.values["Pack_Efficiency"],
@@ -110,10 +120,15 @@ func (c *ModeledBusCurrent) Update(point *datatypes.Datapoint) bool {
 	return len(c.values) >= len(c.fields)
 }
 
+// GetOutput returns the metric ModeledBusCurrent computes
+func (c *ModeledBusCurrent) GetOutput() string {
+	return "Modeled_Bus_Current"
+}
+
 // Compute computes modeled bus current in amps
 func (c *ModeledBusCurrent) Compute() *datatypes.Datapoint {
 	datapoint := &datatypes.Datapoint{
-		Metric: "Modeled_Bus_Current",
+		Metric: c.GetOutput(),
 		Value:  c.values["Modeled_Motor_Power"] / c.values["Average_Bus_Voltage"],
 		Time:   c.timestamp,
 	}
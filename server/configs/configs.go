@@ -4,65 +4,539 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
 	"path"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"server/datatypes"
+	"server/settings"
 )
 
 // CanConfigType holds CAN configuration information
 type CanConfigType struct {
-	CanID       int     `json:"can_id"`
-	Datatype    string  `json:"datatype"`
-	Name        string  `json:"name"`
-	Offset      int     `json:"offset"`
+	CanID    int    `json:"can_id"`
+	Datatype string `json:"datatype"`
+	Name     string `json:"name"`
+	// Offset is the byte the value starts at, or the bit for the bit datatype
+	Offset int `json:"offset"`
+	// BitStart and BitLength select the bits read by the bitfield datatype.
+	// BitStart is the least significant bit of a little-endian bitfield and
+	// the most significant bit of a big-endian one, as in DBC files
+	BitStart  int `json:"bit_start"`
+	BitLength int `json:"bit_length"`
+	// ByteOrder is LittleEndian (the default) or BigEndian
+	ByteOrder string `json:"byte_order"`
+	// Signed reads a bitfield as a two's complement number
+	Signed bool `json:"signed"`
+	// Scale and ValueOffset convert the raw value into the physical value,
+	// Scale * raw + ValueOffset. A Scale of 0 is treated as 1
+	Scale       float64 `json:"scale"`
+	ValueOffset float64 `json:"value_offset"`
+	Units       string  `json:"units"`
+	// Multiplexer marks the signal whose raw value selects which of the
+	// signals with a MuxValue are present in a packet with this CAN ID
+	Multiplexer bool `json:"multiplexer"`
+	// MuxValue, if set, is the raw value of the multiplexer signal for which
+	// this signal is present. Otherwise the signal is in every packet
+	MuxValue *int `json:"mux_value,omitempty"`
+	// Values names the raw values of an enumerated signal
+	Values map[int]string `json:"values,omitempty"`
+	// CheckBounds drops physical values outside of [MinValue, MaxValue]
 	CheckBounds bool    `json:"check_bounds"`
 	MinValue    float64 `json:"min_value"`
 	MaxValue    float64 `json:"max_value"`
 	Description string  `json:"description"`
+	// file is the config file the config was read from, if any
+	file string
 }
 
-var canConfigs map[int][]*CanConfigType
-var configsLock sync.Mutex
+// Byte orders of multi-byte values and bitfields
+const (
+	LittleEndian = "little"
+	BigEndian    = "big"
+)
 
-// LoadConfigs loads the CAN configs from the config file
-func LoadConfigs() (map[int][]*CanConfigType, error) {
-	configsLock.Lock()
-	defer configsLock.Unlock()
-	if canConfigs != nil {
-		return canConfigs, nil
+// payloadBits is the length of a CAN payload in bits
+const payloadBits = 64
+
+// Physical converts a raw value read from the payload into the physical value
+func (c *CanConfigType) Physical(raw float64) float64 {
+	return raw*c.scale() + c.ValueOffset
+}
+
+func (c *CanConfigType) scale() float64 {
+	if c.Scale == 0 {
+		return 1
+	}
+	return c.Scale
+}
+
+// Label returns the name of a physical value of an enumerated signal
+func (c *CanConfigType) Label(value float64) (string, bool) {
+	raw := (value - c.ValueOffset) / c.scale()
+	if raw != math.Trunc(raw) {
+		return "", false
 	}
-	_, filename, _, ok := runtime.Caller(0)
+	label, ok := c.Values[int(raw)]
+	return label, ok
+}
+
+// BigEndian returns whether the value is stored most significant byte first
+func (c *CanConfigType) BigEndian() bool {
+	return c.ByteOrder == BigEndian
+}
+
+// datatypeBits is the size in bits of each fixed size datatype. The offset of a
+// bit is counted in bits, while the offset of any other datatype is counted in bytes
+var datatypeBits = map[string]int{
+	"uint8":   8,
+	"uint16":  16,
+	"uint32":  32,
+	"uint64":  64,
+	"int8":    8,
+	"int16":   16,
+	"int32":   32,
+	"int64":   64,
+	"float32": 32,
+	"float64": 64,
+	"bit":     1,
+}
+
+// Bits returns the positions of the bits of the payload the config reads,
+// from the most to the least significant, or false if the datatype is
+// unknown. Bit n of the payload is bit n%8 of byte n/8. Positions outside of
+// the payload are returned as they are, so they can be reported
+func (c *CanConfigType) Bits() ([]int, bool) {
+	if c.Datatype == "bitfield" {
+		return bitfieldBits(c.BitStart, c.BitLength, c.BigEndian()), true
+	}
+	size, ok := datatypeBits[c.Datatype]
 	if !ok {
-		return nil, fmt.Errorf("Could not find runtime caller")
+		return nil, false
 	}
-	dir := path.Join(path.Dir(filename), "can_configs")
+	if c.Datatype == "bit" {
+		return []int{c.Offset}, true
+	}
+	bits := make([]int, 0, size)
+	for i := size/8 - 1; i >= 0; i-- {
+		byteIndex := c.Offset + i
+		if c.BigEndian() {
+			byteIndex = c.Offset + size/8 - 1 - i
+		}
+		for bit := 7; bit >= 0; bit-- {
+			bits = append(bits, byteIndex*8+bit)
+		}
+	}
+	return bits, true
+}
+
+// bitfieldBits returns the bits of a bitfield from the most to the least
+// significant. A little-endian bitfield counts up from its least significant
+// bit at start. A big-endian bitfield counts down from its most significant
+// bit at start, moving on to the most significant bit of the next byte
+// whenever it reaches the end of a byte
+func bitfieldBits(start int, length int, bigEndian bool) []int {
+	if length <= 0 {
+		return nil
+	}
+	bits := make([]int, length)
+	if !bigEndian {
+		for i := range bits {
+			bits[i] = start + length - 1 - i
+		}
+		return bits
+	}
+	bit := start
+	for i := range bits {
+		bits[i] = bit
+		if bit%8 == 0 {
+			bit += 15
+		} else {
+			bit--
+		}
+	}
+	return bits
+}
+
+// position describes where in the payload the config reads its value
+func (c *CanConfigType) position() string {
+	switch c.Datatype {
+	case "bitfield":
+		return fmt.Sprintf("bit %d with length %d", c.BitStart, c.BitLength)
+	case "bit":
+		return fmt.Sprintf("bit %d", c.Offset)
+	default:
+		return fmt.Sprintf("offset %d", c.Offset)
+	}
+}
+
+// Problem describes something wrong with a CAN config
+type Problem struct {
+	File    string `json:"file,omitempty"`
+	CanID   int    `json:"can_id"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%s (CAN ID 0x%x): %s", p.Name, p.CanID, p.Message)
+	}
+	return fmt.Sprintf("%s: %s (CAN ID 0x%x): %s", p.File, p.Name, p.CanID, p.Message)
+}
+
+// ValidationError is returned when the CAN configs have problems
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.String()
+	}
+	return fmt.Sprintf("invalid CAN configs: %s", strings.Join(messages, "; "))
+}
+
+// Validate returns the problems with a list of CAN configs: illegal or
+// duplicate names, unknown datatypes and byte orders, signals that extend past
+// the end of the payload or overlap another signal with the same CAN ID, and
+// bounds with the minimum above the maximum. Bits may overlap a wider signal,
+// since they are used to pick single flags out of it, and signals with
+// different mux values may overlap each other. Each CAN ID may have one
+// integer multiplexer, which signals with a mux value require
+func Validate(canConfigs []*CanConfigType) []Problem {
+	problems := make([]Problem, 0)
+	problem := func(config *CanConfigType, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			File:    config.file,
+			CanID:   config.CanID,
+			Name:    config.Name,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	names := make(map[string]*CanConfigType)
+	byID := make(map[int][]*CanConfigType)
+	masks := make(map[*CanConfigType]uint64)
+	for _, config := range canConfigs {
+		if !datatypes.ValidMetric(config.Name) {
+			problem(config, "illegal name")
+		} else if other, ok := names[config.Name]; ok {
+			problem(config, "duplicate name, also used by CAN ID 0x%x", other.CanID)
+		} else {
+			names[config.Name] = config
+		}
+		if config.CanID < 0 {
+			problem(config, "negative CAN ID")
+		}
+		if config.MinValue > config.MaxValue {
+			problem(config, "min_value %v is greater than max_value %v", config.MinValue, config.MaxValue)
+		}
+		if config.ByteOrder != "" && config.ByteOrder != LittleEndian && config.ByteOrder != BigEndian {
+			problem(config, "unknown byte_order %q", config.ByteOrder)
+		}
+		if len(config.Values) > 0 && strings.HasPrefix(config.Datatype, "float") {
+			problem(config, "values can't name %s values", config.Datatype)
+		}
+		if config.Multiplexer && config.MuxValue != nil {
+			problem(config, "a multiplexer can't have a mux_value")
+		}
+		if config.Multiplexer && strings.HasPrefix(config.Datatype, "float") {
+			problem(config, "multiplexer must be an integer, not %s", config.Datatype)
+		}
+		if config.Datatype == "bitfield" && (config.BitLength < 1 || config.BitLength > payloadBits) {
+			problem(config, "bit_length %d must be between 1 and %d", config.BitLength, payloadBits)
+			continue
+		}
+		bits, ok := config.Bits()
+		if !ok {
+			problem(config, "unknown datatype %q", config.Datatype)
+			continue
+		}
+		var mask uint64
+		for _, bit := range bits {
+			if bit < 0 || bit >= payloadBits {
+				mask = 0
+				break
+			}
+			mask |= 1 << uint(bit)
+		}
+		if mask == 0 {
+			problem(config, "%s at %s does not fit in an 8 byte payload", config.Datatype, config.position())
+			continue
+		}
+		masks[config] = mask
+		byID[config.CanID] = append(byID[config.CanID], config)
+	}
+	ids := make([]int, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		signals := byID[id]
+		var multiplexer *CanConfigType
+		for _, config := range signals {
+			if !config.Multiplexer {
+				continue
+			}
+			if multiplexer != nil {
+				problem(config, "CAN ID already has the multiplexer %s", multiplexer.Name)
+				continue
+			}
+			multiplexer = config
+		}
+		for i, config := range signals {
+			if config.MuxValue != nil && multiplexer == nil {
+				problem(config, "mux_value %d without a multiplexer signal", *config.MuxValue)
+			}
+			for _, other := range signals[:i] {
+				if (config.Datatype == "bit") != (other.Datatype == "bit") {
+					continue
+				}
+				if config.MuxValue != nil && other.MuxValue != nil && *config.MuxValue != *other.MuxValue {
+					continue
+				}
+				if masks[config]&masks[other] != 0 {
+					problem(config, "overlaps %s", other.Name)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// Set is a directory of CAN configs, loaded the first time they are needed
+// and reloaded when the files change
+type Set struct {
+	lock sync.Mutex
+	dir  string
+	// current holds the map[int][]*CanConfigType loaded most recently
+	current atomic.Value
+}
+
+// NewSet returns the set of CAN configs in dir, which defaults to
+// server/configs/can_configs if empty
+func NewSet(dir string) *Set {
+	s := &Set{}
+	s.SetDir(dir)
+	return s
+}
+
+// defaultSet is the set of CAN configs used by the package level functions
+var defaultSet = NewSet("")
+
+// Default returns the set of CAN configs loaded from the directory passed to SetDir
+func Default() *Set {
+	return defaultSet
+}
+
+// SetDir sets the directory the CAN configs are loaded from, which defaults to
+// server/configs/can_configs. The configs are loaded from it the next time
+// they are needed
+func SetDir(dir string) {
+	defaultSet.SetDir(dir)
+}
+
+// SetDir sets the directory the set's CAN configs are loaded from. The configs
+// are loaded from it the next time they are needed
+func (s *Set) SetDir(dir string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dir = dir
+	s.current.Store(map[int][]*CanConfigType(nil))
+}
+
+func (s *Set) getDir() (string, error) {
+	if s.dir != "" {
+		return s.dir, nil
+	}
+	return settings.SourcePath("can_configs")
+}
+
+// ReadDir reads the CAN configs in every .json file in dir without validating them
+func ReadDir(dir string) ([]*CanConfigType, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	var canConfigList []CanConfigType
-
+	var canConfigList []*CanConfigType
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".json") {
-			rawJSON, err := ioutil.ReadFile(path.Join(dir, file.Name()))
-			if err != nil {
-				return nil, err
-			}
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		rawJSON, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var tmpConfigList []*CanConfigType
+		err = json.Unmarshal(rawJSON, &tmpConfigList)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", file.Name(), err)
+		}
+		for _, config := range tmpConfigList {
+			config.file = file.Name()
+		}
+		canConfigList = append(canConfigList, tmpConfigList...)
+	}
+	return canConfigList, nil
+}
+
+// ValidateDir reads the CAN configs in the config directory and returns their
+// problems, without loading them
+func ValidateDir() ([]Problem, error) {
+	return defaultSet.ValidateDir()
+}
+
+// ValidateDir reads the CAN configs in the set's directory and returns their
+// problems, without loading them
+func (s *Set) ValidateDir() ([]Problem, error) {
+	s.lock.Lock()
+	dir, err := s.getDir()
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	canConfigList, err := ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return Validate(canConfigList), nil
+}
+
+// Current returns the CAN configs loaded most recently keyed by CAN ID,
+// or nil if they have not been loaded yet
+func Current() map[int][]*CanConfigType {
+	return defaultSet.Current()
+}
+
+// Current returns the set's CAN configs loaded most recently keyed by CAN ID,
+// or nil if they have not been loaded yet
+func (s *Set) Current() map[int][]*CanConfigType {
+	canConfigs, _ := s.current.Load().(map[int][]*CanConfigType)
+	return canConfigs
+}
+
+// LoadConfigs returns the current CAN configs keyed by CAN ID,
+// loading them from the config directory the first time
+func LoadConfigs() (map[int][]*CanConfigType, error) {
+	return defaultSet.Load()
+}
+
+// Load returns the set's current CAN configs keyed by CAN ID,
+// loading them from its directory the first time
+func (s *Set) Load() (map[int][]*CanConfigType, error) {
+	if canConfigs := s.Current(); canConfigs != nil {
+		return canConfigs, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if canConfigs := s.Current(); canConfigs != nil {
+		return canConfigs, nil
+	}
+	return s.reload()
+}
 
-			var tmpConfigList []CanConfigType
-			err = json.Unmarshal(rawJSON, &tmpConfigList)
-			if err != nil {
-				return nil, err
+// Enums returns the current CAN configs of enumerated signals keyed by name
+func Enums() (map[string]*CanConfigType, error) {
+	canConfigs, err := LoadConfigs()
+	if err != nil {
+		return nil, err
+	}
+	enums := make(map[string]*CanConfigType)
+	for _, configList := range canConfigs {
+		for _, config := range configList {
+			if len(config.Values) > 0 {
+				enums[config.Name] = config
 			}
-			canConfigList = append(canConfigList, tmpConfigList...)
 		}
 	}
+	return enums, nil
+}
+
+// Reload reads the CAN configs from the config directory again. The new
+// configs replace the current ones only if they are free of problems;
+// otherwise a *ValidationError listing them is returned
+func Reload() error {
+	return defaultSet.Reload()
+}
+
+// Reload reads the set's CAN configs from its directory again, replacing
+// the current ones only if they are free of problems
+func (s *Set) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.reload()
+	return err
+}
 
-	canConfigs = make(map[int][]*CanConfigType)
-	for i := range canConfigList {
-		config := &canConfigList[i]
+func (s *Set) reload() (map[int][]*CanConfigType, error) {
+	dir, err := s.getDir()
+	if err != nil {
+		return nil, err
+	}
+	canConfigList, err := ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if problems := Validate(canConfigList); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	canConfigs := make(map[int][]*CanConfigType)
+	for _, config := range canConfigList {
 		canConfigs[config.CanID] = append(canConfigs[config.CanID], config)
 	}
+	s.current.Store(canConfigs)
 	return canConfigs, nil
 }
+
+// dirState summarizes the names, sizes and modification times of the config files
+func dirState(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var state strings.Builder
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			fmt.Fprintf(&state, "%s:%d:%d\n", file.Name(), file.Size(), file.ModTime().UnixNano())
+		}
+	}
+	return state.String(), nil
+}
+
+// Watch checks the config directory for changes every interval until done is
+// closed, reloading the CAN configs when any of the files change. Configs with
+// problems are logged and ignored until they are fixed
+func Watch(interval time.Duration, done <-chan struct{}) {
+	defaultSet.Watch(interval, done)
+}
+
+// Watch checks the set's directory for changes every interval until done is
+// closed, reloading its CAN configs when any of the files change
+func (s *Set) Watch(interval time.Duration, done <-chan struct{}) {
+	var dir string
+	state := func() (string, error) {
+		var err error
+		s.lock.Lock()
+		dir, err = s.getDir()
+		s.lock.Unlock()
+		if err != nil {
+			return "", err
+		}
+		return dirState(dir)
+	}
+	reload := func() error {
+		err := s.Reload()
+		if err == nil {
+			log.Printf("Reloaded CAN configs from %s\n", dir)
+		}
+		return err
+	}
+	settings.Watch("CAN configs", interval, done, state, reload)
+}
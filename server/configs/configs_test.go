@@ -1,8 +1,14 @@
 package configs
 
 import (
-	"server/storage"
+	"io/ioutil"
+	"os"
+	"path"
+	"server/datatypes"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConfigs(t *testing.T) {
@@ -15,7 +21,7 @@ func TestConfigs(t *testing.T) {
 	// Check that there are no illegal metric names in the config
 	for _, configList := range configs {
 		for _, config := range configList {
-			if !storage.ValidMetric(config.Name) {
+			if !datatypes.ValidMetric(config.Name) {
 				t.Errorf("Illegal metric name: %v", config.Name)
 			}
 			if existingNames[config.Name] {
@@ -25,3 +31,127 @@ func TestConfigs(t *testing.T) {
 		}
 	}
 }
+
+func TestValidate(t *testing.T) {
+	zero, one := 0, 1
+	valid := []*CanConfigType{
+		{CanID: 1, Datatype: "uint16", Name: "Flags", Offset: 0},
+		{CanID: 1, Datatype: "bit", Name: "Flag_1", Offset: 1},
+		{CanID: 1, Datatype: "bit", Name: "Flag_2", Offset: 2},
+		{CanID: 1, Datatype: "float32", Name: "Voltage", Offset: 4, CheckBounds: true, MinValue: 0, MaxValue: 5},
+		{CanID: 2, Datatype: "float64", Name: "Position", Offset: 0},
+		{CanID: 4, Datatype: "int16", Name: "Big_Current", Offset: 0, ByteOrder: BigEndian},
+		{CanID: 4, Datatype: "bitfield", Name: "Low_Field", BitStart: 16, BitLength: 12},
+		{CanID: 4, Datatype: "bitfield", Name: "High_Field", BitStart: 28, BitLength: 4, Signed: true},
+		{CanID: 4, Datatype: "bitfield", Name: "Big_Field", BitStart: 39, BitLength: 16, ByteOrder: BigEndian},
+		{CanID: 5, Datatype: "uint8", Name: "Group", Offset: 0, Multiplexer: true, Values: map[int]string{0: "Low", 1: "High"}},
+		{CanID: 5, Datatype: "uint16", Name: "Low_Cell", Offset: 1, MuxValue: &zero},
+		{CanID: 5, Datatype: "uint16", Name: "High_Cell", Offset: 1, MuxValue: &one},
+	}
+	assert.Empty(t, Validate(valid))
+
+	invalid := map[string]*CanConfigType{
+		"illegal name":        {CanID: 3, Datatype: "uint8", Name: "Bad Name"},
+		"duplicate name":      {CanID: 3, Datatype: "uint8", Name: "Voltage"},
+		"unknown datatype":    {CanID: 3, Datatype: "uint24", Name: "Unknown"},
+		"past end of payload": {CanID: 3, Datatype: "uint32", Name: "Too_Far", Offset: 6},
+		"bit past end":        {CanID: 3, Datatype: "bit", Name: "Bit_Too_Far", Offset: 64},
+		"negative offset":     {CanID: 3, Datatype: "uint8", Name: "Negative", Offset: -1},
+		"min above max":       {CanID: 3, Datatype: "uint8", Name: "Bounds", MinValue: 2, MaxValue: 1},
+		"overlapping signals": {CanID: 1, Datatype: "uint8", Name: "Overlap", Offset: 5},
+		"overlapping bits":    {CanID: 1, Datatype: "bit", Name: "Flag_2_Again", Offset: 2},
+		"negative CAN ID":     {CanID: -1, Datatype: "uint8", Name: "Negative_ID"},
+		"unknown byte order":  {CanID: 3, Datatype: "uint16", Name: "Middle_Endian", ByteOrder: "middle"},
+		"empty bitfield":      {CanID: 3, Datatype: "bitfield", Name: "Empty", BitLength: 0},
+		"bitfield past end":   {CanID: 3, Datatype: "bitfield", Name: "Field_Too_Far", BitStart: 60, BitLength: 8},
+		"big-endian past end": {CanID: 3, Datatype: "bitfield", Name: "Big_Too_Far", BitStart: 59, BitLength: 8, ByteOrder: BigEndian},
+		"overlapping fields":  {CanID: 1, Datatype: "bitfield", Name: "Overlap_Field", BitStart: 38, BitLength: 4},
+		"second multiplexer":  {CanID: 5, Datatype: "uint8", Name: "Group_Again", Offset: 3, Multiplexer: true},
+		"float multiplexer":   {CanID: 6, Datatype: "float32", Name: "Float_Group", Multiplexer: true},
+		"muxed multiplexer":   {CanID: 7, Datatype: "uint8", Name: "Muxed_Group", Multiplexer: true, MuxValue: &one},
+		"missing multiplexer": {CanID: 6, Datatype: "uint8", Name: "Orphan", MuxValue: &zero},
+		"same mux value":      {CanID: 5, Datatype: "uint8", Name: "Low_Overlap", Offset: 2, MuxValue: &zero},
+		"float values":        {CanID: 6, Datatype: "float32", Name: "Named_Float", Values: map[int]string{0: "Zero"}},
+	}
+	for description, config := range invalid {
+		problems := Validate(append(append([]*CanConfigType{}, valid...), config))
+		if assert.Len(t, problems, 1, description) {
+			assert.Equal(t, config.Name, problems[0].Name, description)
+		}
+	}
+}
+
+func TestBits(t *testing.T) {
+	bits, ok := (&CanConfigType{Datatype: "uint16", Offset: 2}).Bits()
+	assert.True(t, ok)
+	assert.Equal(t, []int{31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16}, bits)
+	bits, _ = (&CanConfigType{Datatype: "uint16", Offset: 2, ByteOrder: BigEndian}).Bits()
+	assert.Equal(t, []int{23, 22, 21, 20, 19, 18, 17, 16, 31, 30, 29, 28, 27, 26, 25, 24}, bits)
+	bits, _ = (&CanConfigType{Datatype: "bitfield", BitStart: 6, BitLength: 4}).Bits()
+	assert.Equal(t, []int{9, 8, 7, 6}, bits)
+	bits, _ = (&CanConfigType{Datatype: "bitfield", BitStart: 1, BitLength: 4, ByteOrder: BigEndian}).Bits()
+	assert.Equal(t, []int{1, 0, 15, 14}, bits)
+	_, ok = (&CanConfigType{Datatype: "uint24"}).Bits()
+	assert.False(t, ok)
+}
+
+func TestLabel(t *testing.T) {
+	config := &CanConfigType{Datatype: "uint8", Scale: 2, ValueOffset: -1, Values: map[int]string{0: "Off", 3: "Fault"}}
+	label, ok := config.Label(-1)
+	assert.True(t, ok)
+	assert.Equal(t, "Off", label)
+	label, ok = config.Label(5)
+	assert.True(t, ok)
+	assert.Equal(t, "Fault", label)
+	_, ok = config.Label(1)
+	assert.False(t, ok)
+	_, ok = config.Label(4)
+	assert.False(t, ok)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "can_configs_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer SetDir("")
+	writeConfigs := func(json string) {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "test_config.json"), []byte(json), 0644))
+	}
+	writeConfigs(`[{"can_id": 1, "datatype": "uint8", "name": "Reload_Test", "offset": 0}]`)
+	SetDir(dir)
+	loaded, err := LoadConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, "Reload_Test", loaded[1][0].Name)
+
+	// Configs with problems are rejected and the current configs are kept
+	writeConfigs(`[{"can_id": 1, "datatype": "uint8", "name": "Reload_Test", "offset": 8}]`)
+	err = Reload()
+	validationErr, ok := err.(*ValidationError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Len(t, validationErr.Problems, 1)
+		assert.Equal(t, "test_config.json", validationErr.Problems[0].File)
+	}
+	problems, err := ValidateDir()
+	assert.NoError(t, err)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, loaded, Current())
+
+	writeConfigs(`[{`)
+	assert.Error(t, Reload())
+	assert.Equal(t, loaded, Current())
+
+	// Watch picks up changes to the files
+	done := make(chan struct{})
+	defer close(done)
+	go Watch(10*time.Millisecond, done)
+	time.Sleep(50 * time.Millisecond)
+	writeConfigs(`[{"can_id": 2, "datatype": "uint16", "name": "Reloaded", "offset": 0}]`)
+	deadline := time.Now().Add(5 * time.Second)
+	for Current()[2] == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NotNil(t, Current()[2]) {
+		assert.Equal(t, "Reloaded", Current()[2][0].Name)
+	}
+	assert.Nil(t, Current()[1])
+}
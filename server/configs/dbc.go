@@ -0,0 +1,543 @@
+package configs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// extendedIDFlag is set on the IDs of messages with 29 bit CAN IDs in DBC files
+const extendedIDFlag = 0x80000000
+
+// DBC value types of signals, set by SIG_VALTYPE_
+const (
+	DBCInteger = 0
+	DBCFloat32 = 1
+	DBCFloat64 = 2
+)
+
+// DBC holds the messages of a Vector DBC file
+type DBC struct {
+	Messages []*DBCMessage
+}
+
+// DBCMessage is a CAN message (BO_) in a DBC file
+type DBCMessage struct {
+	ID          int
+	Name        string
+	Size        int
+	Transmitter string
+	Comment     string
+	Signals     []*DBCSignal
+}
+
+// DBCSignal is a signal (SG_) of a message in a DBC file
+type DBCSignal struct {
+	Name string
+	// Multiplexer is the multiplexer indicator, such as "M" or "m3", if any
+	Multiplexer  string
+	StartBit     int
+	Length       int
+	LittleEndian bool
+	Signed       bool
+	// ValueType is DBCInteger, DBCFloat32 or DBCFloat64
+	ValueType int
+	Factor    float64
+	Offset    float64
+	Min       float64
+	Max       float64
+	Unit      string
+	Receivers []string
+	Comment   string
+	// Values names raw values of the signal, set by VAL_
+	Values map[int]string
+}
+
+var (
+	messageRegex  = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)\s+(\w+)`)
+	signalRegex   = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+M?)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(\s*([^,\s]+)\s*,\s*([^)\s]+)\s*\)\s*\[\s*([^|\s]+)\s*\|\s*([^\]\s]+)\s*\]\s*"((?:[^"\\]|\\.)*)"\s*(.*)$`)
+	commentRegex  = regexp.MustCompile(`(?s)^CM_\s+(?:(BO_)\s+(\d+)|(SG_)\s+(\d+)\s+(\w+))\s+"((?:[^"\\]|\\.)*)"\s*;`)
+	valTypeRegex  = regexp.MustCompile(`^SIG_VALTYPE_\s+(\d+)\s+(\w+)\s*:?\s*([0-2])\s*;`)
+	valuesRegex   = regexp.MustCompile(`(?s)^VAL_\s+(\d+)\s+(\w+)((?:\s+-?\d+\s+"(?:[^"\\]|\\.)*")*)\s*;`)
+	valueRegex    = regexp.MustCompile(`(-?\d+)\s+"((?:[^"\\]|\\.)*)"`)
+	muxValueRegex = regexp.MustCompile(`^m(\d+)$`)
+)
+
+// ParseDBC reads the messages, signals, comments, signal value types and value
+// descriptions of a DBC file. Other sections, such as attributes and value
+// tables, are ignored
+func ParseDBC(r io.Reader) (*DBC, error) {
+	d := &DBC{}
+	messages := make(map[int]*DBCMessage)
+	var message *DBCMessage
+	statements, err := dbcStatements(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range statements {
+		line := statement.text
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			match := messageRegex.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("line %d: malformed message: %s", statement.line, line)
+			}
+			id, _ := strconv.ParseInt(match[1], 10, 64)
+			size, _ := strconv.Atoi(match[3])
+			message = &DBCMessage{
+				ID:          int(id &^ extendedIDFlag),
+				Name:        match[2],
+				Size:        size,
+				Transmitter: match[4],
+			}
+			d.Messages = append(d.Messages, message)
+			messages[message.ID] = message
+		case strings.HasPrefix(line, "SG_ "):
+			if message == nil {
+				return nil, fmt.Errorf("line %d: signal outside of a message", statement.line)
+			}
+			signal, err := parseDBCSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", statement.line, err)
+			}
+			message.Signals = append(message.Signals, signal)
+		case strings.HasPrefix(line, "CM_ "):
+			match := commentRegex.FindStringSubmatch(line)
+			if match == nil {
+				// Comments on nodes and the network aren't kept
+				continue
+			}
+			comment := unescapeDBCString(match[6])
+			if match[1] != "" {
+				if m := findDBCMessage(messages, match[2]); m != nil {
+					m.Comment = comment
+				}
+			} else if signal := findDBCSignal(messages, match[4], match[5]); signal != nil {
+				signal.Comment = comment
+			}
+		case strings.HasPrefix(line, "SIG_VALTYPE_ "):
+			match := valTypeRegex.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("line %d: malformed signal value type: %s", statement.line, line)
+			}
+			if signal := findDBCSignal(messages, match[1], match[2]); signal != nil {
+				signal.ValueType, _ = strconv.Atoi(match[3])
+			}
+		case strings.HasPrefix(line, "VAL_ "):
+			match := valuesRegex.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("line %d: malformed value descriptions: %s", statement.line, line)
+			}
+			signal := findDBCSignal(messages, match[1], match[2])
+			if signal == nil {
+				continue
+			}
+			signal.Values = make(map[int]string)
+			for _, value := range valueRegex.FindAllStringSubmatch(match[3], -1) {
+				raw, err := strconv.Atoi(value[1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: malformed value %s", statement.line, value[1])
+				}
+				signal.Values[raw] = unescapeDBCString(value[2])
+			}
+		default:
+			message = nil
+		}
+	}
+	return d, nil
+}
+
+func parseDBCSignal(line string) (*DBCSignal, error) {
+	match := signalRegex.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("malformed signal: %s", line)
+	}
+	signal := &DBCSignal{
+		Name:         match[1],
+		Multiplexer:  match[2],
+		LittleEndian: match[5] == "1",
+		Signed:       match[6] == "-",
+		Unit:         unescapeDBCString(match[11]),
+	}
+	signal.StartBit, _ = strconv.Atoi(match[3])
+	signal.Length, _ = strconv.Atoi(match[4])
+	numbers := []*float64{&signal.Factor, &signal.Offset, &signal.Min, &signal.Max}
+	for i, number := range numbers {
+		value, err := strconv.ParseFloat(match[7+i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed number in signal %s: %s", signal.Name, match[7+i])
+		}
+		*number = value
+	}
+	for _, receiver := range strings.FieldsFunc(match[12], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		signal.Receivers = append(signal.Receivers, receiver)
+	}
+	return signal, nil
+}
+
+func findDBCMessage(messages map[int]*DBCMessage, id string) *DBCMessage {
+	parsed, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return messages[int(parsed&^extendedIDFlag)]
+}
+
+func findDBCSignal(messages map[int]*DBCMessage, id string, name string) *DBCSignal {
+	message := findDBCMessage(messages, id)
+	if message == nil {
+		return nil
+	}
+	for _, signal := range message.Signals {
+		if signal.Name == name {
+			return signal
+		}
+	}
+	return nil
+}
+
+type dbcStatement struct {
+	line int
+	text string
+}
+
+// dbcStatements splits a DBC file into trimmed statements, one per line
+// except for strings that continue onto the following lines
+func dbcStatements(r io.Reader) ([]dbcStatement, error) {
+	var statements []dbcStatement
+	var current strings.Builder
+	start := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if current.Len() == 0 {
+			start = n
+		} else {
+			current.WriteString("\n")
+		}
+		current.WriteString(line)
+		if openString(current.String()) {
+			continue
+		}
+		text := strings.TrimSpace(current.String())
+		if text != "" {
+			statements = append(statements, dbcStatement{line: start, text: text})
+		}
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated string", start)
+	}
+	return statements, scanner.Err()
+}
+
+// openString returns whether text ends inside a string
+func openString(text string) bool {
+	open := false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && open:
+			i++
+		case text[i] == '"':
+			open = !open
+		}
+	}
+	return open
+}
+
+func unescapeDBCString(s string) string {
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+func escapeDBCString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// Write writes the messages to w in the DBC format
+func (d *DBC) Write(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, `VERSION ""`)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "NS_ :")
+	fmt.Fprintln(out, "\tCM_")
+	fmt.Fprintln(out, "\tSIG_VALTYPE_")
+	fmt.Fprintln(out, "\tVAL_")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "BS_:")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "BU_:")
+	for _, message := range d.Messages {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "BO_ %d %s: %d %s\n", dbcMessageID(message), message.Name, message.Size, dbcNode(message.Transmitter))
+		for _, signal := range message.Signals {
+			byteOrder, sign := 0, "+"
+			if signal.LittleEndian {
+				byteOrder = 1
+			}
+			if signal.Signed {
+				sign = "-"
+			}
+			receivers := "Vector__XXX"
+			if len(signal.Receivers) > 0 {
+				receivers = strings.Join(signal.Receivers, ",")
+			}
+			multiplexer := ""
+			if signal.Multiplexer != "" {
+				multiplexer = signal.Multiplexer + " "
+			}
+			fmt.Fprintf(out, " SG_ %s %s: %d|%d@%d%s (%s,%s) [%s|%s] \"%s\" %s\n",
+				signal.Name, multiplexer, signal.StartBit, signal.Length, byteOrder, sign,
+				formatDBCNumber(signal.Factor), formatDBCNumber(signal.Offset),
+				formatDBCNumber(signal.Min), formatDBCNumber(signal.Max),
+				escapeDBCString(signal.Unit), receivers)
+		}
+	}
+	fmt.Fprintln(out)
+	for _, message := range d.Messages {
+		if message.Comment != "" {
+			fmt.Fprintf(out, "CM_ BO_ %d \"%s\";\n", dbcMessageID(message), escapeDBCString(message.Comment))
+		}
+		for _, signal := range message.Signals {
+			if signal.Comment != "" {
+				fmt.Fprintf(out, "CM_ SG_ %d %s \"%s\";\n", dbcMessageID(message), signal.Name, escapeDBCString(signal.Comment))
+			}
+		}
+	}
+	for _, message := range d.Messages {
+		for _, signal := range message.Signals {
+			if signal.ValueType != DBCInteger {
+				fmt.Fprintf(out, "SIG_VALTYPE_ %d %s : %d;\n", dbcMessageID(message), signal.Name, signal.ValueType)
+			}
+		}
+	}
+	for _, message := range d.Messages {
+		for _, signal := range message.Signals {
+			if len(signal.Values) == 0 {
+				continue
+			}
+			raws := make([]int, 0, len(signal.Values))
+			for raw := range signal.Values {
+				raws = append(raws, raw)
+			}
+			sort.Ints(raws)
+			fmt.Fprintf(out, "VAL_ %d %s", dbcMessageID(message), signal.Name)
+			for _, raw := range raws {
+				fmt.Fprintf(out, " %d \"%s\"", raw, escapeDBCString(signal.Values[raw]))
+			}
+			fmt.Fprintln(out, " ;")
+		}
+	}
+	return out.Flush()
+}
+
+func dbcMessageID(message *DBCMessage) int64 {
+	if message.ID > 0x7ff {
+		return int64(message.ID) | extendedIDFlag
+	}
+	return int64(message.ID)
+}
+
+func dbcNode(node string) string {
+	if node == "" {
+		return "Vector__XXX"
+	}
+	return node
+}
+
+func formatDBCNumber(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// dbcDatatypes maps the length and value type of a signal to a datatype.
+// Integers are keyed by their length, with a negative length if signed
+var dbcDatatypes = map[[2]int]string{
+	{DBCInteger, 1}:   "bit",
+	{DBCInteger, 8}:   "uint8",
+	{DBCInteger, 16}:  "uint16",
+	{DBCInteger, 32}:  "uint32",
+	{DBCInteger, 64}:  "uint64",
+	{DBCInteger, -8}:  "int8",
+	{DBCInteger, -16}: "int16",
+	{DBCInteger, -32}: "int32",
+	{DBCInteger, -64}: "int64",
+	{DBCFloat32, 32}:  "float32",
+	{DBCFloat64, 64}:  "float64",
+}
+
+// datatypeSignal returns the DBC value type, length and signedness of a datatype
+func datatypeSignal(datatype string) (int, int, bool, bool) {
+	for key, name := range dbcDatatypes {
+		if name == datatype {
+			length := key[1]
+			if length < 0 {
+				return key[0], -length, true, true
+			}
+			return key[0], length, key[0] != DBCInteger, true
+		}
+	}
+	return 0, 0, false, false
+}
+
+// ImportDBC converts the signals of a DBC file into CAN configs. Signals that
+// can't be represented by a CAN config are skipped and returned as problems
+func ImportDBC(d *DBC) ([]*CanConfigType, []Problem) {
+	canConfigs := make([]*CanConfigType, 0)
+	problems := make([]Problem, 0)
+	for _, message := range d.Messages {
+		for _, signal := range message.Signals {
+			config, err := importDBCSignal(message, signal)
+			if err != nil {
+				problems = append(problems, Problem{
+					CanID:   message.ID,
+					Name:    signal.Name,
+					Message: err.Error(),
+				})
+				continue
+			}
+			canConfigs = append(canConfigs, config)
+		}
+	}
+	return canConfigs, problems
+}
+
+// importDBCSignal converts a signal into a CAN config. Whole bytes, words and
+// floats are read with the fixed size datatypes, single bits with bit and
+// anything else with bitfield
+func importDBCSignal(message *DBCMessage, signal *DBCSignal) (*CanConfigType, error) {
+	config := &CanConfigType{
+		CanID:       message.ID,
+		Name:        signal.Name,
+		Scale:       signal.Factor,
+		ValueOffset: signal.Offset,
+		Units:       signal.Unit,
+		CheckBounds: signal.Min < signal.Max,
+		MinValue:    signal.Min,
+		MaxValue:    signal.Max,
+		Description: signal.Comment,
+	}
+	if len(signal.Values) > 0 {
+		config.Values = signal.Values
+	}
+	switch match := muxValueRegex.FindStringSubmatch(signal.Multiplexer); {
+	case signal.Multiplexer == "":
+	case signal.Multiplexer == "M":
+		config.Multiplexer = true
+	case match != nil:
+		muxValue, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed multiplexer value %s", signal.Multiplexer)
+		}
+		config.MuxValue = &muxValue
+	default:
+		return nil, fmt.Errorf("extended multiplexing is not supported")
+	}
+	if signal.Length == 1 && signal.ValueType == DBCInteger {
+		config.Datatype = "bit"
+		config.Offset = signal.StartBit
+		return config, nil
+	}
+	if !signal.LittleEndian {
+		config.ByteOrder = BigEndian
+	}
+	// The start bit is the least significant bit of a little-endian signal and
+	// the most significant bit of a big-endian one, so a signal made up of whole
+	// bytes starts at either end of its first byte
+	byteAligned := (signal.LittleEndian && signal.StartBit%8 == 0) || (!signal.LittleEndian && signal.StartBit%8 == 7)
+	length := signal.Length
+	if signal.Signed && signal.ValueType == DBCInteger {
+		length = -length
+	}
+	datatype, ok := dbcDatatypes[[2]int{signal.ValueType, length}]
+	if ok && datatype != "bit" && byteAligned {
+		config.Datatype = datatype
+		config.Offset = signal.StartBit / 8
+		return config, nil
+	}
+	if signal.ValueType != DBCInteger {
+		return nil, fmt.Errorf("floats must be %d bits and start on a byte boundary", signal.Length)
+	}
+	config.Datatype = "bitfield"
+	config.BitStart = signal.StartBit
+	config.BitLength = signal.Length
+	config.Signed = signal.Signed
+	return config, nil
+}
+
+// ExportDBC converts CAN configs into a DBC file with a message for each CAN ID
+func ExportDBC(canConfigs []*CanConfigType) (*DBC, error) {
+	byID := make(map[int][]*CanConfigType)
+	for _, config := range canConfigs {
+		byID[config.CanID] = append(byID[config.CanID], config)
+	}
+	ids := make([]int, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	d := &DBC{}
+	for _, id := range ids {
+		message := &DBCMessage{
+			ID:   id,
+			Name: fmt.Sprintf("CAN_0x%X", id),
+			Size: payloadBits / 8,
+		}
+		for _, config := range byID[id] {
+			signal, err := exportDBCSignal(config)
+			if err != nil {
+				return nil, err
+			}
+			message.Signals = append(message.Signals, signal)
+		}
+		d.Messages = append(d.Messages, message)
+	}
+	return d, nil
+}
+
+func exportDBCSignal(config *CanConfigType) (*DBCSignal, error) {
+	signal := &DBCSignal{
+		Name:         config.Name,
+		LittleEndian: !config.BigEndian(),
+		Factor:       config.scale(),
+		Offset:       config.ValueOffset,
+		Unit:         config.Units,
+		Comment:      config.Description,
+		Values:       config.Values,
+	}
+	if config.Multiplexer {
+		signal.Multiplexer = "M"
+	} else if config.MuxValue != nil {
+		signal.Multiplexer = fmt.Sprintf("m%d", *config.MuxValue)
+	}
+	if config.CheckBounds {
+		signal.Min = config.MinValue
+		signal.Max = config.MaxValue
+	}
+	switch config.Datatype {
+	case "bitfield":
+		signal.StartBit = config.BitStart
+		signal.Length = config.BitLength
+		signal.Signed = config.Signed
+	case "bit":
+		signal.StartBit = config.Offset
+		signal.Length = 1
+		signal.LittleEndian = true
+	default:
+		valueType, length, signed, ok := datatypeSignal(config.Datatype)
+		if !ok {
+			return nil, fmt.Errorf("%s has unknown datatype %q", config.Name, config.Datatype)
+		}
+		signal.ValueType = valueType
+		signal.Length = length
+		signal.Signed = signed
+		signal.StartBit = config.Offset * 8
+		if config.BigEndian() {
+			signal.StartBit += 7
+		}
+	}
+	return signal, nil
+}
@@ -0,0 +1,174 @@
+package configs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDBC = `VERSION ""
+
+NS_ :
+	CM_
+	BA_DEF_
+	SIG_VALTYPE_
+
+BS_:
+
+BU_: BMS Dashboard
+
+BO_ 1 BMS_Status: 8 BMS
+ SG_ Trip_Status : 0|8@1+ (1,0) [0|10] "" Dashboard
+ SG_ Pack_Current : 32|32@1- (1,0) [-100|100] "A" Dashboard,Logger
+ SG_ Fan_On : 12|1@1+ (1,0) [0|0] "" Vector__XXX
+
+BO_ 2147484160 Pack_Voltage: 8 BMS
+ SG_ Pack_Voltage : 0|32@1- (1,0) [0|160] "V" Vector__XXX
+ SG_ Scaled_Temp : 39|16@0+ (0.1,-40) [-40|125] "degC" Vector__XXX
+
+BO_ 770 Cells: 8 BMS
+ SG_ Cell_Group M : 0|8@1+ (1,0) [0|0] "" Vector__XXX
+ SG_ Cell_1 m0 : 8|16@1+ (1,0) [0|0] "" Vector__XXX
+ SG_ Cell_2 m1 : 8|16@1+ (1,0) [0|0] "" Vector__XXX
+ SG_ Cell_Ext m1M : 24|8@1+ (1,0) [0|0] "" Vector__XXX
+ SG_ Cell_Odd : 36|12@1+ (1,0) [0|0] "" Vector__XXX
+
+BA_DEF_ BO_ "GenMsgCycleTime" INT 0 10000;
+CM_ BO_ 1 "Status of the BMS";
+CM_ SG_ 1 Trip_Status "Last cause of a BMS trip,
+see the BMS firmware for codes";
+CM_ SG_ 2147484160 Pack_Voltage "Voltage of the \"pack\"";
+SIG_VALTYPE_ 2147484160 Pack_Voltage : 1;
+VAL_TABLE_ Switch 1 "On" 0 "Off" ;
+VAL_ 1 Trip_Status 0 "OK" 1 "Over \"voltage\"" 2 "Under voltage" -1 "Unknown" ;
+`
+
+func TestParseDBC(t *testing.T) {
+	dbc, err := ParseDBC(strings.NewReader(testDBC))
+	assert.NoError(t, err)
+	if !assert.Len(t, dbc.Messages, 3) {
+		return
+	}
+	status := dbc.Messages[0]
+	assert.Equal(t, 1, status.ID)
+	assert.Equal(t, "BMS_Status", status.Name)
+	assert.Equal(t, "BMS", status.Transmitter)
+	assert.Equal(t, "Status of the BMS", status.Comment)
+	assert.Len(t, status.Signals, 3)
+	assert.Equal(t, &DBCSignal{
+		Name:         "Pack_Current",
+		StartBit:     32,
+		Length:       32,
+		LittleEndian: true,
+		Signed:       true,
+		Factor:       1,
+		Min:          -100,
+		Max:          100,
+		Unit:         "A",
+		Receivers:    []string{"Dashboard", "Logger"},
+	}, status.Signals[1])
+
+	voltage := dbc.Messages[1]
+	assert.Equal(t, 0x200, voltage.ID)
+	assert.Equal(t, DBCFloat32, voltage.Signals[0].ValueType)
+	assert.Equal(t, `Voltage of the "pack"`, voltage.Signals[0].Comment)
+	assert.Equal(t, 0.1, voltage.Signals[1].Factor)
+	assert.Equal(t, float64(-40), voltage.Signals[1].Offset)
+	assert.False(t, voltage.Signals[1].LittleEndian)
+	assert.Equal(t, "M", dbc.Messages[2].Signals[0].Multiplexer)
+	assert.Equal(t, "m0", dbc.Messages[2].Signals[1].Multiplexer)
+	assert.Equal(t, map[int]string{0: "OK", 1: `Over "voltage"`, 2: "Under voltage", -1: "Unknown"}, status.Signals[0].Values)
+
+	_, err = ParseDBC(strings.NewReader("BO_ 1 Broken: 8 BMS\n SG_ Broken : 0|8@1+ (1,0)\n"))
+	assert.Error(t, err)
+	_, err = ParseDBC(strings.NewReader("CM_ SG_ 1 Trip_Status \"never closed;\n"))
+	assert.Error(t, err)
+	_, err = ParseDBC(strings.NewReader("VAL_ 1 Trip_Status 0 OK ;\n"))
+	assert.Error(t, err)
+}
+
+func TestImportDBC(t *testing.T) {
+	dbc, err := ParseDBC(strings.NewReader(testDBC))
+	assert.NoError(t, err)
+	canConfigs, problems := ImportDBC(dbc)
+	assert.Equal(t, []*CanConfigType{
+		{CanID: 1, Datatype: "uint8", Name: "Trip_Status", Offset: 0, Scale: 1, CheckBounds: true, MinValue: 0, MaxValue: 10,
+			Values:      map[int]string{0: "OK", 1: `Over "voltage"`, 2: "Under voltage", -1: "Unknown"},
+			Description: "Last cause of a BMS trip,\nsee the BMS firmware for codes"},
+		{CanID: 1, Datatype: "int32", Name: "Pack_Current", Offset: 4, Scale: 1, Units: "A", CheckBounds: true, MinValue: -100, MaxValue: 100},
+		{CanID: 1, Datatype: "bit", Name: "Fan_On", Offset: 12, Scale: 1},
+		{CanID: 0x200, Datatype: "float32", Name: "Pack_Voltage", Offset: 0, Scale: 1, Units: "V", CheckBounds: true, MinValue: 0, MaxValue: 160,
+			Description: `Voltage of the "pack"`},
+		{CanID: 0x200, Datatype: "uint16", Name: "Scaled_Temp", Offset: 4, ByteOrder: BigEndian,
+			Scale: 0.1, ValueOffset: -40, Units: "degC", CheckBounds: true, MinValue: -40, MaxValue: 125},
+		{CanID: 770, Datatype: "uint8", Name: "Cell_Group", Offset: 0, Scale: 1, Multiplexer: true},
+		{CanID: 770, Datatype: "uint16", Name: "Cell_1", Offset: 1, Scale: 1, MuxValue: intPointer(0)},
+		{CanID: 770, Datatype: "uint16", Name: "Cell_2", Offset: 1, Scale: 1, MuxValue: intPointer(1)},
+		{CanID: 770, Datatype: "bitfield", Name: "Cell_Odd", BitStart: 36, BitLength: 12, Scale: 1},
+	}, canConfigs)
+	skipped := make([]string, len(problems))
+	for i, problem := range problems {
+		skipped[i] = problem.Name
+	}
+	assert.Equal(t, []string{"Cell_Ext"}, skipped)
+	assert.Empty(t, Validate(canConfigs))
+}
+
+func TestExportDBC(t *testing.T) {
+	canConfigs, err := ReadDir("can_configs")
+	assert.NoError(t, err)
+	dbc, err := ExportDBC(canConfigs)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, dbc.Write(&buf))
+
+	// Importing the exported configs gives back the same configs
+	parsed, err := ParseDBC(&buf)
+	assert.NoError(t, err)
+	imported, problems := ImportDBC(parsed)
+	assert.Empty(t, problems)
+	expected := make(map[string]CanConfigType)
+	for _, config := range canConfigs {
+		normalized := *config
+		normalized.file = ""
+		normalized.Scale = normalized.scale()
+		if !normalized.CheckBounds || normalized.MinValue >= normalized.MaxValue {
+			normalized.CheckBounds = false
+			normalized.MinValue = 0
+			normalized.MaxValue = 0
+		}
+		expected[config.Name] = normalized
+	}
+	assert.Len(t, imported, len(expected))
+	for _, config := range imported {
+		assert.Equal(t, expected[config.Name], *config)
+	}
+
+	_, err = ExportDBC([]*CanConfigType{{CanID: 1, Datatype: "uint24", Name: "Unknown"}})
+	assert.Error(t, err)
+
+	// Big-endian values and bitfields keep their layout
+	layouts := []*CanConfigType{
+		{CanID: 3, Datatype: "int16", Name: "Big_Word", Offset: 2, ByteOrder: BigEndian, Scale: 0.5, ValueOffset: 10, Units: "rpm"},
+		{CanID: 3, Datatype: "bitfield", Name: "Big_Field", BitStart: 39, BitLength: 12, ByteOrder: BigEndian, Scale: 1},
+		{CanID: 3, Datatype: "bitfield", Name: "Little_Field", BitStart: 52, BitLength: 5, Signed: true, Scale: 1},
+		{CanID: 4, Datatype: "uint8", Name: "Mode", Offset: 0, Scale: 1, Multiplexer: true, Values: map[int]string{0: "Idle", 1: "Drive"}},
+		{CanID: 4, Datatype: "int16", Name: "Idle_Current", Offset: 1, Scale: 1, MuxValue: intPointer(0)},
+		{CanID: 4, Datatype: "int16", Name: "Drive_Current", Offset: 1, Scale: 1, MuxValue: intPointer(1)},
+	}
+	dbc, err = ExportDBC(layouts)
+	assert.NoError(t, err)
+	buf.Reset()
+	assert.NoError(t, dbc.Write(&buf))
+	parsed, err = ParseDBC(&buf)
+	assert.NoError(t, err)
+	imported, problems = ImportDBC(parsed)
+	assert.Empty(t, problems)
+	assert.Equal(t, layouts, imported)
+}
+
+func intPointer(value int) *int {
+	return &value
+}
@@ -1,9 +1,17 @@
 package datatypes
 
 import (
+	"regexp"
 	"time"
 )
 
+var metricRegex = regexp.MustCompile("\\A[a-zA-Z0-9_-]+\\z")
+
+// ValidMetric returns whether the metric name is valid
+func ValidMetric(metric string) bool {
+	return metricRegex.MatchString(metric)
+}
+
 // Datapoint is a container for raw data from the car
 type Datapoint struct {
 	// Metric is the name of the metric type for this datapoint
@@ -0,0 +1,30 @@
+package datatypes
+
+// Tag keys stamped onto datapoints as they are ingested
+const (
+	// CarTag is the car the datapoint came from (e.g. SR-3)
+	CarTag = "car"
+	// SourceTag is how the datapoint reached the server
+	SourceTag = "source"
+	// ConnectionTag identifies the connection the datapoint arrived on
+	ConnectionTag = "connection"
+	// SessionTag is the test session the datapoint was recorded during
+	SessionTag = "session"
+	// SubscriberTag is the publisher subscriber a metric about a subscriber describes
+	SubscriberTag = "subscriber"
+	// ComputationTag is the computation a metric about a computation describes
+	ComputationTag = "computation"
+)
+
+// Values of SourceTag
+const (
+	SourceTCP         = "tcp"
+	SourceUDP         = "udp"
+	SourceUnix        = "unix"
+	SourceMerge       = "merge"
+	SourceCSV         = "csv"
+	SourceComputation = "computation"
+)
+
+// TagKeys lists the tag keys the server stamps onto datapoints
+var TagKeys = []string{CarTag, SourceTag, ConnectionTag, SessionTag, SubscriberTag, ComputationTag}
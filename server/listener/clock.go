@@ -0,0 +1,60 @@
+package listener
+
+import (
+	"time"
+)
+
+// clockWindow is how long the offset between a car's clock and the server's
+// is estimated over. It bounds how long the estimate takes to follow the car's
+// clock after it restarts
+const clockWindow = time.Minute
+
+// unixTimestampMin is the smallest car timestamp, in milliseconds, taken to be a
+// unix timestamp rather than the time since the car's clock started (2001-09-09)
+const unixTimestampMin = 1e12
+
+// clockEstimator estimates when packets stamped with the time since the car's
+// clock started were sent. Packets take at least as long as the quickest packet
+// to arrive, so the smallest difference between when packets arrived and their
+// timestamps is the best estimate of the offset between the clocks. Packets
+// replayed from buffers on the car arrive late, so they don't affect it
+type clockEstimator struct {
+	window time.Duration
+	// samples holds, in order of arrival, the offsets in the window that are
+	// smaller than every offset that arrived after them, so the first is the smallest
+	samples []clockSample
+}
+
+type clockSample struct {
+	received time.Time
+	offset   time.Duration
+}
+
+func newClockEstimator(window time.Duration) *clockEstimator {
+	return &clockEstimator{window: window}
+}
+
+// update adds a packet with a car timestamp, in milliseconds since the car's clock
+// started, that was received at the given time, and returns the estimated offset
+func (c *clockEstimator) update(carMillis uint64, received time.Time) time.Duration {
+	offset := received.Sub(time.Unix(0, 0)) - time.Duration(carMillis)*time.Millisecond
+	for len(c.samples) > 0 && c.samples[len(c.samples)-1].offset >= offset {
+		c.samples = c.samples[:len(c.samples)-1]
+	}
+	c.samples = append(c.samples, clockSample{received, offset})
+	for received.Sub(c.samples[0].received) > c.window {
+		c.samples = c.samples[1:]
+	}
+	return c.samples[0].offset
+}
+
+// carTime returns when a packet with the given car timestamp received at the
+// given time was sent, along with the estimated offset between the clocks.
+// Unix timestamps are used as they are, with no offset
+func (c *clockEstimator) carTime(carMillis uint64, received time.Time) (time.Time, time.Duration) {
+	if carMillis >= unixTimestampMin {
+		return time.Unix(0, int64(carMillis)*int64(time.Millisecond)), 0
+	}
+	offset := c.update(carMillis, received)
+	return time.Unix(0, 0).Add(time.Duration(carMillis)*time.Millisecond + offset), offset
+}
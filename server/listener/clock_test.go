@@ -0,0 +1,39 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockEstimator(t *testing.T) {
+	clock := newClockEstimator(time.Minute)
+	start := time.Unix(1600000000, 0)
+	offset := start.Sub(time.Unix(0, 0))
+	// The quickest packet sets the offset
+	sent, estimate := clock.carTime(0, start.Add(50*time.Millisecond))
+	assert.Equal(t, offset+50*time.Millisecond, estimate)
+	assert.Equal(t, start.Add(50*time.Millisecond), sent)
+	sent, estimate = clock.carTime(1000, start.Add(1010*time.Millisecond))
+	assert.Equal(t, offset+10*time.Millisecond, estimate)
+	assert.Equal(t, start.Add(1010*time.Millisecond), sent)
+	// Late packets, such as those replayed from a buffer, don't change it
+	sent, estimate = clock.carTime(2000, start.Add(30*time.Second))
+	assert.Equal(t, offset+10*time.Millisecond, estimate)
+	assert.Equal(t, start.Add(2010*time.Millisecond), sent)
+
+	// After the car's clock restarts, the estimate follows it once the
+	// offsets from before the restart leave the window
+	restart := start.Add(40 * time.Second)
+	_, estimate = clock.carTime(0, restart)
+	assert.Equal(t, offset+10*time.Millisecond, estimate)
+	sent, estimate = clock.carTime(55000, restart.Add(55*time.Second))
+	assert.Equal(t, restart.Sub(time.Unix(0, 0)), estimate)
+	assert.Equal(t, restart.Add(55*time.Second), sent)
+
+	// Unix timestamps are used as they are
+	sent, estimate = clock.carTime(1600000000123, restart)
+	assert.Equal(t, time.Duration(0), estimate)
+	assert.Equal(t, time.Unix(1600000000, 123e6), sent)
+}
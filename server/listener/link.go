@@ -0,0 +1,139 @@
+package listener
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"server/datatypes"
+)
+
+// linkReportInterval is how often the stats of each link are published
+const linkReportInterval = 5 * time.Second
+
+// Metrics published for each link, tagged with the link's tags
+const (
+	packetCountMetric       = "Packet_Count"
+	packetBytesMetric       = "Packet_Bytes"
+	packetParseErrorsMetric = "Packet_Parse_Errors"
+	packetOutOfBoundsMetric = "Packet_Out_Of_Bounds"
+	packetCRCFailuresMetric = "Packet_CRC_Failures"
+	packetGapsMetric        = "Packet_Gaps"
+	packetTruncatedMetric   = "Packet_Truncated"
+	packetLossMetric        = "Packet_Loss"
+	packetLatencyMetric     = "Packet_Latency"
+)
+
+// isLinkMetric returns whether the metric is one of the stats published for each link
+func isLinkMetric(metric string) bool {
+	switch metric {
+	case packetCountMetric, packetBytesMetric, packetParseErrorsMetric, packetOutOfBoundsMetric,
+		packetCRCFailuresMetric, packetGapsMetric, packetTruncatedMetric, packetLossMetric, packetLatencyMetric:
+		return true
+	}
+	return false
+}
+
+// link is a connection the car's data is received on
+type link struct {
+	tags   map[string]string
+	parser *PacketParser
+	since  time.Time
+}
+
+// links holds the *link of each open connection, keyed by connection
+var links sync.Map
+
+// registerLink starts reporting the stats of the parser for a connection.
+// It returns a function that stops reporting them once the connection closes
+func registerLink(connection string, tags map[string]string, parser *PacketParser) func() {
+	links.Store(connection, &link{
+		tags:   tags,
+		parser: parser,
+		since:  time.Now(),
+	})
+	return func() {
+		links.Delete(connection)
+	}
+}
+
+// Link describes the health of a connection the car's data is received on
+type Link struct {
+	Connection string            `json:"connection"`
+	Tags       map[string]string `json:"tags"`
+	Since      time.Time         `json:"since"`
+	LinkStats
+	// Loss is the fraction of framed packets that never arrived, judging by
+	// the gaps in their sequence numbers
+	Loss float64 `json:"loss"`
+}
+
+// Links returns the health of each open connection, sorted by connection
+func Links() []Link {
+	result := make([]Link, 0)
+	links.Range(func(key, value interface{}) bool {
+		l := value.(*link)
+		stats := l.parser.Stats()
+		result = append(result, Link{
+			Connection: key.(string),
+			Tags:       l.tags,
+			Since:      l.since,
+			LinkStats:  stats,
+			Loss:       loss(stats),
+		})
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Connection < result[j].Connection
+	})
+	return result
+}
+
+func loss(stats LinkStats) float64 {
+	if stats.Gaps == 0 {
+		return 0
+	}
+	return float64(stats.Gaps) / float64(stats.Gaps+stats.Packets)
+}
+
+// reportLinks periodically publishes the stats of each open connection until ctx is done
+func reportLinks(ctx context.Context, publisher *DatapointPublisher) {
+	ticker := time.NewTicker(linkReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		publishLinks(publisher, time.Now())
+	}
+}
+
+func publishLinks(publisher *DatapointPublisher, now time.Time) {
+	for _, l := range Links() {
+		values := map[string]float64{
+			packetCountMetric:       float64(l.Packets),
+			packetBytesMetric:       float64(l.Bytes),
+			packetParseErrorsMetric: float64(l.ParseErrors),
+			packetOutOfBoundsMetric: float64(l.OutOfBounds),
+			packetCRCFailuresMetric: float64(l.CRCFailures),
+			packetGapsMetric:        float64(l.Gaps),
+			packetTruncatedMetric:   float64(l.Truncated),
+			packetLossMetric:        l.Loss,
+		}
+		if l.Timestamped > 0 {
+			values[packetLatencyMetric] = l.LatencyMillis
+		}
+		for metric, value := range values {
+			point := &datatypes.Datapoint{
+				Metric: metric,
+				Value:  value,
+				Time:   now,
+			}
+			tagPoint(point, l.Tags)
+			publisher.Publish(point)
+		}
+	}
+}
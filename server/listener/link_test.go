@@ -0,0 +1,71 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"server/configs"
+	"server/datatypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishLinks(t *testing.T) {
+	parser := NewPacketParser(map[int][]*configs.CanConfigType{
+		1: {
+			{CanID: 1, Datatype: "uint8", Name: "Bounded", Offset: 0, CheckBounds: true, MinValue: 0, MaxValue: 10},
+			{CanID: 1, Datatype: "float32", Name: "Invalid", Offset: 4},
+		},
+	})
+	for _, sequence := range []uint16{1, 2, 5} {
+		frame, err := EncodeFrame(sequence, 1, []byte{20, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF})
+		assert.NoError(t, err)
+		for _, b := range frame {
+			if parser.ParseByte(b) {
+				assert.Empty(t, parser.ParsePacket())
+			}
+		}
+	}
+	defer registerLink("Link_Test", map[string]string{datatypes.CarTag: "SR-3", datatypes.ConnectionTag: "Link_Test"}, parser)()
+
+	var link *Link
+	for _, l := range Links() {
+		if l.Connection == "Link_Test" {
+			l := l
+			link = &l
+		}
+	}
+	if !assert.NotNil(t, link) {
+		return
+	}
+	assert.Equal(t, LinkStats{Packets: 3, Bytes: 60, ParseErrors: 3, OutOfBounds: 3, Gaps: 2}, link.LinkStats)
+	assert.Equal(t, 0.4, link.Loss)
+
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 100)
+	assert.NoError(t, publisher.Subscribe(c))
+	now := time.Now()
+	publishLinks(publisher, now)
+	time.Sleep(100 * time.Millisecond)
+	values := make(map[string]float64)
+	for len(c) > 0 {
+		point := <-c
+		if point.Tags[datatypes.ConnectionTag] != "Link_Test" {
+			continue
+		}
+		assert.Equal(t, "SR-3", point.Tags[datatypes.CarTag])
+		assert.Equal(t, now, point.Time)
+		values[point.Metric] = point.Value
+	}
+	assert.Equal(t, map[string]float64{
+		packetCountMetric:       3,
+		packetBytesMetric:       60,
+		packetParseErrorsMetric: 3,
+		packetOutOfBoundsMetric: 3,
+		packetCRCFailuresMetric: 0,
+		packetGapsMetric:        2,
+		packetTruncatedMetric:   0,
+		packetLossMetric:        0.4,
+	}, values)
+}
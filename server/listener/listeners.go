@@ -0,0 +1,251 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"server/configs"
+	"server/datatypes"
+	"server/settings"
+	"server/storage"
+)
+
+// Transports a listener can receive car data over
+const (
+	TransportTCP  = "tcp"
+	TransportUDP  = "udp"
+	TransportUnix = "unix"
+)
+
+// transportSources are the values of the source tag for each transport
+var transportSources = map[string]string{
+	TransportTCP:  datatypes.SourceTCP,
+	TransportUDP:  datatypes.SourceUDP,
+	TransportUnix: datatypes.SourceUnix,
+}
+
+const (
+	// maxAcceptFailures is how many connections in a row may fail to be
+	// accepted before a stream listener is restarted
+	maxAcceptFailures = 5
+	// acceptRetryDelay is how long a stream listener waits after failing to
+	// accept a connection before trying again
+	acceptRetryDelay = 100 * time.Millisecond
+	// minRestartDelay and maxRestartDelay bound how long a failed listener
+	// waits before restarting. The delay doubles with each failure in a row
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// configWatchInterval is how often the CAN config directories of the
+	// listeners with their own configs are checked for changes
+	configWatchInterval = 2 * time.Second
+)
+
+// Listen starts each of the given listeners, restarting any that fail, until ctx is
+// done. Datapoints received are tagged as coming from the listener's car, or the
+// given car if it has none, and with the listener's name as their connection. Listeners without their own CAN config directory use
+// the default set of configs. The number of active connections is periodically
+// reported to store. The returned channel is closed once every listener and its
+// connections have been closed after ctx is done. An error is returned, and nothing
+// is started, if a listener is invalid or its CAN configs can't be loaded
+func Listen(ctx context.Context, store storage.Storage, listeners []settings.Listener, car string) (<-chan struct{}, error) {
+	sets := make(map[string]*configs.Set)
+	for _, l := range listeners {
+		if _, ok := transportSources[l.Transport]; !ok {
+			return nil, fmt.Errorf("Unknown transport %q for listener on %s", l.Transport, l.Address)
+		}
+		if l.Address == "" {
+			return nil, fmt.Errorf("Missing address for %s listener", l.Transport)
+		}
+		if _, ok := sets[l.CANConfigDir]; ok {
+			continue
+		}
+		set := configs.Default()
+		if l.CANConfigDir != "" {
+			set = configs.NewSet(l.CANConfigDir)
+		}
+		_, err := set.Load()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading CAN configs for %s listener on %s: %s", l.Transport, l.Address, err)
+		}
+		sets[l.CANConfigDir] = set
+	}
+	go reportConnections(ctx, store)
+	go reportLinks(ctx, GetDatapointPublisher())
+	go reportPublisher(ctx, GetDatapointPublisher())
+	go writerThread(ctx)
+	go monitorConnection(ctx)
+	for dir, set := range sets {
+		if dir != "" {
+			go set.Watch(configWatchInterval, ctx.Done())
+		}
+	}
+	var running sync.WaitGroup
+	for _, l := range listeners {
+		if l.Car == "" {
+			l.Car = car
+		}
+		if l.Name == "" {
+			l.Name = l.Address
+		}
+		running.Add(1)
+		go func(l settings.Listener) {
+			defer running.Done()
+			runListener(ctx, l, sets[l.CANConfigDir])
+		}(l)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+	return stopped, nil
+}
+
+// runListener serves l until ctx is done, restarting it whenever it fails
+func runListener(ctx context.Context, l settings.Listener, set *configs.Set) {
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		err := serve(ctx, l, set)
+		if ctx.Err() != nil {
+			return
+		}
+		// A listener that ran for a while before failing starts backing off afresh
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		log.Printf("%s listener on %s failed, restarting in %s: %s\n", l.Transport, l.Address, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// serve listens on l until it fails or ctx is done, parsing the packets
+// received with the configs in set
+func serve(ctx context.Context, l settings.Listener, set *configs.Set) error {
+	tags := map[string]string{
+		datatypes.CarTag:        l.Car,
+		datatypes.SourceTag:     transportSources[l.Transport],
+		datatypes.ConnectionTag: l.Name,
+	}
+	newParser := func() *PacketParser {
+		return NewSetPacketParser(set)
+	}
+	if l.Transport == TransportUDP {
+		return serveUDP(ctx, l.Address, tags, newParser)
+	}
+	return serveStream(ctx, l.Transport, l.Address, tags, newParser)
+}
+
+// serveStream accepts TCP or Unix socket connections on address, handling
+// each in its own goroutine. Once ctx is done the open connections are closed
+// and it returns when their handlers have finished
+func serveStream(ctx context.Context, transport string, address string, tags map[string]string, newParser func() *PacketParser) error {
+	if transport == TransportUnix {
+		// A socket left behind by a server that didn't shut down cleanly
+		// would stop the listener from starting
+		info, err := os.Lstat(address)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	connListener, err := net.Listen(transport, address)
+	if err != nil {
+		return err
+	}
+	defer connListener.Close()
+	stop := closeOnDone(connListener, ctx.Done())
+	defer close(stop)
+	log.Printf("Listening on %s %s\n", address, transport)
+	var handlers sync.WaitGroup
+	consecutiveFailures := 0
+	for {
+		conn, err := connListener.Accept()
+		if err == nil {
+			consecutiveFailures = 0
+			log.Println("Received connection from", conn.RemoteAddr().String())
+			handler := NewTCPConnectionHandler(GetDatapointPublisher(), newParser())
+			handler.Tags = tags
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				stop := closeOnDone(conn, ctx.Done())
+				defer close(stop)
+				handler.HandleTCPConnection(conn)
+			}()
+			continue
+		}
+		if ctx.Err() != nil {
+			handlers.Wait()
+			return nil
+		}
+		consecutiveFailures++
+		log.Printf("Error accepting connection on %s: %s\n", address, err)
+		if consecutiveFailures >= maxAcceptFailures {
+			connListener.Close()
+			handlers.Wait()
+			return fmt.Errorf("%d consecutive connection failures", consecutiveFailures)
+		}
+		select {
+		case <-time.After(acceptRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// serveUDP reads datagrams sent to address until ctx is done
+// This code runs in a single goroutine since UDP is connectionless
+func serveUDP(ctx context.Context, address string, tags map[string]string, newParser func() *PacketParser) error {
+	conn, err := net.ListenPacket(TransportUDP, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := closeOnDone(conn, ctx.Done())
+	defer close(stop)
+	log.Printf("Listening on %s %s\n", address, TransportUDP)
+
+	// initialize the UDP handler to handle all UDP packets
+	handler := NewUDPHandler(GetDatapointPublisher(), newParser)
+	handler.Tags = tags
+	defer handler.Close()
+
+	message := make([]byte, maxDatagramSize)
+	for {
+		rlen, addr, err := conn.ReadFrom(message)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		handler.HandleDatagram(addr.String(), message[:rlen], time.Now())
+	}
+}
+
+// closeOnDone closes c when done is closed, unblocking anything waiting on it.
+// It stops waiting once the returned channel is closed
+func closeOnDone(c io.Closer, done <-chan struct{}) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,133 @@
+package listener
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"server/configs"
+	"server/datatypes"
+	"server/settings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddress returns a local address nothing is listening on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// dial connects to address, retrying while the listener starts up
+func dial(transport string, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 30; i++ {
+		conn, err = net.Dial(transport, address)
+		if err == nil {
+			return conn, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, "test_config.json"), []byte(`[{"can_id": 256, "datatype": "uint8", "name": "Listener_Test", "offset": 0}]`), 0644)
+	assert.NoError(t, err)
+	set := configs.NewSet(dir)
+	_, err = set.Load()
+	assert.NoError(t, err)
+
+	points := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, Subscribe(points, "Listener_Test"))
+	defer Unsubscribe(points)
+
+	socket := path.Join(dir, "telemetry.sock")
+	// A socket left behind by an earlier server is replaced
+	stale, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners := []settings.Listener{
+		{Transport: TransportTCP, Address: freeAddress(t), Car: "SR-3", Name: "Radio"},
+		{Transport: TransportUDP, Address: freeAddress(t), Car: "SR-2"},
+		{Transport: TransportUnix, Address: socket, Car: "SR-1"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{}, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			runListener(ctx, l, set)
+			finished <- struct{}{}
+		}()
+	}
+	for i, l := range listeners {
+		conn, err := dial(l.Transport, l.Address)
+		if !assert.NoError(t, err, l.Transport) {
+			continue
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte{'G', 'T', 0x00, 0x01, byte(i), 0, 0, 0, 0, 0, 0, 0})
+		assert.NoError(t, err)
+		select {
+		case point := <-points:
+			assert.Equal(t, float64(i), point.Value)
+			assert.Equal(t, l.Car, point.Tags[datatypes.CarTag])
+			assert.Equal(t, transportSources[l.Transport], point.Tags[datatypes.SourceTag])
+			assert.Equal(t, l.Name, point.Tags[datatypes.ConnectionTag])
+		case <-time.After(time.Second):
+			t.Errorf("No point received over %s", l.Transport)
+		}
+	}
+
+	// Cancelling the context stops every listener and closes their connections
+	cancel()
+	for range listeners {
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatal("Listener didn't stop")
+		}
+	}
+	_, err = net.Dial(TransportTCP, listeners[0].Address)
+	assert.Error(t, err)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunListenerRestarts(t *testing.T) {
+	address := freeAddress(t)
+	blocker, err := net.Listen("tcp", address)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runListener(ctx, settings.Listener{Transport: TransportTCP, Address: address}, configs.NewSet(""))
+	// The listener can't start until the address is free, then restarts
+	time.Sleep(100 * time.Millisecond)
+	blocker.Close()
+	conn, err := dial(TransportTCP, address)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func TestListenInvalid(t *testing.T) {
+	_, err := Listen(context.Background(), nil, []settings.Listener{{Transport: "sctp", Address: "0.0.0.0:6001"}}, "SR-3")
+	assert.Error(t, err)
+	_, err = Listen(context.Background(), nil, []settings.Listener{{Transport: TransportTCP}}, "SR-3")
+	assert.Error(t, err)
+	_, err = Listen(context.Background(), nil, []settings.Listener{{Transport: TransportTCP, Address: "0.0.0.0:6001", CANConfigDir: "missing"}}, "SR-3")
+	assert.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package listener
 
 import (
+	"context"
 	"log"
 	"server/datatypes"
 	"time"
@@ -9,21 +10,25 @@ import (
 const connStatusMetric = "Connection_Status"
 
 // monitorConnection listens for data from the car, posting updates
-// to Slack for when connection is established and lost.
-func monitorConnection() {
+// to Slack for when connection is established and lost, until ctx is done.
+func monitorConnection(ctx context.Context) {
 	p := GetDatapointPublisher()
 	points := make(chan *datatypes.Datapoint, 1000)
-	err := Subscribe(points)
+	err := SubscribeWith(points, SubscribeOptions{Name: "connection monitor"})
 	if err != nil {
 		log.Fatalf("Error subscribing to publisher: %v", err)
 	}
+	defer Unsubscribe(points)
 	connected := false
 	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
 	receivedPoint := false
 	for {
 		select {
 		case point := <-points:
-			if point.Metric == connStatusMetric {
+			// Only data parsed from the car counts, not the metrics the server publishes about it
+			source := point.Tags[datatypes.SourceTag]
+			if (source != datatypes.SourceTCP && source != datatypes.SourceUDP && source != datatypes.SourceUnix) || isLinkMetric(point.Metric) {
 				continue
 			}
 			receivedPoint = true
@@ -46,6 +51,8 @@ func monitorConnection() {
 				connected = false
 			}
 			receivedPoint = false
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -3,8 +3,10 @@ package listener
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"math"
+	"sync/atomic"
 	"time"
 
 	"server/configs"
@@ -14,8 +16,31 @@ import (
 const (
 	idle          ReceiverState = 0
 	preambleRecvd ReceiverState = 1
+	framedRecvd   ReceiverState = 2
 )
 
+// Framed packets start with "GF", a version byte, the length of the body and a
+// little-endian uint16 sequence number, followed by the body and a little-endian
+// CRC32 (IEEE) of everything before it. The body is a little-endian uint16 CAN ID
+// and up to 8 bytes of payload. Version 2 frames also carry a little-endian uint64
+// timestamp after the sequence number, in milliseconds since the unix epoch or
+// since the car's clock started. Legacy packets are "GT", the CAN ID and an 8
+// byte payload, with no integrity check
+const (
+	// FrameVersion is the version of framed packets without a timestamp
+	FrameVersion = 1
+	// TimestampedFrameVersion is the version of framed packets with a timestamp
+	TimestampedFrameVersion = 2
+	frameHeaderLength       = 6
+	timestampLength         = 8
+	frameCRCLength          = 4
+	minFrameBody            = 2
+	maxFrameBody            = 10
+)
+
+// latencyWeight is the weight of each new latency in the moving average
+const latencyWeight = 0.1
+
 // ReceiverState is the enumerated type for receiver state
 type ReceiverState int
 
@@ -26,6 +51,58 @@ type PacketParser struct {
 	PreambleBuffer []byte
 	Offset         int
 	CANConfigs     map[int][]*configs.CanConfigType
+	// FrameBuffer holds the framed packet being received
+	FrameBuffer []byte
+	// Sequence is the sequence number of the last framed packet received
+	Sequence uint16
+	// configSet, if set, parses each packet with its current CAN configs instead of CANConfigs
+	configSet *configs.Set
+	// sequenced is set once a framed packet has been received, so Sequence
+	// can be used to find gaps
+	sequenced bool
+	// stats is updated atomically, since it is read by other goroutines
+	stats LinkStats
+	// latency and clockOffset hold the float64 bits of the latency and clock
+	// offset in stats, so they can be updated atomically too
+	latency     uint64
+	clockOffset uint64
+	// clock estimates when timestamped packets were sent
+	clock *clockEstimator
+	// packetTime is when the current packet was sent, or zero if it wasn't timestamped
+	packetTime time.Time
+	// pending holds the bytes of a bad frame after its first, which are parsed
+	// again in case the next packet started among them
+	pending []byte
+}
+
+// LinkStats counts what a parser has received
+type LinkStats struct {
+	// Packets is the number of complete packets received
+	Packets uint64 `json:"packets"`
+	// Bytes is the number of bytes received, including those of dropped packets
+	Bytes uint64 `json:"bytes"`
+	// ParseErrors is the number of values that could not be parsed
+	ParseErrors uint64 `json:"parse_errors"`
+	// OutOfBounds is the number of values dropped by their config's bounds
+	OutOfBounds uint64 `json:"out_of_bounds"`
+	// CRCFailures is the number of framed packets dropped because their CRC didn't match
+	CRCFailures uint64 `json:"crc_failures"`
+	// BadFrames is the number of framed packets dropped because of an
+	// unsupported version or invalid length
+	BadFrames uint64 `json:"bad_frames"`
+	// Gaps is the number of framed packets missing from the sequence numbers received
+	Gaps uint64 `json:"gaps"`
+	// Truncated is the number of packets cut off by the end of a UDP datagram
+	Truncated uint64 `json:"truncated"`
+	// Timestamped is the number of packets received with a car timestamp
+	Timestamped uint64 `json:"timestamped"`
+	// LatencyMillis is the moving average of the time timestamped packets took
+	// to arrive. For timestamps since the car's clock started, it is the time
+	// they took beyond the quickest packet
+	LatencyMillis float64 `json:"latency_ms"`
+	// ClockOffsetMillis is the estimated offset from the car's clock to the
+	// unix epoch, if its timestamps aren't unix timestamps
+	ClockOffsetMillis float64 `json:"clock_offset_ms"`
 }
 
 // NewPacketParser returns a new PacketParser with the standard implementation
@@ -35,15 +112,135 @@ func NewPacketParser(canConfigs map[int][]*configs.CanConfigType) *PacketParser
 		PacketBuffer:   make([]byte, 12),
 		PreambleBuffer: make([]byte, 0),
 		CANConfigs:     canConfigs,
+		FrameBuffer:    make([]byte, 0, frameHeaderLength+timestampLength+maxFrameBody+frameCRCLength),
+		clock:          newClockEstimator(clockWindow),
 	}
 }
 
+// NewReloadingPacketParser returns a new PacketParser that parses each packet
+// with the current CAN configs, so that it picks up configs reloaded from disk
+func NewReloadingPacketParser() *PacketParser {
+	return NewSetPacketParser(configs.Default())
+}
+
+// NewSetPacketParser returns a new PacketParser that parses each packet with
+// the current CAN configs of the set
+func NewSetPacketParser(set *configs.Set) *PacketParser {
+	p := NewPacketParser(nil)
+	p.configSet = set
+	return p
+}
+
+// Stats returns what the parser has received so far
+func (p *PacketParser) Stats() LinkStats {
+	return LinkStats{
+		Packets:     atomic.LoadUint64(&p.stats.Packets),
+		Bytes:       atomic.LoadUint64(&p.stats.Bytes),
+		ParseErrors: atomic.LoadUint64(&p.stats.ParseErrors),
+		OutOfBounds: atomic.LoadUint64(&p.stats.OutOfBounds),
+		CRCFailures: atomic.LoadUint64(&p.stats.CRCFailures),
+		BadFrames:   atomic.LoadUint64(&p.stats.BadFrames),
+		Gaps:        atomic.LoadUint64(&p.stats.Gaps),
+		Truncated:   atomic.LoadUint64(&p.stats.Truncated),
+		Timestamped: atomic.LoadUint64(&p.stats.Timestamped),
+
+		LatencyMillis:     math.Float64frombits(atomic.LoadUint64(&p.latency)),
+		ClockOffsetMillis: math.Float64frombits(atomic.LoadUint64(&p.clockOffset)),
+	}
+}
+
+// EncodeFrame returns a framed packet carrying payload for the CAN ID
+func EncodeFrame(sequence uint16, canID uint16, payload []byte) ([]byte, error) {
+	return encodeFrame(FrameVersion, sequence, nil, canID, payload)
+}
+
+// EncodeTimestampedFrame returns a framed packet carrying payload for the CAN ID,
+// stamped with a time in milliseconds since the unix epoch or the car's clock started
+func EncodeTimestampedFrame(sequence uint16, carMillis uint64, canID uint16, payload []byte) ([]byte, error) {
+	timestamp := make([]byte, timestampLength)
+	binary.LittleEndian.PutUint64(timestamp, carMillis)
+	return encodeFrame(TimestampedFrameVersion, sequence, timestamp, canID, payload)
+}
+
+func encodeFrame(version byte, sequence uint16, timestamp []byte, canID uint16, payload []byte) ([]byte, error) {
+	if len(payload) > maxFrameBody-minFrameBody {
+		return nil, fmt.Errorf("payload of %d bytes is longer than %d bytes", len(payload), maxFrameBody-minFrameBody)
+	}
+	frame := []byte{'G', 'F', version, byte(minFrameBody + len(payload)), 0, 0}
+	binary.LittleEndian.PutUint16(frame[4:6], sequence)
+	frame = append(frame, timestamp...)
+	frame = append(frame, 0, 0)
+	binary.LittleEndian.PutUint16(frame[len(frame)-2:], canID)
+	frame = append(frame, payload...)
+	crc := make([]byte, frameCRCLength)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(frame))
+	return append(frame, crc...), nil
+}
+
+// frameHeader returns the length of the header of a framed packet of the
+// given version, or false if the version isn't supported
+func frameHeader(version byte) (int, bool) {
+	switch version {
+	case FrameVersion:
+		return frameHeaderLength, true
+	case TimestampedFrameVersion:
+		return frameHeaderLength + timestampLength, true
+	}
+	return 0, false
+}
+
 // payloadParsers maps datatype strings to methods to parse a value in bytes at a given offset
 var payloadParsers map[string]func([]byte, int) (float64, error)
 
+// Truncate discards any packet partly received, counting it as truncated.
+// It is used when a packet can't continue, such as at the end of a UDP datagram
+func (p *PacketParser) Truncate() {
+	partial := p.State != idle || (len(p.PreambleBuffer) > 0 && p.PreambleBuffer[0] == 'G')
+	p.State = idle
+	p.PreambleBuffer = p.PreambleBuffer[:0]
+	p.FrameBuffer = p.FrameBuffer[:0]
+	p.pending = nil
+	if partial {
+		atomic.AddUint64(&p.stats.Truncated, 1)
+	}
+}
+
 // ParseByte maintains the parser state machine, parsing one byte at a time
-// It returns true when the full packet has been received
+// It returns true when the full packet has been received. Framed packets
+// that fail their CRC check or have a bad header are counted and dropped, and
+// the parser resyncs on the next packet starting after their first byte
 func (p *PacketParser) ParseByte(value byte) bool {
+	atomic.AddUint64(&p.stats.Bytes, 1)
+	if len(p.pending) > 0 {
+		p.pending = append(p.pending, value)
+		return p.parsePending()
+	}
+	return p.parseByte(value) || p.parsePending()
+}
+
+// parsePending parses the bytes of a bad frame left to be parsed again until
+// a packet is complete
+func (p *PacketParser) parsePending() bool {
+	for len(p.pending) > 0 {
+		value := p.pending[0]
+		p.pending = p.pending[1:]
+		if p.parseByte(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// resync drops the first byte of the bad frame in FrameBuffer and queues the
+// rest to be parsed again, since its length may have been corrupted and the
+// next packet may have started within it
+func (p *PacketParser) resync() {
+	p.State = idle
+	p.pending = append(append([]byte{}, p.FrameBuffer[1:]...), p.pending...)
+	p.FrameBuffer = p.FrameBuffer[:0]
+}
+
+func (p *PacketParser) parseByte(value byte) bool {
 	switch p.State {
 	case idle:
 		// append the value into the PreambleBuffer
@@ -53,6 +250,10 @@ func (p *PacketParser) ParseByte(value byte) bool {
 				p.State = preambleRecvd
 				p.Offset = 2 // Preamble offset
 				p.PreambleBuffer = make([]byte, 0)
+			} else if p.PreambleBuffer[0] == 'G' && p.PreambleBuffer[1] == 'F' {
+				p.State = framedRecvd
+				p.FrameBuffer = append(p.FrameBuffer[:0], p.PreambleBuffer...)
+				p.PreambleBuffer = make([]byte, 0)
 			} else {
 				// pop off the first element of preamble buffer, continue waiting.
 				p.PreambleBuffer = p.PreambleBuffer[1:]
@@ -63,8 +264,29 @@ func (p *PacketParser) ParseByte(value byte) bool {
 		p.Offset++
 		if p.Offset >= len(p.PacketBuffer) {
 			p.State = idle
+			p.packetTime = time.Time{}
+			atomic.AddUint64(&p.stats.Packets, 1)
 			return true
 		}
+	case framedRecvd:
+		p.FrameBuffer = append(p.FrameBuffer, value)
+		if len(p.FrameBuffer) < 4 {
+			return false
+		}
+		headerLength, ok := frameHeader(p.FrameBuffer[2])
+		bodyLength := int(p.FrameBuffer[3])
+		if !ok || bodyLength < minFrameBody || bodyLength > maxFrameBody {
+			atomic.AddUint64(&p.stats.BadFrames, 1)
+			p.resync()
+			return false
+		}
+		if len(p.FrameBuffer) == headerLength+bodyLength+frameCRCLength {
+			p.State = idle
+			if p.acceptFrame(headerLength, time.Now()) {
+				return true
+			}
+			p.resync()
+		}
 	default:
 		log.Println("Unrecognized packet parser state: ", p.State)
 		p.State = idle
@@ -74,35 +296,181 @@ func (p *PacketParser) ParseByte(value byte) bool {
 	return false
 }
 
+// acceptFrame checks the CRC of the framed packet in FrameBuffer, received
+// at the given time, and copies its CAN ID and payload into PacketBuffer,
+// padding the payload with zeros
+func (p *PacketParser) acceptFrame(headerLength int, received time.Time) bool {
+	crcStart := len(p.FrameBuffer) - frameCRCLength
+	if crc32.ChecksumIEEE(p.FrameBuffer[:crcStart]) != binary.LittleEndian.Uint32(p.FrameBuffer[crcStart:]) {
+		atomic.AddUint64(&p.stats.CRCFailures, 1)
+		return false
+	}
+	sequence := binary.LittleEndian.Uint16(p.FrameBuffer[4:6])
+	// A sequence number behind the last one is a repeated or reordered
+	// packet, or the sender restarting, rather than a gap
+	if gap := sequence - p.Sequence - 1; p.sequenced && gap < 1<<15 {
+		atomic.AddUint64(&p.stats.Gaps, uint64(gap))
+	}
+	p.Sequence = sequence
+	p.sequenced = true
+	atomic.AddUint64(&p.stats.Packets, 1)
+	p.packetTime = time.Time{}
+	if headerLength > frameHeaderLength {
+		p.stampPacket(binary.LittleEndian.Uint64(p.FrameBuffer[frameHeaderLength:headerLength]), received)
+	}
+	n := copy(p.PacketBuffer[2:], p.FrameBuffer[headerLength:crcStart])
+	for i := 2 + n; i < len(p.PacketBuffer); i++ {
+		p.PacketBuffer[i] = 0
+	}
+	return true
+}
+
+// stampPacket sets when the current packet was sent from its car timestamp
+// and updates the latency and clock offset of the link
+func (p *PacketParser) stampPacket(carMillis uint64, received time.Time) {
+	sent, offset := p.clock.carTime(carMillis, received)
+	p.packetTime = sent
+	latency := float64(received.Sub(sent)) / float64(time.Millisecond)
+	if timestamped := atomic.AddUint64(&p.stats.Timestamped, 1); timestamped > 1 {
+		previous := math.Float64frombits(atomic.LoadUint64(&p.latency))
+		latency = previous + latencyWeight*(latency-previous)
+	}
+	atomic.StoreUint64(&p.latency, math.Float64bits(latency))
+	atomic.StoreUint64(&p.clockOffset, math.Float64bits(float64(offset)/float64(time.Millisecond)))
+}
+
 // ParsePacket returns the datapoint parsed from the current packet saved within the parser
 func (p *PacketParser) ParsePacket() []*datatypes.Datapoint {
 	canID := int(binary.LittleEndian.Uint16(p.PacketBuffer[2:4]))
-	canConfigs := p.CANConfigs[canID]
+	canConfigMap := p.CANConfigs
+	if p.configSet != nil {
+		canConfigMap = p.configSet.Current()
+	}
+	canConfigs := canConfigMap[canID]
+	muxValue, muxOK := parseMux(p.PacketBuffer[4:], canConfigs)
+	// Timestamped packets are stamped with when the car sent them, and the
+	// rest with when they were parsed
+	packetTime := p.packetTime
+	if packetTime.IsZero() {
+		packetTime = time.Now()
+	}
 	points := make([]*datatypes.Datapoint, 0)
 	for _, config := range canConfigs {
+		if config.MuxValue != nil && (!muxOK || *config.MuxValue != muxValue) {
+			continue
+		}
 		point := &datatypes.Datapoint{
 			Metric: config.Name,
-			Time:   time.Now(),
-		}
-		converter, ok := payloadParsers[config.Datatype]
-		if !ok {
-			log.Println("Unrecognized datatype: " + config.Datatype)
-			continue
+			Time:   packetTime,
 		}
-		value, err := converter(p.PacketBuffer[4:], config.Offset)
+		value, err := parseValue(p.PacketBuffer[4:], config)
 		if err != nil {
+			atomic.AddUint64(&p.stats.ParseErrors, 1)
 			log.Printf("Error parsing %s from CAN id 0x%x at offset %d: %s\n", config.Datatype, config.CanID, config.Offset, err)
 			continue
 		}
-		point.Value = value
-		if !config.CheckBounds || (config.MinValue <= point.Value && config.MaxValue >= point.Value) {
-			points = append(points, point)
+		point.Value = config.Physical(value)
+		if config.CheckBounds && (config.MinValue > point.Value || config.MaxValue < point.Value) {
+			atomic.AddUint64(&p.stats.OutOfBounds, 1)
+			continue
 		}
+		points = append(points, point)
 	}
 	return points
 }
 
+// parseMux returns the raw value of the multiplexer signal among canConfigs,
+// or false if there is none or it can't be parsed
+func parseMux(payload []byte, canConfigs []*configs.CanConfigType) (int, bool) {
+	for _, config := range canConfigs {
+		if !config.Multiplexer {
+			continue
+		}
+		value, err := parseValue(payload, config)
+		if err != nil {
+			return 0, false
+		}
+		return int(value), true
+	}
+	return 0, false
+}
+
+// bigEndianParsers maps multi-byte datatype strings to methods to parse a big-endian value in bytes at a given offset
+var bigEndianParsers map[string]func([]byte, int) (float64, error)
+
+// parseValue returns the raw value of the signal described by config in payload.
+// The configs given to NewPacketParser aren't validated, so signals reaching
+// outside of the payload are errors rather than read
+func parseValue(payload []byte, config *configs.CanConfigType) (float64, error) {
+	bits, ok := config.Bits()
+	if !ok {
+		return 0, fmt.Errorf("unrecognized datatype")
+	}
+	for _, bit := range bits {
+		if bit < 0 || bit >= len(payload)*8 {
+			return 0, fmt.Errorf("bit %d is outside of the payload", bit)
+		}
+	}
+	if config.Datatype == "bitfield" {
+		return parseBitfield(payload, bits, config)
+	}
+	parsers := payloadParsers
+	if _, ok := bigEndianParsers[config.Datatype]; ok && config.BigEndian() {
+		parsers = bigEndianParsers
+	}
+	converter, ok := parsers[config.Datatype]
+	if !ok {
+		return 0, fmt.Errorf("unrecognized datatype")
+	}
+	return converter(payload, config.Offset)
+}
+
+// parseBitfield reads the bits of a bitfield from the most to the least significant
+func parseBitfield(payload []byte, bits []int, config *configs.CanConfigType) (float64, error) {
+	if len(bits) == 0 || len(bits) > 64 {
+		return 0, fmt.Errorf("invalid bit_length %d", config.BitLength)
+	}
+	var raw uint64
+	for _, bit := range bits {
+		raw = raw<<1 | uint64(payload[bit/8]>>uint(bit%8)&1)
+	}
+	if config.Signed && len(bits) < 64 && raw&(1<<uint(len(bits)-1)) != 0 {
+		// Sign extend the two's complement value
+		raw |= ^uint64(0) << uint(len(bits))
+	}
+	if config.Signed {
+		return float64(int64(raw)), nil
+	}
+	return float64(raw), nil
+}
+
 func init() {
+	bigEndianParsers = make(map[string]func([]byte, int) (float64, error))
+	bigEndianParsers["uint16"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(binary.BigEndian.Uint16(bytes[offset : offset+2])), nil
+	}
+	bigEndianParsers["uint32"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(binary.BigEndian.Uint32(bytes[offset : offset+4])), nil
+	}
+	bigEndianParsers["uint64"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(binary.BigEndian.Uint64(bytes[offset : offset+8])), nil
+	}
+	bigEndianParsers["int16"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(int16(binary.BigEndian.Uint16(bytes[offset : offset+2]))), nil
+	}
+	bigEndianParsers["int32"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(int32(binary.BigEndian.Uint32(bytes[offset : offset+4]))), nil
+	}
+	bigEndianParsers["int64"] = func(bytes []byte, offset int) (float64, error) {
+		return float64(int64(binary.BigEndian.Uint64(bytes[offset : offset+8]))), nil
+	}
+	bigEndianParsers["float32"] = func(bytes []byte, offset int) (float64, error) {
+		return checkFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(bytes[offset : offset+4]))))
+	}
+	bigEndianParsers["float64"] = func(bytes []byte, offset int) (float64, error) {
+		return checkFloat(math.Float64frombits(binary.BigEndian.Uint64(bytes[offset : offset+8])))
+	}
+
 	payloadParsers = make(map[string]func([]byte, int) (float64, error))
 	payloadParsers["uint8"] = func(bytes []byte, offset int) (float64, error) {
 		return float64(bytes[offset]), nil
@@ -130,19 +498,11 @@ func init() {
 	}
 	payloadParsers["float32"] = func(bytes []byte, offset int) (float64, error) {
 		rawValue := binary.LittleEndian.Uint32(bytes[offset : offset+4])
-		value := float64(math.Float32frombits(rawValue))
-		if math.IsNaN(value) || math.IsInf(value, 0) {
-			return value, fmt.Errorf("invalid float value parsed from packet")
-		}
-		return value, nil
+		return checkFloat(float64(math.Float32frombits(rawValue)))
 	}
 	payloadParsers["float64"] = func(bytes []byte, offset int) (float64, error) {
 		rawValue := binary.LittleEndian.Uint64(bytes[offset : offset+8])
-		value := math.Float64frombits(rawValue)
-		if math.IsNaN(value) || math.IsInf(value, 0) {
-			return value, fmt.Errorf("invalid float value parsed from packet")
-		}
-		return value, nil
+		return checkFloat(math.Float64frombits(rawValue))
 	}
 	payloadParsers["bit"] = func(bytes []byte, offset int) (float64, error) {
 		byteOffset := offset / 8
@@ -153,3 +513,11 @@ func init() {
 		return 0, nil
 	}
 }
+
+// checkFloat rejects NaN and infinite values parsed from a packet
+func checkFloat(value float64) (float64, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return value, fmt.Errorf("invalid float value parsed from packet")
+	}
+	return value, nil
+}
@@ -3,7 +3,10 @@ package listener
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -112,6 +115,31 @@ func TestInvalidValues(t *testing.T) {
 	assert.Equal(t, 0, len(points))
 }
 
+func TestSignalsOutsidePayload(t *testing.T) {
+	canConfig := map[int][]*configs.CanConfigType{
+		0: {
+			{CanID: 0, Datatype: "uint8", Name: "Inside", Offset: 7},
+			{CanID: 0, Datatype: "uint32", Name: "Past_End", Offset: 6},
+			{CanID: 0, Datatype: "int64", Name: "Big_Endian", Offset: 1, ByteOrder: configs.BigEndian},
+			{CanID: 0, Datatype: "uint16", Name: "Negative", Offset: -1},
+			{CanID: 0, Datatype: "bit", Name: "Bit", Offset: 64},
+			{CanID: 0, Datatype: "bitfield", Name: "Bitfield", BitStart: 60, BitLength: 8},
+		},
+	}
+	parser := NewPacketParser(canConfig)
+	packet := append([]byte("GT"), make([]byte, 10)...)
+	packet[11] = 5
+	for i := 0; i < len(packet); i++ {
+		parser.ParseByte(packet[i])
+	}
+	points := parser.ParsePacket()
+	if assert.Equal(t, 1, len(points)) {
+		assert.Equal(t, "Inside", points[0].Metric)
+		assert.Equal(t, 5.0, points[0].Value)
+	}
+	assert.Equal(t, uint64(5), parser.Stats().ParseErrors)
+}
+
 func TestParseConfigs(t *testing.T) {
 	configsMap, err := configs.LoadConfigs() // test loading the JSON file
 	assert.NoError(t, err)
@@ -158,3 +186,239 @@ func TestBitParser(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, float64(0), value)
 }
+
+func TestParseLayouts(t *testing.T) {
+	payload := []byte{0x12, 0x34, 0xF5, 0xA0, 0x00, 0x00, 0x00, 0x00}
+	layouts := map[*configs.CanConfigType]float64{
+		{Datatype: "uint16", Offset: 0}:                                                  0x3412,
+		{Datatype: "uint16", Offset: 0, ByteOrder: configs.BigEndian}:                    0x1234,
+		{Datatype: "int16", Offset: 2, ByteOrder: configs.BigEndian}:                     float64(int16(-0x0A60)),
+		{Datatype: "bitfield", BitStart: 4, BitLength: 8}:                                0x41,
+		{Datatype: "bitfield", BitStart: 16, BitLength: 4, Signed: true}:                 5,
+		{Datatype: "bitfield", BitStart: 20, BitLength: 4, Signed: true}:                 -1,
+		{Datatype: "bitfield", BitStart: 3, BitLength: 12, ByteOrder: configs.BigEndian}: 0x234,
+	}
+	for config, expected := range layouts {
+		value, err := parseValue(payload, config)
+		assert.NoError(t, err, "%+v", *config)
+		assert.Equal(t, expected, value, "%+v", *config)
+	}
+
+	_, err := parseValue(payload, &configs.CanConfigType{Datatype: "bitfield", BitStart: 60, BitLength: 8})
+	assert.Error(t, err)
+}
+
+func TestScaledValues(t *testing.T) {
+	canConfig := map[int][]*configs.CanConfigType{
+		0: {
+			{CanID: 0, Datatype: "uint8", Name: "Temperature", Offset: 0, Scale: 0.5, ValueOffset: -40,
+				CheckBounds: true, MinValue: -40, MaxValue: 0},
+			{CanID: 0, Datatype: "uint8", Name: "Too_Hot", Offset: 1, Scale: 0.5, ValueOffset: -40,
+				CheckBounds: true, MinValue: -40, MaxValue: 0},
+		},
+	}
+	parser := NewPacketParser(canConfig)
+	packet := append([]byte("GT"), make([]byte, 10)...)
+	packet[4] = 60
+	packet[5] = 100
+	for _, b := range packet {
+		parser.ParseByte(b)
+	}
+	points := parser.ParsePacket()
+	// The bounds are checked against the scaled value
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, "Temperature", points[0].Metric)
+		assert.Equal(t, float64(-10), points[0].Value)
+	}
+}
+
+func TestMultiplexedPacket(t *testing.T) {
+	low, high := 0, 1
+	canConfig := map[int][]*configs.CanConfigType{
+		0: {
+			{CanID: 0, Datatype: "uint8", Name: "Cell_Group", Offset: 0, Multiplexer: true},
+			{CanID: 0, Datatype: "uint16", Name: "Cell_Low", Offset: 1, MuxValue: &low},
+			{CanID: 0, Datatype: "uint16", Name: "Cell_High", Offset: 1, MuxValue: &high},
+			{CanID: 0, Datatype: "uint8", Name: "Pack_Temp", Offset: 7},
+		},
+	}
+	parser := NewPacketParser(canConfig)
+	parse := func(group byte) map[string]float64 {
+		packet := append([]byte("GT"), make([]byte, 10)...)
+		packet[4] = group
+		packet[5] = 42
+		packet[11] = 25
+		for _, b := range packet {
+			parser.ParseByte(b)
+		}
+		values := make(map[string]float64)
+		for _, point := range parser.ParsePacket() {
+			values[point.Metric] = point.Value
+		}
+		return values
+	}
+	// Only the signals selected by the multiplexer are parsed
+	assert.Equal(t, map[string]float64{"Cell_Group": 0, "Cell_Low": 42, "Pack_Temp": 25}, parse(0))
+	assert.Equal(t, map[string]float64{"Cell_Group": 1, "Cell_High": 42, "Pack_Temp": 25}, parse(1))
+	assert.Equal(t, map[string]float64{"Cell_Group": 2, "Pack_Temp": 25}, parse(2))
+}
+
+func TestFramedPackets(t *testing.T) {
+	canConfig := map[int][]*configs.CanConfigType{
+		0x123: {
+			{CanID: 0x123, Datatype: "uint16", Name: "Framed_Value", Offset: 0},
+			{CanID: 0x123, Datatype: "uint8", Name: "Padded_Value", Offset: 7},
+		},
+	}
+	parser := NewPacketParser(canConfig)
+	parse := func(stream []byte) []map[string]float64 {
+		var packets []map[string]float64
+		for _, b := range stream {
+			if parser.ParseByte(b) {
+				values := make(map[string]float64)
+				for _, point := range parser.ParsePacket() {
+					values[point.Metric] = point.Value
+				}
+				packets = append(packets, values)
+			}
+		}
+		return packets
+	}
+	frame, err := EncodeFrame(7, 0x123, []byte{0x34, 0x12, 0, 0, 0, 0, 0, 9})
+	assert.NoError(t, err)
+	assert.Len(t, frame, 20)
+	// Short payloads are padded with zeros
+	short, err := EncodeFrame(8, 0x123, []byte{0x02, 0x01})
+	assert.NoError(t, err)
+	legacy := []byte{'G', 'T', 0x23, 0x01, 5, 0, 0, 0, 0, 0, 0, 0}
+	stream := append(append(append([]byte{0xFF, 'G'}, frame...), legacy...), short...)
+	assert.Equal(t, []map[string]float64{
+		{"Framed_Value": 0x1234, "Padded_Value": 9},
+		{"Framed_Value": 5, "Padded_Value": 0},
+		{"Framed_Value": 0x102, "Padded_Value": 0},
+	}, parse(stream))
+	assert.Equal(t, uint16(8), parser.Sequence)
+	assert.Equal(t, LinkStats{Packets: 3, Bytes: uint64(len(stream))}, parser.Stats())
+
+	// Corrupted frames are counted and dropped
+	corrupted := append([]byte{}, frame...)
+	corrupted[9] ^= 0x40
+	assert.Empty(t, parse(corrupted))
+	assert.Equal(t, uint64(1), parser.Stats().CRCFailures)
+	assert.Equal(t, uint16(8), parser.Sequence)
+
+	// So are frames with an unknown version or length
+	unknownVersion := append([]byte{}, frame...)
+	unknownVersion[2] = 9
+	tooLong := append([]byte{}, frame...)
+	tooLong[3] = maxFrameBody + 1
+	assert.Empty(t, parse(append(unknownVersion[:4], tooLong[:4]...)))
+	assert.Equal(t, uint64(2), parser.Stats().BadFrames)
+	assert.Len(t, parse(frame), 1)
+
+	// The frame repeated sequence number 7, which isn't a gap
+	assert.Equal(t, uint64(0), parser.Stats().Gaps)
+	next, err := EncodeFrame(12, 0x123, nil)
+	assert.NoError(t, err)
+	parse(next)
+	assert.Equal(t, uint64(4), parser.Stats().Gaps)
+
+	// The parser resyncs on a packet starting within a bad frame, such as
+	// one following a frame cut off partway through
+	assert.Len(t, parse(append(append([]byte{}, frame[:10]...), frame...)), 1)
+	assert.Equal(t, uint64(2), parser.Stats().CRCFailures)
+	assert.Len(t, parse(append(append(unknownVersion[:4], legacy...), short...)), 2)
+	assert.Equal(t, uint64(3), parser.Stats().BadFrames)
+
+	_, err = EncodeFrame(9, 0x123, make([]byte, 9))
+	assert.Error(t, err)
+}
+
+func TestTimestampedPackets(t *testing.T) {
+	parser := NewPacketParser(map[int][]*configs.CanConfigType{
+		1: {{CanID: 1, Datatype: "uint8", Name: "Timestamped_Value", Offset: 0}},
+	})
+	parse := func(frame []byte) *datatypes.Datapoint {
+		var points []*datatypes.Datapoint
+		for _, b := range frame {
+			if parser.ParseByte(b) {
+				points = append(points, parser.ParsePacket()...)
+			}
+		}
+		if !assert.Len(t, points, 1) {
+			return &datatypes.Datapoint{}
+		}
+		return points[0]
+	}
+	// Points are stamped with the car's unix timestamp
+	sent := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	frame, err := EncodeTimestampedFrame(1, uint64(sent.UnixNano()/1e6), 1, []byte{42})
+	assert.NoError(t, err)
+	assert.Len(t, frame, 21)
+	point := parse(frame)
+	assert.Equal(t, float64(42), point.Value)
+	assert.True(t, sent.Equal(point.Time))
+	stats := parser.Stats()
+	assert.Equal(t, uint64(1), stats.Timestamped)
+	assert.InDelta(t, float64(time.Minute/time.Millisecond), stats.LatencyMillis, 1000)
+	assert.Equal(t, float64(0), stats.ClockOffsetMillis)
+
+	// Timestamps since the car's clock started are offset by the quickest
+	// packet, so a packet replayed from a buffer is stamped with when it was sent
+	before := time.Now()
+	frame, err = EncodeTimestampedFrame(2, 60000, 1, []byte{1})
+	assert.NoError(t, err)
+	point = parse(frame)
+	assert.False(t, point.Time.Before(before))
+	frame, err = EncodeTimestampedFrame(3, 50000, 1, []byte{2})
+	assert.NoError(t, err)
+	replayed := parse(frame)
+	assert.InDelta(t, float64(10*time.Second), float64(point.Time.Sub(replayed.Time)), float64(100*time.Millisecond))
+	assert.InDelta(t, float64(before.UnixNano()/1e6-60000), parser.Stats().ClockOffsetMillis, 1000)
+
+	// Packets without a timestamp are stamped with when they were parsed
+	before = time.Now()
+	frame, err = EncodeFrame(4, 1, []byte{3})
+	assert.NoError(t, err)
+	point = parse(frame)
+	assert.False(t, point.Time.Before(before))
+}
+
+func TestReloadingPacketParser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parser_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer configs.SetDir("")
+	writeConfigs := func(name string) {
+		json := fmt.Sprintf(`[{"can_id": 5, "datatype": "uint8", "name": "%s", "offset": 0}]`, name)
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "test_config.json"), []byte(json), 0644))
+	}
+	writeConfigs("Before_Reload")
+	configs.SetDir(dir)
+	_, err = configs.LoadConfigs()
+	assert.NoError(t, err)
+
+	parser := NewReloadingPacketParser()
+	packet := append([]byte("GT"), make([]byte, 10)...)
+	packet[2] = 5
+	packet[4] = 7
+	parse := func() []*datatypes.Datapoint {
+		for _, b := range packet {
+			parser.ParseByte(b)
+		}
+		return parser.ParsePacket()
+	}
+	points := parse()
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, "Before_Reload", points[0].Metric)
+		assert.Equal(t, float64(7), points[0].Value)
+	}
+
+	// The existing parser picks up the reloaded configs
+	writeConfigs("After_Reload")
+	assert.NoError(t, configs.Reload())
+	points = parse()
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, "After_Reload", points[0].Metric)
+	}
+}
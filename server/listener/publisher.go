@@ -1,28 +1,144 @@
 package listener
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"server/datatypes"
 )
 
+// publishQueueSize is how many published points can wait to be sent to the
+// subscribers before Publish blocks
+const publishQueueSize = 10000
+
+// subscriberBufferSize is how many points can wait for a subscriber's delivery
+// goroutine before the points after them are dropped
+const subscriberBufferSize = 10000
+
 // DatapointPublisher provides pub/sub functionality for Datapoint streams
 type DatapointPublisher struct {
-	publishChannel      chan *datatypes.Datapoint
+	publishChannel      chan publication
 	specificSubscribers map[string][]chan *datatypes.Datapoint
 	subscribers         []chan *datatypes.Datapoint
-	subscribersLock     *sync.Mutex
+	// patternSubscribers are keyed by glob pattern. The channels whose
+	// patterns match each metric published are cached in patternMatches
+	// until a channel subscribes or unsubscribes
+	patternSubscribers map[string][]chan *datatypes.Datapoint
+	patternMatches     map[string][]chan *datatypes.Datapoint
+	subscriptions      map[chan *datatypes.Datapoint]*subscription
+	subscribersLock    *sync.Mutex
+	// handled is signalled with subscribersLock whenever a subscriber handles a point
+	handled         *sync.Cond
+	subscriberCount int
+	// done is closed when the publishing thread has sent every point published
+	done chan struct{}
+}
+
+// Policy is what the publisher does with a point when a subscriber's channel is full
+type Policy string
+
+// Policies for full subscriber channels
+const (
+	// DropNewest drops the point being published. This is the default
+	DropNewest Policy = "drop-newest"
+	// DropOldest drops the oldest point waiting in the channel to make room
+	DropOldest Policy = "drop-oldest"
+	// Block waits up to the subscriber's timeout for room in the channel. The
+	// points after it wait in the subscriber's buffer, so the other subscribers
+	// and the publishers aren't held up. If the timeout passes the point is
+	// dropped, and so are the points after it until the subscriber has room again
+	Block Policy = "block"
+)
+
+// SubscribeOptions configures how points are sent to a subscriber
+type SubscribeOptions struct {
+	// Name identifies the subscriber in its stats
+	Name   string
+	Policy Policy
+	// Timeout is how long the Block policy waits for room in the channel
+	Timeout time.Duration
+	// Tags limits the subscription to points with all of these tags,
+	// such as the car or source they came from
+	Tags map[string]string
+}
+
+// subscription is the state kept for each subscribed channel. Points are put in
+// its buffer by the publishing thread and sent to the channel by its own delivery
+// goroutine, so a subscriber that is slow to take them only delays itself
+type subscription struct {
+	name      string
+	policy    Policy
+	timeout   time.Duration
+	all       bool
+	metrics   []string
+	tags      map[string]string
+	delivered uint64
+	dropped   uint64
+	// dropping is set from the point a subscriber's channel is full
+	// until a point is sent to it again
+	dropping bool
+	buffer   chan *datatypes.Datapoint
+	// buffered counts the points put in the buffer and handled those the
+	// delivery goroutine has since sent or dropped
+	buffered uint64
+	handled  uint64
+	// stop is closed on unsubscribing, and stopped is set along with it
+	stop    chan struct{}
+	stopped bool
+	// exited is closed when the delivery goroutine returns
+	exited chan struct{}
+}
+
+// SubscriberStats are the stats of a channel subscribed to the publisher
+type SubscriberStats struct {
+	Name   string `json:"name"`
+	Policy Policy `json:"policy"`
+	// Metrics are the metrics and patterns subscribed to, or empty for every metric
+	Metrics []string `json:"metrics,omitempty"`
+	// Tags are the tags points must have to be sent to the subscriber
+	Tags map[string]string `json:"tags,omitempty"`
+	// Queued is the number of points waiting in the channel
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+	// Buffered is the number of points waiting to be sent to the channel
+	Buffered  int    `json:"buffered"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// PublisherStats are the stats of a DatapointPublisher and its subscribers
+type PublisherStats struct {
+	// Queued is the number of published points waiting to be sent to the subscribers
+	Queued      int               `json:"queued"`
+	Capacity    int               `json:"capacity"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// publication is either a datapoint to publish or a request to be told, by
+// closing flushed, once everything published before it has been sent or dropped
+type publication struct {
+	point   *datatypes.Datapoint
+	flushed chan struct{}
 }
 
 func newDatapointPublisher() *DatapointPublisher {
 	publisher := &DatapointPublisher{
-		publishChannel:      make(chan *datatypes.Datapoint, 10000),
+		publishChannel:      make(chan publication, publishQueueSize),
 		specificSubscribers: make(map[string][]chan *datatypes.Datapoint),
 		subscribers:         []chan *datatypes.Datapoint{},
+		patternSubscribers:  make(map[string][]chan *datatypes.Datapoint),
+		patternMatches:      make(map[string][]chan *datatypes.Datapoint),
+		subscriptions:       make(map[chan *datatypes.Datapoint]*subscription),
 		subscribersLock:     new(sync.Mutex),
+		done:                make(chan struct{}),
 	}
+	publisher.handled = sync.NewCond(publisher.subscribersLock)
 	go publisher.publisherThread()
 	return publisher
 }
@@ -47,22 +163,90 @@ func GetDatapointPublisher() *DatapointPublisher {
 // Subscribe subscribes the given channel to the publisher. Whenever Publish is
 // called on this publisher, the datapoint will be sent to the provided channel.
 // If specific metrics are provided, the channel will only be sent datapoints
-// for those specific metrics
+// for those specific metrics. Metrics containing *, ? or [ are glob patterns,
+// such as Cell_Voltage_*, matching every metric with a name of that form.
+// Points are dropped while the channel is full
 func (publisher *DatapointPublisher) Subscribe(c chan *datatypes.Datapoint, metrics ...string) error {
+	return publisher.SubscribeWith(c, SubscribeOptions{}, metrics...)
+}
+
+// SubscribeWith subscribes the given channel to the publisher like Subscribe,
+// naming it, choosing what is done with points while it is full and limiting
+// it to points with the given tags
+func (publisher *DatapointPublisher) SubscribeWith(c chan *datatypes.Datapoint, options SubscribeOptions, metrics ...string) error {
+	for _, metric := range metrics {
+		if _, err := path.Match(metric, ""); err != nil {
+			return fmt.Errorf("Subscribe: malformed pattern %q", metric)
+		}
+	}
+	switch options.Policy {
+	case "", DropNewest, DropOldest:
+	case Block:
+		if options.Timeout <= 0 {
+			return fmt.Errorf("Subscribe: the %s policy needs a timeout", Block)
+		}
+	default:
+		return fmt.Errorf("Subscribe: unknown policy %q", options.Policy)
+	}
 	publisher.subscribersLock.Lock()
 	defer publisher.subscribersLock.Unlock()
-	if len(metrics) == 0 {
+	sub, ok := publisher.subscriptions[c]
+	if !ok {
+		publisher.subscriberCount++
+		sub = &subscription{
+			name:   fmt.Sprintf("subscriber-%d", publisher.subscriberCount),
+			policy: DropNewest,
+			buffer: make(chan *datatypes.Datapoint, subscriberBufferSize),
+			stop:   make(chan struct{}),
+			exited: make(chan struct{}),
+		}
+		publisher.subscriptions[c] = sub
+		go publisher.deliveryThread(c, sub)
+	}
+	if options.Name != "" {
+		sub.name = options.Name
+	}
+	if options.Policy != "" {
+		sub.policy = options.Policy
+		sub.timeout = options.Timeout
+	}
+	if options.Tags != nil {
+		sub.tags = options.Tags
+	}
+	publisher.patternMatches = make(map[string][]chan *datatypes.Datapoint)
+	// A channel subscribed again is only sent each point once
+	if len(metrics) == 0 && !sub.all {
 		publisher.subscribers = append(publisher.subscribers, c)
+		sub.all = true
 	}
 	for _, metric := range metrics {
-		publisher.specificSubscribers[metric] = append(publisher.specificSubscribers[metric], c)
+		if sub.subscribed(metric) {
+			continue
+		}
+		if isPattern(metric) {
+			publisher.patternSubscribers[metric] = append(publisher.patternSubscribers[metric], c)
+		} else {
+			publisher.specificSubscribers[metric] = append(publisher.specificSubscribers[metric], c)
+		}
+		sub.metrics = append(sub.metrics, metric)
 	}
 	return nil
 }
 
 // Unsubscribe unsubscribes a channel from the publisher. Datapoints published
-// to the publisher will no longer be sent to the provided channel
+// to the publisher will no longer be sent to the provided channel, and those
+// still waiting in its buffer are dropped
 func (publisher *DatapointPublisher) Unsubscribe(c chan *datatypes.Datapoint) error {
+	sub, err := publisher.unsubscribe(c)
+	if err != nil {
+		return err
+	}
+	// Once the delivery goroutine returns, nothing more is sent to the channel
+	<-sub.exited
+	return nil
+}
+
+func (publisher *DatapointPublisher) unsubscribe(c chan *datatypes.Datapoint) (*subscription, error) {
 	publisher.subscribersLock.Lock()
 	defer publisher.subscribersLock.Unlock()
 	found := false
@@ -80,35 +264,60 @@ func (publisher *DatapointPublisher) Unsubscribe(c chan *datatypes.Datapoint) er
 			}
 		}
 	}
+	for k := range publisher.patternSubscribers {
+		for i, channel := range publisher.patternSubscribers[k] {
+			if c == channel {
+				publisher.patternSubscribers[k] = append(publisher.patternSubscribers[k][:i], publisher.patternSubscribers[k][i+1:]...)
+				found = true
+			}
+		}
+		if len(publisher.patternSubscribers[k]) == 0 {
+			delete(publisher.patternSubscribers, k)
+		}
+	}
 	if !found {
-		return fmt.Errorf("Unsubscribe: channel not found in subscriber list")
+		return nil, fmt.Errorf("Unsubscribe: channel not found in subscriber list")
 	}
-	return nil
+	sub := publisher.subscriptions[c]
+	delete(publisher.subscriptions, c)
+	publisher.patternMatches = make(map[string][]chan *datatypes.Datapoint)
+	sub.stopped = true
+	close(sub.stop)
+	publisher.handled.Broadcast()
+	return sub, nil
 }
 
 // Publish publishes a given datapoint. The datapoint will be sent to all subscribing channels
 func (publisher *DatapointPublisher) Publish(point *datatypes.Datapoint) {
-	publisher.publishChannel <- point
+	publisher.publishChannel <- publication{point: point}
 }
 
-// Close closes the given publisher, stopping the publishing thread and closing all subscriber channels
+// Flush blocks until every datapoint published before it was called has been
+// sent to the subscribers, or dropped following their policies
+func (publisher *DatapointPublisher) Flush() {
+	flushed := make(chan struct{})
+	publisher.publishChannel <- publication{flushed: flushed}
+	<-flushed
+}
+
+// Close closes the given publisher, stopping the publishing thread and the delivery
+// goroutines once they have sent the points already published and then closing all
+// subscriber channels
 func (publisher *DatapointPublisher) Close() {
 	publisherLock.Lock()
 	defer publisherLock.Unlock()
 	close(publisher.publishChannel)
+	<-publisher.done
 	publisher.subscribersLock.Lock()
-	defer publisher.subscribersLock.Unlock()
-	for _, c := range publisher.subscribers {
-		close(c)
+	subscriptions := make(map[chan *datatypes.Datapoint]*subscription, len(publisher.subscriptions))
+	for c, sub := range publisher.subscriptions {
+		close(sub.buffer)
+		subscriptions[c] = sub
 	}
-	closed := make(map[chan *datatypes.Datapoint]bool)
-	for _, subscribers := range publisher.specificSubscribers {
-		for _, c := range subscribers {
-			if !closed[c] {
-				close(c)
-				closed[c] = true
-			}
-		}
+	publisher.subscribersLock.Unlock()
+	for c, sub := range subscriptions {
+		<-sub.exited
+		close(c)
 	}
 	if publisher == globalPublisher {
 		globalPublisher = nil
@@ -116,22 +325,275 @@ func (publisher *DatapointPublisher) Close() {
 }
 
 func (publisher *DatapointPublisher) publisherThread() {
-	for point := range publisher.publishChannel {
+	defer close(publisher.done)
+	for p := range publisher.publishChannel {
+		if p.flushed != nil {
+			publisher.flushSubscribers(p.flushed)
+			continue
+		}
+		point := p.point
 		publisher.subscribersLock.Lock()
-		for _, subscriber := range publisher.subscribers {
-			send(subscriber, point)
+		for _, subscribers := range [][]chan *datatypes.Datapoint{
+			publisher.subscribers,
+			publisher.specificSubscribers[point.Metric],
+			publisher.matchPatterns(point.Metric),
+		} {
+			for _, subscriber := range subscribers {
+				publisher.subscriptions[subscriber].enqueue(point)
+			}
 		}
-		for _, subscriber := range publisher.specificSubscribers[point.Metric] {
-			send(subscriber, point)
+		publisher.subscribersLock.Unlock()
+	}
+}
+
+// flushSubscribers closes flushed once every subscriber has handled the points
+// already put in its buffer. It waits on its own goroutine so that the points
+// published after the flush aren't held up
+func (publisher *DatapointPublisher) flushSubscribers(flushed chan struct{}) {
+	publisher.subscribersLock.Lock()
+	targets := make(map[*subscription]uint64, len(publisher.subscriptions))
+	for _, sub := range publisher.subscriptions {
+		targets[sub] = sub.buffered
+	}
+	publisher.subscribersLock.Unlock()
+	go func() {
+		publisher.subscribersLock.Lock()
+		for sub, target := range targets {
+			for sub.handled < target && !sub.stopped {
+				publisher.handled.Wait()
+			}
 		}
 		publisher.subscribersLock.Unlock()
+		close(flushed)
+	}()
+}
+
+// isPattern returns whether a metric subscribed to is a glob pattern
+func isPattern(metric string) bool {
+	return strings.ContainsAny(metric, "*?[")
+}
+
+// matchPatterns returns the channels subscribed to a pattern matching metric
+// that aren't already sent it because they subscribed to every metric or to
+// the metric by name. The matches are worked out once for each metric
+func (publisher *DatapointPublisher) matchPatterns(metric string) []chan *datatypes.Datapoint {
+	if len(publisher.patternSubscribers) == 0 {
+		return nil
+	}
+	matches, ok := publisher.patternMatches[metric]
+	if ok {
+		return matches
+	}
+	matched := make(map[chan *datatypes.Datapoint]bool)
+	for pattern, subscribers := range publisher.patternSubscribers {
+		if ok, _ := path.Match(pattern, metric); !ok {
+			continue
+		}
+		for _, subscriber := range subscribers {
+			sub := publisher.subscriptions[subscriber]
+			if matched[subscriber] || sub.all || sub.subscribed(metric) {
+				continue
+			}
+			matched[subscriber] = true
+			matches = append(matches, subscriber)
+		}
+	}
+	publisher.patternMatches[metric] = matches
+	return matches
+}
+
+// enqueue puts point in the subscriber's buffer if it has the subscriber's tags.
+// The point is dropped if the buffer is full. It is called with the subscribers lock held
+func (sub *subscription) enqueue(point *datatypes.Datapoint) {
+	for key, value := range sub.tags {
+		if point.Tags[key] != value {
+			return
+		}
+	}
+	select {
+	case sub.buffer <- point:
+		sub.buffered++
+	default:
+		sub.drop()
 	}
 }
 
-func send(subscriber chan *datatypes.Datapoint, point *datatypes.Datapoint) {
+// deliveryThread sends the points in the subscriber's buffer to its channel
+// until the buffer is closed or the subscriber unsubscribes
+func (publisher *DatapointPublisher) deliveryThread(subscriber chan *datatypes.Datapoint, sub *subscription) {
+	defer close(sub.exited)
+	for {
+		select {
+		case point, ok := <-sub.buffer:
+			if !ok {
+				return
+			}
+			publisher.deliver(subscriber, sub, point)
+		case <-sub.stop:
+			return
+		}
+	}
+}
+
+// deliver sends point to a subscriber, following its policy if its channel is full.
+// The subscribers lock is only held to read the policy and count the point, so a
+// Block subscriber doesn't hold up subscribing and the stats while it is waited for
+func (publisher *DatapointPublisher) deliver(subscriber chan *datatypes.Datapoint, sub *subscription, point *datatypes.Datapoint) {
+	publisher.subscribersLock.Lock()
+	policy, timeout, dropping := sub.policy, sub.timeout, sub.dropping
+	publisher.subscribersLock.Unlock()
+	sent := false
+	droppedOldest := false
 	select {
 	case subscriber <- point:
+		sent = true
 	default:
-		log.Printf("WARNING: Subscriber %v blocked publisher. Skipping...", subscriber)
+	}
+	if !sent {
+		switch policy {
+		case DropOldest:
+			select {
+			case <-subscriber:
+				droppedOldest = true
+			default:
+			}
+			select {
+			case subscriber <- point:
+				sent = true
+			default:
+			}
+		case Block:
+			if !dropping {
+				timer := time.NewTimer(timeout)
+				select {
+				case subscriber <- point:
+					sent = true
+				case <-timer.C:
+				case <-sub.stop:
+				}
+				timer.Stop()
+			}
+		}
+	}
+	publisher.subscribersLock.Lock()
+	defer publisher.subscribersLock.Unlock()
+	if droppedOldest {
+		sub.drop()
+	}
+	if sent {
+		sub.deliver()
+	} else {
+		sub.drop()
+	}
+	sub.handled++
+	publisher.handled.Broadcast()
+}
+
+// subscribed returns whether the subscriber has subscribed to the metric by name
+func (sub *subscription) subscribed(metric string) bool {
+	for _, m := range sub.metrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver counts a point sent to the subscriber, which has room again if it was full
+func (sub *subscription) deliver() {
+	sub.delivered++
+	sub.dropping = false
+}
+
+// drop counts a point dropped because the subscriber's channel was full
+func (sub *subscription) drop() {
+	if !sub.dropping {
+		log.Printf("WARNING: Subscriber %s is full. Dropping points until it catches up...\n", sub.name)
+		sub.dropping = true
+	}
+	sub.dropped++
+}
+
+// Stats returns the stats of the publisher and each of its subscribers, sorted by name
+func (publisher *DatapointPublisher) Stats() PublisherStats {
+	publisher.subscribersLock.Lock()
+	defer publisher.subscribersLock.Unlock()
+	stats := PublisherStats{
+		Queued:      len(publisher.publishChannel),
+		Capacity:    cap(publisher.publishChannel),
+		Subscribers: make([]SubscriberStats, 0, len(publisher.subscriptions)),
+	}
+	for c, sub := range publisher.subscriptions {
+		subscriberStats := SubscriberStats{
+			Name:      sub.name,
+			Policy:    sub.policy,
+			Queued:    len(c),
+			Capacity:  cap(c),
+			Buffered:  len(sub.buffer),
+			Delivered: sub.delivered,
+			Dropped:   sub.dropped,
+		}
+		if !sub.all {
+			subscriberStats.Metrics = append([]string(nil), sub.metrics...)
+		}
+		if len(sub.tags) > 0 {
+			subscriberStats.Tags = make(map[string]string, len(sub.tags))
+			for key, value := range sub.tags {
+				subscriberStats.Tags[key] = value
+			}
+		}
+		stats.Subscribers = append(stats.Subscribers, subscriberStats)
+	}
+	sort.Slice(stats.Subscribers, func(i, j int) bool {
+		return stats.Subscribers[i].Name < stats.Subscribers[j].Name
+	})
+	return stats
+}
+
+// publisherReportInterval is how often the stats of the publisher are published
+const publisherReportInterval = 5 * time.Second
+
+// Metrics published about the publisher. The subscriber metrics are tagged with the subscriber's name
+const (
+	publisherQueueDepthMetric  = "Publisher_Queue_Depth"
+	subscriberQueueDepthMetric = "Subscriber_Queue_Depth"
+	subscriberDroppedMetric    = "Subscriber_Dropped_Points"
+)
+
+// reportPublisher periodically publishes the stats of the publisher until ctx is done
+func reportPublisher(ctx context.Context, publisher *DatapointPublisher) {
+	ticker := time.NewTicker(publisherReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		publishPublisherStats(publisher, time.Now())
+	}
+}
+
+func publishPublisherStats(publisher *DatapointPublisher, now time.Time) {
+	stats := publisher.Stats()
+	publisher.Publish(&datatypes.Datapoint{
+		Metric: publisherQueueDepthMetric,
+		Value:  float64(stats.Queued),
+		Time:   now,
+	})
+	for _, subscriber := range stats.Subscribers {
+		tags := map[string]string{datatypes.SubscriberTag: subscriber.Name}
+		publisher.Publish(&datatypes.Datapoint{
+			Metric: subscriberQueueDepthMetric,
+			Value:  float64(subscriber.Queued + subscriber.Buffered),
+			Time:   now,
+			Tags:   tags,
+		})
+		publisher.Publish(&datatypes.Datapoint{
+			Metric: subscriberDroppedMetric,
+			Value:  float64(subscriber.Dropped),
+			Time:   now,
+			Tags:   tags,
+		})
 	}
 }
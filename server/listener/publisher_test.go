@@ -111,6 +111,222 @@ func TestUnsubscribe(t *testing.T) {
 	close(c2)
 }
 
+func TestFlush(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 100)
+	err := publisher.Subscribe(c)
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		publisher.Publish(&datatypes.Datapoint{Metric: "metric1", Value: float64(i)})
+	}
+	// Every point published before the flush has been sent once it returns
+	publisher.Flush()
+	assert.Len(t, c, 100)
+}
+
+func TestPatternSubscribers(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	cells := make(chan *datatypes.Datapoint, 10)
+	left := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, publisher.Subscribe(cells, "Cell_Voltage_*", "Cell_Voltage_?", "Pack_Voltage"))
+	assert.NoError(t, publisher.Subscribe(left, "Left_*", "Left_Bus_Voltage"))
+	assert.Error(t, publisher.Subscribe(make(chan *datatypes.Datapoint), "Cell_Voltage_[1"))
+
+	for _, metric := range []string{"Cell_Voltage_1", "Cell_Voltage_35", "Pack_Voltage", "Left_Bus_Voltage", "Right_Bus_Voltage", "Cell_Voltage_1"} {
+		publisher.Publish(&datatypes.Datapoint{Metric: metric})
+	}
+	publisher.Flush()
+	// Each channel is sent each point once, however many of its patterns match
+	assert.Equal(t, []string{"Cell_Voltage_1", "Cell_Voltage_35", "Pack_Voltage", "Cell_Voltage_1"}, receivedMetrics(cells))
+	assert.Equal(t, []string{"Left_Bus_Voltage"}, receivedMetrics(left))
+
+	// Unsubscribing stops the patterns matching
+	assert.NoError(t, publisher.Unsubscribe(cells))
+	publisher.Publish(&datatypes.Datapoint{Metric: "Cell_Voltage_1"})
+	publisher.Publish(&datatypes.Datapoint{Metric: "Left_Motor_Current"})
+	publisher.Flush()
+	assert.Empty(t, receivedMetrics(cells))
+	assert.Equal(t, []string{"Left_Motor_Current"}, receivedMetrics(left))
+}
+
+func TestTagSubscribers(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	sr3 := make(chan *datatypes.Datapoint, 10)
+	udp := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, publisher.SubscribeWith(sr3, SubscribeOptions{Name: "sr3", Tags: map[string]string{datatypes.CarTag: "SR-3"}}))
+	assert.NoError(t, publisher.SubscribeWith(udp, SubscribeOptions{Name: "udp", Tags: map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceUDP}}, "Speed_*"))
+
+	publisher.Publish(&datatypes.Datapoint{Metric: "Speed_Left", Tags: map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceUDP}})
+	publisher.Publish(&datatypes.Datapoint{Metric: "Speed_Right", Tags: map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceTCP}})
+	publisher.Publish(&datatypes.Datapoint{Metric: "Speed_Left", Tags: map[string]string{datatypes.CarTag: "SR-2", datatypes.SourceTag: datatypes.SourceUDP}})
+	publisher.Publish(&datatypes.Datapoint{Metric: "Speed_Left"})
+	publisher.Flush()
+	assert.Equal(t, []string{"Speed_Left", "Speed_Right"}, receivedMetrics(sr3))
+	assert.Equal(t, []string{"Speed_Left"}, receivedMetrics(udp))
+	// Points without the tags aren't counted as dropped
+	stats := publisher.Stats()
+	assert.Equal(t, SubscriberStats{Name: "udp", Policy: DropNewest, Metrics: []string{"Speed_*"},
+		Tags: map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceUDP}, Capacity: 10, Delivered: 1}, stats.Subscribers[1])
+}
+
+// receivedMetrics returns the metrics of the points waiting in c
+func receivedMetrics(c chan *datatypes.Datapoint) []string {
+	var metrics []string
+	for len(c) > 0 {
+		metrics = append(metrics, (<-c).Metric)
+	}
+	return metrics
+}
+
+func TestSubscriberPolicies(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	newest := make(chan *datatypes.Datapoint, 2)
+	oldest := make(chan *datatypes.Datapoint, 2)
+	blocking := make(chan *datatypes.Datapoint, 2)
+	assert.NoError(t, publisher.Subscribe(newest))
+	assert.NoError(t, publisher.SubscribeWith(oldest, SubscribeOptions{Name: "oldest", Policy: DropOldest}))
+	assert.NoError(t, publisher.SubscribeWith(blocking, SubscribeOptions{Name: "blocking", Policy: Block, Timeout: time.Second}))
+	assert.Error(t, publisher.SubscribeWith(make(chan *datatypes.Datapoint), SubscribeOptions{Policy: Block}))
+	assert.Error(t, publisher.SubscribeWith(make(chan *datatypes.Datapoint), SubscribeOptions{Policy: "drop-everything"}))
+
+	// The blocking subscriber reads slowly, but fast enough to get every point
+	received := make(chan []float64)
+	go func() {
+		var values []float64
+		for i := 0; i < 4; i++ {
+			time.Sleep(20 * time.Millisecond)
+			values = append(values, (<-blocking).Value)
+		}
+		received <- values
+	}()
+	for i := 0; i < 4; i++ {
+		publisher.Publish(&datatypes.Datapoint{Metric: "metric1", Value: float64(i)})
+	}
+	publisher.Flush()
+	assert.Equal(t, []float64{0, 1, 2, 3}, <-received)
+	assert.Equal(t, float64(0), (<-newest).Value)
+	assert.Equal(t, float64(1), (<-newest).Value)
+	assert.Equal(t, float64(2), (<-oldest).Value)
+	assert.Equal(t, float64(3), (<-oldest).Value)
+
+	stats := publisher.Stats()
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, publishQueueSize, stats.Capacity)
+	assert.Equal(t, []SubscriberStats{
+		{Name: "blocking", Policy: Block, Capacity: 2, Delivered: 4},
+		{Name: "oldest", Policy: DropOldest, Capacity: 2, Delivered: 4, Dropped: 2},
+		{Name: "subscriber-1", Policy: DropNewest, Capacity: 2, Delivered: 2, Dropped: 2},
+	}, stats.Subscribers)
+
+	// Once a blocking subscriber times out, points are dropped without
+	// waiting until it has room again
+	assert.NoError(t, publisher.Unsubscribe(newest))
+	assert.NoError(t, publisher.Unsubscribe(oldest))
+	assert.NoError(t, publisher.SubscribeWith(blocking, SubscribeOptions{Policy: Block, Timeout: 50 * time.Millisecond}))
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		publisher.Publish(&datatypes.Datapoint{Metric: "metric1", Value: float64(i)})
+	}
+	publisher.Flush()
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	stats = publisher.Stats()
+	assert.Equal(t, []SubscriberStats{
+		{Name: "blocking", Policy: Block, Queued: 2, Capacity: 2, Delivered: 6, Dropped: 8},
+	}, stats.Subscribers)
+}
+
+func TestBlockingSubscriberDoesntHoldLock(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	blocking := make(chan *datatypes.Datapoint)
+	other := make(chan *datatypes.Datapoint, 1)
+	assert.NoError(t, publisher.SubscribeWith(blocking, SubscribeOptions{Name: "blocking", Policy: Block, Timeout: time.Second}))
+	assert.NoError(t, publisher.Subscribe(other))
+	publisher.Publish(&datatypes.Datapoint{Metric: "metric1"})
+
+	// The other subscribers are sent the point, and the stats and
+	// subscriptions don't wait, while the blocking subscriber is waited for
+	assertReceived(t, other, "Point wasn't sent past the blocking subscriber")
+	start := time.Now()
+	publisher.Stats()
+	assert.NoError(t, publisher.Unsubscribe(other))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assertReceived(t, blocking, "Blocking subscriber wasn't sent the point")
+}
+
+func TestBlockingSubscriberOnlyDelaysItself(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	blocking := make(chan *datatypes.Datapoint)
+	other := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, publisher.SubscribeWith(blocking, SubscribeOptions{Name: "blocking", Policy: Block, Timeout: time.Second}))
+	assert.NoError(t, publisher.SubscribeWith(other, SubscribeOptions{Name: "other"}))
+	for i := 0; i < 5; i++ {
+		publisher.Publish(&datatypes.Datapoint{Metric: "metric1", Value: float64(i)})
+	}
+
+	// Every point reaches the other subscriber while the first is still waited for
+	for i := 0; i < 5; i++ {
+		select {
+		case point := <-other:
+			assert.Equal(t, float64(i), point.Value)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("Points after the first were held up by the blocking subscriber")
+		}
+	}
+	// The point being waited for may still be in the buffer too
+	stats := publisher.Stats()
+	assert.True(t, stats.Subscribers[0].Buffered >= 4)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, float64(i), (<-blocking).Value)
+	}
+}
+
+func TestDropOldestRecovers(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 1)
+	assert.NoError(t, publisher.SubscribeWith(c, SubscribeOptions{Policy: DropOldest}))
+	publisher.Publish(&datatypes.Datapoint{Metric: "metric1"})
+	publisher.Publish(&datatypes.Datapoint{Metric: "metric1"})
+	publisher.Flush()
+	publisher.subscribersLock.Lock()
+	assert.False(t, publisher.subscriptions[c].dropping)
+	assert.Equal(t, uint64(1), publisher.subscriptions[c].dropped)
+	publisher.subscribersLock.Unlock()
+}
+
+func TestCloseSendsPublished(t *testing.T) {
+	publisher := newDatapointPublisher()
+	c := make(chan *datatypes.Datapoint, 100)
+	assert.NoError(t, publisher.Subscribe(c))
+	for i := 0; i < 100; i++ {
+		publisher.Publish(&datatypes.Datapoint{Metric: "metric1"})
+	}
+	publisher.Close()
+	assert.Len(t, receivedMetrics(c), 100)
+	_, ok := <-c
+	assert.False(t, ok)
+}
+
+func TestPublishPublisherStats(t *testing.T) {
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, publisher.SubscribeWith(c, SubscribeOptions{Name: "stats"}, publisherQueueDepthMetric, subscriberQueueDepthMetric, subscriberDroppedMetric))
+	now := time.Now()
+	publishPublisherStats(publisher, now)
+	publisher.Flush()
+	assert.Equal(t, &datatypes.Datapoint{Metric: publisherQueueDepthMetric, Value: 0, Time: now}, <-c)
+	tags := map[string]string{datatypes.SubscriberTag: "stats"}
+	assert.Equal(t, &datatypes.Datapoint{Metric: subscriberQueueDepthMetric, Value: 0, Time: now, Tags: tags}, <-c)
+	assert.Equal(t, &datatypes.Datapoint{Metric: subscriberDroppedMetric, Value: 0, Time: now, Tags: tags}, <-c)
+}
+
 func assertReceived(t *testing.T, c chan *datatypes.Datapoint, message ...interface{}) {
 	select {
 	case <-c:
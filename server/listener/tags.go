@@ -0,0 +1,44 @@
+package listener
+
+import (
+	"sync"
+
+	"server/datatypes"
+)
+
+var currentSession string
+var sessionLock sync.RWMutex
+
+// SetSession sets the test session stamped onto datapoints as they are
+// received. An empty name ends the current session
+func SetSession(name string) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	currentSession = name
+}
+
+// Session returns the name of the current test session, or an empty string
+// if there is none
+func Session() string {
+	sessionLock.RLock()
+	defer sessionLock.RUnlock()
+	return currentSession
+}
+
+// tagPoint stamps the provided tags and the current session onto a newly
+// parsed datapoint
+func tagPoint(point *datatypes.Datapoint, tags map[string]string) {
+	session := Session()
+	if len(tags) == 0 && session == "" {
+		return
+	}
+	if point.Tags == nil {
+		point.Tags = make(map[string]string, len(tags)+1)
+	}
+	for key, value := range tags {
+		point.Tags[key] = value
+	}
+	if session != "" {
+		point.Tags[datatypes.SessionTag] = session
+	}
+}
@@ -1,30 +1,26 @@
 package listener
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"server/storage"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"server/configs"
 	"server/datatypes"
 )
 
-const (
-	connHost = "0.0.0.0"
-	connPort = 6001
-	connType = "tcp"
-)
-
 // TCPConnectionHandler is the object representing the TCP listener
 type TCPConnectionHandler struct {
 	Publisher *DatapointPublisher
 	Parser    *PacketParser
+	// Tags are stamped onto every datapoint received, along with the current session
+	Tags map[string]string
 }
 
 // NewTCPConnectionHandler returns an initialized TCPConnectionHandler
@@ -38,16 +34,15 @@ func NewTCPConnectionHandler(publisher *DatapointPublisher, parser *PacketParser
 var connections sync.Map
 var activeConnectionCount uint32
 
-func reportConnections() {
-	store, err := storage.NewStorage()
-	if err != nil {
-		log.Println("Error getting storage for connection reporting.")
-		return
-	}
-	defer store.Close()
+func reportConnections(ctx context.Context, store storage.Storage) {
 	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 		store.Insert([]*datatypes.Datapoint{
 			{
 				Metric: "Active_TCP_Connections",
@@ -61,11 +56,14 @@ func reportConnections() {
 // HandleTCPConnection handles a new connection
 func (handler *TCPConnectionHandler) HandleTCPConnection(conn net.Conn) {
 	defer conn.Close()
-	connectionKey := conn.RemoteAddr().String() + ";" + string(rand.Intn(1000000))
+	// The key only tells connections apart within the server. Tagging points
+	// with it would start new series in the store every time the car reconnects
+	connectionKey := conn.RemoteAddr().String() + ";" + strconv.Itoa(rand.Intn(1000000))
 	connections.Store(connectionKey, conn)
 	atomic.AddUint32(&activeConnectionCount, 1)
 	defer connections.Delete(connectionKey)
 	defer atomic.AddUint32(&activeConnectionCount, ^uint32(0)) // This is the documented way to decrement a uint atomically
+	defer registerLink(connectionKey, handler.Tags, handler.Parser)()
 	buf := make([]byte, 1024)
 	for {
 		reqLen, err := conn.Read(buf)
@@ -80,6 +78,7 @@ func (handler *TCPConnectionHandler) HandleTCPConnection(conn net.Conn) {
 			if handler.Parser.ParseByte(buf[i]) {
 				points := handler.Parser.ParsePacket()
 				for _, point := range points {
+					tagPoint(point, handler.Tags)
 					handler.Publisher.Publish(point)
 				}
 			}
@@ -87,40 +86,6 @@ func (handler *TCPConnectionHandler) HandleTCPConnection(conn net.Conn) {
 	}
 }
 
-// TCPListen is the main function of listener which listens to the TCP data port for incoming connections
-func TCPListen() {
-	go reportConnections()
-	go writerThread()
-	go monitorConnection()
-	canConfigs, err := configs.LoadConfigs()
-	if err != nil {
-		log.Fatalf("Error loading CAN configs: %s", err)
-	}
-	connListener, err := net.Listen(connType, fmt.Sprintf("%s:%d", connHost, connPort))
-	if err != nil {
-		log.Fatalf("Error listening on TCP port: %s", err)
-	}
-	defer connListener.Close()
-	log.Printf("Listening on %s:%d TCP\n", connHost, connPort)
-	consecutiveFailures := 0
-	for {
-		conn, err := connListener.Accept()
-		if err == nil {
-			consecutiveFailures = 0
-			log.Println("Received connection from", conn.RemoteAddr().String())
-			handler := NewTCPConnectionHandler(GetDatapointPublisher(), NewPacketParser(canConfigs))
-			go handler.HandleTCPConnection(conn)
-		} else {
-			consecutiveFailures++
-			log.Println("Error accepting connection in function Listen: listener/listener.go")
-			log.Printf("Consecutive connection failures: %d\n", consecutiveFailures)
-			if consecutiveFailures >= 5 {
-				log.Fatal("Consecutive connection failures exceeded maximum limit")
-			}
-		}
-	}
-}
-
 var writeChannel = make(chan []byte, 100)
 
 // TCPWriter writes messages to all open TCP connections
@@ -138,9 +103,14 @@ func (w *TCPWriter) Write(buf []byte) {
 	w.writeChannel <- append(make([]byte, 0, len(buf)), buf...)
 }
 
-func writerThread() {
+func writerThread(ctx context.Context) {
 	for {
-		buf := <-writeChannel
+		var buf []byte
+		select {
+		case buf = <-writeChannel:
+		case <-ctx.Done():
+			return
+		}
 		connections.Range(func(key, value interface{}) bool {
 			conn := value.(net.Conn)
 			_, err := conn.Write(buf)
@@ -155,11 +125,17 @@ func writerThread() {
 
 // Subscribe subscribes the channel c to the datapoint publisher.
 // If metrics are provided, the channel will only be subscribed to
-// those metrics
+// those metrics, which may be glob patterns such as Cell_Voltage_*
 func Subscribe(c chan *datatypes.Datapoint, metrics ...string) error {
 	return GetDatapointPublisher().Subscribe(c, metrics...)
 }
 
+// SubscribeWith subscribes the channel c to the datapoint publisher with the
+// given name and policy for when it is full
+func SubscribeWith(c chan *datatypes.Datapoint, options SubscribeOptions, metrics ...string) error {
+	return GetDatapointPublisher().SubscribeWith(c, options, metrics...)
+}
+
 // Unsubscribe unsubscribes the channel c from the datapoint publisher
 func Unsubscribe(c chan *datatypes.Datapoint) error {
 	return GetDatapointPublisher().Unsubscribe(c)
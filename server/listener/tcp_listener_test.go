@@ -65,3 +65,96 @@ func TestTCPConnectionHandler(t *testing.T) {
 	assert.True(t, gotTest1)
 	assert.True(t, gotTest2)
 }
+
+func TestTCPConnectionHandlerTags(t *testing.T) {
+	parser := NewPacketParser(map[int][]*configs.CanConfigType{
+		0x100: {{
+			CanID:    0x100,
+			Datatype: "int32",
+			Name:     "Test1",
+			Offset:   0,
+		}},
+	})
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 1)
+	err := publisher.Subscribe(c)
+	assert.NoError(t, err)
+	SetSession("Unit Test Session")
+	defer SetSession("")
+	l := NewTCPConnectionHandler(publisher, parser)
+	l.Tags = map[string]string{
+		datatypes.CarTag:        "SR-3",
+		datatypes.SourceTag:     datatypes.SourceTCP,
+		datatypes.ConnectionTag: "0.0.0.0:6001",
+	}
+	server, client := net.Pipe()
+	go l.HandleTCPConnection(client)
+	server.Write([]byte{'G', 'T'})
+	binary.Write(server, binary.LittleEndian, uint16(0x100))
+	binary.Write(server, binary.LittleEndian, int32(12345))
+	binary.Write(server, binary.LittleEndian, int32(0))
+	time.Sleep(100 * time.Millisecond)
+	err = server.Close()
+	assert.NoError(t, err)
+
+	select {
+	case p := <-c:
+		assert.Equal(t, "Test1", p.Metric)
+		assert.Equal(t, "SR-3", p.Tags[datatypes.CarTag])
+		assert.Equal(t, datatypes.SourceTCP, p.Tags[datatypes.SourceTag])
+		assert.Equal(t, "Unit Test Session", p.Tags[datatypes.SessionTag])
+		// Points are tagged with the listener rather than the connection, so
+		// reconnecting doesn't start new series in the store
+		assert.Equal(t, "0.0.0.0:6001", p.Tags[datatypes.ConnectionTag])
+	default:
+		t.Fail()
+	}
+}
+
+func TestTCPConnectionHandlerLinks(t *testing.T) {
+	parser := NewPacketParser(map[int][]*configs.CanConfigType{
+		0x100: {{
+			CanID:    0x100,
+			Datatype: "int32",
+			Name:     "Test1",
+			Offset:   0,
+		}},
+	})
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	l := NewTCPConnectionHandler(publisher, parser)
+	l.Tags = map[string]string{datatypes.CarTag: "SR-3", datatypes.ConnectionTag: "Links_Test"}
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		l.HandleTCPConnection(client)
+		close(done)
+	}()
+	frame, err := EncodeFrame(1, 0x100, []byte{1, 0, 0, 0})
+	assert.NoError(t, err)
+	corrupted := append([]byte{}, frame...)
+	corrupted[8] = 2
+	server.Write(append(corrupted, frame...))
+	time.Sleep(100 * time.Millisecond)
+
+	// The connection's stats are available while it is open
+	var found *Link
+	for _, link := range Links() {
+		if link.Tags[datatypes.ConnectionTag] == "Links_Test" {
+			link := link
+			found = &link
+		}
+	}
+	if assert.NotNil(t, found) {
+		assert.Contains(t, found.Connection, client.RemoteAddr().String())
+		assert.Equal(t, uint64(1), found.Packets)
+		assert.Equal(t, uint64(1), found.CRCFailures)
+		assert.Equal(t, uint64(2*len(frame)), found.Bytes)
+	}
+	assert.NoError(t, server.Close())
+	<-done
+	for _, link := range Links() {
+		assert.NotEqual(t, "SR-3", link.Tags[datatypes.CarTag])
+	}
+}
@@ -1,65 +1,91 @@
 package listener
 
 import (
-	"log"
-	"net"
-	"server/configs"
+	"time"
 )
 
+// udpSenderTimeout is how long a UDP sender may be silent before its parser
+// and stats are dropped
+const udpSenderTimeout = time.Minute
+
 // UDPHandler is the object representing the UDP listener
 type UDPHandler struct {
 	Publisher *DatapointPublisher
-	Parser    *PacketParser
+	// NewParser returns the parser for a new sender. Each sender has its own
+	// parser, so senders can't corrupt each other's packets or stats
+	NewParser func() *PacketParser
+	// Tags are stamped onto every datapoint received, along with the current session
+	Tags map[string]string
+
+	senders   map[string]*udpSender
+	lastSweep time.Time
+}
+
+// udpSender is the state kept for each address datagrams are received from
+type udpSender struct {
+	parser     *PacketParser
+	lastSeen   time.Time
+	unregister func()
 }
 
 // NewUDPHandler returns an initialized UDPHandler
-func NewUDPHandler(publisher *DatapointPublisher, parser *PacketParser) *UDPHandler {
+func NewUDPHandler(publisher *DatapointPublisher, newParser func() *PacketParser) *UDPHandler {
 	return &UDPHandler{
 		Publisher: publisher,
-		Parser:    parser,
+		NewParser: newParser,
+		senders:   make(map[string]*udpSender),
 	}
 }
 
-// UDPListen listens for UDP data
-// This code runs in a single goroutine since UDP is connectionless
-// Read data gets streamed to the DatapointPublisher
-func UDPListen() {
-	canConfigs, err := configs.LoadConfigs()
-
-	if err != nil {
-		log.Fatalf("Error loading CAN configs: %s", err)
-	}
-
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		Port: connPort,
-		IP:   net.ParseIP(connHost),
-	})
-
-	if err != nil {
-		log.Fatalf("Error listening on UDP port: %s", err)
-	}
-	defer conn.Close()
-	log.Printf("Listening on %s:%d UDP\n", connHost, connPort)
-
-	// initialize the UDP handler to handle all UDP packets
-	handler := NewUDPHandler(GetDatapointPublisher(), NewPacketParser(canConfigs))
-
-	for {
-		message := make([]byte, 20)
-		rlen, _, err := conn.ReadFromUDP(message[:])
-
-		if err != nil {
-			log.Fatalf("UDP error: %s", err)
+// HandleDatagram parses the packets in a datagram received from addr at the given
+// time. Packets can't span datagrams, so one cut off by the end of the datagram
+// is dropped, but a datagram may hold any number of packets
+func (handler *UDPHandler) HandleDatagram(addr string, datagram []byte, now time.Time) {
+	sender := handler.sender(addr, now)
+	for _, b := range datagram {
+		if sender.parser.ParseByte(b) {
+			points := sender.parser.ParsePacket()
+			for _, point := range points {
+				tagPoint(point, handler.Tags)
+				handler.Publisher.Publish(point)
+			}
 		}
+	}
+	sender.parser.Truncate()
+}
 
-		for i := 0; i < rlen; i++ {
-			if handler.Parser.ParseByte(message[i]) {
-				points := handler.Parser.ParsePacket()
-				for _, point := range points {
-					handler.Publisher.Publish(point)
-				}
+// sender returns the state of the sender at addr, starting to track it if it
+// is new, and stops tracking senders that have gone silent
+func (handler *UDPHandler) sender(addr string, now time.Time) *udpSender {
+	if now.Sub(handler.lastSweep) > udpSenderTimeout {
+		handler.lastSweep = now
+		for key, sender := range handler.senders {
+			if now.Sub(sender.lastSeen) > udpSenderTimeout {
+				sender.unregister()
+				delete(handler.senders, key)
 			}
 		}
+	}
+	sender, ok := handler.senders[addr]
+	if !ok {
+		parser := handler.NewParser()
+		sender = &udpSender{
+			parser:     parser,
+			unregister: registerLink(addr, handler.Tags, parser),
+		}
+		handler.senders[addr] = sender
+	}
+	sender.lastSeen = now
+	return sender
+}
 
+// Close stops reporting the stats of every sender
+func (handler *UDPHandler) Close() {
+	for key, sender := range handler.senders {
+		sender.unregister()
+		delete(handler.senders, key)
 	}
 }
+
+// maxDatagramSize is the largest UDP datagram read, which fits in an ethernet frame
+const maxDatagramSize = 1500
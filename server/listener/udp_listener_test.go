@@ -0,0 +1,69 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"server/configs"
+	"server/datatypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPHandler(t *testing.T) {
+	canConfigs := map[int][]*configs.CanConfigType{
+		1: {{CanID: 1, Datatype: "uint8", Name: "UDP_Test", Offset: 0}},
+	}
+	publisher := newDatapointPublisher()
+	defer publisher.Close()
+	c := make(chan *datatypes.Datapoint, 10)
+	assert.NoError(t, publisher.Subscribe(c))
+	handler := NewUDPHandler(publisher, func() *PacketParser {
+		return NewPacketParser(canConfigs)
+	})
+	handler.Tags = map[string]string{datatypes.SourceTag: datatypes.SourceUDP, datatypes.ConnectionTag: "0.0.0.0:6001"}
+	defer handler.Close()
+
+	frame := func(sequence uint16, value byte) []byte {
+		frame, err := EncodeFrame(sequence, 1, []byte{value})
+		assert.NoError(t, err)
+		return frame
+	}
+	now := time.Now()
+	// A datagram may hold several packets, but they can't span datagrams,
+	// so the start of a packet from one sender doesn't corrupt the next
+	// datagram from another
+	handler.HandleDatagram("10.0.0.1:5000", append(frame(1, 1), frame(2, 2)[:5]...), now)
+	handler.HandleDatagram("10.0.0.2:5000", append(frame(1, 3), 'G', 'T', 1, 0, 4, 0, 0, 0, 0, 0, 0, 0), now)
+	handler.HandleDatagram("10.0.0.1:5000", append(frame(3, 5), frame(4, 6)...), now)
+	time.Sleep(100 * time.Millisecond)
+
+	values := make([]float64, 0)
+	for len(c) > 0 {
+		point := <-c
+		assert.Equal(t, datatypes.SourceUDP, point.Tags[datatypes.SourceTag])
+		assert.Equal(t, "0.0.0.0:6001", point.Tags[datatypes.ConnectionTag])
+		values = append(values, point.Value)
+	}
+	assert.Equal(t, []float64{1, 3, 4, 5, 6}, values)
+
+	// Each sender has its own stats
+	stats := make(map[string]LinkStats)
+	for _, link := range Links() {
+		stats[link.Connection] = link.LinkStats
+	}
+	assert.Equal(t, uint64(3), stats["10.0.0.1:5000"].Packets)
+	assert.Equal(t, uint64(1), stats["10.0.0.1:5000"].Truncated)
+	assert.Equal(t, uint64(1), stats["10.0.0.1:5000"].Gaps)
+	assert.Equal(t, uint64(2), stats["10.0.0.2:5000"].Packets)
+	assert.Equal(t, uint64(0), stats["10.0.0.2:5000"].Truncated)
+
+	// Senders that go silent are dropped
+	handler.HandleDatagram("10.0.0.2:5000", frame(2, 7), now.Add(2*udpSenderTimeout))
+	connections := make([]string, 0)
+	for _, link := range Links() {
+		connections = append(connections, link.Connection)
+	}
+	assert.Contains(t, connections, "10.0.0.2:5000")
+	assert.NotContains(t, connections, "10.0.0.1:5000")
+}
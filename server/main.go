@@ -1,25 +1,64 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"server/api"
 	"server/computations"
+	"server/configs"
 	"server/datatypes"
 	"server/listener"
+	"server/settings"
 	"server/storage"
 )
 
+// configWatchInterval is how often the CAN config directory and formulas file are checked for changes
+const configWatchInterval = 2 * time.Second
+
 func main() {
-	go listener.TCPListen()
-	go listener.UDPListen()
-	store, err := storage.NewStorage()
+	config, err := settings.Load()
+	if err != nil {
+		log.Fatalf("Error loading server configuration: %s", err)
+	}
+	configs.SetDir(config.CANConfigDir)
+	_, err = configs.LoadConfigs()
+	if err != nil {
+		log.Fatalf("Error loading CAN configs: %s", err)
+	}
+	err = computations.LoadFormulas(config.FormulasFile)
+	if err != nil {
+		log.Fatalf("Error loading formulas: %s", err)
+	}
+	err = computations.LoadSOCConfig(config.SOCConfigFile)
+	if err != nil {
+		log.Fatalf("Error loading SOC config: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+	go configs.Watch(configWatchInterval, ctx.Done())
+	go computations.WatchFormulas(config.FormulasFile, configWatchInterval, ctx.Done())
+	store, err := storage.NewStorage(config.Storage)
 	if err != nil {
 		log.Fatalf("Error initializing storage: %s", err)
 	}
 	defer store.Close()
-	go api.StartServer([]api.RouteHandler{
+	queue, err := storage.NewWriteAheadQueue(store, config.Storage.QueuePath)
+	if err != nil {
+		log.Fatalf("Error opening storage queue: %s", err)
+	}
+	defer queue.Close()
+	listenersStopped, err := listener.Listen(ctx, store, config.Listeners, config.Car)
+	if err != nil {
+		log.Fatalf("Error starting listeners: %s", err)
+	}
+	serverStopped := make(chan error, 1)
+	handlers := []api.RouteHandler{
 		api.NewChatHandler(),
 		api.NewCore(store),
 		api.NewCSVHandler(store),
@@ -29,19 +68,83 @@ func main() {
 		api.NewMapHandler(),
 		api.NewReconToolHandler(store),
 		api.NewMergeHandler(store),
-	})
-	go computations.RunComputations()
-	err = recordData(store)
-	log.Fatalf("Error recording data: %s", err)
+	}
+	go func() {
+		serverStopped <- api.StartServer(ctx, handlers)
+	}()
+	// Computations have their own context so that they can compute the last
+	// points received once the listeners have stopped
+	computeCtx, stopComputations := context.WithCancel(context.Background())
+	defer stopComputations()
+	computationsStopped := computations.RunComputations(computeCtx)
+	// Recording has its own context so that it can keep going until
+	// everything received before the shutdown has been published
+	recordCtx, stopRecording := context.WithCancel(context.Background())
+	defer stopRecording()
+	recording := make(chan error, 1)
+	go func() {
+		recording <- recordData(recordCtx, queue)
+	}()
+	select {
+	case <-ctx.Done():
+	case err = <-recording:
+		log.Fatalf("Error recording data: %s", err)
+	case err = <-serverStopped:
+		log.Fatalf("Error running HTTP server: %s", err)
+	}
+
+	log.Println("Shutting down...")
+	<-listenersStopped
+	err = <-serverStopped
+	if err != nil {
+		log.Printf("Error shutting down HTTP server: %s", err)
+	}
+	stopComputations()
+	<-computationsStopped
+	listener.GetDatapointPublisher().Flush()
+	stopRecording()
+	err = <-recording
+	if err != nil {
+		log.Printf("Error recording data: %s", err)
+	}
+	log.Println("Shut down")
 }
 
-func recordData(store *storage.Storage) error {
+// cancelOnSignal cancels the server's context when it is asked to stop, so
+// that it can shut down cleanly. A second signal stops it straight away
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down\n", sig)
+	cancel()
+	sig = <-signals
+	log.Fatalf("Received %s while shutting down", sig)
+}
+
+// queueDepthMetric is the number of points waiting to be inserted into the store
+const queueDepthMetric = "Storage_Queue_Depth"
+
+// storageSubscriberTimeout is how long the publisher waits for room to send a
+// point to be recorded before dropping it
+const storageSubscriberTimeout = 2 * time.Second
+
+// recordData queues the points published to be inserted into the store until
+// ctx is done, when the points it has received but not queued are queued
+func recordData(ctx context.Context, queue *storage.WriteAheadQueue) error {
 	points := make(chan *datatypes.Datapoint, 1000)
-	err := listener.Subscribe(points)
+	// Waiting for room keeps storage from losing points to a short stall. The
+	// points wait in the subscriber's own buffer, so the listeners aren't held up
+	err := listener.SubscribeWith(points, listener.SubscribeOptions{
+		Name:    "storage",
+		Policy:  listener.Block,
+		Timeout: storageSubscriberTimeout,
+	})
 	if err != nil {
 		return err
 	}
 	defer listener.Unsubscribe(points)
+	publisher := listener.GetDatapointPublisher()
 	bufferedPoints := make([]*datatypes.Datapoint, 0, 100)
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -50,11 +153,27 @@ func recordData(store *storage.Storage) error {
 		case point := <-points:
 			bufferedPoints = append(bufferedPoints, point)
 		case <-ticker.C:
-			err = store.Insert(bufferedPoints)
+			err = queue.Enqueue(bufferedPoints)
 			if err != nil {
-				return err
+				// Keep the points and try again on the next tick
+				log.Printf("Error queueing %d points for storage: %s\n", len(bufferedPoints), err)
+			} else {
+				bufferedPoints = make([]*datatypes.Datapoint, 0, 100)
+			}
+			publisher.Publish(&datatypes.Datapoint{
+				Metric: queueDepthMetric,
+				Value:  float64(queue.Depth()),
+				Time:   time.Now(),
+			})
+		case <-ctx.Done():
+			for {
+				select {
+				case point := <-points:
+					bufferedPoints = append(bufferedPoints, point)
+				default:
+					return queue.Enqueue(bufferedPoints)
+				}
 			}
-			bufferedPoints = make([]*datatypes.Datapoint, 0, 100)
 		}
 	}
 }
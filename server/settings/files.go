@@ -0,0 +1,58 @@
+package settings
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"time"
+)
+
+// SourcePath returns name joined to the directory of the source file calling it,
+// which is where the server's default files are kept
+func SourcePath(name string) (string, error) {
+	_, filename, _, ok := runtime.Caller(1)
+	if !ok {
+		return "", fmt.Errorf("Could not find runtime caller")
+	}
+	return path.Join(path.Dir(filename), name), nil
+}
+
+// FileState returns a summary of filename which changes when it is modified,
+// created or removed
+func FileState(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// Watch calls state every interval until done is closed, calling reload whenever
+// the state changes. The first state is taken to be the one already loaded.
+// Errors are logged as errors reloading what
+func Watch(what string, interval time.Duration, done <-chan struct{}, state func() (string, error), reload func() error) {
+	var lastState string
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		current, err := state()
+		if err == nil && current != lastState {
+			if lastState != "" {
+				err = reload()
+			}
+			lastState = current
+		}
+		if err != nil {
+			log.Printf("Error reloading %s: %s\n", what, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
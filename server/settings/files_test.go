@@ -0,0 +1,73 @@
+package settings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourcePath(t *testing.T) {
+	filename, err := SourcePath(configFileName)
+	assert.NoError(t, err)
+	assert.Equal(t, configFileName, path.Base(filename))
+	_, err = os.Stat(filename)
+	assert.NoError(t, err)
+}
+
+func TestFileState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "watched.json")
+
+	missing, err := FileState(filename)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("{}"), 0644))
+	written, err := FileState(filename)
+	assert.NoError(t, err)
+	assert.NotEqual(t, missing, written)
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("[]\n"), 0644))
+	rewritten, err := FileState(filename)
+	assert.NoError(t, err)
+	assert.NotEqual(t, written, rewritten)
+}
+
+func TestWatch(t *testing.T) {
+	states := make(chan string, 4)
+	states <- "first"
+	states <- "first"
+	states <- "second"
+	states <- "third"
+	reloads := make(chan string, 4)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var current string
+	go func() {
+		defer close(stopped)
+		state := func() (string, error) {
+			select {
+			case current = <-states:
+				return current, nil
+			default:
+				return "", fmt.Errorf("No more states")
+			}
+		}
+		reload := func() error {
+			reloads <- current
+			return nil
+		}
+		Watch("test", time.Millisecond, done, state, reload)
+	}()
+
+	// The first state is taken as loaded and unchanged states aren't reloaded
+	assert.Equal(t, "second", <-reloads)
+	assert.Equal(t, "third", <-reloads)
+	close(done)
+	<-stopped
+	assert.Empty(t, reloads)
+}
@@ -0,0 +1,212 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const configFileName = "server_config.json"
+
+// Settings mirrors the structure of the server configuration file
+type Settings struct {
+	// Car is the car datapoints received by the listeners are tagged with
+	Car string `json:"car"`
+	// CANConfigDir is the directory of CAN config files, defaulting to
+	// configs/can_configs. It is watched for changes while the server runs
+	CANConfigDir string `json:"can_config_dir"`
+	// FormulasFile is the file of computations defined by formulas, defaulting
+	// to computations/formulas.json. It is watched for changes while the server runs
+	FormulasFile string `json:"formulas_file"`
+	// SOCConfigFile is the file of cell tables and filter parameters used to
+	// estimate the pack's state of charge, defaulting to computations/soc_config.json
+	SOCConfigFile string `json:"soc_config_file"`
+	// Listeners are the sockets car data is received on
+	Listeners []Listener `json:"listeners"`
+	Storage   Storage    `json:"storage"`
+}
+
+// Listener describes a socket car data is received on
+type Listener struct {
+	// Transport is one of "tcp", "udp" or "unix"
+	Transport string `json:"transport"`
+	// Address is the host:port to listen on, or the path of the socket for "unix"
+	Address string `json:"address"`
+	// Car overrides the car datapoints received on this listener are tagged with
+	Car string `json:"car"`
+	// Name is the connection datapoints received on this listener are tagged
+	// with, defaulting to its address
+	Name string `json:"name"`
+	// CANConfigDir overrides the directory of CAN config files used to parse
+	// the packets received on this listener
+	CANConfigDir string `json:"can_config_dir"`
+}
+
+// Storage holds the configuration of the persistent store
+type Storage struct {
+	// Backend is either "influx" or "embedded"
+	Backend string `json:"backend"`
+	// Path is the directory the embedded backend keeps its data in
+	Path string `json:"path"`
+	// QueuePath is the directory points waiting to be inserted are kept in
+	// while the store is unavailable, defaulting to storage/queue_data
+	QueuePath string `json:"queue_path"`
+	Influx    Influx `json:"influx"`
+}
+
+// Influx holds the configuration of the InfluxDB connection
+type Influx struct {
+	// Addr should be of the form "http://host:port"
+	Addr     string `json:"addr"`
+	Database string `json:"database"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PasswordFile is a file to read the password from, so that it
+	// can be kept with the other secrets instead of in this file
+	PasswordFile string `json:"password_file"`
+	// RetentionPolicy is the retention policy points are written to.
+	// It is created on startup if it is missing
+	RetentionPolicy string `json:"retention_policy"`
+	// RetentionDuration is how long raw points are kept, as an InfluxQL
+	// duration such as "52w" or "INF"
+	RetentionDuration string `json:"retention_duration"`
+	// Rollups are tiers of downsampled points that can be kept for longer
+	Rollups []Rollup `json:"rollups"`
+	TLS     TLS      `json:"tls"`
+}
+
+// Rollup describes a tier in which every metric is rolled up into windows of
+// a fixed length. Each tier has its own retention policy, filled by a
+// continuous query
+type Rollup struct {
+	// Resolution is the length of each window as an InfluxQL duration such as "1s" or "1m"
+	Resolution string `json:"resolution"`
+	// Duration is how long the rollups are kept as an InfluxQL duration
+	// such as "52w". Empty or "INF" keeps them forever
+	Duration string `json:"duration"`
+}
+
+// TLS holds the TLS settings for an HTTPS connection
+type TLS struct {
+	// CACertificate is the path of a PEM file of certificate
+	// authorities to trust in addition to the system pool
+	CACertificate      string `json:"ca_certificate"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// Default returns the settings used when nothing is configured
+func Default() *Settings {
+	return &Settings{
+		Car: "SR-3",
+		Listeners: []Listener{
+			{Transport: "tcp", Address: "0.0.0.0:6001"},
+			{Transport: "udp", Address: "0.0.0.0:6001"},
+		},
+		Storage: Storage{
+			Backend: "influx",
+			Influx: Influx{
+				Addr:              "http://influxdb:8086",
+				Database:          "telemetry",
+				RetentionPolicy:   "autogen",
+				RetentionDuration: "INF",
+			},
+		},
+	}
+}
+
+// Load reads the server configuration file and applies any overrides from
+// the environment. The file is read from the path in the SERVER_CONFIG
+// environment variable, defaulting to settings/server_config.json. A missing
+// file is not an error; the defaults are used instead
+func Load() (*Settings, error) {
+	filename, ok := os.LookupEnv("SERVER_CONFIG")
+	if !ok || filename == "" {
+		var err error
+		filename, err = SourcePath(configFileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := LoadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	err = s.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = s.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadFile reads the settings from the given file on top of the defaults
+func LoadFile(filename string) (*Settings, error) {
+	s := Default()
+	rawJSON, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rawJSON, s)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", filename, err)
+	}
+	return s, nil
+}
+
+func (s *Settings) applyEnv() error {
+	stringVars := map[string]*string{
+		"CAR":                         &s.Car,
+		"CAN_CONFIG_DIR":              &s.CANConfigDir,
+		"FORMULAS_FILE":               &s.FormulasFile,
+		"SOC_CONFIG_FILE":             &s.SOCConfigFile,
+		"STORAGE_BACKEND":             &s.Storage.Backend,
+		"STORAGE_PATH":                &s.Storage.Path,
+		"STORAGE_QUEUE_PATH":          &s.Storage.QueuePath,
+		"INFLUXDB_ADDR":               &s.Storage.Influx.Addr,
+		"INFLUXDB_DB":                 &s.Storage.Influx.Database,
+		"INFLUXDB_USER":               &s.Storage.Influx.Username,
+		"INFLUXDB_PASSWORD":           &s.Storage.Influx.Password,
+		"INFLUXDB_PASSWORD_FILE":      &s.Storage.Influx.PasswordFile,
+		"INFLUXDB_RETENTION_POLICY":   &s.Storage.Influx.RetentionPolicy,
+		"INFLUXDB_RETENTION_DURATION": &s.Storage.Influx.RetentionDuration,
+		"INFLUXDB_TLS_CA":             &s.Storage.Influx.TLS.CACertificate,
+	}
+	for name, field := range stringVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = strings.Trim(value, "\"")
+		}
+	}
+	boolVars := map[string]*bool{
+		"INFLUXDB_TLS_SKIP_VERIFY": &s.Storage.Influx.TLS.InsecureSkipVerify,
+	}
+	for name, field := range boolVars {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Error parsing %s: %s", name, err)
+			}
+			*field = parsed
+		}
+	}
+	return nil
+}
+
+func (s *Settings) resolveSecrets() error {
+	influx := &s.Storage.Influx
+	if influx.PasswordFile != "" && influx.Password == "" {
+		password, err := ioutil.ReadFile(influx.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("Error reading InfluxDB password: %s", err)
+		}
+		influx.Password = strings.TrimSpace(string(password))
+	}
+	return nil
+}
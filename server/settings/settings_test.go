@@ -0,0 +1,81 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A missing file falls back to the defaults
+	s, err := LoadFile(path.Join(dir, "missing.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), s)
+
+	// Fields missing from the file keep their defaults
+	filename := path.Join(dir, configFileName)
+	err = ioutil.WriteFile(filename, []byte(`{"storage": {"influx": {"database": "sr3", "username": "telemetry"}}}`), 0644)
+	assert.NoError(t, err)
+	s, err = LoadFile(filename)
+	assert.NoError(t, err)
+	expected := Default()
+	expected.Storage.Influx.Database = "sr3"
+	expected.Storage.Influx.Username = "telemetry"
+	assert.Equal(t, expected, s)
+
+	// Listeners in the file replace the default ones
+	err = ioutil.WriteFile(filename, []byte(`{"listeners": [{"transport": "unix", "address": "/run/telemetry.sock", "car": "SR-2"}]}`), 0644)
+	assert.NoError(t, err)
+	s, err = LoadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []Listener{{Transport: "unix", Address: "/run/telemetry.sock", Car: "SR-2"}}, s.Listeners)
+
+	err = ioutil.WriteFile(filename, []byte(`{"storage": `), 0644)
+	assert.NoError(t, err)
+	_, err = LoadFile(filename)
+	assert.Error(t, err)
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, configFileName)
+	err = ioutil.WriteFile(filename, []byte(`{"storage": {"influx": {"database": "sr3"}}}`), 0644)
+	assert.NoError(t, err)
+	passwordFile := path.Join(dir, "influx_password.txt")
+	err = ioutil.WriteFile(passwordFile, []byte("hunter2\n"), 0600)
+	assert.NoError(t, err)
+
+	env := map[string]string{
+		"SERVER_CONFIG":            filename,
+		"INFLUXDB_DB":              "\"telemetry_test\"",
+		"INFLUXDB_PASSWORD_FILE":   passwordFile,
+		"INFLUXDB_TLS_SKIP_VERIFY": "true",
+		"FORMULAS_FILE":            "/etc/telemetry/formulas.json",
+		"SOC_CONFIG_FILE":          "/etc/telemetry/soc_config.json",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	s, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "telemetry_test", s.Storage.Influx.Database)
+	assert.Equal(t, "hunter2", s.Storage.Influx.Password)
+	assert.True(t, s.Storage.Influx.TLS.InsecureSkipVerify)
+	assert.Equal(t, "http://influxdb:8086", s.Storage.Influx.Addr)
+	assert.Equal(t, "/etc/telemetry/formulas.json", s.FormulasFile)
+	assert.Equal(t, "/etc/telemetry/soc_config.json", s.SOCConfigFile)
+
+	os.Setenv("INFLUXDB_TLS_SKIP_VERIFY", "maybe")
+	_, err = Load()
+	assert.Error(t, err)
+}
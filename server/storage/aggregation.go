@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"server/datatypes"
+)
+
+// Aggregation is a function summarizing the points of a metric in a window of time
+type Aggregation string
+
+// Aggregations supported by Storage.Aggregate
+const (
+	// First takes the earliest point in each window
+	First Aggregation = "first"
+	// Last takes the latest point in each window
+	Last Aggregation = "last"
+	// Mean averages the points in each window
+	Mean Aggregation = "mean"
+	// Min takes the smallest point in each window
+	Min Aggregation = "min"
+	// Max takes the largest point in each window
+	Max Aggregation = "max"
+	// Count counts the points in each window
+	Count Aggregation = "count"
+	// P95 takes the 95th percentile of the points in each window
+	P95 Aggregation = "p95"
+)
+
+// Aggregations lists every supported aggregation
+var Aggregations = []Aggregation{First, Last, Mean, Min, Max, Count, P95}
+
+// ParseAggregation returns the aggregation with the given name.
+// An empty name is the default aggregation, First
+func ParseAggregation(name string) (Aggregation, error) {
+	if name == "" {
+		return First, nil
+	}
+	for _, aggregation := range Aggregations {
+		if Aggregation(name) == aggregation {
+			return aggregation, nil
+		}
+	}
+	return "", fmt.Errorf("unknown aggregation: %s", name)
+}
+
+// influxQL returns the InfluxQL selector computing the aggregation of the value field
+func (a Aggregation) influxQL() (string, error) {
+	switch a {
+	case First, Last, Mean, Min, Max, Count:
+		return fmt.Sprintf("%s(value)", a), nil
+	case P95:
+		return "percentile(value, 95)", nil
+	default:
+		return "", fmt.Errorf("unknown aggregation: %s", a)
+	}
+}
+
+// apply computes the aggregation of values, which are in time order
+func (a Aggregation) apply(values []float64) float64 {
+	switch a {
+	case Last:
+		return values[len(values)-1]
+	case Mean:
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values))
+	case Min:
+		min := values[0]
+		for _, value := range values {
+			min = math.Min(min, value)
+		}
+		return min
+	case Max:
+		max := values[0]
+		for _, value := range values {
+			max = math.Max(max, value)
+		}
+		return max
+	case Count:
+		return float64(len(values))
+	case P95:
+		return percentile(values, 95)
+	default:
+		return values[0]
+	}
+}
+
+// percentile picks the nearest-rank percentile of values the same way InfluxDB does
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	i := int(math.Floor(float64(len(sorted))*p/100+0.5)) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// aggregatePoints aggregates time-ordered points into windows starting at start,
+// returning a point at the start of each window containing any points
+func aggregatePoints(metric string, points []*datatypes.Datapoint, start time.Time, window time.Duration, aggregation Aggregation) []*datatypes.Datapoint {
+	results := make([]*datatypes.Datapoint, 0)
+	for i := 0; i < len(points); {
+		index := points[i].Time.Sub(start) / window
+		windowStart := start.Add(index * window)
+		windowEnd := windowStart.Add(window)
+		values := make([]float64, 0)
+		for ; i < len(points) && points[i].Time.Before(windowEnd); i++ {
+			values = append(values, points[i].Value)
+		}
+		results = append(results, &datatypes.Datapoint{
+			Metric: metric,
+			Value:  aggregation.apply(values),
+			Time:   windowStart.UTC(),
+		})
+	}
+	return results
+}
+
+// validWindow returns an error if the aggregation window is unusable
+func validWindow(window time.Duration) error {
+	if window <= 0 {
+		return fmt.Errorf("aggregation window must be positive")
+	}
+	return nil
+}
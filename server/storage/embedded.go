@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"server/datatypes"
+)
+
+const embeddedFileSuffix = ".jsonl"
+
+// EmbeddedStorage is a Storage that keeps every series in memory, sorted by
+// time, and optionally persists it to an append-only log per metric on local
+// disk. It lets the server run at a race without the InfluxDB container and
+// lets tests run with no outside services
+type EmbeddedStorage struct {
+	dir     string
+	series  map[string][]*datatypes.Datapoint
+	tagSets map[string][]*tagSet
+	lock    sync.RWMutex
+}
+
+// tagSet is an entry of the tag index of a metric: a combination of tags
+// carried by its points and the span of time those points cover
+type tagSet struct {
+	tags  map[string]string
+	first time.Time
+	last  time.Time
+}
+
+// NewEmbeddedStorage returns an EmbeddedStorage persisted to the directory
+// dir, loading any data already stored there. If dir is empty, the store is
+// kept in memory only
+func NewEmbeddedStorage(dir string) (*EmbeddedStorage, error) {
+	s := &EmbeddedStorage{
+		dir:     dir,
+		series:  make(map[string][]*datatypes.Datapoint),
+		tagSets: make(map[string][]*tagSet),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), embeddedFileSuffix) {
+			continue
+		}
+		metric := strings.TrimSuffix(file.Name(), embeddedFileSuffix)
+		if !datatypes.ValidMetric(metric) {
+			continue
+		}
+		err = s.load(metric)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading %s: %s", file.Name(), err)
+		}
+	}
+	return s, nil
+}
+
+func (s *EmbeddedStorage) metricPath(metric string) string {
+	return path.Join(s.dir, metric+embeddedFileSuffix)
+}
+
+// load replays the log of the given metric into memory
+func (s *EmbeddedStorage) load(metric string) error {
+	file, err := os.Open(s.metricPath(metric))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		point := &datatypes.Datapoint{}
+		err = json.Unmarshal(line, point)
+		if err != nil {
+			// A partially written final line is left behind if the server
+			// died mid-write. Everything before it is still good
+			break
+		}
+		point.Metric = metric
+		point.Time = point.Time.UTC()
+		s.insertSorted(point)
+	}
+	return scanner.Err()
+}
+
+// Insert inserts points into the store
+func (s *EmbeddedStorage) Insert(points []*datatypes.Datapoint) error {
+	for _, point := range points {
+		if !datatypes.ValidMetric(point.Metric) {
+			return metricError(point.Metric)
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	byMetric := make(map[string][]*datatypes.Datapoint)
+	for _, point := range points {
+		stored := copyPoint(point)
+		if stored.Time.IsZero() {
+			stored.Time = time.Now()
+		}
+		stored.Time = stored.Time.UTC()
+		byMetric[stored.Metric] = append(byMetric[stored.Metric], stored)
+	}
+	for metric, metricPoints := range byMetric {
+		if s.dir != "" {
+			err := s.appendToLog(metric, metricPoints)
+			if err != nil {
+				// The disk may be full or briefly unwritable
+				return fmt.Errorf("%w: %s", ErrUnavailable, err)
+			}
+		}
+		for _, point := range metricPoints {
+			s.insertSorted(point)
+		}
+	}
+	return nil
+}
+
+func (s *EmbeddedStorage) appendToLog(metric string, points []*datatypes.Datapoint) error {
+	file, err := os.OpenFile(s.metricPath(metric), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, point := range points {
+		err = encoder.Encode(point)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// insertSorted inserts the point into its series, keeping the series ordered
+// by time. Like InfluxDB, a point with the same timestamp and tags as an
+// existing point overwrites it
+func (s *EmbeddedStorage) insertSorted(point *datatypes.Datapoint) {
+	s.indexTags(point)
+	series := s.series[point.Metric]
+	i := sort.Search(len(series), func(i int) bool {
+		return series[i].Time.After(point.Time)
+	})
+	for j := i - 1; j >= 0 && series[j].Time.Equal(point.Time); j-- {
+		if tagsEqual(series[j].Tags, point.Tags) {
+			series[j] = point
+			return
+		}
+	}
+	series = append(series, nil)
+	copy(series[i+1:], series[i:])
+	series[i] = point
+	s.series[point.Metric] = series
+}
+
+// indexTags adds the tags of the point to the tag index of its metric
+func (s *EmbeddedStorage) indexTags(point *datatypes.Datapoint) {
+	for _, set := range s.tagSets[point.Metric] {
+		if tagsEqual(set.tags, point.Tags) {
+			if point.Time.Before(set.first) {
+				set.first = point.Time
+			}
+			if point.Time.After(set.last) {
+				set.last = point.Time
+			}
+			return
+		}
+	}
+	s.tagSets[point.Metric] = append(s.tagSets[point.Metric], &tagSet{
+		tags:  point.Tags,
+		first: point.Time,
+		last:  point.Time,
+	})
+}
+
+// SelectMetric selects all entries for specified metric
+func (s *EmbeddedStorage) SelectMetric(metric string) ([]*datatypes.Datapoint, error) {
+	return s.run(newQuery(metric))
+}
+
+// SelectMetricTimeRange selects entries for metric within specified time range
+// whose tags match all of the provided tags
+func (s *EmbeddedStorage) SelectMetricTimeRange(metric string, start time.Time, end time.Time, tags map[string]string) ([]*datatypes.Datapoint, error) {
+	return s.run(newQuery(metric).withTags(tags).since(start).through(end))
+}
+
+// Iterate returns an iterator over the entries for metric within specified
+// time range whose tags match all of the provided tags
+func (s *EmbeddedStorage) Iterate(metric string, start time.Time, end time.Time, tags map[string]string) (PointIterator, error) {
+	q := newQuery(metric).withTags(tags).since(start).through(end)
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	from := start
+	inclusive := true
+	return newChunkIterator(func() ([]*datatypes.Datapoint, error) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		series := s.series[metric]
+		i := sort.Search(len(series), func(i int) bool {
+			return series[i].Time.After(from) || (inclusive && series[i].Time.Equal(from))
+		})
+		chunk := make([]*datatypes.Datapoint, 0)
+		j := i
+		// Chunks only end between points at different times, so that the next
+		// chunk can pick up after the time of the last point in this one
+		for ; j < len(series) && !series[j].Time.After(end); j++ {
+			if len(chunk) >= chunkSize && !series[j].Time.Equal(series[j-1].Time) {
+				break
+			}
+			if q.matches(series[j]) {
+				chunk = append(chunk, copyPoint(series[j]))
+			}
+		}
+		if j == i {
+			return nil, nil
+		}
+		from = series[j-1].Time
+		inclusive = false
+		return chunk, nil
+	}, nil), nil
+}
+
+// Aggregate aggregates the points of metric in [start, end) into windows
+func (s *EmbeddedStorage) Aggregate(metric string, start time.Time, end time.Time, window time.Duration, aggregation Aggregation, tags map[string]string) ([]*datatypes.Datapoint, error) {
+	return s.run(newQuery(metric).withTags(tags).since(start).until(end).aggregate(aggregation, window))
+}
+
+// Latest returns the most recent datapoint for the given metric
+// whose tags match all of the provided tags
+func (s *EmbeddedStorage) Latest(metric string, tags map[string]string) (*datatypes.Datapoint, error) {
+	return s.latest(newQuery(metric).withTags(tags))
+}
+
+// LatestNonZero returns the most recent non-zero datapoint for the given metric
+// whose tags match all of the provided tags
+func (s *EmbeddedStorage) LatestNonZero(metric string, tags map[string]string) (*datatypes.Datapoint, error) {
+	return s.latest(newQuery(metric).withTags(tags).whereValue(notEqual, 0))
+}
+
+func (s *EmbeddedStorage) latest(q *query) (*datatypes.Datapoint, error) {
+	points, err := s.run(q.newestFirst().first(1))
+	if err != nil || len(points) == 0 {
+		return nil, err
+	}
+	return points[0], nil
+}
+
+// run evaluates the query against the series of its metric
+func (s *EmbeddedStorage) run(q *query) ([]*datatypes.Datapoint, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	series := s.series[q.metric]
+	first := 0
+	if !q.start.IsZero() {
+		first = sort.Search(len(series), func(i int) bool {
+			return !series[i].Time.Before(q.start)
+		})
+	}
+	last := len(series)
+	if !q.end.IsZero() {
+		last = sort.Search(len(series), func(i int) bool {
+			return series[i].Time.After(q.end)
+		})
+	}
+	matched := make([]*datatypes.Datapoint, 0)
+	if q.descending && q.limit > 0 && q.aggregation == "" {
+		// Only the newest few points are wanted, so search from the end
+		for i := last - 1; i >= first && len(matched) < q.limit; i-- {
+			if q.matches(series[i]) {
+				matched = append(matched, series[i])
+			}
+		}
+		return copyPoints(matched), nil
+	}
+	for i := first; i < last; i++ {
+		if q.matches(series[i]) {
+			matched = append(matched, series[i])
+		}
+	}
+	if q.aggregation != "" {
+		return q.apply(matched), nil
+	}
+	return copyPoints(q.apply(matched)), nil
+}
+
+// TagValues returns the distinct values of the key tag among the points of metric
+// in the time range whose tags match all of the provided tags, in sorted order.
+// Points without the tag give an empty value. Only the tag index is read, so a
+// combination of tags is counted if its points span the range without being in it
+func (s *EmbeddedStorage) TagValues(metric string, key string, start time.Time, end time.Time, tags map[string]string) ([]string, error) {
+	if err := newQuery(metric).withTags(tags).tagValues(key).validate(); err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	seen := make(map[string]bool)
+	values := make([]string, 0)
+	for _, set := range s.tagSets[metric] {
+		if (!start.IsZero() && set.last.Before(start)) || (!end.IsZero() && set.first.After(end)) {
+			continue
+		}
+		if !tagsMatch(set.tags, tags) {
+			continue
+		}
+		value := set.tags[key]
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// ListMetrics lists all of the metrics in the store
+func (s *EmbeddedStorage) ListMetrics() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	metrics := make([]string, 0, len(s.series))
+	for metric := range s.series {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics, nil
+}
+
+// DeleteMetric deletes a metric from the store
+func (s *EmbeddedStorage) DeleteMetric(metric string) error {
+	if err := newQuery(metric).validate(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.series, metric)
+	delete(s.tagSets, metric)
+	if s.dir == "" {
+		return nil
+	}
+	err := os.Remove(s.metricPath(metric))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close performs cleanup work. Every Insert is already written through to
+// disk, so there is nothing to flush
+func (s *EmbeddedStorage) Close() error {
+	return nil
+}
+
+func copyPoint(point *datatypes.Datapoint) *datatypes.Datapoint {
+	copied := *point
+	if len(point.Tags) > 0 {
+		copied.Tags = make(map[string]string, len(point.Tags))
+		for k, v := range point.Tags {
+			copied.Tags[k] = v
+		}
+	} else {
+		copied.Tags = nil
+	}
+	return &copied
+}
+
+func copyPoints(points []*datatypes.Datapoint) []*datatypes.Datapoint {
+	copied := make([]*datatypes.Datapoint, len(points))
+	for i, point := range points {
+		copied[i] = copyPoint(point)
+	}
+	return copied
+}
+
+func tagsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
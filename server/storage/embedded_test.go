@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedStoragePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded_storage_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewEmbeddedStorage(dir)
+	assert.NoError(t, err)
+	points := []*datatypes.Datapoint{
+		{
+			Metric: "Unit_Test_Persist",
+			Value:  2,
+			Time:   time.Unix(2, 0).UTC(),
+			Tags:   map[string]string{"car": "SR-3"},
+		},
+		{
+			Metric: "Unit_Test_Persist",
+			Value:  1,
+			Time:   time.Unix(1, 0).UTC(),
+		},
+		{
+			Metric: "Unit_Test_Deleted",
+			Value:  3,
+			Time:   time.Unix(1, 0).UTC(),
+		},
+	}
+	err = store.Insert(points)
+	assert.NoError(t, err)
+	err = store.DeleteMetric("Unit_Test_Deleted")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	// A torn final write should not prevent the rest of the log from loading
+	file, err := os.OpenFile(path.Join(dir, "Unit_Test_Persist.jsonl"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	file.Write([]byte(`{"metric":"Unit_Test_Pers`))
+	file.Close()
+
+	reopened, err := storage.NewEmbeddedStorage(dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	metrics, err := reopened.ListMetrics()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Unit_Test_Persist"}, metrics)
+	stored, err := reopened.SelectMetric("Unit_Test_Persist")
+	assert.NoError(t, err)
+	assert.Equal(t, []*datatypes.Datapoint{points[1], points[0]}, stored)
+}
+
+func TestEmbeddedStorageOverwrite(t *testing.T) {
+	store, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	at := time.Unix(5, 0).UTC()
+	err = store.Insert([]*datatypes.Datapoint{
+		{Metric: "Unit_Test_Overwrite", Value: 1, Time: at},
+		{Metric: "Unit_Test_Overwrite", Value: 2, Time: at},
+		{Metric: "Unit_Test_Overwrite", Value: 3, Time: at, Tags: map[string]string{"source": "udp"}},
+	})
+	assert.NoError(t, err)
+	stored, err := store.SelectMetric("Unit_Test_Overwrite")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(stored))
+	assert.Equal(t, float64(2), stored[0].Value)
+	assert.Equal(t, float64(3), stored[1].Value)
+
+	// Mutating a returned point must not change what is stored
+	stored[0].Value = 100
+	latest, err := store.Latest("Unit_Test_Overwrite", nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, float64(100), latest.Value)
+}
+
+func TestEmbeddedStorageTagValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded_storage_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewEmbeddedStorage(dir)
+	assert.NoError(t, err)
+	err = store.Insert([]*datatypes.Datapoint{
+		{Metric: "Unit_Test_Tag_Values", Value: 1, Time: time.Unix(1, 0), Tags: map[string]string{"car": "SR-3", "source": "tcp"}},
+		{Metric: "Unit_Test_Tag_Values", Value: 2, Time: time.Unix(5, 0), Tags: map[string]string{"car": "SR-4", "source": "udp"}},
+		{Metric: "Unit_Test_Tag_Values", Value: 3, Time: time.Unix(9, 0), Tags: map[string]string{"car": "SR-3", "source": "tcp"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	// The index is rebuilt from the logs on disk
+	reopened, err := storage.NewEmbeddedStorage(dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	values, err := reopened.TagValues("Unit_Test_Tag_Values", "car", time.Unix(0, 0), time.Unix(10, 0), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SR-3", "SR-4"}, values)
+	values, err = reopened.TagValues("Unit_Test_Tag_Values", "car", time.Unix(0, 0), time.Unix(10, 0), map[string]string{"source": "udp"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SR-4"}, values)
+	values, err = reopened.TagValues("Unit_Test_Tag_Values", "car", time.Unix(6, 0), time.Unix(8, 0), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SR-3"}, values)
+	values, err = reopened.TagValues("Unit_Test_Tag_Values", "car", time.Unix(10, 0), time.Unix(20, 0), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	_, err = reopened.TagValues("Unit_Test_Tag_Values", "car; DROP", time.Unix(0, 0), time.Unix(10, 0), nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, reopened.DeleteMetric("Unit_Test_Tag_Values"))
+	values, err = reopened.TagValues("Unit_Test_Tag_Values", "car", time.Unix(0, 0), time.Unix(10, 0), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+}
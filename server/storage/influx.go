@@ -0,0 +1,618 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/datatypes"
+	"server/settings"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+var identifierRegex = regexp.MustCompile("\\A[a-zA-Z0-9_-]+\\z")
+var durationRegex = regexp.MustCompile("\\A(INF|([0-9]+(ns|u|ms|s|m|h|d|w))+)\\z")
+
+// pingTimeout is how long to wait for InfluxDB to answer before taking it to be down
+const pingTimeout = 2 * time.Second
+
+// InfluxStorage is the Storage backed by InfluxDB
+type InfluxStorage struct {
+	client          client.Client
+	database        string
+	retentionPolicy string
+	// rawDuration is how long raw points are kept, 0 if forever
+	rawDuration time.Duration
+	// rawDurationQL is the InfluxQL duration of the raw points from the settings
+	rawDurationQL string
+	tiers         []tier
+	// created is whether the database has been set up, which is retried until
+	// InfluxDB can be reached
+	created     bool
+	createdLock sync.Mutex
+}
+
+// NewInfluxStorage returns an initialized InfluxStorage connected as described
+// by config. The database and retention policy are created if they are missing.
+// If InfluxDB can't be reached yet they are created once it can, so that points
+// are kept in the write-ahead queue in the meantime
+func NewInfluxStorage(config settings.Influx) (*InfluxStorage, error) {
+	if !identifierRegex.MatchString(config.Database) {
+		return nil, fmt.Errorf("illegal database name: %v", config.Database)
+	}
+	if !identifierRegex.MatchString(config.RetentionPolicy) {
+		return nil, fmt.Errorf("illegal retention policy name: %v", config.RetentionPolicy)
+	}
+	rawDuration, err := parseInfluxDuration(config.RetentionDuration)
+	if err != nil {
+		return nil, fmt.Errorf("illegal retention duration: %v", config.RetentionDuration)
+	}
+	tiers, err := parseTiers(config.Rollups)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := getTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:               config.Addr,
+		Username:           config.Username,
+		Password:           config.Password,
+		InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		TLSConfig:          tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage := &InfluxStorage{
+		client:          c,
+		database:        config.Database,
+		retentionPolicy: config.RetentionPolicy,
+		rawDuration:     rawDuration,
+		rawDurationQL:   config.RetentionDuration,
+		tiers:           tiers,
+	}
+	err = storage.ensureDatabase()
+	if err != nil {
+		log.Printf("WARNING: Could not set up InfluxDB, retrying when it is used: %s\n", err)
+	}
+	return storage, nil
+}
+
+func getTLSConfig(config settings.TLS) (*tls.Config, error) {
+	if config.CACertificate == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(config.CACertificate)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.CACertificate)
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}, nil
+}
+
+// ensureDatabase sets up the database unless it already has been. InfluxDB may
+// still be starting up alongside the server, so this is tried again every time
+// the database is used until it succeeds
+func (s *InfluxStorage) ensureDatabase() error {
+	s.createdLock.Lock()
+	defer s.createdLock.Unlock()
+	if s.created {
+		return nil
+	}
+	err := s.createDatabase()
+	if err != nil {
+		return err
+	}
+	s.created = true
+	log.Printf("Set up InfluxDB database %s\n", s.database)
+	return nil
+}
+
+// createDatabase creates the database and retention policies if they do not
+// exist yet, and the continuous queries filling the rollup tiers
+func (s *InfluxStorage) createDatabase() error {
+	_, _, err := s.client.Ping(pingTimeout)
+	if err != nil {
+		return err
+	}
+	err = s.execute("CREATE DATABASE " + quoteIdentifier(s.database))
+	if err != nil {
+		return err
+	}
+	policies, err := s.retentionPolicies()
+	if err != nil {
+		return err
+	}
+	err = s.ensureRetentionPolicy(policies, s.retentionPolicy, s.rawDurationQL, true)
+	if err != nil {
+		return err
+	}
+	for i := range s.tiers {
+		t := &s.tiers[i]
+		err = s.ensureRetentionPolicy(policies, t.name, t.durationQL, false)
+		if err != nil {
+			return err
+		}
+		err = s.ensureContinuousQuery(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execute runs a statement that returns no results
+func (s *InfluxStorage) execute(command string) error {
+	response, err := s.client.Query(client.Query{Command: command})
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+// retentionPolicies returns the duration of each retention policy on the database
+func (s *InfluxStorage) retentionPolicies() (map[string]time.Duration, error) {
+	response, err := s.client.Query(client.Query{
+		Command: "SHOW RETENTION POLICIES ON " + quoteIdentifier(s.database),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	policies := make(map[string]time.Duration)
+	if len(response.Results) == 0 {
+		return policies, nil
+	}
+	for _, series := range response.Results[0].Series {
+		for _, value := range series.Values {
+			name, ok := value[0].(string)
+			if !ok {
+				continue
+			}
+			duration, _ := value[1].(string)
+			policies[name], _ = time.ParseDuration(duration)
+		}
+	}
+	return policies, nil
+}
+
+// ensureRetentionPolicy creates the retention policy, or changes how long it keeps
+// points if that no longer matches the settings
+func (s *InfluxStorage) ensureRetentionPolicy(policies map[string]time.Duration, name string, duration string, isDefault bool) error {
+	parsed, err := parseInfluxDuration(duration)
+	if err != nil {
+		return err
+	}
+	current, ok := policies[name]
+	if ok && current == parsed {
+		return nil
+	} else if ok {
+		log.Printf("Changing duration of retention policy %s on %s to %s\n", name, s.database, duration)
+		return s.execute(fmt.Sprintf("ALTER RETENTION POLICY %s ON %s DURATION %s",
+			quoteIdentifier(name), quoteIdentifier(s.database), duration))
+	}
+	log.Printf("Creating retention policy %s on %s with duration %s\n", name, s.database, duration)
+	command := fmt.Sprintf("CREATE RETENTION POLICY %s ON %s DURATION %s REPLICATION 1",
+		quoteIdentifier(name), quoteIdentifier(s.database), duration)
+	if isDefault {
+		command += " DEFAULT"
+	}
+	return s.execute(command)
+}
+
+// ensureContinuousQuery (re)creates the continuous query filling a tier,
+// so that it always matches the settings
+func (s *InfluxStorage) ensureContinuousQuery(t *tier) error {
+	response, err := s.client.Query(client.Query{Command: "SHOW CONTINUOUS QUERIES"})
+	if err != nil {
+		return err
+	}
+	if response.Error() != nil {
+		return response.Error()
+	}
+	if len(response.Results) > 0 {
+		for _, series := range response.Results[0].Series {
+			if series.Name != s.database {
+				continue
+			}
+			for _, value := range series.Values {
+				if name, ok := value[0].(string); ok && name == t.name {
+					err = s.execute(fmt.Sprintf("DROP CONTINUOUS QUERY %s ON %s", quoteIdentifier(t.name), quoteIdentifier(s.database)))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return s.execute(t.continuousQuery(s.database, s.retentionPolicy))
+}
+
+// Insert inserts points into the store
+func (s *InfluxStorage) Insert(points []*datatypes.Datapoint) error {
+	if err := s.ensureDatabase(); err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:        s.database,
+		RetentionPolicy: s.retentionPolicy,
+		Precision:       "ns",
+	})
+	if err != nil {
+		return err
+	}
+	for _, point := range points {
+		if !datatypes.ValidMetric(point.Metric) {
+			return metricError(point.Metric)
+		}
+		fields := map[string]interface{}{"value": point.Value}
+		pt, err := getPoint(point.Metric, point.Tags, fields, point.Time)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	err = s.client.Write(bp)
+	if err != nil && influxUnavailable(err) {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return err
+}
+
+// influxUnavailable returns whether an error writing to InfluxDB came from not
+// reaching it or from it being too busy, rather than from it rejecting the points
+func influxUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "timeout") || strings.Contains(message, "cache maximum memory size exceeded")
+}
+
+func getPoint(metric string, tags map[string]string, fields map[string]interface{}, time time.Time) (*client.Point, error) {
+	if time.IsZero() {
+		return client.NewPoint(metric, tags, fields)
+	}
+	return client.NewPoint(metric, tags, fields, time)
+}
+
+// DeleteMetric deletes a metric from the store
+func (s *InfluxStorage) DeleteMetric(metric string) error {
+	if err := newQuery(metric).validate(); err != nil {
+		return err
+	}
+	if err := s.ensureDatabase(); err != nil {
+		return err
+	}
+	response, err := s.client.Query(client.Query{
+		Command:         "DROP MEASUREMENT " + quoteIdentifier(metric),
+		Database:        s.database,
+		RetentionPolicy: s.retentionPolicy,
+	})
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+// SelectMetric selects all entries for specified metric
+func (s *InfluxStorage) SelectMetric(metric string) ([]*datatypes.Datapoint, error) {
+	return s.run(newQuery(metric))
+}
+
+// SelectMetricTimeRange selects entries for metric within specified time range
+// whose tags match all of the provided tags
+func (s *InfluxStorage) SelectMetricTimeRange(metric string, start time.Time, end time.Time, tags map[string]string) ([]*datatypes.Datapoint, error) {
+	return s.run(newQuery(metric).withTags(tags).since(start).through(end))
+}
+
+// Iterate returns an iterator over the entries for metric within specified
+// time range whose tags match all of the provided tags, read with a chunked query
+func (s *InfluxStorage) Iterate(metric string, start time.Time, end time.Time, tags map[string]string) (PointIterator, error) {
+	command, err := newQuery(metric).withTags(tags).since(start).through(end).flattened().influxQL(s.database, s.retentionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureDatabase(); err != nil {
+		return nil, err
+	}
+	command.Chunked = true
+	command.ChunkSize = chunkSize
+	response, err := s.client.QueryAsChunk(command)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkIterator(func() ([]*datatypes.Datapoint, error) {
+		chunk, err := response.NextResponse()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if chunk.Error() != nil {
+			return nil, chunk.Error()
+		}
+		return getDatapoints(metric, chunk)
+	}, response.Close), nil
+}
+
+// Aggregate aggregates the points of metric in [start, end) into windows,
+// reading from the coarsest rollup tier that can answer the query. The newest
+// windows, which haven't been rolled up yet, are aggregated from the raw points
+func (s *InfluxStorage) Aggregate(metric string, start time.Time, end time.Time, window time.Duration, aggregation Aggregation, tags map[string]string) ([]*datatypes.Datapoint, error) {
+	aggregate := func(start time.Time, end time.Time, t *tier) ([]*datatypes.Datapoint, error) {
+		return s.run(newQuery(metric).withTags(tags).since(start).until(end).aggregate(aggregation, window).fromTier(t))
+	}
+	now := time.Now()
+	t := selectTier(s.tiers, s.rawDuration, start, window, aggregation, now)
+	if t == nil {
+		return aggregate(start, end, nil)
+	}
+	split := t.rolledUpUntil(start, window, now)
+	if !end.IsZero() && !end.After(split) {
+		return aggregate(start, end, t)
+	}
+	if !split.After(start) {
+		return aggregate(start, end, nil)
+	}
+	rolledUp, err := aggregate(start, split, t)
+	if err != nil {
+		return nil, err
+	}
+	recent, err := aggregate(split, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(rolledUp, recent...), nil
+}
+
+// run executes the query, merging the series of every combination of tags it selects
+func (s *InfluxStorage) run(q *query) ([]*datatypes.Datapoint, error) {
+	command, err := q.influxQL(s.database, s.retentionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureDatabase(); err != nil {
+		return nil, err
+	}
+	response, err := s.client.Query(command)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	points, err := getDatapoints(q.metric, response)
+	if err != nil {
+		return nil, err
+	}
+	return q.arrange(points), nil
+}
+
+// getDatapoints collects the points of every series (one per combination of
+// tags) in the response, ordered by time. Besides the tags of the series, any
+// column other than time and value holds a tag of the point
+func getDatapoints(metric string, response *client.Response) ([]*datatypes.Datapoint, error) {
+	results := make([]*datatypes.Datapoint, 0)
+	if len(response.Results) == 0 {
+		return results, nil
+	}
+	for _, series := range response.Results[0].Series {
+		var timeColumn, valueColumn int
+		tagColumns := make(map[int]string)
+		for i, columnName := range series.Columns {
+			if columnName == "time" {
+				timeColumn = i
+			} else if columnName == "value" {
+				valueColumn = i
+			} else {
+				tagColumns[i] = columnName
+			}
+		}
+		var seriesTags map[string]string
+		for key, value := range series.Tags {
+			// Series without a tag that other series have report it as empty
+			if value == "" {
+				continue
+			}
+			if seriesTags == nil {
+				seriesTags = make(map[string]string, len(series.Tags))
+			}
+			seriesTags[key] = value
+		}
+		for _, value := range series.Values {
+			timeString, ok := value[timeColumn].(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected time in %s: %v", series.Name, value[timeColumn])
+			}
+			timestamp, err := time.Parse(time.RFC3339Nano, timeString)
+			if err != nil {
+				return nil, err
+			}
+			// Windows without points hold null
+			number, ok := value[valueColumn].(json.Number)
+			if !ok {
+				continue
+			}
+			val, err := strconv.ParseFloat(string(number), 64)
+			if err != nil {
+				return nil, err
+			}
+			tags := seriesTags
+			if len(tagColumns) > 0 {
+				tags = columnTags(seriesTags, tagColumns, value)
+			}
+			results = append(results, &datatypes.Datapoint{
+				Metric: metric,
+				Value:  val,
+				Tags:   tags,
+				Time:   timestamp,
+			})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	return results, nil
+}
+
+// columnTags returns the tags of a series combined with those in the tag columns
+// of one of its rows. Points without a tag have a null in its column
+func columnTags(seriesTags map[string]string, tagColumns map[int]string, row []interface{}) map[string]string {
+	var tags map[string]string
+	for key, value := range seriesTags {
+		if tags == nil {
+			tags = make(map[string]string, len(seriesTags)+len(tagColumns))
+		}
+		tags[key] = value
+	}
+	for i, key := range tagColumns {
+		if value, ok := row[i].(string); ok && value != "" {
+			if tags == nil {
+				tags = make(map[string]string, len(tagColumns))
+			}
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// TagValues returns the distinct values of the key tag among the series of metric
+// whose tags match all of the provided tags, in sorted order. The time range only
+// narrows them down when InfluxDB uses the TSI index. Series without the tag give an
+// empty value
+func (s *InfluxStorage) TagValues(metric string, key string, start time.Time, end time.Time, tags map[string]string) ([]string, error) {
+	values, err := s.show(newQuery(metric).withTags(tags).since(start).through(end).tagValues(key), 1)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tags[key]; !ok {
+		// SHOW TAG VALUES leaves out series without the tag, which InfluxDB
+		// matches with an empty value
+		untagged := map[string]string{key: ""}
+		series, err := s.show(newQuery(metric).withTags(tags).withTags(untagged).since(start).through(end).series().first(1), 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) > 0 {
+			values = append(values, "")
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// show runs a query selecting series and returns the given column of every row
+func (s *InfluxStorage) show(q *query, column int) ([]string, error) {
+	command, err := q.influxQL(s.database, s.retentionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureDatabase(); err != nil {
+		return nil, err
+	}
+	response, err := s.client.Query(command)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	values := make([]string, 0)
+	if len(response.Results) == 0 {
+		return values, nil
+	}
+	for _, series := range response.Results[0].Series {
+		for _, row := range series.Values {
+			var value string
+			ok := column < len(row)
+			if ok {
+				value, ok = row[column].(string)
+			}
+			if !ok {
+				return nil, fmt.Errorf("unexpected row in %s: %v", series.Name, row)
+			}
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// ListMetrics lists all of the metrics in the table
+func (s *InfluxStorage) ListMetrics() ([]string, error) {
+	if err := s.ensureDatabase(); err != nil {
+		return nil, err
+	}
+	response, err := s.client.Query(client.Query{
+		Command:         "SHOW MEASUREMENTS",
+		Database:        s.database,
+		RetentionPolicy: s.retentionPolicy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	if len(response.Results) == 0 || len(response.Results[0].Series) == 0 {
+		return make([]string, 0), nil
+	}
+	values := response.Results[0].Series[0].Values
+	metrics := make([]string, len(values))
+	for i, value := range values {
+		metrics[i] = value[0].(string)
+	}
+	return metrics, nil
+}
+
+// Latest returns the most recent datapoint for the given metric
+// whose tags match all of the provided tags
+func (s *InfluxStorage) Latest(metric string, tags map[string]string) (*datatypes.Datapoint, error) {
+	return s.latest(newQuery(metric).withTags(tags))
+}
+
+// LatestNonZero returns the most recent non-zero datapoint for the given metric
+// whose tags match all of the provided tags
+func (s *InfluxStorage) LatestNonZero(metric string, tags map[string]string) (*datatypes.Datapoint, error) {
+	return s.latest(newQuery(metric).withTags(tags).whereValue(notEqual, 0))
+}
+
+func (s *InfluxStorage) latest(q *query) (*datatypes.Datapoint, error) {
+	points, err := s.run(q.newestFirst().first(1))
+	if err != nil || len(points) == 0 {
+		return nil, err
+	}
+	return points[0], nil
+}
+
+// Close performs cleanup work
+func (s *InfluxStorage) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/settings"
+
+	client "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDatapointsSkipsNulls(t *testing.T) {
+	response := &client.Response{Results: []client.Result{{Series: []models.Row{{
+		Name:    "BMS_Current",
+		Columns: []string{"time", "value"},
+		Values: [][]interface{}{
+			{"1970-01-01T00:00:10Z", json.Number("1.5")},
+			{"1970-01-01T00:00:20Z", nil},
+			{"1970-01-01T00:00:30Z", json.Number("2")},
+		},
+	}}}}}
+	points, err := getDatapoints("BMS_Current", response)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, 1.5, points[0].Value)
+		assert.Equal(t, time.Unix(30, 0).UTC(), points[1].Time)
+	}
+
+	response.Results[0].Series[0].Values = [][]interface{}{{nil, json.Number("1")}}
+	_, err = getDatapoints("BMS_Current", response)
+	assert.Error(t, err)
+}
+
+func TestNewInfluxStorageWhileDown(t *testing.T) {
+	config := settings.Default().Storage.Influx
+	// Nothing listens on port 1, so connecting is refused straight away
+	config.Addr = "http://127.0.0.1:1"
+	store, err := NewInfluxStorage(config)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	err = store.Insert([]*datatypes.Datapoint{{Metric: "BMS_Current", Value: 1, Time: time.Now()}})
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	assert.False(t, store.created)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"time"
+
+	"server/datatypes"
+)
+
+// chunkSize is the number of points read from the store at a time by a PointIterator
+const chunkSize = 10000
+
+// PointIterator reads points in time order a chunk at a time, so that long time
+// ranges can be processed without holding every point in memory
+type PointIterator interface {
+	// Next advances to the next point, returning false once there are no more
+	// points or reading them failed
+	Next() bool
+	// Point returns the point Next advanced to
+	Point() *datatypes.Datapoint
+	// Err returns the error that ended the iteration, if any
+	Err() error
+	// Close releases the resources held by the iterator
+	Close() error
+}
+
+// chunkIterator is a PointIterator over the chunks returned by next.
+// next returns a nil chunk once there are no more points
+type chunkIterator struct {
+	next  func() ([]*datatypes.Datapoint, error)
+	close func() error
+	chunk []*datatypes.Datapoint
+	i     int
+	done  bool
+	err   error
+}
+
+func newChunkIterator(next func() ([]*datatypes.Datapoint, error), close func() error) *chunkIterator {
+	return &chunkIterator{next: next, close: close}
+}
+
+// Next advances to the next point, reading another chunk if needed
+func (it *chunkIterator) Next() bool {
+	for it.i+1 >= len(it.chunk) {
+		if it.done || it.err != nil {
+			return false
+		}
+		chunk, err := it.next()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if chunk == nil {
+			it.done = true
+			return false
+		}
+		it.chunk = chunk
+		it.i = -1
+	}
+	it.i++
+	return true
+}
+
+// Point returns the point Next advanced to
+func (it *chunkIterator) Point() *datatypes.Datapoint {
+	if it.i < 0 || it.i >= len(it.chunk) {
+		return nil
+	}
+	return it.chunk[it.i]
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *chunkIterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator
+func (it *chunkIterator) Close() error {
+	it.done = true
+	it.chunk = nil
+	if it.close == nil {
+		return nil
+	}
+	return it.close()
+}
+
+// metricsIterator is a PointIterator over the points of several metrics,
+// one metric after another
+type metricsIterator struct {
+	s       Storage
+	metrics []string
+	start   time.Time
+	end     time.Time
+	tags    map[string]string
+	current PointIterator
+	err     error
+}
+
+// IterateMetrics returns an iterator over the points of each of the metrics in turn,
+// as returned by Storage.Iterate. Only one metric is read from the store at a time
+func IterateMetrics(s Storage, metrics []string, start time.Time, end time.Time, tags map[string]string) PointIterator {
+	return &metricsIterator{
+		s:       s,
+		metrics: metrics,
+		start:   start,
+		end:     end,
+		tags:    tags,
+	}
+}
+
+// Next advances to the next point, moving on to the next metric if needed
+func (it *metricsIterator) Next() bool {
+	for it.err == nil {
+		if it.current != nil {
+			if it.current.Next() {
+				return true
+			}
+			it.err = it.current.Err()
+			it.current.Close()
+			it.current = nil
+			continue
+		}
+		if len(it.metrics) == 0 {
+			return false
+		}
+		it.current, it.err = it.s.Iterate(it.metrics[0], it.start, it.end, it.tags)
+		it.metrics = it.metrics[1:]
+	}
+	return false
+}
+
+// Point returns the point Next advanced to
+func (it *metricsIterator) Point() *datatypes.Datapoint {
+	if it.current == nil {
+		return nil
+	}
+	return it.current.Point()
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *metricsIterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator
+func (it *metricsIterator) Close() error {
+	it.metrics = nil
+	if it.current == nil {
+		return nil
+	}
+	err := it.current.Close()
+	it.current = nil
+	return err
+}
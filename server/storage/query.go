@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"server/datatypes"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// operator compares the value of a point in a value predicate
+type operator string
+
+const (
+	equal          operator = "="
+	notEqual       operator = "!="
+	less           operator = "<"
+	lessOrEqual    operator = "<="
+	greater        operator = ">"
+	greaterOrEqual operator = ">="
+)
+
+type valuePredicate struct {
+	op    operator
+	value float64
+}
+
+func (p valuePredicate) matches(value float64) bool {
+	switch p.op {
+	case equal:
+		return value == p.value
+	case notEqual:
+		return value != p.value
+	case less:
+		return value < p.value
+	case lessOrEqual:
+		return value <= p.value
+	case greater:
+		return value > p.value
+	case greaterOrEqual:
+		return value >= p.value
+	default:
+		return false
+	}
+}
+
+// query describes a selection of the points of one metric. It is built up with
+// its methods, then either compiled into InfluxQL by influxQL or evaluated in memory
+// with matches and apply. Names are validated and quoted and every value is bound
+// as a parameter, so nothing a caller provides is ever spliced into a statement.
+// The first invalid argument is remembered and returned by influxQL
+type query struct {
+	metric       string
+	tags         map[string]string
+	values       []valuePredicate
+	start        time.Time
+	end          time.Time
+	endInclusive bool
+	aggregation  Aggregation
+	window       time.Duration
+	descending   bool
+	limit        int
+	flat         bool
+	tagKey       string
+	seriesOnly   bool
+	tier         *tier
+	err          error
+}
+
+// newQuery starts a query selecting every point of metric
+func newQuery(metric string) *query {
+	q := &query{metric: metric}
+	if !datatypes.ValidMetric(metric) {
+		q.err = metricError(metric)
+	}
+	return q
+}
+
+func (q *query) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// withTags selects only points with all of the provided tags
+func (q *query) withTags(tags map[string]string) *query {
+	if err := validTags(tags); err != nil {
+		q.fail(err)
+		return q
+	}
+	for key, value := range tags {
+		if q.tags == nil {
+			q.tags = make(map[string]string, len(tags))
+		}
+		q.tags[key] = value
+	}
+	return q
+}
+
+// whereValue selects only points whose value compares to the given value with op
+func (q *query) whereValue(op operator, value float64) *query {
+	switch op {
+	case equal, notEqual, less, lessOrEqual, greater, greaterOrEqual:
+		q.values = append(q.values, valuePredicate{op, value})
+	default:
+		q.fail(fmt.Errorf("unknown operator: %s", op))
+	}
+	return q
+}
+
+// since selects only points at or after start
+func (q *query) since(start time.Time) *query {
+	q.start = start
+	return q
+}
+
+// through selects only points at or before end
+func (q *query) through(end time.Time) *query {
+	q.end = end
+	q.endInclusive = true
+	return q
+}
+
+// until selects only points before end
+func (q *query) until(end time.Time) *query {
+	q.end = end
+	q.endInclusive = false
+	return q
+}
+
+// aggregate summarizes the points in windows of the given length starting at the
+// start of the query, which must be set
+func (q *query) aggregate(aggregation Aggregation, window time.Duration) *query {
+	if err := validWindow(window); err != nil {
+		q.fail(err)
+	} else if _, err := aggregation.influxQL(); err != nil {
+		q.fail(err)
+	}
+	q.aggregation = aggregation
+	q.window = window
+	return q
+}
+
+// newestFirst orders the points from newest to oldest
+func (q *query) newestFirst() *query {
+	q.descending = true
+	return q
+}
+
+// first selects at most n points
+func (q *query) first(n int) *query {
+	if n <= 0 {
+		q.fail(fmt.Errorf("limit must be positive"))
+	}
+	q.limit = n
+	return q
+}
+
+// flattened selects the tags of each point as columns instead of grouping the points
+// by them, so the points of every combination of tags come back in a single series
+// ordered by time. It can't be combined with aggregation
+func (q *query) flattened() *query {
+	q.flat = true
+	return q
+}
+
+// tagValues selects the distinct values of the key tag among the series the query
+// selects instead of their points. Only InfluxDB runs it, as SHOW TAG VALUES
+func (q *query) tagValues(key string) *query {
+	if !datatypes.ValidMetric(key) {
+		q.fail(fmt.Errorf("%w: tag key %q", ErrIllegalName, key))
+	}
+	q.tagKey = key
+	return q
+}
+
+// series selects the series the query selects instead of their points.
+// Only InfluxDB runs it, as SHOW SERIES
+func (q *query) series() *query {
+	q.seriesOnly = true
+	return q
+}
+
+// fromTier aggregates the rollups of a tier instead of the raw points.
+// Only the InfluxDB backend keeps rollups, so it is ignored in memory
+func (q *query) fromTier(t *tier) *query {
+	q.tier = t
+	return q
+}
+
+// showsSeries returns whether the query selects series rather than points
+func (q *query) showsSeries() bool {
+	return q.tagKey != "" || q.seriesOnly
+}
+
+// quoteIdentifier quotes an InfluxQL identifier such as a measurement or tag key
+func quoteIdentifier(name string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(name) + "\""
+}
+
+// validate returns the first problem with the query, if any
+func (q *query) validate() error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.aggregation != "" && q.start.IsZero() {
+		return fmt.Errorf("aggregation requires a start time")
+	}
+	if q.aggregation != "" && q.flat {
+		return fmt.Errorf("aggregated points can't be flattened")
+	}
+	if q.showsSeries() && (q.aggregation != "" || q.flat || q.descending || len(q.values) > 0) {
+		return fmt.Errorf("series can only be selected by time and tags")
+	}
+	if q.tier != nil {
+		if _, ok := q.tier.selector(q.aggregation); !ok {
+			return fmt.Errorf("%s can't be computed from rollups", q.aggregation)
+		}
+	}
+	return nil
+}
+
+// influxQL compiles the query into an InfluxQL statement with bound parameters
+func (q *query) influxQL(database string, retentionPolicy string) (client.Query, error) {
+	if err := q.validate(); err != nil {
+		return client.Query{}, err
+	}
+	params := make(map[string]interface{})
+	bind := func(value interface{}) string {
+		name := fmt.Sprintf("p%d", len(params))
+		params[name] = value
+		return "$" + name
+	}
+	var conditions []string
+	if !q.start.IsZero() {
+		conditions = append(conditions, "time >= "+bind(q.start.Format(time.RFC3339Nano)))
+	}
+	if !q.end.IsZero() {
+		op := "<"
+		if q.endInclusive {
+			op = "<="
+		}
+		conditions = append(conditions, fmt.Sprintf("time %s %s", op, bind(q.end.Format(time.RFC3339Nano))))
+	}
+	keys := make([]string, 0, len(q.tags))
+	for key := range q.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conditions = append(conditions, fmt.Sprintf("%s = %s", quoteIdentifier(key), bind(q.tags[key])))
+	}
+	for _, predicate := range q.values {
+		conditions = append(conditions, fmt.Sprintf("value %s %s", predicate.op, bind(predicate.value)))
+	}
+
+	var command strings.Builder
+	if q.tagKey != "" {
+		fmt.Fprintf(&command, "SHOW TAG VALUES FROM %s WITH KEY = %s", quoteIdentifier(q.metric), quoteIdentifier(q.tagKey))
+	} else if q.seriesOnly {
+		fmt.Fprintf(&command, "SHOW SERIES FROM %s", quoteIdentifier(q.metric))
+	} else if q.tier != nil {
+		selector, _ := q.tier.selector(q.aggregation)
+		fmt.Fprintf(&command, "SELECT %s AS value", selector)
+		retentionPolicy = q.tier.name
+	} else if q.aggregation != "" {
+		selector, _ := q.aggregation.influxQL()
+		fmt.Fprintf(&command, "SELECT %s AS value", selector)
+	} else if q.flat {
+		command.WriteString("SELECT *")
+	} else {
+		command.WriteString("SELECT value")
+	}
+	if !q.showsSeries() {
+		fmt.Fprintf(&command, " FROM %s", quoteIdentifier(q.metric))
+	}
+	if len(conditions) > 0 {
+		fmt.Fprintf(&command, " WHERE %s", strings.Join(conditions, " AND "))
+	}
+	if q.aggregation != "" {
+		// InfluxDB aligns windows to the epoch, so offset them to line up with start
+		offset := time.Duration(q.start.UnixNano()) % q.window
+		if offset < 0 {
+			offset += q.window
+		}
+		fmt.Fprintf(&command, " GROUP BY time(%dns, %dns) fill(none)", q.window.Nanoseconds(), offset.Nanoseconds())
+	} else if !q.flat && !q.showsSeries() {
+		command.WriteString(" GROUP BY *")
+	}
+	if q.descending {
+		command.WriteString(" ORDER BY time DESC")
+	}
+	// The limit applies to each series, so it is applied again once they are merged
+	if q.limit > 0 {
+		fmt.Fprintf(&command, " LIMIT %d", q.limit)
+	}
+	return client.Query{
+		Command:         command.String(),
+		Database:        database,
+		RetentionPolicy: retentionPolicy,
+		Parameters:      params,
+	}, nil
+}
+
+// matches returns whether the query selects the point, ignoring aggregation and limits
+func (q *query) matches(point *datatypes.Datapoint) bool {
+	if !q.start.IsZero() && point.Time.Before(q.start) {
+		return false
+	}
+	if !q.end.IsZero() && (point.Time.After(q.end) || (!q.endInclusive && point.Time.Equal(q.end))) {
+		return false
+	}
+	if !MatchesTags(point, q.tags) {
+		return false
+	}
+	for _, predicate := range q.values {
+		if !predicate.matches(point.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply aggregates, orders and limits the points the query matches,
+// which are sorted oldest first
+func (q *query) apply(points []*datatypes.Datapoint) []*datatypes.Datapoint {
+	if q.aggregation != "" {
+		points = aggregatePoints(q.metric, points, q.start, q.window, q.aggregation)
+	}
+	return q.arrange(points)
+}
+
+// arrange orders and limits the selected points, which are sorted oldest first
+func (q *query) arrange(points []*datatypes.Datapoint) []*datatypes.Datapoint {
+	if q.descending {
+		reversed := make([]*datatypes.Datapoint, len(points))
+		for i, point := range points {
+			reversed[len(points)-1-i] = point
+		}
+		points = reversed
+	}
+	if q.limit > 0 && len(points) > q.limit {
+		points = points[:q.limit]
+	}
+	return points
+}
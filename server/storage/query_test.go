@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"server/datatypes"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryInfluxQL(t *testing.T) {
+	start := time.Unix(10, 0).UTC()
+	end := time.Unix(20, 0).UTC()
+	hostile := "SR-3' OR ''=' \\ \" $p0"
+	command, err := newQuery("BMS_Current").
+		withTags(map[string]string{datatypes.SessionTag: hostile, datatypes.CarTag: "SR-3"}).
+		whereValue(notEqual, 0).
+		since(start).
+		through(end).
+		newestFirst().
+		first(1).
+		influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT value FROM "BMS_Current" WHERE time >= $p0 AND time <= $p1 AND "car" = $p2 AND "session" = $p3 AND value != $p4 GROUP BY * ORDER BY time DESC LIMIT 1`, command.Command)
+	assert.Equal(t, map[string]interface{}{
+		"p0": "1970-01-01T00:00:10Z",
+		"p1": "1970-01-01T00:00:20Z",
+		"p2": "SR-3",
+		"p3": hostile,
+		"p4": float64(0),
+	}, command.Parameters)
+	assert.Equal(t, "telemetry", command.Database)
+	assert.Equal(t, "autogen", command.RetentionPolicy)
+
+	command, err = newQuery("BMS_Current").since(start).until(end).aggregate(P95, 3*time.Second).influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT percentile(value, 95) AS value FROM "BMS_Current" WHERE time >= $p0 AND time < $p1 GROUP BY time(3000000000ns, 1000000000ns) fill(none)`, command.Command)
+
+	command, err = newQuery("BMS_Current").influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT value FROM "BMS_Current" GROUP BY *`, command.Command)
+	assert.Empty(t, command.Parameters)
+
+	command, err = newQuery("BMS_Current").withTags(map[string]string{datatypes.SessionTag: "1"}).since(start).through(end).tagValues(datatypes.CarTag).influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SHOW TAG VALUES FROM "BMS_Current" WITH KEY = "car" WHERE time >= $p0 AND time <= $p1 AND "session" = $p2`, command.Command)
+
+	command, err = newQuery("BMS_Current").withTags(map[string]string{datatypes.CarTag: ""}).series().first(1).influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SHOW SERIES FROM "BMS_Current" WHERE "car" = $p0 LIMIT 1`, command.Command)
+}
+
+func TestQueryErrors(t *testing.T) {
+	hostileNames := []string{"", "BMS_Current; DROP DATABASE telemetry", `BMS_Current" WHERE 1=1 --`, "BMS Current", "BMS_Current\n"}
+	for _, name := range hostileNames {
+		_, err := newQuery(name).influxQL("telemetry", "autogen")
+		assert.True(t, errors.Is(err, ErrIllegalName), "%q", name)
+		_, err = newQuery("BMS_Current").withTags(map[string]string{name: "SR-3"}).influxQL("telemetry", "autogen")
+		assert.True(t, errors.Is(err, ErrIllegalName), "%q", name)
+	}
+	_, err := newQuery("BMS_Current").aggregate(Mean, time.Second).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+	_, err = newQuery("BMS_Current").since(time.Unix(0, 0)).aggregate(Mean, 0).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+	_, err = newQuery("BMS_Current").since(time.Unix(0, 0)).aggregate("median", time.Second).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+	_, err = newQuery("BMS_Current").first(0).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+	_, err = newQuery("BMS_Current").whereValue("; DROP", 0).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+	_, err = newQuery("BMS_Current").tagValues("car\" --").influxQL("telemetry", "autogen")
+	assert.True(t, errors.Is(err, ErrIllegalName))
+	_, err = newQuery("BMS_Current").whereValue(notEqual, 0).series().influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+}
+
+func TestQueryMatches(t *testing.T) {
+	q := newQuery("BMS_Current").
+		withTags(map[string]string{datatypes.CarTag: "SR-3"}).
+		whereValue(greater, 1).
+		since(time.Unix(10, 0)).
+		until(time.Unix(20, 0))
+	sr3 := map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceTCP}
+	assert.True(t, q.matches(&datatypes.Datapoint{Value: 2, Time: time.Unix(10, 0), Tags: sr3}))
+	assert.False(t, q.matches(&datatypes.Datapoint{Value: 2, Time: time.Unix(20, 0), Tags: sr3}))
+	assert.False(t, q.matches(&datatypes.Datapoint{Value: 1, Time: time.Unix(15, 0), Tags: sr3}))
+	assert.False(t, q.matches(&datatypes.Datapoint{Value: 2, Time: time.Unix(15, 0)}))
+	assert.True(t, q.through(time.Unix(20, 0)).matches(&datatypes.Datapoint{Value: 2, Time: time.Unix(20, 0), Tags: sr3}))
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"server/datatypes"
+	"server/settings"
+)
+
+const (
+	queueSegmentSuffix = ".wal"
+	// queueRejectedFile holds the batches the store rejected, in the same
+	// format as the segments, so they can be looked into and fixed by hand
+	queueRejectedFile = "rejected.jsonl"
+	// queueProgressFile records how far into its oldest segment the log has
+	// been inserted
+	queueProgressFile   = "progress.json"
+	queueInitialBackoff = time.Second
+	queueMaxBackoff     = time.Minute
+)
+
+// WriteAheadQueue sits between the publisher and a Storage so that telemetry
+// survives the store being unavailable. Points are appended to a log on disk as
+// they are enqueued, and a background goroutine inserts them into the store in
+// the order they arrived, retrying with backoff while the store is unavailable.
+// Batches the store rejects are moved out of the way so they don't hold up the
+// rest. Points still in the log when the server stops are inserted once it starts again
+type WriteAheadQueue struct {
+	store   Storage
+	dir     string
+	lock    sync.Mutex
+	file    *os.File
+	nextSeq int
+	depth   int64
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// queueProgress is how far into a segment the log has been inserted, so that
+// the batches already inserted aren't inserted again after a restart
+type queueProgress struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// NewWriteAheadQueue returns a WriteAheadQueue inserting into store that keeps its log in dir,
+// defaulting to storage/queue_data. Any points left in the log are queued to be inserted first
+func NewWriteAheadQueue(store Storage, dir string) (*WriteAheadQueue, error) {
+	if dir == "" {
+		var err error
+		dir, err = settings.SourcePath("queue_data")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	q := &WriteAheadQueue{
+		store:   store,
+		dir:     dir,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	segments, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		var seq int
+		fmt.Sscanf(path.Base(segment), "%d", &seq)
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+		err = readSegment(segment, q.progress(segment), func(points []*datatypes.Datapoint, end int64) bool {
+			q.depth += int64(len(points))
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(segments) > 0 {
+		log.Printf("Replaying %d points queued for storage in %s\n", q.depth, dir)
+	}
+	go q.drain()
+	return q, nil
+}
+
+// Enqueue appends points to the log on disk to be inserted into the store
+func (q *WriteAheadQueue) Enqueue(points []*datatypes.Datapoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		q.file, err = os.OpenFile(path.Join(q.dir, fmt.Sprintf("%016d%s", q.nextSeq, queueSegmentSuffix)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			q.file = nil
+			return err
+		}
+		q.nextSeq++
+	}
+	_, err = q.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = q.file.Sync()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&q.depth, int64(len(points)))
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of points waiting to be inserted into the store
+func (q *WriteAheadQueue) Depth() int {
+	return int(atomic.LoadInt64(&q.depth))
+}
+
+// Close stops inserting points into the store. Points still queued stay in the
+// log on disk and are inserted by the next WriteAheadQueue using the same
+// directory, which picks up after the last batch inserted
+func (q *WriteAheadQueue) Close() error {
+	close(q.done)
+	<-q.stopped
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// segments returns the paths of the segments of the log, oldest first
+func (q *WriteAheadQueue) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), queueSegmentSuffix) {
+			segments = append(segments, path.Join(q.dir, file.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// nextSegment returns the oldest segment of the log, starting a new segment for
+// points enqueued from now on if it is the one being appended to
+func (q *WriteAheadQueue) nextSegment() (string, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	segments, err := q.segments()
+	if err != nil {
+		log.Printf("Error listing queued points: %s\n", err)
+		return "", false
+	}
+	if len(segments) == 0 {
+		return "", false
+	}
+	if q.file != nil && segments[0] == q.file.Name() {
+		q.file.Close()
+		q.file = nil
+	}
+	return segments[0], true
+}
+
+// drain inserts the segments of the log into the store in order until the queue is closed
+func (q *WriteAheadQueue) drain() {
+	defer close(q.stopped)
+	for {
+		segment, ok := q.nextSegment()
+		if !ok {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		err := readSegment(segment, q.progress(segment), func(points []*datatypes.Datapoint, end int64) bool {
+			if !q.insert(points) {
+				return false
+			}
+			atomic.AddInt64(&q.depth, -int64(len(points)))
+			q.setProgress(segment, end)
+			return true
+		})
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("Error reading queued points from %s, discarding the rest of it: %s\n", segment, err)
+		}
+		// The progress goes first, so that a crash in between inserts the
+		// segment again rather than skipping part of a later one with its name
+		err = os.Remove(path.Join(q.dir, queueProgressFile))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing queue progress: %s\n", err)
+		}
+		err = os.Remove(segment)
+		if err != nil {
+			log.Printf("Error removing %s: %s\n", segment, err)
+		}
+	}
+}
+
+// insert inserts points into the store, retrying with backoff while it is
+// unavailable. Points it rejects are set aside in the rejected file instead.
+// It returns false if the queue was closed first
+func (q *WriteAheadQueue) insert(points []*datatypes.Datapoint) bool {
+	backoff := queueInitialBackoff
+	for {
+		err := q.store.Insert(points)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, ErrUnavailable) {
+			q.reject(points, err)
+			return true
+		}
+		log.Printf("Error inserting %d queued points, retrying in %s: %s\n", len(points), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-q.done:
+			return false
+		}
+		backoff *= 2
+		if backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+}
+
+// progress returns the offset of the first batch of segment not inserted yet
+func (q *WriteAheadQueue) progress(segment string) int64 {
+	data, err := ioutil.ReadFile(path.Join(q.dir, queueProgressFile))
+	if err != nil {
+		return 0
+	}
+	var progress queueProgress
+	err = json.Unmarshal(data, &progress)
+	if err != nil || progress.Segment != path.Base(segment) {
+		return 0
+	}
+	return progress.Offset
+}
+
+// setProgress records that segment has been inserted up to offset. The file
+// is replaced in one go, so a crash leaves either the old progress or the new
+func (q *WriteAheadQueue) setProgress(segment string, offset int64) {
+	data, err := json.Marshal(queueProgress{Segment: path.Base(segment), Offset: offset})
+	if err != nil {
+		log.Printf("Error saving queue progress: %s\n", err)
+		return
+	}
+	filename := path.Join(q.dir, queueProgressFile)
+	err = ioutil.WriteFile(filename+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		log.Printf("Error saving queue progress: %s\n", err)
+	}
+}
+
+// reject appends a batch of points the store rejected to the rejected file
+func (q *WriteAheadQueue) reject(points []*datatypes.Datapoint, reason error) {
+	filename := path.Join(q.dir, queueRejectedFile)
+	log.Printf("WARNING: Store rejected %d queued points, moving them to %s: %s\n", len(points), filename, reason)
+	line, err := json.Marshal(points)
+	if err != nil {
+		log.Printf("Error saving rejected points: %s\n", err)
+		return
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error saving rejected points: %s\n", err)
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("Error saving rejected points: %s\n", err)
+	}
+}
+
+// readSegment calls handle with each batch of points in a segment of the log
+// from offset, and the offset after the batch, until it returns false. A torn
+// final batch from a crash while it was being written is ignored, and so are
+// batches that can't be parsed
+func readSegment(segment string, offset int64, handle func([]*datatypes.Datapoint, int64) bool) error {
+	file, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		var points []*datatypes.Datapoint
+		err = json.Unmarshal(line, &points)
+		if err != nil {
+			log.Printf("Skipping unreadable batch of queued points in %s: %s\n", segment, err)
+			continue
+		}
+		if !handle(points, offset) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/datatypes"
+	"server/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore fails every insert while it is down and records the order of the inserts that succeed
+type flakyStore struct {
+	storage.Storage
+	lock sync.Mutex
+	down bool
+	// allow is how many inserts succeed even though the store is down
+	allow    int
+	attempts int
+	inserted []float64
+}
+
+func (s *flakyStore) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *flakyStore) Insert(points []*datatypes.Datapoint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts++
+	if s.down && s.allow > 0 {
+		s.allow--
+	} else if s.down {
+		return fmt.Errorf("%w: down for the test", storage.ErrUnavailable)
+	}
+	for _, point := range points {
+		s.inserted = append(s.inserted, point.Value)
+	}
+	return s.Storage.Insert(points)
+}
+
+func (s *flakyStore) insertedValues() []float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]float64(nil), s.inserted...)
+}
+
+func queuePoints(values ...float64) []*datatypes.Datapoint {
+	points := make([]*datatypes.Datapoint, len(values))
+	for i, value := range values {
+		points[i] = &datatypes.Datapoint{
+			Metric: "Queue_Test",
+			Value:  value,
+			Time:   time.Unix(int64(value), 0).UTC(),
+		}
+	}
+	return points
+}
+
+func waitForEmptyQueue(t *testing.T, queue *storage.WriteAheadQueue) {
+	deadline := time.Now().Add(10 * time.Second)
+	for queue.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, queue.Depth())
+}
+
+func TestWriteAheadQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_ahead_queue_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	embedded, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	defer embedded.Close()
+	store := &flakyStore{Storage: embedded, down: true}
+	queue, err := storage.NewWriteAheadQueue(store, dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	assert.NoError(t, queue.Enqueue(queuePoints(1, 2)))
+	assert.NoError(t, queue.Enqueue(queuePoints(3)))
+	assert.NoError(t, queue.Enqueue(nil))
+	assert.Equal(t, 3, queue.Depth())
+	store.setDown(false)
+	assert.NoError(t, queue.Enqueue(queuePoints(4)))
+	waitForEmptyQueue(t, queue)
+	assert.Equal(t, []float64{1, 2, 3, 4}, store.insertedValues())
+	store.lock.Lock()
+	assert.True(t, store.attempts > 1)
+	store.lock.Unlock()
+
+	points, err := embedded.SelectMetric("Queue_Test")
+	assert.NoError(t, err)
+	assert.Len(t, points, 4)
+}
+
+func TestWriteAheadQueueResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_ahead_queue_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	embedded, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	defer embedded.Close()
+
+	down := &flakyStore{Storage: embedded, down: true}
+	queue, err := storage.NewWriteAheadQueue(down, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Enqueue(queuePoints(1, 2)))
+	assert.NoError(t, queue.Enqueue(queuePoints(3)))
+	down.lock.Lock()
+	down.allow = 1
+	down.lock.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for queue.Depth() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, queue.Close())
+	assert.Equal(t, []float64{1, 2}, down.insertedValues())
+
+	// The batch inserted before the queue closed partway through its segment
+	// isn't queued or inserted again
+	up := &flakyStore{Storage: embedded, down: true}
+	queue, err = storage.NewWriteAheadQueue(up, dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+	assert.Equal(t, 1, queue.Depth())
+	up.setDown(false)
+	waitForEmptyQueue(t, queue)
+	assert.Equal(t, []float64{3}, up.insertedValues())
+}
+
+func TestWriteAheadQueueRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_ahead_queue_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	embedded, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	defer embedded.Close()
+	store := &flakyStore{Storage: embedded}
+	queue, err := storage.NewWriteAheadQueue(store, dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	// A batch the store rejects is set aside rather than holding up the rest
+	assert.NoError(t, queue.Enqueue([]*datatypes.Datapoint{{Metric: "Bad Metric", Value: 1, Time: time.Now()}}))
+	assert.NoError(t, queue.Enqueue(queuePoints(2)))
+	waitForEmptyQueue(t, queue)
+	points, err := embedded.SelectMetric("Queue_Test")
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	rejected, err := ioutil.ReadFile(path.Join(dir, "rejected.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(rejected), "Bad Metric"))
+}
+
+func TestWriteAheadQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write_ahead_queue_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	embedded, err := storage.NewEmbeddedStorage("")
+	assert.NoError(t, err)
+	defer embedded.Close()
+
+	down := &flakyStore{Storage: embedded, down: true}
+	queue, err := storage.NewWriteAheadQueue(down, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Enqueue(queuePoints(1, 2)))
+	assert.NoError(t, queue.Enqueue(queuePoints(3)))
+	assert.NoError(t, queue.Close())
+	assert.Empty(t, down.insertedValues())
+
+	// A batch torn by a crash while it was being written is dropped
+	segments, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, segments)
+	file, err := os.OpenFile(dir+"/"+segments[len(segments)-1].Name(), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`[{"Metric":"Queue_Test","Val`)
+	assert.NoError(t, err)
+	file.Close()
+
+	up := &flakyStore{Storage: embedded}
+	queue, err = storage.NewWriteAheadQueue(up, dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+	assert.NoError(t, queue.Enqueue(queuePoints(4)))
+	waitForEmptyQueue(t, queue)
+	assert.Equal(t, []float64{1, 2, 3, 4}, up.insertedValues())
+}
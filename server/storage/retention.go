@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"server/settings"
+)
+
+var durationPartRegex = regexp.MustCompile("([0-9]+)(ns|u|ms|s|m|h|d|w)")
+
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseInfluxDuration parses an InfluxQL duration such as "52w" or "1h30m".
+// "INF" is returned as 0
+func parseInfluxDuration(duration string) (time.Duration, error) {
+	if !durationRegex.MatchString(duration) {
+		return 0, fmt.Errorf("illegal duration: %v", duration)
+	}
+	var total time.Duration
+	for _, part := range durationPartRegex.FindAllStringSubmatch(duration, -1) {
+		n, err := strconv.ParseInt(part[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(n) * durationUnits[part[2]]
+	}
+	return total, nil
+}
+
+// tier is a rollup of every metric into windows of a fixed length. The mean,
+// min, max, sum and count of the raw points in each window are kept in their
+// own retention policy, filled by a continuous query
+type tier struct {
+	// name names both the retention policy and the continuous query
+	name       string
+	resolution time.Duration
+	// duration is how long the rollups are kept, 0 if forever
+	duration time.Duration
+	// resolutionQL and durationQL are the InfluxQL durations from the settings
+	resolutionQL string
+	durationQL   string
+}
+
+// parseTiers validates the configured rollups, returning them finest first
+func parseTiers(rollups []settings.Rollup) ([]tier, error) {
+	tiers := make([]tier, 0, len(rollups))
+	for _, rollup := range rollups {
+		resolution, err := parseInfluxDuration(rollup.Resolution)
+		if err != nil || resolution <= 0 {
+			return nil, fmt.Errorf("illegal rollup resolution: %v", rollup.Resolution)
+		}
+		durationQL := rollup.Duration
+		if durationQL == "" {
+			durationQL = "INF"
+		}
+		duration, err := parseInfluxDuration(durationQL)
+		if err != nil {
+			return nil, fmt.Errorf("illegal rollup duration: %v", rollup.Duration)
+		}
+		for _, other := range tiers {
+			if other.resolution == resolution {
+				return nil, fmt.Errorf("duplicate rollup resolution: %v", rollup.Resolution)
+			}
+		}
+		tiers = append(tiers, tier{
+			name:         "rollup_" + rollup.Resolution,
+			resolution:   resolution,
+			duration:     duration,
+			resolutionQL: rollup.Resolution,
+			durationQL:   durationQL,
+		})
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].resolution < tiers[j].resolution
+	})
+	return tiers, nil
+}
+
+// continuousQuery returns the statement creating the continuous query that
+// rolls the raw points in the source retention policy up into the tier
+func (t *tier) continuousQuery(database string, source string) string {
+	return fmt.Sprintf("CREATE CONTINUOUS QUERY %s ON %s BEGIN "+
+		"SELECT mean(value) AS mean, min(value) AS min, max(value) AS max, sum(value) AS sum, count(value) AS count "+
+		"INTO %s.%s.:MEASUREMENT FROM %s.%s./.*/ GROUP BY time(%s), * END",
+		quoteIdentifier(t.name), quoteIdentifier(database),
+		quoteIdentifier(database), quoteIdentifier(t.name),
+		quoteIdentifier(database), quoteIdentifier(source),
+		t.resolutionQL)
+}
+
+// selector returns the InfluxQL selector computing the aggregation from the
+// rollups of the tier, or false if the rollups can't compute it
+func (t *tier) selector(aggregation Aggregation) (string, bool) {
+	switch aggregation {
+	case Mean:
+		return `sum("sum") / sum("count")`, true
+	case Min:
+		return `min("min")`, true
+	case Max:
+		return `max("max")`, true
+	case Count:
+		return `sum("count")`, true
+	default:
+		return "", false
+	}
+}
+
+// holds returns whether the tier still holds rollups from start onward
+func (t *tier) holds(start time.Time, now time.Time) bool {
+	return t.duration == 0 || !start.Before(now.Add(-t.duration))
+}
+
+// rolledUpUntil returns the start of the first window, counting from start, that
+// the tier hasn't rolled up entirely by now. The continuous query only rolls up a
+// window of the tier once it is over, and the one that just ended may not have
+// been written yet, so neither is counted
+func (t *tier) rolledUpUntil(start time.Time, window time.Duration, now time.Time) time.Time {
+	rolledUp := now.Add(-time.Duration(now.UnixNano())%t.resolution - t.resolution)
+	if !rolledUp.After(start) {
+		return start
+	}
+	return start.Add(rolledUp.Sub(start) / window * window)
+}
+
+// selectTier picks the tier to aggregate windows of the given length from
+// start onward, or nil if the raw points should be used. The coarsest tier
+// whose rollups line up exactly with the windows is used. If the raw points
+// from start have already expired, the finest tier still holding the range
+// is used even if its rollups straddle the edges of the windows. Windows the
+// tier hasn't rolled up yet still have to be aggregated from the raw points
+func selectTier(tiers []tier, raw time.Duration, start time.Time, window time.Duration, aggregation Aggregation, now time.Time) *tier {
+	var exact, approximate *tier
+	for i := range tiers {
+		t := &tiers[i]
+		if _, ok := t.selector(aggregation); !ok {
+			continue
+		}
+		if t.resolution > window || window%t.resolution != 0 || !t.holds(start, now) {
+			continue
+		}
+		if time.Duration(start.UnixNano())%t.resolution == 0 {
+			exact = t
+		} else if approximate == nil {
+			approximate = t
+		}
+	}
+	if exact != nil {
+		return exact
+	}
+	if raw != 0 && start.Before(now.Add(-raw)) {
+		return approximate
+	}
+	return nil
+}
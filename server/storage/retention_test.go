@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"server/settings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfluxDuration(t *testing.T) {
+	durations := map[string]time.Duration{
+		"INF":   0,
+		"1s":    time.Second,
+		"500ms": 500 * time.Millisecond,
+		"1h30m": 90 * time.Minute,
+		"7d":    7 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+	}
+	for duration, expected := range durations {
+		parsed, err := parseInfluxDuration(duration)
+		assert.NoError(t, err, duration)
+		assert.Equal(t, expected, parsed, duration)
+	}
+	for _, duration := range []string{"", "7 days", "1y", "-1s", "INF; DROP DATABASE telemetry"} {
+		_, err := parseInfluxDuration(duration)
+		assert.Error(t, err, duration)
+	}
+}
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := parseTiers([]settings.Rollup{
+		{Resolution: "1m", Duration: "52w"},
+		{Resolution: "1s"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []tier{
+		{name: "rollup_1s", resolution: time.Second, resolutionQL: "1s", durationQL: "INF"},
+		{name: "rollup_1m", resolution: time.Minute, duration: 52 * 7 * 24 * time.Hour, resolutionQL: "1m", durationQL: "52w"},
+	}, tiers)
+	assert.Equal(t, `CREATE CONTINUOUS QUERY "rollup_1s" ON "telemetry" BEGIN `+
+		`SELECT mean(value) AS mean, min(value) AS min, max(value) AS max, sum(value) AS sum, count(value) AS count `+
+		`INTO "telemetry"."rollup_1s".:MEASUREMENT FROM "telemetry"."autogen"./.*/ GROUP BY time(1s), * END`,
+		tiers[0].continuousQuery("telemetry", "autogen"))
+
+	invalid := [][]settings.Rollup{
+		{{Resolution: "INF"}},
+		{{Resolution: "0s"}},
+		{{Resolution: "1s", Duration: "forever"}},
+		{{Resolution: "1s"}, {Resolution: "1000ms"}},
+	}
+	for _, rollups := range invalid {
+		_, err = parseTiers(rollups)
+		assert.Error(t, err, "%v", rollups)
+	}
+}
+
+func TestSelectTier(t *testing.T) {
+	tiers, err := parseTiers([]settings.Rollup{
+		{Resolution: "1s", Duration: "30d"},
+		{Resolution: "1m", Duration: "INF"},
+	})
+	assert.NoError(t, err)
+	second, minute := &tiers[0], &tiers[1]
+	raw := 7 * 24 * time.Hour
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	recent := now.Add(-time.Hour)
+	lastMonth := now.Add(-20 * 24 * time.Hour)
+	lastYear := now.Add(-365 * 24 * time.Hour)
+
+	// The coarsest tier whose rollups line up with the windows is used
+	assert.Equal(t, minute, selectTier(tiers, raw, recent, 5*time.Minute, Max, now))
+	assert.Equal(t, second, selectTier(tiers, raw, recent, 30*time.Second, Mean, now))
+	assert.Equal(t, second, selectTier(tiers, raw, recent, 90*time.Second, Count, now))
+	assert.Equal(t, second, selectTier(tiers, raw, recent.Add(time.Second), time.Minute, Min, now))
+	// Tiers that no longer hold the start of the range are skipped
+	assert.Equal(t, minute, selectTier(tiers, raw, lastYear, time.Hour, Mean, now))
+	assert.Nil(t, selectTier(tiers, raw, lastYear, time.Second, Mean, now))
+	// Raw points are used for aggregations rollups can't compute, windows
+	// smaller than any rollup and windows that don't line up with any
+	assert.Nil(t, selectTier(tiers, raw, recent, time.Minute, First, now))
+	assert.Nil(t, selectTier(tiers, raw, recent, time.Minute, P95, now))
+	assert.Nil(t, selectTier(tiers, raw, recent, 500*time.Millisecond, Mean, now))
+	assert.Nil(t, selectTier(tiers, raw, recent.Add(time.Millisecond), time.Minute, Mean, now))
+	// Unless the raw points have expired
+	assert.Equal(t, second, selectTier(tiers, raw, lastMonth.Add(time.Millisecond), time.Minute, Mean, now))
+	assert.Nil(t, selectTier(nil, raw, lastMonth, time.Minute, Mean, now))
+	assert.Nil(t, selectTier(nil, 0, lastYear, time.Minute, Mean, now))
+}
+
+func TestRolledUpUntil(t *testing.T) {
+	tiers, err := parseTiers([]settings.Rollup{{Resolution: "1m"}})
+	assert.NoError(t, err)
+	minute := &tiers[0]
+	now := time.Date(2020, time.June, 1, 12, 0, 30, 0, time.UTC)
+
+	// Neither the minute in progress nor the one that just ended are rolled up
+	start := now.Add(-time.Hour).Truncate(time.Minute)
+	assert.Equal(t, time.Date(2020, time.June, 1, 11, 59, 0, 0, time.UTC), minute.rolledUpUntil(start, time.Minute, now))
+	// The split falls on the edge of a window counted from start
+	assert.Equal(t, time.Date(2020, time.June, 1, 11, 55, 0, 0, time.UTC), minute.rolledUpUntil(start, 5*time.Minute, now))
+	assert.Equal(t, time.Date(2020, time.June, 1, 11, 0, 0, 0, time.UTC), minute.rolledUpUntil(start, 2*time.Hour, now))
+	// Ranges starting after the last rollup use none of them
+	recent := time.Date(2020, time.June, 1, 11, 59, 0, 0, time.UTC)
+	assert.Equal(t, recent, minute.rolledUpUntil(recent, time.Minute, now))
+}
+
+func TestQueryFromTier(t *testing.T) {
+	tiers, err := parseTiers([]settings.Rollup{{Resolution: "1m"}})
+	assert.NoError(t, err)
+	start := time.Unix(60, 0).UTC()
+	end := time.Unix(600, 0).UTC()
+	command, err := newQuery("BMS_Current").since(start).until(end).aggregate(Mean, 2*time.Minute).fromTier(&tiers[0]).influxQL("telemetry", "autogen")
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT sum("sum") / sum("count") AS value FROM "BMS_Current" WHERE time >= $p0 AND time < $p1 GROUP BY time(120000000000ns, 60000000000ns) fill(none)`, command.Command)
+	assert.Equal(t, "rollup_1m", command.RetentionPolicy)
+
+	_, err = newQuery("BMS_Current").since(start).aggregate(Last, time.Minute).fromTier(&tiers[0]).influxQL("telemetry", "autogen")
+	assert.Error(t, err)
+}
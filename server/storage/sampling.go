@@ -4,59 +4,61 @@ import (
 	"fmt"
 	"log"
 	"time"
+
+	"server/datatypes"
 )
 
 // GetSampledPointsForMetric returns sampled data for a particular metric in the time range specified by start and end
-// at the given resolution
-func (s *Storage) GetSampledPointsForMetric(metric string, start time.Time, end time.Time, resolution int) ([]float64, error) {
-	points, err := s.SelectMetricTimeRange(metric, start, end)
+// at the given resolution, with each row holding the aggregation of the points in that bucket. Only points whose tags
+// match all of the provided tags are sampled
+func GetSampledPointsForMetric(s Storage, metric string, start time.Time, end time.Time, resolution int, aggregation Aggregation, tags map[string]string) ([]float64, error) {
+	points, err := s.Aggregate(metric, start, end, resolutionDuration(resolution), aggregation, tags)
 	if err != nil {
 		return nil, err
 	}
-	duration := end.Sub(start)
-	durMillis := duration.Nanoseconds() / 1e6
-	resolutionDur := time.Duration(resolution) * time.Millisecond
-	numRows := int(durMillis-1)/resolution + 1
-	column := make([]float64, numRows)
-	var last float64
+	return fillColumn(points, start, end, resolution, aggregation, 0), nil
+}
+
+func resolutionDuration(resolution int) time.Duration {
+	return time.Duration(resolution) * time.Millisecond
+}
+
+func numRows(start time.Time, end time.Time, resolution int) int {
+	durMillis := end.Sub(start).Nanoseconds() / 1e6
+	return int(durMillis-1)/resolution + 1
+}
+
+// fillColumn lays out points aggregated into buckets of the given resolution as a column
+// with a row per bucket. Empty buckets carry the last value forward, starting from last,
+// or are 0 when counting
+func fillColumn(points []*datatypes.Datapoint, start time.Time, end time.Time, resolution int, aggregation Aggregation, last float64) []float64 {
+	column := make([]float64, numRows(start, end, resolution))
+	resolutionDur := resolutionDuration(resolution)
 	i := 0
-	row := 0
-	for timestamp := start; timestamp.Before(end); timestamp = timestamp.Add(resolutionDur) {
-		for i < len(points) && points[i].Time.Before(timestamp) {
+	for row := range column {
+		bucket := start.Add(time.Duration(row) * resolutionDur)
+		for i < len(points) && points[i].Time.Before(bucket) {
 			i++
 		}
-		next := timestamp.Add(resolutionDur)
-		if i >= len(points) || points[i].Time.Equal(next) || points[i].Time.After(next) {
-			column[row] = last
-		} else {
-			column[row] = points[i].Value
+		if i < len(points) && points[i].Time.Equal(bucket) {
 			last = points[i].Value
+			column[row] = last
+		} else if aggregation != Count {
+			column[row] = last
 		}
-		row++
 	}
-	return column, nil
-}
-
-// GetAllMetricPointsRange returns sampled data for all metrics in the specified time range
-func (s *Storage) GetAllMetricPointsRange(start time.Time, end time.Time, resolution int) (map[string][]float64, error) {
-	metrics, err := s.ListMetrics()
-	if err != nil {
-		return nil, err
-	}
-	return s.GetMetricPointsRange(metrics, start, end, resolution, false)
+	return column
 }
 
 // GetMetricPointsRange returns sampled data for the specified metrics in the specified time range
-func (s *Storage) GetMetricPointsRange(metrics []string, start time.Time, end time.Time, resolution int, strict bool) (map[string][]float64, error) {
+func GetMetricPointsRange(s Storage, metrics []string, start time.Time, end time.Time, resolution int, aggregation Aggregation, strict bool, tags map[string]string) (map[string][]float64, error) {
 	colChannels := make([]chan []float64, len(metrics))
 	for i, metric := range metrics {
 		colChannels[i] = make(chan []float64, 1)
 		go func(metric string, colChan chan []float64) {
-			column, err := s.GetSampledPointsForMetric(metric, start, end, resolution)
+			column, err := GetSampledPointsForMetric(s, metric, start, end, resolution, aggregation, tags)
 			if err != nil {
 				log.Printf("Error getting values for metric %s: %s\n", metric, err)
-				colChan <- nil
-				return
 			}
 			colChan <- column
 		}(metric, colChannels[i])
@@ -72,3 +74,86 @@ func (s *Storage) GetMetricPointsRange(metrics []string, start time.Time, end ti
 	}
 	return columns, nil
 }
+
+// GroupedColumnName returns the name of the column holding the points of
+// metric whose groupBy tag has the given value, e.g. BMS_Current{car=SR-3}.
+// Points without the tag are kept in a column named after just the metric
+func GroupedColumnName(metric string, groupBy string, value string) string {
+	if groupBy == "" || value == "" {
+		return metric
+	}
+	return fmt.Sprintf("%s{%s=%s}", metric, groupBy, value)
+}
+
+// aggregatedPageRows is how many rows an AggregatedColumn aggregates at a time
+const aggregatedPageRows = 10000
+
+// AggregatedColumn reads the rows GetSampledPointsForMetric would return one at a time,
+// aggregating a page of rows from the store whenever it runs out. Each page is a
+// call to Storage.Aggregate, so long ranges are read from the rollup tiers
+type AggregatedColumn struct {
+	store       Storage
+	metric      string
+	tags        map[string]string
+	aggregation Aggregation
+	resolution  int
+	pageStart   time.Time
+	end         time.Time
+	rows        []float64
+	last        float64
+	err         error
+}
+
+// NewAggregatedColumn returns an AggregatedColumn of the points of metric in the time
+// range whose tags match all of the provided tags, with a row per step of the resolution
+func NewAggregatedColumn(s Storage, metric string, start time.Time, end time.Time, resolution int, aggregation Aggregation, tags map[string]string) *AggregatedColumn {
+	return &AggregatedColumn{
+		store:       s,
+		metric:      metric,
+		tags:        tags,
+		aggregation: aggregation,
+		resolution:  resolution,
+		pageStart:   start,
+		end:         end,
+	}
+}
+
+// Next returns the value of the next row. Like GetSampledPointsForMetric, empty rows
+// carry the last value forward, or are 0 when counting. Once reading a page fails,
+// every row is 0
+func (c *AggregatedColumn) Next() float64 {
+	if len(c.rows) == 0 && c.err == nil && c.pageStart.Before(c.end) {
+		c.readPage()
+	}
+	if len(c.rows) == 0 {
+		if c.err != nil || c.aggregation == Count {
+			return 0
+		}
+		return c.last
+	}
+	value := c.rows[0]
+	c.rows = c.rows[1:]
+	return value
+}
+
+func (c *AggregatedColumn) readPage() {
+	pageEnd := c.pageStart.Add(aggregatedPageRows * resolutionDuration(c.resolution))
+	if pageEnd.After(c.end) {
+		pageEnd = c.end
+	}
+	points, err := c.store.Aggregate(c.metric, c.pageStart, pageEnd, resolutionDuration(c.resolution), c.aggregation, c.tags)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.rows = fillColumn(points, c.pageStart, pageEnd, c.resolution, c.aggregation, c.last)
+	if c.aggregation != Count {
+		c.last = c.rows[len(c.rows)-1]
+	}
+	c.pageStart = pageEnd
+}
+
+// Err returns the error aggregating the points of the column, if any
+func (c *AggregatedColumn) Err() error {
+	return c.err
+}
@@ -1,7 +1,6 @@
 package storage_test
 
 import (
-	"os"
 	"server/datatypes"
 	"server/storage"
 	"testing"
@@ -11,43 +10,115 @@ import (
 )
 
 func TestGetSampledPointsForMetric(t *testing.T) {
-	_, ok := os.LookupEnv("IN_DOCKER")
-	if !ok {
-		return
-	}
-	store, err := storage.NewStorage()
-	assert.NoError(t, err)
-	start := time.Unix(0, 0)
-	end := time.Unix(2, 0)
-	resolution := 250
-	metric := "Unit_Test_Sampled_Points_For_Metric"
-	points := []*datatypes.Datapoint{
-		{
-			Metric: metric,
-			Value:  1,
-			Time:   time.Unix(0, 250*1e6),
-		},
-		{
-			Metric: metric,
-			Value:  2,
-			Time:   time.Unix(0, 251*1e6),
-		},
-		{
-			Metric: metric,
-			Value:  3,
-			Time:   time.Unix(0, 752*1e6),
-		},
-		{
-			Metric: metric,
-			Value:  4,
-			Time:   time.Unix(1, 250*1e6),
-		},
-	}
-	err = store.Insert(points)
-	assert.NoError(t, err)
-
-	expectedValues := []float64{0, 1, 1, 3, 3, 4, 4, 4}
-	actualValues, err := store.GetSampledPointsForMetric(metric, start, end, resolution)
-	assert.NoError(t, err)
-	assert.Equal(t, expectedValues, actualValues)
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		start := time.Unix(0, 0)
+		end := time.Unix(2, 0)
+		resolution := 250
+		metric := "Unit_Test_Sampled_Points_For_Metric"
+		points := []*datatypes.Datapoint{
+			{
+				Metric: metric,
+				Value:  1,
+				Time:   time.Unix(0, 250*1e6),
+			},
+			{
+				Metric: metric,
+				Value:  2,
+				Time:   time.Unix(0, 251*1e6),
+			},
+			{
+				Metric: metric,
+				Value:  3,
+				Time:   time.Unix(0, 752*1e6),
+			},
+			{
+				Metric: metric,
+				Value:  4,
+				Time:   time.Unix(1, 250*1e6),
+			},
+		}
+		err := store.Insert(points)
+		assert.NoError(t, err)
+
+		expectedValues := []float64{0, 1, 1, 3, 3, 4, 4, 4}
+		actualValues, err := storage.GetSampledPointsForMetric(store, metric, start, end, resolution, storage.First, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedValues, actualValues)
+
+		expectedValues = []float64{0, 1.5, 1.5, 3, 3, 4, 4, 4}
+		actualValues, err = storage.GetSampledPointsForMetric(store, metric, start, end, resolution, storage.Mean, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedValues, actualValues)
+
+		expectedValues = []float64{0, 2, 0, 1, 0, 1, 0, 0}
+		actualValues, err = storage.GetSampledPointsForMetric(store, metric, start, end, resolution, storage.Count, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedValues, actualValues)
+	})
+}
+
+func TestGroupedSampledColumns(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		metric := "Unit_Test_Grouped_Points"
+		sr3 := map[string]string{datatypes.CarTag: "SR-3"}
+		sr4 := map[string]string{datatypes.CarTag: "SR-4"}
+		err := store.Insert([]*datatypes.Datapoint{
+			{Metric: metric, Value: 1, Time: time.Unix(0, 0), Tags: sr3},
+			{Metric: metric, Value: 2, Time: time.Unix(0, 0), Tags: sr4},
+			{Metric: metric, Value: 3, Time: time.Unix(1, 0), Tags: sr3},
+			{Metric: metric, Value: 4, Time: time.Unix(1, 0)},
+		})
+		assert.NoError(t, err)
+		start := time.Unix(0, 0)
+		end := time.Unix(2, 0)
+		values, err := store.TagValues(metric, datatypes.CarTag, start, end, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"", "SR-3", "SR-4"}, values)
+		columns := make(map[string][]float64)
+		for _, value := range values {
+			column := storage.NewAggregatedColumn(store, metric, start, end, 1000, storage.First, map[string]string{datatypes.CarTag: value})
+			columns[storage.GroupedColumnName(metric, datatypes.CarTag, value)] = []float64{column.Next(), column.Next()}
+			assert.NoError(t, column.Err())
+		}
+		assert.Equal(t, map[string][]float64{
+			"Unit_Test_Grouped_Points{car=SR-3}": {1, 3},
+			"Unit_Test_Grouped_Points{car=SR-4}": {2, 2},
+			"Unit_Test_Grouped_Points":           {0, 4},
+		}, columns)
+		columns, err = storage.GetMetricPointsRange(store, []string{metric}, time.Unix(0, 0), time.Unix(2, 0), 1000, storage.First, true, sr4)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]float64{metric: {2, 2}}, columns)
+		err = store.DeleteMetric(metric)
+		assert.NoError(t, err)
+	})
+}
+
+func TestAggregatedColumn(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		start := time.Unix(0, 0)
+		// Enough rows at this resolution to span several pages
+		end := time.Unix(25, 0)
+		resolution := 1
+		metric := "Unit_Test_Aggregated_Column"
+		err := store.Insert([]*datatypes.Datapoint{
+			{Metric: metric, Value: 1, Time: time.Unix(0, 250*1e6)},
+			{Metric: metric, Value: 2, Time: time.Unix(0, 250*1e6+1e5)},
+			{Metric: metric, Value: 3, Time: time.Unix(9, 999*1e6)},
+			{Metric: metric, Value: 4, Time: time.Unix(21, 0)},
+		})
+		assert.NoError(t, err)
+		for _, aggregation := range storage.Aggregations {
+			expectedValues, err := storage.GetSampledPointsForMetric(store, metric, start, end, resolution, aggregation, nil)
+			assert.NoError(t, err)
+			column := storage.NewAggregatedColumn(store, metric, start, end, resolution, aggregation, nil)
+			actualValues := make([]float64, len(expectedValues))
+			for i := range actualValues {
+				actualValues[i] = column.Next()
+			}
+			assert.NoError(t, column.Err())
+			assert.Equal(t, expectedValues, actualValues, "%s", aggregation)
+		}
+		err = store.DeleteMetric(metric)
+		assert.NoError(t, err)
+	})
 }
@@ -1,235 +1,110 @@
 package storage
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
 	"time"
 
 	"server/datatypes"
-
-	client "github.com/influxdata/influxdb/client/v2"
+	"server/settings"
 )
 
-const tableName = "telemetry"
-
-var metricRegex = regexp.MustCompile("\\A[a-zA-Z0-9_-]+\\z")
+// ErrIllegalName is wrapped by the errors returned for metric names and tag
+// keys that are not made up of only letters, digits, underscores and hyphens
+var ErrIllegalName = errors.New("illegal name")
 
-// ValidMetric returns whether the metric name is valid
-func ValidMetric(metric string) bool {
-	return metricRegex.MatchString(metric)
-}
+// ErrUnavailable is wrapped by the errors returned when the store can't be
+// reached or can't take points for now, so inserting them again later may
+// succeed. Any other error inserting points means the store rejected them
+var ErrUnavailable = errors.New("storage unavailable")
 
 // Storage describes the interface with persistent storage
-type Storage struct {
-	client client.Client
+type Storage interface {
+	// Insert inserts points into the store
+	Insert(points []*datatypes.Datapoint) error
+	// SelectMetric selects all entries for specified metric
+	SelectMetric(metric string) ([]*datatypes.Datapoint, error)
+	// SelectMetricTimeRange selects entries for metric within specified time range
+	// whose tags match all of the provided tags. nil tags selects every entry
+	SelectMetricTimeRange(metric string, start time.Time, end time.Time, tags map[string]string) ([]*datatypes.Datapoint, error)
+	// Iterate returns an iterator over the entries SelectMetricTimeRange selects,
+	// which are read from the store a chunk at a time. The iterator must be closed
+	Iterate(metric string, start time.Time, end time.Time, tags map[string]string) (PointIterator, error)
+	// Aggregate divides [start, end) into windows of the given length and returns a
+	// point at the start of each window holding the aggregation of the metric's
+	// points in it whose tags match all of the provided tags. Windows without
+	// points are omitted
+	Aggregate(metric string, start time.Time, end time.Time, window time.Duration, aggregation Aggregation, tags map[string]string) ([]*datatypes.Datapoint, error)
+	// Latest returns the most recent datapoint for the given metric whose
+	// tags match all of the provided tags, or nil if there is none
+	Latest(metric string, tags map[string]string) (*datatypes.Datapoint, error)
+	// LatestNonZero returns the most recent non-zero datapoint for the given
+	// metric whose tags match all of the provided tags, or nil if there is none
+	LatestNonZero(metric string, tags map[string]string) (*datatypes.Datapoint, error)
+	// TagValues returns the distinct values of the key tag among the series of
+	// metric with points in the time range whose tags match all of the provided
+	// tags, in sorted order. Series without the tag give an empty value
+	TagValues(metric string, key string, start time.Time, end time.Time, tags map[string]string) ([]string, error)
+	// ListMetrics lists all of the metrics in the store
+	ListMetrics() ([]string, error)
+	// DeleteMetric deletes a metric from the store
+	DeleteMetric(metric string) error
+	// Close performs cleanup work
+	Close() error
 }
 
-// NewStorage returns an initialized Storage, backed by InfluxDB
-func NewStorage() (*Storage, error) {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr: "http://influxdb:8086",
-	})
-	if err != nil {
-		return nil, err
-	}
-	storage := &Storage{
-		client: c,
-	}
-	return storage, nil
-}
+const (
+	backendInflux   = "influx"
+	backendEmbedded = "embedded"
+)
 
-// Insert inserts points into the store
-func (s *Storage) Insert(points []*datatypes.Datapoint) error {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  tableName,
-		Precision: "ns",
-	})
-	if err != nil {
-		return err
-	}
-	for _, point := range points {
-		if !ValidMetric(point.Metric) {
-			return metricError(point.Metric)
-		}
-		fields := map[string]interface{}{"value": point.Value}
-		pt, err := getPoint(point.Metric, point.Tags, fields, point.Time)
-		if err != nil {
-			return err
+// NewStorage returns an initialized Storage using the backend described by
+// config: "influx" connects to InfluxDB, while "embedded" keeps data on local
+// disk so the server can run without the InfluxDB container
+func NewStorage(config settings.Storage) (Storage, error) {
+	switch config.Backend {
+	case backendInflux, "":
+		return NewInfluxStorage(config.Influx)
+	case backendEmbedded:
+		dir := config.Path
+		if dir == "" {
+			var err error
+			dir, err = settings.SourcePath("embedded_data")
+			if err != nil {
+				return nil, err
+			}
 		}
-		bp.AddPoint(pt)
-	}
-	return s.client.Write(bp)
-}
-
-func getPoint(metric string, tags map[string]string, fields map[string]interface{}, time time.Time) (*client.Point, error) {
-	if time.IsZero() {
-		return client.NewPoint(metric, tags, fields)
+		return NewEmbeddedStorage(dir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
 	}
-	return client.NewPoint(metric, tags, fields, time)
 }
 
-// DeleteMetric deletes a metric from the store
-func (s *Storage) DeleteMetric(metric string) error {
-	if !ValidMetric(metric) {
-		return metricError(metric)
-	}
-	response, err := s.client.Query(client.Query{
-		Command:  fmt.Sprintf("DROP MEASUREMENT %s", metric),
-		Database: tableName,
-	})
-	if err != nil {
-		return err
-	}
-	return response.Error()
-}
-
-// SelectMetric selects all entries for specified metric
-func (s *Storage) SelectMetric(metric string) ([]*datatypes.Datapoint, error) {
-	if !ValidMetric(metric) {
-		return nil, metricError(metric)
-	}
-	response, err := s.client.Query(client.Query{
-		Command:  fmt.Sprintf("SELECT * FROM %s", metric),
-		Database: tableName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if response.Error() != nil {
-		return nil, response.Error()
-	}
-	return getDatapoints(metric, response)
-}
-
-// SelectMetricTimeRange selects entries for metric within specified time range
-func (s *Storage) SelectMetricTimeRange(metric string, start time.Time, end time.Time) ([]*datatypes.Datapoint, error) {
-	if !ValidMetric(metric) {
-		return nil, metricError(metric)
-	}
-	response, err := s.client.Query(client.Query{
-		Command: fmt.Sprintf("SELECT * FROM %s WHERE time >= '%s' AND time <= '%s'",
-			metric, start.Format(time.RFC3339Nano), end.Format(time.RFC3339Nano)),
-		Database: tableName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if response.Error() != nil {
-		return nil, response.Error()
-	}
-	return getDatapoints(metric, response)
+// MatchesTags returns whether the point has all of the provided tags
+func MatchesTags(point *datatypes.Datapoint, tags map[string]string) bool {
+	return tagsMatch(point.Tags, tags)
 }
 
-func getDatapoints(metric string, response *client.Response) ([]*datatypes.Datapoint, error) {
-	if len(response.Results) == 0 || len(response.Results[0].Series) == 0 {
-		return make([]*datatypes.Datapoint, 0), nil
-	}
-	var timeColumn, valueColumn int
-	for i, columnName := range response.Results[0].Series[0].Columns {
-		if columnName == "time" {
-			timeColumn = i
-		} else if columnName == "value" {
-			valueColumn = i
-		}
-	}
-	values := response.Results[0].Series[0].Values
-	results := make([]*datatypes.Datapoint, len(values))
-	for i, value := range values {
-		timestamp, err := time.Parse(time.RFC3339Nano, value[timeColumn].(string))
-		if err != nil {
-			return nil, err
+// tagsMatch returns whether the tags hold every tag in filter
+func tagsMatch(tags map[string]string, filter map[string]string) bool {
+	for key, value := range filter {
+		if tags[key] != value {
+			return false
 		}
-		val, err := strconv.ParseFloat(string(value[valueColumn].(json.Number)), 64)
-		if err != nil {
-			return nil, err
-		}
-		results[i] = &datatypes.Datapoint{
-			Metric: metric,
-			Value:  val,
-			Tags:   response.Results[0].Series[0].Tags,
-			Time:   timestamp,
-		}
-	}
-	return results, nil
-}
-
-// ListMetrics lists all of the metrics in the table
-func (s *Storage) ListMetrics() ([]string, error) {
-	response, err := s.client.Query(client.Query{
-		Command:  "SHOW MEASUREMENTS",
-		Database: tableName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if response.Error() != nil {
-		return nil, response.Error()
-	}
-	values := response.Results[0].Series[0].Values
-	metrics := make([]string, len(values))
-	for i, value := range values {
-		metrics[i] = value[0].(string)
-	}
-	return metrics, nil
-}
-
-// Latest returns the most recent datapoint for the given metric
-func (s *Storage) Latest(metric string) (*datatypes.Datapoint, error) {
-	if !ValidMetric(metric) {
-		return nil, metricError(metric)
-	}
-	response, err := s.client.Query(client.Query{
-		Command:  fmt.Sprintf("SELECT * FROM %s ORDER BY DESC LIMIT 1", metric),
-		Database: tableName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if response.Error() != nil {
-		return nil, response.Error()
 	}
-	points, err := getDatapoints(metric, response)
-	if err != nil {
-		return nil, err
-	}
-	if len(points) != 1 {
-		return nil, nil
-	}
-	return points[0], nil
+	return true
 }
 
-// LatestNonZero returns the most recent non-zero datapoint for the given metric
-func (s *Storage) LatestNonZero(metric string) (*datatypes.Datapoint, error) {
-	if !ValidMetric(metric) {
-		return nil, metricError(metric)
-	}
-	response, err := s.client.Query(client.Query{
-		Command:  fmt.Sprintf("SELECT * FROM %s WHERE value != 0 ORDER BY DESC LIMIT 1", metric),
-		Database: tableName,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if response.Error() != nil {
-		return nil, response.Error()
-	}
-	points, err := getDatapoints(metric, response)
-	if err != nil {
-		return nil, err
-	}
-	if len(points) != 1 {
-		return nil, nil
+// validTags returns an error if any of the tag keys is not a valid identifier
+func validTags(tags map[string]string) error {
+	for key := range tags {
+		if !datatypes.ValidMetric(key) {
+			return fmt.Errorf("%w: tag key %q", ErrIllegalName, key)
+		}
 	}
-	return points[0], nil
-}
-
-// Close performs cleanup work
-func (s *Storage) Close() error {
-	return s.client.Close()
+	return nil
 }
 
 func metricError(metric string) error {
-	return fmt.Errorf("illegal metric name: %v", metric)
+	return fmt.Errorf("%w: metric %q", ErrIllegalName, metric)
 }
@@ -1,159 +1,410 @@
 package storage_test
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
 	"server/datatypes"
+	"server/settings"
 	"server/storage"
 
 	"github.com/stretchr/testify/assert"
 )
 
-// These tests are skipped if this is not running in a Docker environment
-// so that the tests can pass in a local environment without an InfluxDB
-// connection
-
-func TestStorage(t *testing.T) {
-	_, ok := os.LookupEnv("IN_DOCKER")
-	if !ok {
-		return
-	}
-	store, err := storage.NewStorage()
+// These tests run against every storage backend. The InfluxDB backend is
+// skipped if this is not running in a Docker environment so that the tests
+// can pass in a local environment without an InfluxDB connection
+func forEachStore(t *testing.T, test func(t *testing.T, store storage.Storage)) {
+	dir, err := ioutil.TempDir("", "embedded_storage_test")
 	assert.NoError(t, err)
-	err = store.DeleteMetric("Unit_Test_1")
+	defer os.RemoveAll(dir)
+	embedded, err := storage.NewEmbeddedStorage(dir)
 	assert.NoError(t, err)
-	utc, err := time.LoadLocation("UTC")
-	assert.NoError(t, err)
-	datapoints := []*datatypes.Datapoint{
-		{
-			Metric: "Unit_Test_1",
-			Value:  12345,
-			Time:   time.Date(2069, time.April, 20, 4, 20, 0, 0, utc),
-		},
-		{
-			Metric: "Unit_Test_1",
-			Value:  54321,
-			Time:   time.Date(2018, time.May, 21, 0, 0, 0, 0, utc),
-		},
+	t.Run("embedded", func(t *testing.T) {
+		test(t, embedded)
+	})
+	embedded.Close()
+	if _, ok := os.LookupEnv("IN_DOCKER"); !ok {
+		return
 	}
-	err = store.Insert(datapoints)
+	config, err := settings.Load()
 	assert.NoError(t, err)
-	metrics, err := store.ListMetrics()
+	influx, err := storage.NewInfluxStorage(config.Storage.Influx)
 	assert.NoError(t, err)
-	assert.NotEqual(t, 0, len(metrics))
-	unitTestInMetrics := false
-	for _, metric := range metrics {
-		if metric == "Unit_Test_1" {
-			unitTestInMetrics = true
-			break
+	t.Run("influx", func(t *testing.T) {
+		test(t, influx)
+	})
+	influx.Close()
+}
+
+func TestStorage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		err := store.DeleteMetric("Unit_Test_1")
+		assert.NoError(t, err)
+		utc, err := time.LoadLocation("UTC")
+		assert.NoError(t, err)
+		datapoints := []*datatypes.Datapoint{
+			{
+				Metric: "Unit_Test_1",
+				Value:  12345,
+				Time:   time.Date(2069, time.April, 20, 4, 20, 0, 0, utc),
+			},
+			{
+				Metric: "Unit_Test_1",
+				Value:  54321,
+				Time:   time.Date(2018, time.May, 21, 0, 0, 0, 0, utc),
+			},
 		}
-	}
-	assert.True(t, unitTestInMetrics, "Unit_Test_1 not found in metrics")
-	storedDatapoints, err := store.SelectMetric("Unit_Test_1")
-	assert.NoError(t, err)
-	assert.ElementsMatch(t, datapoints, storedDatapoints)
-	storedDatapoints, err = store.SelectMetricTimeRange(
-		"Unit_Test_1",
-		time.Date(2060, time.January, 1, 0, 0, 0, 0, utc),
-		time.Date(2070, time.January, 1, 0, 0, 0, 0, utc),
-	)
-	assert.NoError(t, err)
-	assert.ElementsMatch(t, []*datatypes.Datapoint{datapoints[0]}, storedDatapoints)
-	latest, err := store.Latest("Unit_Test_1")
-	assert.NoError(t, err)
-	assert.Equal(t, datapoints[0], latest)
-	err = store.DeleteMetric("Unit_Test_1")
-	assert.NoError(t, err)
+		err = store.Insert(datapoints)
+		assert.NoError(t, err)
+		metrics, err := store.ListMetrics()
+		assert.NoError(t, err)
+		assert.NotEqual(t, 0, len(metrics))
+		unitTestInMetrics := false
+		for _, metric := range metrics {
+			if metric == "Unit_Test_1" {
+				unitTestInMetrics = true
+				break
+			}
+		}
+		assert.True(t, unitTestInMetrics, "Unit_Test_1 not found in metrics")
+		storedDatapoints, err := store.SelectMetric("Unit_Test_1")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, datapoints, storedDatapoints)
+		storedDatapoints, err = store.SelectMetricTimeRange(
+			"Unit_Test_1",
+			time.Date(2060, time.January, 1, 0, 0, 0, 0, utc),
+			time.Date(2070, time.January, 1, 0, 0, 0, 0, utc),
+			nil,
+		)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []*datatypes.Datapoint{datapoints[0]}, storedDatapoints)
+		latest, err := store.Latest("Unit_Test_1", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, datapoints[0], latest)
+		err = store.DeleteMetric("Unit_Test_1")
+		assert.NoError(t, err)
+	})
 }
 
 func TestLatestNonZero(t *testing.T) {
-	_, ok := os.LookupEnv("IN_DOCKER")
-	if !ok {
-		return
-	}
-	store, err := storage.NewStorage()
-	assert.NoError(t, err)
-	utc, err := time.LoadLocation("UTC")
-	assert.NoError(t, err)
-	datapoints := []*datatypes.Datapoint{{
-		Metric: "Unit_Test_2",
-		Value:  0,
-		Time:   time.Date(2069, time.April, 20, 0, 0, 0, 0, utc),
-	}, {
-		Metric: "Unit_Test_2",
-		Value:  12345,
-		Time:   time.Date(2018, time.May, 21, 0, 0, 0, 0, utc),
-	}}
-	err = store.Insert(datapoints)
-	assert.NoError(t, err)
-	point, err := store.LatestNonZero("Unit_Test_2")
-	assert.NoError(t, err)
-	assert.Equal(t, datapoints[1], point)
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		utc, err := time.LoadLocation("UTC")
+		assert.NoError(t, err)
+		datapoints := []*datatypes.Datapoint{{
+			Metric: "Unit_Test_2",
+			Value:  0,
+			Time:   time.Date(2069, time.April, 20, 0, 0, 0, 0, utc),
+		}, {
+			Metric: "Unit_Test_2",
+			Value:  12345,
+			Time:   time.Date(2018, time.May, 21, 0, 0, 0, 0, utc),
+		}}
+		err = store.Insert(datapoints)
+		assert.NoError(t, err)
+		point, err := store.LatestNonZero("Unit_Test_2", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, datapoints[1], point)
+	})
 }
 
 func TestInsertEmptyPoints(t *testing.T) {
-	_, ok := os.LookupEnv("IN_DOCKER")
-	if !ok {
-		return
-	}
-	store, err := storage.NewStorage()
-	assert.NoError(t, err)
-	err = store.Insert([]*datatypes.Datapoint{})
-	assert.NoError(t, err)
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		err := store.Insert([]*datatypes.Datapoint{})
+		assert.NoError(t, err)
+	})
 }
 
 func TestInOrder(t *testing.T) {
-	_, ok := os.LookupEnv("IN_DOCKER")
-	if !ok {
-		return
-	}
-	points := []*datatypes.Datapoint{
-		{
-			Metric: "Unit_Test_Order",
-			Value:  0,
-			Time:   time.Unix(3, 0).UTC(),
-		},
-		{
-			Metric: "Unit_Test_Order",
-			Value:  1,
-			Time:   time.Unix(1, 0).UTC(),
-		},
-		{
-			Metric: "Unit_Test_Order",
-			Value:  2,
-			Time:   time.Unix(2, 0).UTC(),
-		},
-	}
-	store, err := storage.NewStorage()
-	assert.NoError(t, err)
-	err = store.Insert(points)
-	assert.NoError(t, err)
-	storedPoints, err := store.SelectMetric("Unit_Test_Order")
-	assert.NoError(t, err)
-	points = []*datatypes.Datapoint{points[1], points[2], points[0]}
-	assert.Equal(t, points, storedPoints)
-	storedPoints, err = store.SelectMetricTimeRange("Unit_Test_Order", time.Unix(0, 0), time.Unix(3, 0))
-	assert.NoError(t, err)
-	assert.Equal(t, points, storedPoints)
-	err = store.DeleteMetric("Unit_Test_Order")
-	assert.NoError(t, err)
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		points := []*datatypes.Datapoint{
+			{
+				Metric: "Unit_Test_Order",
+				Value:  0,
+				Time:   time.Unix(3, 0).UTC(),
+			},
+			{
+				Metric: "Unit_Test_Order",
+				Value:  1,
+				Time:   time.Unix(1, 0).UTC(),
+			},
+			{
+				Metric: "Unit_Test_Order",
+				Value:  2,
+				Time:   time.Unix(2, 0).UTC(),
+			},
+		}
+		err := store.Insert(points)
+		assert.NoError(t, err)
+		storedPoints, err := store.SelectMetric("Unit_Test_Order")
+		assert.NoError(t, err)
+		points = []*datatypes.Datapoint{points[1], points[2], points[0]}
+		assert.Equal(t, points, storedPoints)
+		storedPoints, err = store.SelectMetricTimeRange("Unit_Test_Order", time.Unix(0, 0), time.Unix(3, 0), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, points, storedPoints)
+		err = store.DeleteMetric("Unit_Test_Order")
+		assert.NoError(t, err)
+	})
 }
 
 func TestIllegalMetricName(t *testing.T) {
-	for _, metric := range []string{
-		"metric space",
-		"metric\nnewline",
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		for _, metric := range []string{
+			"metric space",
+			"metric\nnewline",
+		} {
+			points := []*datatypes.Datapoint{{
+				Metric: metric,
+				Value:  0,
+				Time:   time.Now(),
+			}}
+			err := store.Insert(points)
+			assert.Errorf(t, err, "Metric %q should have been rejected", metric)
+		}
+	})
+}
+
+func TestInfluxStorageIllegalConfig(t *testing.T) {
+	for _, mutate := range []func(*settings.Influx){
+		func(c *settings.Influx) { c.Database = "telemetry\"; DROP DATABASE telemetry" },
+		func(c *settings.Influx) { c.RetentionPolicy = "" },
+		func(c *settings.Influx) { c.RetentionDuration = "forever" },
 	} {
-		points := []*datatypes.Datapoint{{
-			Metric: metric,
-			Value:  0,
-			Time:   time.Now(),
-		}}
-		store, err := storage.NewStorage()
-		assert.NoError(t, err)
-		err = store.Insert(points)
-		assert.Errorf(t, err, "Metric %q should have been rejected", metric)
+		config := settings.Default().Storage.Influx
+		mutate(&config)
+		_, err := storage.NewInfluxStorage(config)
+		assert.Error(t, err)
 	}
 }
+
+func TestTags(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		sr3 := map[string]string{datatypes.CarTag: "SR-3", datatypes.SourceTag: datatypes.SourceTCP}
+		sr4 := map[string]string{datatypes.CarTag: "SR-4", datatypes.SourceTag: datatypes.SourceTCP}
+		quoted := map[string]string{datatypes.CarTag: "SR-3' OR ''='", datatypes.SourceTag: datatypes.SourceUDP}
+		points := []*datatypes.Datapoint{
+			{Metric: "Unit_Test_Tags", Value: 1, Time: time.Unix(1, 0).UTC(), Tags: sr3},
+			{Metric: "Unit_Test_Tags", Value: 2, Time: time.Unix(2, 0).UTC(), Tags: sr4},
+			{Metric: "Unit_Test_Tags", Value: 3, Time: time.Unix(3, 0).UTC(), Tags: sr3},
+			{Metric: "Unit_Test_Tags", Value: 0, Time: time.Unix(4, 0).UTC(), Tags: sr3},
+			{Metric: "Unit_Test_Tags", Value: 5, Time: time.Unix(5, 0).UTC(), Tags: quoted},
+		}
+		err := store.Insert(points)
+		assert.NoError(t, err)
+
+		stored, err := store.SelectMetricTimeRange("Unit_Test_Tags", time.Unix(0, 0), time.Unix(10, 0), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, points, stored)
+		stored, err = store.SelectMetricTimeRange("Unit_Test_Tags", time.Unix(0, 0), time.Unix(10, 0), map[string]string{datatypes.CarTag: "SR-3"})
+		assert.NoError(t, err)
+		assert.Equal(t, []*datatypes.Datapoint{points[0], points[2], points[3]}, stored)
+		stored, err = store.SelectMetricTimeRange("Unit_Test_Tags", time.Unix(0, 0), time.Unix(10, 0), map[string]string{datatypes.CarTag: quoted[datatypes.CarTag]})
+		assert.NoError(t, err)
+		assert.Equal(t, []*datatypes.Datapoint{points[4]}, stored)
+		_, err = store.SelectMetricTimeRange("Unit_Test_Tags", time.Unix(0, 0), time.Unix(10, 0), map[string]string{"car = '' OR car": ""})
+		assert.Error(t, err)
+
+		latest, err := store.Latest("Unit_Test_Tags", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, points[4], latest)
+		latest, err = store.Latest("Unit_Test_Tags", map[string]string{datatypes.CarTag: "SR-4"})
+		assert.NoError(t, err)
+		assert.Equal(t, points[1], latest)
+		latest, err = store.LatestNonZero("Unit_Test_Tags", map[string]string{datatypes.CarTag: "SR-3"})
+		assert.NoError(t, err)
+		assert.Equal(t, points[2], latest)
+		latest, err = store.Latest("Unit_Test_Tags", map[string]string{datatypes.CarTag: "SR-5"})
+		assert.NoError(t, err)
+		assert.Nil(t, latest)
+
+		err = store.DeleteMetric("Unit_Test_Tags")
+		assert.NoError(t, err)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		metric := "Unit_Test_Aggregate"
+		start := time.Unix(10, 0)
+		values := []float64{4, 1, 3, 2, 10, 8}
+		points := make([]*datatypes.Datapoint, len(values))
+		for i, value := range values {
+			points[i] = &datatypes.Datapoint{
+				Metric: metric,
+				Value:  value,
+				Time:   start.Add(time.Duration(i) * 500 * time.Millisecond).UTC(),
+			}
+		}
+		// Points outside of [start, end) are not aggregated
+		points = append(points,
+			&datatypes.Datapoint{Metric: metric, Value: 100, Time: start.Add(-time.Millisecond).UTC()},
+			&datatypes.Datapoint{Metric: metric, Value: 100, Time: start.Add(5 * time.Second).UTC()},
+		)
+		err := store.Insert(points)
+		assert.NoError(t, err)
+
+		end := start.Add(5 * time.Second)
+		window := 2 * time.Second
+		expected := map[storage.Aggregation][]float64{
+			storage.First: {4, 10},
+			storage.Last:  {2, 8},
+			storage.Mean:  {2.5, 9},
+			storage.Min:   {1, 8},
+			storage.Max:   {4, 10},
+			storage.Count: {4, 2},
+			storage.P95:   {4, 10},
+		}
+		for aggregation, expectedValues := range expected {
+			aggregated, err := store.Aggregate(metric, start, end, window, aggregation, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, len(expectedValues), len(aggregated), "%s", aggregation)
+			for i := 0; i < len(aggregated) && i < len(expectedValues); i++ {
+				assert.Equal(t, expectedValues[i], aggregated[i].Value, "%s", aggregation)
+				assert.True(t, start.Add(time.Duration(i)*window).Equal(aggregated[i].Time), "%s", aggregation)
+			}
+		}
+
+		// Windows without points are left out
+		aggregated, err := store.Aggregate(metric, start.Add(-time.Second), end, time.Second, storage.Mean, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, len(aggregated))
+		aggregated, err = store.Aggregate(metric, start, end, window, storage.Mean, map[string]string{datatypes.CarTag: "SR-3"})
+		assert.NoError(t, err)
+		assert.Empty(t, aggregated)
+
+		_, err = store.Aggregate(metric, start, end, 0, storage.Mean, nil)
+		assert.Error(t, err)
+		_, err = store.Aggregate(metric, start, end, window, storage.Aggregation("median"), nil)
+		assert.Error(t, err)
+
+		err = store.DeleteMetric(metric)
+		assert.NoError(t, err)
+	})
+}
+
+func TestHostileNames(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		metric := "Unit_Test_Hostile_Names"
+		hostileNames := []string{"Unit_Test_Hostile_Names; DROP MEASUREMENT Unit_Test_Hostile_Names", `Unit_Test_Hostile_Names" WHERE 1=1 --`, "Unit Test"}
+		start := time.Unix(0, 0)
+		end := time.Unix(10, 0)
+		for _, name := range hostileNames {
+			err := store.Insert([]*datatypes.Datapoint{{Metric: name, Value: 1, Time: start}})
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.SelectMetric(name)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.SelectMetricTimeRange(name, start, end, nil)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.Aggregate(name, start, end, time.Second, storage.Mean, nil)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.Latest(name, nil)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.LatestNonZero(name, nil)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			err = store.DeleteMetric(name)
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+			_, err = store.Latest(metric, map[string]string{name: "SR-3"})
+			assert.True(t, errors.Is(err, storage.ErrIllegalName), "%q", name)
+		}
+
+		// Tag values are matched exactly, whatever characters they contain
+		hostileValues := []string{"SR-3' OR ''='", `SR-3\`, `SR-3"`, "$p0", ") OR (1=1"}
+		points := make([]*datatypes.Datapoint, len(hostileValues))
+		for i, value := range hostileValues {
+			points[i] = &datatypes.Datapoint{
+				Metric: metric,
+				Value:  float64(i + 1),
+				Time:   start.Add(time.Duration(i) * time.Second).UTC(),
+				Tags:   map[string]string{datatypes.CarTag: value},
+			}
+		}
+		err := store.Insert(points)
+		assert.NoError(t, err)
+		for i, value := range hostileValues {
+			tags := map[string]string{datatypes.CarTag: value}
+			stored, err := store.SelectMetricTimeRange(metric, start, end, tags)
+			assert.NoError(t, err)
+			assert.Equal(t, []*datatypes.Datapoint{points[i]}, stored, "%q", value)
+			latest, err := store.LatestNonZero(metric, tags)
+			assert.NoError(t, err)
+			assert.Equal(t, points[i], latest, "%q", value)
+		}
+		stored, err := store.SelectMetric(metric)
+		assert.NoError(t, err)
+		assert.Equal(t, points, stored)
+
+		err = store.DeleteMetric(metric)
+		assert.NoError(t, err)
+	})
+}
+
+func TestIterate(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store storage.Storage) {
+		metric := "Unit_Test_Iterate"
+		start := time.Unix(0, 0)
+		// Enough points for several chunks, two at each time
+		points := make([]*datatypes.Datapoint, 25000)
+		for i := range points {
+			car := "SR-3"
+			if i%2 == 1 {
+				car = "SR-4"
+			}
+			points[i] = &datatypes.Datapoint{
+				Metric: metric,
+				Value:  float64(i),
+				Time:   start.Add(time.Duration(i/2) * time.Millisecond).UTC(),
+				Tags:   map[string]string{datatypes.CarTag: car},
+			}
+		}
+		err := store.Insert(points)
+		assert.NoError(t, err)
+		end := points[len(points)-1].Time
+
+		iterator, err := store.Iterate(metric, start, end, nil)
+		assert.NoError(t, err)
+		count := 0
+		for iterator.Next() {
+			point := iterator.Point()
+			if count < len(points) && !assert.True(t, points[count].Time.Equal(point.Time)) {
+				break
+			}
+			count++
+		}
+		assert.NoError(t, iterator.Err())
+		assert.NoError(t, iterator.Close())
+		assert.Equal(t, len(points), count)
+
+		iterator, err = store.Iterate(metric, start.Add(time.Second), end, map[string]string{datatypes.CarTag: "SR-4"})
+		assert.NoError(t, err)
+		var selected []*datatypes.Datapoint
+		for iterator.Next() {
+			selected = append(selected, iterator.Point())
+		}
+		assert.NoError(t, iterator.Err())
+		assert.NoError(t, iterator.Close())
+		expected, err := store.SelectMetricTimeRange(metric, start.Add(time.Second), end, map[string]string{datatypes.CarTag: "SR-4"})
+		assert.NoError(t, err)
+		assert.Equal(t, len(expected), len(selected))
+		assert.Equal(t, expected, selected)
+
+		_, err = store.Iterate("Unit Test", start, end, nil)
+		assert.True(t, errors.Is(err, storage.ErrIllegalName))
+
+		all := storage.IterateMetrics(store, []string{metric, "Unit_Test_Iterate_Missing", metric}, start, start.Add(time.Millisecond), nil)
+		count = 0
+		for all.Next() {
+			assert.Equal(t, metric, all.Point().Metric)
+			count++
+		}
+		assert.NoError(t, all.Err())
+		assert.NoError(t, all.Close())
+		assert.Equal(t, 8, count)
+
+		err = store.DeleteMetric(metric)
+		assert.NoError(t, err)
+	})
+}
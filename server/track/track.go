@@ -28,6 +28,8 @@ type Track struct {
 	messenger pointUploader
 	slack     *message.SlackMessenger
 	done      chan bool
+	// stopped is closed once the uploader has stopped
+	stopped chan struct{}
 }
 
 // NewTrack initializes a new Track object with default values
@@ -42,6 +44,7 @@ func NewTrack(messenger *message.CarMessenger) (*Track, error) {
 		messenger: messenger,
 		slack:     message.NewSlackMessenger(),
 		done:      make(chan bool),
+		stopped:   make(chan struct{}),
 	}
 	go t.uploader()
 	return t, nil
@@ -64,8 +67,9 @@ func (t *Track) GetRoute() ([]*datatypes.RoutePoint, error) {
 }
 
 func (t *Track) uploader() {
+	defer close(t.stopped)
 	status := make(chan *datatypes.Datapoint, 10)
-	err := listener.Subscribe(status, "Connection_Status")
+	err := listener.SubscribeWith(status, listener.SubscribeOptions{Name: "track status"}, "Connection_Status")
 	if err != nil {
 		log.Fatalf("error subscribing to connection status: %+v", err)
 	}
@@ -126,6 +130,11 @@ func (t *Track) uploader() {
 				quit <- true
 				wg.Wait()
 			}
+			// Save how far the upload got so it picks up from there on restart
+			err := t.model.Commit()
+			if err != nil {
+				log.Printf("Error saving track info: %s", err)
+			}
 			return
 		}
 	}
@@ -138,7 +147,7 @@ func (t *Track) uploadPoints(track []*datatypes.RoutePoint, quit chan bool, wg *
 	defer wg.Done()
 	log.Printf("Attempting route upload")
 	c := make(chan *datatypes.Datapoint, 10)
-	listener.Subscribe(c, newTrackInfoACK, packetACK)
+	listener.SubscribeWith(c, listener.SubscribeOptions{Name: "track upload"}, newTrackInfoACK, packetACK)
 	defer listener.Unsubscribe(c)
 	timeoutCount := 0
 	for !t.model.IsTrackInfoUploaded {
@@ -188,7 +197,11 @@ func (t *Track) uploadPoints(track []*datatypes.RoutePoint, quit chan bool, wg *
 	}
 }
 
-// Close stops the uploader goroutine
+// Close stops the uploader goroutine, waiting for it to save its progress
 func (t *Track) Close() {
-	t.done <- true
+	select {
+	case t.done <- true:
+	case <-t.stopped:
+	}
+	<-t.stopped
 }
@@ -61,6 +61,7 @@ func TestTrackUploader(t *testing.T) {
 		messenger: messenger,
 		slack:     message.NewSlackMessenger(),
 		done:      make(chan bool),
+		stopped:   make(chan struct{}),
 	}
 	defer track.Close()
 	go track.uploader()